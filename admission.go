@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// What the validating webhook does with workloads omitting their learned seccomp profile: warn or deny
+var admissionEnforcement string
+
+// Kubelet seccomp root the learned profiles are installed in
+var seccompProfileRoot string
+
+// jsonPatchOperation is an operation of the JSON patch returned by the mutating webhook
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// admissionPodSpec is the Pod template of an admitted object, along with its JSON path
+type admissionPodSpec struct {
+	spec *corev1.PodSpec
+	path string
+}
+
+func registerAdmissionHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/admission/mutate", func(w http.ResponseWriter, r *http.Request) {
+		serveAdmission(w, r, mutateWorkload)
+	})
+	mux.HandleFunc("/admission/validate", func(w http.ResponseWriter, r *http.Request) {
+		serveAdmission(w, r, validateWorkload)
+	})
+}
+
+// serveAdmission decodes an AdmissionReview, has it reviewed and writes the response back
+func serveAdmission(w http.ResponseWriter, r *http.Request, review func(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) {
+	var admissionReview admissionv1.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&admissionReview); err != nil || admissionReview.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	response := review(admissionReview.Request)
+	response.UID = admissionReview.Request.UID
+	admissionReview.Response = response
+	admissionReview.Request = nil
+	writeJSONResponse(w, http.StatusOK, admissionReview)
+}
+
+// admissionPodSpecOf extracts the Pod template of the workload kinds the profiles are learned for
+func admissionPodSpecOf(request *admissionv1.AdmissionRequest) (*admissionPodSpec, error) {
+	var object interface{}
+	switch request.Kind.Kind {
+	case "Pod":
+		object = &corev1.Pod{}
+	case "Deployment":
+		object = &appsv1.Deployment{}
+	case "StatefulSet":
+		object = &appsv1.StatefulSet{}
+	case "DaemonSet":
+		object = &appsv1.DaemonSet{}
+	case "ReplicaSet":
+		object = &appsv1.ReplicaSet{}
+	case "Job":
+		object = &batchv1.Job{}
+	case "CronJob":
+		object = &batchv1.CronJob{}
+	default:
+		return nil, nil
+	}
+	if err := json.Unmarshal(request.Object.Raw, object); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", request.Kind.Kind, err)
+	}
+
+	switch o := object.(type) {
+	case *corev1.Pod:
+		// Pods of a controller are handled through their controller
+		if len(o.OwnerReferences) > 0 {
+			return nil, nil
+		}
+		return &admissionPodSpec{spec: &o.Spec, path: "/spec"}, nil
+	case *appsv1.Deployment:
+		return &admissionPodSpec{spec: &o.Spec.Template.Spec, path: "/spec/template/spec"}, nil
+	case *appsv1.StatefulSet:
+		return &admissionPodSpec{spec: &o.Spec.Template.Spec, path: "/spec/template/spec"}, nil
+	case *appsv1.DaemonSet:
+		return &admissionPodSpec{spec: &o.Spec.Template.Spec, path: "/spec/template/spec"}, nil
+	case *appsv1.ReplicaSet:
+		return &admissionPodSpec{spec: &o.Spec.Template.Spec, path: "/spec/template/spec"}, nil
+	case *batchv1.Job:
+		return &admissionPodSpec{spec: &o.Spec.Template.Spec, path: "/spec/template/spec"}, nil
+	case *batchv1.CronJob:
+		return &admissionPodSpec{spec: &o.Spec.JobTemplate.Spec.Template.Spec, path: "/spec/jobTemplate/spec/template/spec"}, nil
+	}
+	return nil, nil
+}
+
+// learnedSeccompProfile returns the seccomp profile of a workload container once its profile stabilized, as shared with
+// every node if the profiles are installed, as learned on this node otherwise
+func learnedSeccompProfile(workload string) (string, bool) {
+	state, err := learnedSyscalls(workload)
+	if err != nil {
+		log.Printf("Error loading the profile of %s: %v\n", workload, err)
+		return "", false
+	}
+	if state == nil || !profileStabilized(state) {
+		return "", false
+	}
+	return seccompProfileName(workload), true
+}
+
+// hasSeccompProfile returns true if the container already runs with the given localhost profile
+func hasSeccompProfile(spec *corev1.PodSpec, container *corev1.Container, profile string) bool {
+	seccompProfile := (*corev1.SeccompProfile)(nil)
+	if spec.SecurityContext != nil {
+		seccompProfile = spec.SecurityContext.SeccompProfile
+	}
+	if container.SecurityContext != nil && container.SecurityContext.SeccompProfile != nil {
+		seccompProfile = container.SecurityContext.SeccompProfile
+	}
+	return seccompProfile != nil && seccompProfile.Type == corev1.SeccompProfileTypeLocalhost &&
+		seccompProfile.LocalhostProfile != nil && *seccompProfile.LocalhostProfile == profile
+}
+
+// mutateWorkload injects the learned seccomp profile into the containers which don't set one. Only the profiles shared
+// through their ConfigMap are injected, the agents of every node install them.
+func mutateWorkload(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{Allowed: true}
+	podSpec, err := admissionPodSpecOf(request)
+	if err != nil || podSpec == nil || seccompProfiles == nil {
+		return response
+	}
+
+	var patch []jsonPatchOperation
+	for i := range podSpec.spec.Containers {
+		container := &podSpec.spec.Containers[i]
+		profile, ok := learnedSeccompProfile(fmt.Sprintf("%s/%s/%s/%s", request.Namespace, request.Kind.Kind, request.Name, container.Name))
+		if !ok {
+			continue
+		}
+		// Never override a profile chosen explicitly
+		if container.SecurityContext != nil && container.SecurityContext.SeccompProfile != nil {
+			continue
+		}
+		seccompProfile := &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &profile}
+		containerPath := fmt.Sprintf("%s/containers/%d/securityContext", podSpec.path, i)
+		if container.SecurityContext == nil {
+			patch = append(patch, jsonPatchOperation{Op: "add", Path: containerPath, Value: &corev1.SecurityContext{SeccompProfile: seccompProfile}})
+		} else {
+			patch = append(patch, jsonPatchOperation{Op: "add", Path: containerPath + "/seccompProfile", Value: seccompProfile})
+		}
+	}
+	if len(patch) == 0 {
+		return response
+	}
+
+	data, err := json.Marshal(patch)
+	if err != nil {
+		log.Printf("Error encoding admission patch: %v\n", err)
+		return response
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	response.Patch = data
+	response.PatchType = &patchType
+	return response
+}
+
+// validateWorkload warns about or denies the containers omitting their learned seccomp profile
+func validateWorkload(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{Allowed: true}
+	podSpec, err := admissionPodSpecOf(request)
+	if err != nil || podSpec == nil {
+		return response
+	}
+
+	var violations []string
+	for i := range podSpec.spec.Containers {
+		container := &podSpec.spec.Containers[i]
+		profile, ok := learnedSeccompProfile(fmt.Sprintf("%s/%s/%s/%s", request.Namespace, request.Kind.Kind, request.Name, container.Name))
+		if !ok || hasSeccompProfile(podSpec.spec, container, profile) {
+			continue
+		}
+		violations = append(violations, fmt.Sprintf("container %s doesn't use its learned seccomp profile Localhost/%s", container.Name, profile))
+	}
+	if len(violations) == 0 {
+		return response
+	}
+
+	if admissionEnforcement == "deny" {
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonForbidden,
+			Message: fmt.Sprintf("%s %s/%s: %v", request.Kind.Kind, request.Namespace, request.Name, violations),
+		}
+		return response
+	}
+	response.Warnings = violations
+	return response
+}
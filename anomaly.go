@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Occurrences of an item outside of the baseline needed to raise an alert, by inventory category, 0 disables the
+// category. Nil if anomalies are not detected.
+var anomalyThresholds map[string]uint64
+
+// parseAnomalySensitivity parses category=occurrences pairs separated by commas
+func parseAnomalySensitivity(spec string) (map[string]uint64, error) {
+	thresholds := map[string]uint64{
+		inventoryBinaries:     1,
+		inventoryPathPrefixes: 1,
+		inventoryDestinations: 1,
+		inventorySyscalls:     1,
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		if pair == "" {
+			continue
+		}
+		category, value, ok := strings.Cut(pair, "=")
+		if _, known := thresholds[category]; !ok || !known {
+			return nil, fmt.Errorf("invalid sensitivity %q, expected <category>=<occurrences> with a category among binaries, pathPrefixes, destinations and syscalls", pair)
+		}
+		threshold, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid occurrences of %s: %w", category, err)
+		}
+		// The syscalls come from cumulative snapshots, they are only seen once
+		if category == inventorySyscalls && threshold > 1 {
+			return nil, fmt.Errorf("invalid occurrences of syscalls %d, new syscalls are alerted on at once (1) or not at all (0)", threshold)
+		}
+		thresholds[category] = threshold
+	}
+	return thresholds, nil
+}
+
+// syscallAnomaliesEnabled returns true unless new syscalls were excluded from the anomaly alerts
+func syscallAnomaliesEnabled() bool {
+	return anomalyThresholds == nil || anomalyThresholds[inventorySyscalls] > 0
+}
+
+// detectAnomaly raises an alert when an item outside of the baseline of the workload reaches the occurrences of its category
+func detectAnomaly(key ContainerKey, event *Event, category string, value string, count uint64, outsideBaseline bool) {
+	threshold := anomalyThresholds[category]
+	if threshold == 0 {
+		return
+	}
+	// The new items of a full category aren't recorded, they can't be told apart from the baseline anymore
+	if count == 0 {
+		if inventory.MarkFull(event.Workload, category) {
+			message := fmt.Sprintf("%s of the inventory full at %d items, the new ones are no longer detected", category, maxInventoryItems)
+			log.Printf("Anomaly in workload %s: %s\n", event.Workload, message)
+			writeContainerEvent(key, event.Time, fmt.Sprintf("anomaly: %s full\n", category))
+			dispatchAnomaly(key, event, category, "", message)
+		}
+		return
+	}
+	if !outsideBaseline || count != threshold {
+		return
+	}
+
+	log.Printf("Anomaly in workload %s: new %s %s\n", event.Workload, category, value)
+	writeContainerEvent(key, event.Time, fmt.Sprintf("anomaly: %s %s\n", category, value))
+	dispatchAnomaly(key, event, category, value, "")
+}
+
+// dispatchAnomaly sends an anomaly of the event to the sinks if its workload is alerted on
+func dispatchAnomaly(key ContainerKey, event *Event, category string, value string, message string) {
+	state, ok := containers.Get(key)
+	if !ok || !state.Alerts() || !hasSinks() {
+		return
+	}
+	anomaly := *event
+	anomaly.Type = "anomaly"
+	anomaly.Category = category
+	anomaly.Value = value
+	anomaly.Message = message
+	dispatchEvent(&anomaly)
+}
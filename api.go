@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// apiMux serves the HTTP API of the agent, features register their handlers on it
+var apiMux = http.NewServeMux()
+
+// startAPIServer serves the API on addr over TLS, the requests carry the bearer tokens of their users
+func startAPIServer(addr string, certFile string, keyFile string) {
+	server := &http.Server{Addr: addr, Handler: apiMux}
+	// Gatekeeper authenticates with its client certificate, the other clients with their bearer tokens
+	if gatekeeperClientCAs != nil {
+		server.TLSConfig = &tls.Config{ClientCAs: gatekeeperClientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+	}
+	go func() {
+		err := server.ListenAndServeTLS(certFile, keyFile)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("API server failed: %v\n", err)
+			health.SetDegraded("api", err.Error())
+		}
+	}()
+	log.Printf("API server listening on %s\n", addr)
+}
+
+// Default URL of the API for the commands querying a running agent
+const defaultAPIURL = "https://localhost:8443"
+
+// newAPIClient returns the client of the commands querying the API, trusting the certificates of the CA file if
+// given, of the system otherwise
+func newAPIClient(caFile string, timeout time.Duration) (*http.Client, error) {
+	client := &http.Client{Timeout: timeout}
+	if caFile == "" {
+		return client, nil
+	}
+	pool, err := readCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return client, nil
+}
+
+// readCertPool returns the pool of the certificates of a PEM file
+func readCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// writeJSONResponse encodes v as the JSON body of the response
+func writeJSONResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing API response: %v\n", err)
+	}
+}
+
+func registerProfileHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/namespaces/", namespaceProfilesHandler)
+}
+
+// namespaceProfilesHandler serves the data of the workloads of a namespace to the users allowed to read its Pods:
+//   - /api/v1/namespaces/<namespace>/profiles: the learned profiles
+//   - /api/v1/namespaces/<namespace>/inventory?workload=<kind>/<name>/<container>[&category=...][&prefix=...]: the
+//     behavioral inventory of a workload
+//   - /api/v1/namespaces/<namespace>/compare?workload=<kind>/<name>/<container>&base=<digest>&head=<digest>: the
+//     behavior of a workload running two images compared
+func namespaceProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+	if len(parts) != 2 || parts[0] == "" || (parts[1] != "profiles" && parts[1] != "inventory" && parts[1] != "compare") {
+		http.NotFound(w, r)
+		return
+	}
+	namespace := parts[0]
+	if status, err := authorizeNamespace(r, namespace); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if parts[1] == "inventory" {
+		serveInventory(w, r, namespace)
+		return
+	}
+	if parts[1] == "compare" {
+		serveComparison(w, r, namespace)
+		return
+	}
+	profiles, err := store.ListSyscalls(namespace + "/")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"namespace": namespace, "profiles": profiles})
+}
+
+func serveInventory(w http.ResponseWriter, r *http.Request, namespace string) {
+	if inventory == nil {
+		http.Error(w, "the inventory is disabled", http.StatusNotFound)
+		return
+	}
+	workload := r.URL.Query().Get("workload")
+	if strings.Count(workload, "/") != 2 {
+		http.Error(w, "workload must be <kind>/<name>/<container>", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	items := inventory.Query(namespace+"/"+workload, query.Get("category"), query.Get("prefix"))
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"workload": namespace + "/" + workload, "categories": items})
+}
@@ -0,0 +1,305 @@
+//go:build !no_archive_sink
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveIndexEntry describes a closed archive in the index.ndjson of the archive directory
+type ArchiveIndexEntry struct {
+	File string `json:"file"`
+	Node string `json:"node"`
+	// Time of the first and last event of the archive
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Number of events, by type
+	Events int            `json:"events"`
+	Types  map[string]int `json:"types"`
+	// Containers with events in the archive, as namespace/pod/container
+	Containers []string `json:"containers"`
+	// Size of the NDJSON events, and of the archive
+	Bytes           int64 `json:"bytes"`
+	CompressedBytes int64 `json:"compressedBytes"`
+}
+
+// archiveSink writes the events of all the containers, as NDJSON, to a single zstd compressed archive per node, rolled
+// once it reaches a size or an age. The archive being written is named <archive>.part, so the archives can be shipped as
+// soon as they lose the suffix.
+type archiveSink struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	level    int
+
+	lock    sync.Mutex
+	file    *os.File
+	writer  *zstd.Encoder
+	entry   *ArchiveIndexEntry
+	opened  time.Time
+	seen    map[string]bool
+	stop    chan struct{}
+	stopped chan struct{}
+	errors  sinkErrorTracker
+}
+
+func init() {
+	var dir *string
+	var maxSize *int64
+	var maxAge *time.Duration
+	var level *int
+	registerSink(sinkRegistration{
+		name: "archive",
+		flags: func() {
+			dir = flag.String("archive-dir", "", "Directory to archive the events of all the containers to, as zstd compressed NDJSON rolled into a new archive by size or age and listed in index.ndjson, disabled if empty")
+			maxSize = flag.Int64("archive-max-size", 256<<20, "Size in bytes of the events, before compression, after which the archive is rolled")
+			maxAge = flag.Duration("archive-max-age", time.Hour, "Age after which the archive is rolled")
+			level = flag.Int("archive-level", 3, "zstd compression level of the archives, from 1 (fastest) to 19 (smallest)")
+		},
+		create: func() (Sink, error) {
+			if *dir == "" {
+				return nil, nil
+			}
+			return NewArchiveSink(*dir, *maxSize, *maxAge, *level)
+		},
+	})
+}
+
+// NewArchiveSink writes the archives to dir, rolling them after maxBytes of events or maxAge
+func NewArchiveSink(dir string, maxBytes int64, maxAge time.Duration, level int) (Sink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating archive directory: %w", err)
+	}
+	s := &archiveSink{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		level:    level,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		errors:   sinkErrorTracker{name: "archive:" + dir},
+	}
+	s.recover()
+	go s.run()
+	return s, nil
+}
+
+// recover completes the archives an agent which didn't stop cleanly left as .part, with the events still readable
+func (s *archiveSink) recover() {
+	// An archive whose recovery was interrupted is recovered again from the original
+	recovering, _ := filepath.Glob(filepath.Join(s.dir, "*.part.recover"))
+	for _, path := range recovering {
+		os.Remove(strings.TrimSuffix(path, ".recover"))
+	}
+	parts, _ := filepath.Glob(filepath.Join(s.dir, "*.part"))
+	for _, part := range parts {
+		if err := os.Rename(part, part+".recover"); err != nil {
+			log.Printf("Error recovering archive %s: %v\n", part, err)
+			continue
+		}
+		recovering = append(recovering, part+".recover")
+	}
+	for _, path := range recovering {
+		if err := s.recoverPart(path); err != nil {
+			log.Printf("Error recovering archive %s: %v\n", path, err)
+			continue
+		}
+		os.Remove(path)
+	}
+}
+
+// recoverPart writes the complete events of an interrupted archive into a new archive of the same name, indexed
+func (s *archiveSink) recoverPart(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder, err := zstd.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	name := strings.TrimSuffix(filepath.Base(path), ".part.recover")
+	if err := s.open(name); err != nil {
+		return err
+	}
+	// The decoding stops at the end of the last complete block, a line cut there is left out
+	reader := bufio.NewReader(decoder)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var event Event
+		if json.Unmarshal(line, &event) != nil {
+			continue
+		}
+		if _, err := s.writer.Write(line); err != nil {
+			return err
+		}
+		s.add(&event, len(line))
+	}
+	if s.entry.Events == 0 {
+		s.writer.Close()
+		s.file.Close()
+		os.Remove(filepath.Join(s.dir, name+".part"))
+		s.writer, s.file, s.entry = nil, nil, nil
+		return nil
+	}
+	log.Printf("Recovered %d events of the interrupted archive %s\n", s.entry.Events, name)
+	return s.roll()
+}
+
+// run rolls the archive once it is too old, even if no event comes to roll it
+func (s *archiveSink) run() {
+	defer close(s.stopped)
+
+	interval := s.maxAge / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			if s.writer != nil && time.Since(s.opened) >= s.maxAge {
+				s.errors.Track(s.roll())
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+func (s *archiveSink) Write(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encoding event: %w", err)
+	}
+	data = append(data, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.writer == nil {
+		name := fmt.Sprintf("events-%s-%s.ndjson.zst", NodeName, time.Now().UTC().Format("20060102T150405.000Z"))
+		if err := s.open(name); err != nil {
+			s.errors.Track(err)
+			return err
+		}
+	}
+	_, err = s.writer.Write(data)
+	if s.errors.Track(err) {
+		return err
+	}
+
+	s.add(event, len(data))
+	if s.entry.Bytes >= s.maxBytes {
+		return s.roll()
+	}
+	return nil
+}
+
+// add accounts for an event written to the archive in its index entry, the lock must be held
+func (s *archiveSink) add(event *Event, size int) {
+	if s.entry.Events == 0 {
+		s.entry.Start = event.Time
+	}
+	s.entry.End = event.Time
+	s.entry.Events++
+	s.entry.Types[event.Type]++
+	s.entry.Bytes += int64(size)
+	container := event.Namespace + "/" + event.Pod + "/" + event.Container
+	if !s.seen[container] {
+		s.seen[container] = true
+		s.entry.Containers = append(s.entry.Containers, container)
+	}
+}
+
+// open starts a new archive, the lock must be held
+func (s *archiveSink) open(name string) error {
+	s.opened = time.Now()
+	f, err := os.OpenFile(filepath.Join(s.dir, name+".part"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("creating archive: %w", err)
+	}
+	writer, err := zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(s.level)))
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("creating archive: %w", err)
+	}
+	s.file = f
+	s.writer = writer
+	s.entry = &ArchiveIndexEntry{File: name, Node: NodeName, Types: make(map[string]int)}
+	s.seen = make(map[string]bool)
+	return nil
+}
+
+// roll completes the current archive and records it in the index, the lock must be held
+func (s *archiveSink) roll() error {
+	writer, f, entry := s.writer, s.file, s.entry
+	s.writer, s.file, s.entry = nil, nil, nil
+
+	err := writer.Close()
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("completing archive %s: %w", entry.File, err)
+	}
+	path := filepath.Join(s.dir, entry.File)
+	if err := os.Rename(path+".part", path); err != nil {
+		return fmt.Errorf("completing archive %s: %w", entry.File, err)
+	}
+	if info, err := os.Stat(path); err == nil {
+		entry.CompressedBytes = info.Size()
+	}
+	sort.Strings(entry.Containers)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encoding index entry: %w", err)
+	}
+	index, err := os.OpenFile(filepath.Join(s.dir, "index.ndjson"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening index: %w", err)
+	}
+	defer index.Close()
+	if err := writeWithRetry(index, string(data)+"\n"); err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+	log.Printf("Archived %d events into %s\n", entry.Events, entry.File)
+	return nil
+}
+
+// Close completes the current archive
+func (s *archiveSink) Close() error {
+	close(s.stop)
+	<-s.stopped
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.writer == nil {
+		return nil
+	}
+	return s.roll()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// How long the exec requests of the audit log are kept for correlation, the API server batches its audit events
+const auditRetention = 10 * time.Minute
+
+// Maximum time between an exec request and the start of the session it opened
+const auditCorrelationWindow = 30 * time.Second
+
+// Tolerated clock skew between the API server and the node
+const auditClockSkew = 5 * time.Second
+
+// Bearer token the API server audit webhook has to present, the webhook isn't served if empty
+var auditWebhookToken string
+
+// Maximum size of a batch of audit events
+const maxAuditRequestBytes = 32 << 20
+
+// Header of the audit events forwarded by another agent, which aren't forwarded again
+const auditForwardedHeader = "X-Wlftracer-Audit-Forwarded"
+
+// How long the list of the other agents is reused
+const auditPeersTTL = time.Minute
+
+// auditEvent holds the fields of an audit.k8s.io/v1 event used for the correlation
+type auditEvent struct {
+	AuditID    string `json:"auditID"`
+	Stage      string `json:"stage"`
+	RequestURI string `json:"requestURI"`
+	Verb       string `json:"verb"`
+	User       struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	ImpersonatedUser *struct {
+		Username string `json:"username"`
+	} `json:"impersonatedUser,omitempty"`
+	ObjectRef *struct {
+		Resource    string `json:"resource"`
+		Namespace   string `json:"namespace"`
+		Name        string `json:"name"`
+		Subresource string `json:"subresource"`
+	} `json:"objectRef,omitempty"`
+	RequestReceivedTimestamp time.Time `json:"requestReceivedTimestamp"`
+}
+
+// execRequest is an exec (or attach) into a container requested to the API server
+type execRequest struct {
+	AuditID   string
+	User      string
+	Namespace string
+	Pod       string
+	// Empty if the request didn't name the container, i.e. the default container of the Pod
+	Container string
+	Time      time.Time
+}
+
+// AuditCorrelator keeps the recent exec requests of the API server audit log, to find who opened a session
+type AuditCorrelator struct {
+	lock     sync.Mutex
+	requests map[string]*execRequest
+}
+
+var auditCorrelator *AuditCorrelator
+
+// AuditForwarder sends the exec requests into the Pods of the other nodes to the agents of the DaemonSet, as the API
+// server delivers its audit events to the single agent the webhook Service picked
+type AuditForwarder struct {
+	client     kubernetes.Interface
+	httpClient *http.Client
+	namespace  string
+	self       string
+	// Selector of the Pods of the agent, the labels of its own Pod
+	selector string
+	port     string
+	lock     sync.Mutex
+	peers    []string
+	listed   time.Time
+}
+
+var auditForwarder *AuditForwarder
+
+// NewAuditForwarder creates a forwarder to the Pods labeled as the Pod of the agent, on the port of its API. The agents
+// are reached by Pod IP, their certificate is verified against the CA file and the server name if given.
+func NewAuditForwarder(client kubernetes.Interface, namespace string, pod string, port string, caFile string, serverName string) (*AuditForwarder, error) {
+	if namespace == "" || pod == "" {
+		return nil, fmt.Errorf("forwarding the audit events requires $POD_NAMESPACE and $POD_NAME")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	self, err := client.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting own Pod: %w", err)
+	}
+	httpClient, err := newAPIClient(caFile, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if serverName != "" {
+		transport, ok := httpClient.Transport.(*http.Transport)
+		if !ok {
+			transport = http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{}
+			httpClient.Transport = transport
+		}
+		transport.TLSClientConfig.ServerName = serverName
+	}
+	return &AuditForwarder{
+		client:     client,
+		httpClient: httpClient,
+		namespace:  namespace,
+		self:       pod,
+		selector:   labels.SelectorFromSet(self.Labels).String(),
+		port:       port,
+	}, nil
+}
+
+// peerURLs returns the webhook URLs of the other agents
+func (f *AuditForwarder) peerURLs() ([]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if time.Since(f.listed) < auditPeersTTL {
+		return f.peers, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	pods, err := f.client.CoreV1().Pods(f.namespace).List(ctx, metav1.ListOptions{LabelSelector: f.selector})
+	if err != nil {
+		return nil, err
+	}
+	f.peers = f.peers[:0]
+	for _, pod := range pods.Items {
+		if pod.Name == f.self || pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		f.peers = append(f.peers, (&url.URL{Scheme: "https", Host: pod.Status.PodIP + ":" + f.port, Path: "/audit/webhook"}).String())
+	}
+	f.listed = time.Now()
+	return f.peers, nil
+}
+
+// Forward sends the events to every other agent, each keeping the requests into the Pods of its node
+func (f *AuditForwarder) Forward(events []auditEvent) {
+	peers, err := f.peerURLs()
+	if err != nil {
+		log.Printf("Error listing the agents to forward the audit events to: %v\n", err)
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{"kind": "EventList", "apiVersion": "audit.k8s.io/v1", "items": events})
+	if err != nil {
+		log.Printf("Error encoding the forwarded audit events: %v\n", err)
+		return
+	}
+	for _, peer := range peers {
+		request, err := http.NewRequest(http.MethodPost, peer, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Error forwarding the audit events to %s: %v\n", peer, err)
+			continue
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer "+auditWebhookToken)
+		request.Header.Set(auditForwardedHeader, NodeName)
+		resp, err := f.httpClient.Do(request)
+		if err != nil {
+			log.Printf("Error forwarding the audit events to %s: %v\n", peer, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Error forwarding the audit events to %s: %s\n", peer, resp.Status)
+		}
+	}
+}
+
+// NewAuditCorrelator creates an empty correlator
+func NewAuditCorrelator() *AuditCorrelator {
+	return &AuditCorrelator{requests: make(map[string]*execRequest)}
+}
+
+func registerAuditHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/audit/webhook", auditWebhookHandler)
+}
+
+// auditWebhookHandler receives the audit events of the API server webhook backend, as an audit.k8s.io/v1 EventList
+func auditWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(auditWebhookToken)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	var list struct {
+		Items []auditEvent `json:"items"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAuditRequestBytes)).Decode(&list); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var others []auditEvent
+	for i := range list.Items {
+		if !isExecRequest(&list.Items[i]) {
+			continue
+		}
+		if !auditCorrelator.Add(&list.Items[i]) {
+			others = append(others, list.Items[i])
+		}
+	}
+	// The events forwarded by another agent were sent to every agent already
+	if len(others) > 0 && auditForwarder != nil && r.Header.Get(auditForwardedHeader) == "" {
+		go auditForwarder.Forward(others)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// isExecRequest returns true if the event is an exec or attach into a container
+func isExecRequest(event *auditEvent) bool {
+	ref := event.ObjectRef
+	return ref != nil && ref.Resource == "pods" && (ref.Subresource == "exec" || ref.Subresource == "attach")
+}
+
+// Add records the event if it is an exec or attach into a container of this node, and returns false if it isn't
+func (c *AuditCorrelator) Add(event *auditEvent) bool {
+	if !isExecRequest(event) {
+		return false
+	}
+	ref := event.ObjectRef
+	if !containers.HasPod(ref.Namespace, ref.Name) {
+		return false
+	}
+	// The same request shows up at every stage
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.requests[event.AuditID]; ok {
+		return true
+	}
+
+	user := event.User.Username
+	if event.ImpersonatedUser != nil {
+		user = event.ImpersonatedUser.Username + " (impersonated by " + user + ")"
+	}
+	var container string
+	if requestURI, err := url.ParseRequestURI(event.RequestURI); err == nil {
+		container = requestURI.Query().Get("container")
+	}
+	c.requests[event.AuditID] = &execRequest{
+		AuditID:   event.AuditID,
+		User:      user,
+		Namespace: ref.Namespace,
+		Pod:       ref.Name,
+		Container: container,
+		Time:      event.RequestReceivedTimestamp,
+	}
+
+	for id, request := range c.requests {
+		if time.Since(request.Time) > auditRetention {
+			delete(c.requests, id)
+		}
+	}
+	return true
+}
+
+// Lookup returns the latest exec request into the container which could have started a session at the given time
+func (c *AuditCorrelator) Lookup(key ContainerKey, start time.Time) *execRequest {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var found *execRequest
+	for _, request := range c.requests {
+		if request.Namespace != key.Namespace || request.Pod != key.Podname {
+			continue
+		}
+		if request.Container != "" && request.Container != key.ContainerName {
+			continue
+		}
+		if request.Time.After(start.Add(auditClockSkew)) || start.Sub(request.Time) > auditCorrelationWindow {
+			continue
+		}
+		if found == nil || request.Time.After(found.Time) {
+			found = request
+		}
+	}
+	return found
+}
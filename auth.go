@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Client used to authenticate and authorize the API requests
+var apiAuthClient kubernetes.Interface
+
+// authorizeNamespace checks that the bearer token of the request belongs to a user allowed to read the Pods of the
+// namespace, so tenants only see their own data
+func authorizeNamespace(r *http.Request, namespace string) (int, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return http.StatusUnauthorized, fmt.Errorf("a bearer token is required")
+	}
+	if apiAuthClient == nil {
+		return http.StatusServiceUnavailable, fmt.Errorf("authentication is not available")
+	}
+
+	review, err := apiAuthClient.AuthenticationV1().TokenReviews().Create(r.Context(), &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return http.StatusServiceUnavailable, fmt.Errorf("reviewing token: %w", err)
+	}
+	if !review.Status.Authenticated {
+		return http.StatusUnauthorized, fmt.Errorf("invalid token")
+	}
+
+	extra := make(map[string]authorizationv1.ExtraValue, len(review.Status.User.Extra))
+	for key, value := range review.Status.User.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+	access, err := apiAuthClient.AuthorizationV1().SubjectAccessReviews().Create(r.Context(), &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   review.Status.User.Username,
+			UID:    review.Status.User.UID,
+			Groups: review.Status.User.Groups,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      "get",
+				Resource:  "pods",
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return http.StatusServiceUnavailable, fmt.Errorf("reviewing access: %w", err)
+	}
+	if !access.Status.Allowed {
+		return http.StatusForbidden, fmt.Errorf("%s can't read namespace %s", review.Status.User.Username, namespace)
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SchemaRegistryConfig configures the Confluent Schema Registry the Avro schema of the events is registered with
+type SchemaRegistryConfig struct {
+	URL      string
+	Subject  string
+	Username string
+	Password string
+}
+
+var schemaRegistryConfig SchemaRegistryConfig
+
+// ID of the Avro schema of the events in the registry, prefixed to every Avro record
+var avroSchemaID uint32
+
+// avroField is a field of the Avro record of the events with the function appending its value
+type avroField struct {
+	name string
+	// Avro type of the field, as it appears in the schema
+	schema interface{}
+	append func(b []byte, e *Event) []byte
+}
+
+func avroStringField(name string, value func(e *Event) string) avroField {
+	return avroField{name, "string", func(b []byte, e *Event) []byte { return appendAvroString(b, value(e)) }}
+}
+
+func avroLongField(name string, value func(e *Event) int64) avroField {
+	return avroField{name, "long", func(b []byte, e *Event) []byte { return appendAvroLong(b, value(e)) }}
+}
+
+func avroBooleanField(name string, value func(e *Event) bool) avroField {
+	return avroField{name, "boolean", func(b []byte, e *Event) []byte {
+		if value(e) {
+			return append(b, 1)
+		}
+		return append(b, 0)
+	}}
+}
+
+func avroStringsField(name string, value func(e *Event) []string) avroField {
+	return avroField{name, map[string]interface{}{"type": "array", "items": "string"}, func(b []byte, e *Event) []byte {
+		values := value(e)
+		if len(values) > 0 {
+			b = appendAvroLong(b, int64(len(values)))
+			for _, v := range values {
+				b = appendAvroString(b, v)
+			}
+		}
+		return appendAvroLong(b, 0)
+	}}
+}
+
+// Fields of the Avro record of the events, in the order of proto/event.proto. Fields are only ever appended, with a
+// default, so the schema stays backward compatible in the registry.
+var avroEventFields = []avroField{
+	{"time", map[string]interface{}{"type": "long", "logicalType": "timestamp-micros"}, func(b []byte, e *Event) []byte {
+		return appendAvroLong(b, e.Time.UnixMicro())
+	}},
+	avroStringField("type", func(e *Event) string { return e.Type }),
+	avroStringField("node", func(e *Event) string { return e.Node }),
+	avroStringField("namespace", func(e *Event) string { return e.Namespace }),
+	avroStringField("pod", func(e *Event) string { return e.Pod }),
+	avroStringField("container", func(e *Event) string { return e.Container }),
+	avroStringField("containerID", func(e *Event) string { return e.ContainerID }),
+	avroStringField("workload", func(e *Event) string { return e.Workload }),
+	avroStringField("image", func(e *Event) string { return e.Image }),
+	avroLongField("pid", func(e *Event) int64 { return int64(e.Pid) }),
+	avroLongField("ppid", func(e *Event) int64 { return int64(e.Ppid) }),
+	avroLongField("uid", func(e *Event) int64 { return int64(e.Uid) }),
+	avroStringField("comm", func(e *Event) string { return e.Comm }),
+	avroStringField("path", func(e *Event) string { return e.Path }),
+	avroStringsField("args", func(e *Event) []string { return e.Args }),
+	avroStringField("user", func(e *Event) string { return e.User }),
+	avroStringField("auditID", func(e *Event) string { return e.AuditID }),
+	avroStringField("errno", func(e *Event) string { return e.Errno }),
+	avroStringField("operation", func(e *Event) string { return e.Operation }),
+	avroStringField("src", func(e *Event) string { return e.Src }),
+	avroStringField("dst", func(e *Event) string { return e.Dst }),
+	avroLongField("sport", func(e *Event) int64 { return int64(e.Sport) }),
+	avroLongField("dport", func(e *Event) int64 { return int64(e.Dport) }),
+	avroStringField("dnsName", func(e *Event) string { return e.DNSName }),
+	avroStringField("queryType", func(e *Event) string { return e.QueryType }),
+	avroStringField("rcode", func(e *Event) string { return e.Rcode }),
+	avroStringsField("addresses", func(e *Event) []string { return e.Addresses }),
+	avroStringField("nameserver", func(e *Event) string { return e.Nameserver }),
+	avroStringField("capability", func(e *Event) string { return e.Capability }),
+	avroStringField("verdict", func(e *Event) string { return e.Verdict }),
+	avroStringField("drift", func(e *Event) string { return e.Drift }),
+	avroStringField("syscall", func(e *Event) string { return e.Syscall }),
+	avroStringField("category", func(e *Event) string { return e.Category }),
+	avroStringField("value", func(e *Event) string { return e.Value }),
+	avroStringField("rule", func(e *Event) string { return e.Rule }),
+	avroStringField("severity", func(e *Event) string { return e.Severity }),
+	avroStringField("message", func(e *Event) string { return e.Message }),
+	avroStringField("alertedType", func(e *Event) string { return e.AlertedType }),
+	avroBooleanField("truncated", func(e *Event) bool { return e.Truncated }),
+	avroBooleanField("startup", func(e *Event) bool { return e.Startup }),
+	avroLongField("gid", func(e *Event) int64 { return int64(e.Gid) }),
+	avroStringField("imageDigest", func(e *Event) string { return e.ImageDigest }),
+	{"lineage", map[string]interface{}{"type": "array", "items": map[string]interface{}{
+		"type": "record",
+		"name": "ProcessAncestor",
+		"fields": []map[string]interface{}{
+			{"name": "pid", "type": "long"},
+			{"name": "comm", "type": "string"},
+			{"name": "path", "type": "string"},
+		},
+	}}, func(b []byte, e *Event) []byte {
+		if len(e.Lineage) > 0 {
+			b = appendAvroLong(b, int64(len(e.Lineage)))
+			for _, ancestor := range e.Lineage {
+				b = appendAvroLong(b, int64(ancestor.Pid))
+				b = appendAvroString(b, ancestor.Comm)
+				b = appendAvroString(b, ancestor.Path)
+			}
+		}
+		return appendAvroLong(b, 0)
+	}},
+	avroLongField("checkpoint", func(e *Event) int64 { return int64(e.Checkpoint) }),
+	{"counters", map[string]interface{}{"type": "map", "values": "long"}, func(b []byte, e *Event) []byte {
+		if len(e.Counters) > 0 {
+			b = appendAvroLong(b, int64(len(e.Counters)))
+			for name, count := range e.Counters {
+				b = appendAvroString(b, name)
+				b = appendAvroLong(b, int64(count))
+			}
+		}
+		return appendAvroLong(b, 0)
+	}},
+	avroStringField("id", func(e *Event) string { return e.ID }),
+}
+
+// avroEventSchema returns the Avro schema of the events
+func avroEventSchema() string {
+	fields := make([]map[string]interface{}, 0, len(avroEventFields))
+	for _, field := range avroEventFields {
+		f := map[string]interface{}{"name": field.name, "type": field.schema}
+		// The defaults let the readers of a newer schema read the records of an older one
+		switch field.schema {
+		case "string":
+			f["default"] = ""
+		case "long":
+			f["default"] = 0
+		case "boolean":
+			f["default"] = false
+		default:
+			if schema, ok := field.schema.(map[string]interface{}); ok && schema["type"] == "map" {
+				f["default"] = map[string]interface{}{}
+			} else if field.name != "time" {
+				f["default"] = []string{}
+			}
+		}
+		fields = append(fields, f)
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":      "record",
+		"name":      "Event",
+		"namespace": "io.wlftracer.v1",
+		"doc":       "Event of the workload file activity tracer",
+		"fields":    fields,
+	})
+	return string(data)
+}
+
+// marshalEventAvro encodes the event in the Confluent wire format: a zero magic byte, the ID of the schema in the
+// registry and the Avro binary encoding of the record
+func marshalEventAvro(e *Event) []byte {
+	b := make([]byte, 5, 256)
+	binary.BigEndian.PutUint32(b[1:], avroSchemaID)
+	for _, field := range avroEventFields {
+		b = field.append(b, e)
+	}
+	return b
+}
+
+func appendAvroLong(b []byte, value int64) []byte {
+	return binary.AppendUvarint(b, uint64((value<<1)^(value>>63)))
+}
+
+func appendAvroString(b []byte, value string) []byte {
+	b = appendAvroLong(b, int64(len(value)))
+	return append(b, value...)
+}
+
+// registerAvroSchema checks that the schema of the events is compatible with the one registered for the subject, and
+// registers it
+func registerAvroSchema(config SchemaRegistryConfig) (uint32, error) {
+	schema, err := json.Marshal(map[string]string{"schema": avroEventSchema()})
+	if err != nil {
+		return 0, err
+	}
+	subject := url.PathEscape(config.Subject)
+	registry := strings.TrimSuffix(config.URL, "/")
+
+	compatibility := struct {
+		IsCompatible bool `json:"is_compatible"`
+	}{}
+	status, err := schemaRegistryRequest(config, registry+"/compatibility/subjects/"+subject+"/versions/latest", schema, &compatibility)
+	switch {
+	case status == http.StatusNotFound:
+		// First registration of the subject
+	case err != nil:
+		return 0, fmt.Errorf("checking compatibility: %w", err)
+	case !compatibility.IsCompatible:
+		return 0, fmt.Errorf("the schema of the events is incompatible with the latest version of subject %s", config.Subject)
+	}
+
+	registered := struct {
+		ID uint32 `json:"id"`
+	}{}
+	if _, err := schemaRegistryRequest(config, registry+"/subjects/"+subject+"/versions", schema, &registered); err != nil {
+		return 0, fmt.Errorf("registering schema: %w", err)
+	}
+	return registered.ID, nil
+}
+
+// schemaRegistryRequest posts the body to the registry and decodes the response into v
+func schemaRegistryRequest(config SchemaRegistryConfig, endpoint string, body []byte, v interface{}) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if config.Username != "" {
+		request.SetBasicAuth(config.Username, config.Password)
+	}
+	response, err := (&http.Client{Timeout: 30 * time.Second}).Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return response.StatusCode, err
+	}
+	if response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("registry returned %s: %s", response.Status, strings.TrimSpace(string(data)))
+	}
+	return response.StatusCode, json.Unmarshal(data, v)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// avroReader decodes the Avro binary encoding by the schema, as a consumer of the records would
+type avroReader struct {
+	b []byte
+}
+
+func (r *avroReader) long() (int64, error) {
+	value, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid long")
+	}
+	r.b = r.b[n:]
+	return int64(value>>1) ^ -int64(value&1), nil
+}
+
+func (r *avroReader) read(schema interface{}) (interface{}, error) {
+	switch s := schema.(type) {
+	case string:
+		switch s {
+		case "long":
+			return r.long()
+		case "boolean":
+			if len(r.b) == 0 || r.b[0] > 1 {
+				return nil, fmt.Errorf("invalid boolean")
+			}
+			value := r.b[0] == 1
+			r.b = r.b[1:]
+			return value, nil
+		case "string":
+			size, err := r.long()
+			if err != nil || size < 0 || int(size) > len(r.b) {
+				return nil, fmt.Errorf("invalid string")
+			}
+			value := string(r.b[:size])
+			r.b = r.b[size:]
+			return value, nil
+		}
+	case map[string]interface{}:
+		switch s["type"] {
+		case "long":
+			return r.long()
+		case "record":
+			record := make(map[string]interface{})
+			for _, field := range s["fields"].([]interface{}) {
+				f := field.(map[string]interface{})
+				value, err := r.read(f["type"])
+				if err != nil {
+					return nil, fmt.Errorf("field %s: %w", f["name"], err)
+				}
+				record[f["name"].(string)] = value
+			}
+			return record, nil
+		case "array", "map":
+			var items []interface{}
+			values := make(map[string]interface{})
+			for {
+				count, err := r.long()
+				if err != nil {
+					return nil, err
+				}
+				if count == 0 {
+					break
+				}
+				for i := int64(0); i < count; i++ {
+					if s["type"] == "map" {
+						key, err := r.read("string")
+						if err != nil {
+							return nil, err
+						}
+						if values[key.(string)], err = r.read(s["values"]); err != nil {
+							return nil, err
+						}
+						continue
+					}
+					item, err := r.read(s["items"])
+					if err != nil {
+						return nil, err
+					}
+					items = append(items, item)
+				}
+			}
+			if s["type"] == "map" {
+				return values, nil
+			}
+			return items, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported schema %v", schema)
+}
+
+// decodeEventAvro decodes a record in the Confluent wire format with the schema of the events
+func decodeEventAvro(t *testing.T, record []byte) (uint32, map[string]interface{}) {
+	t.Helper()
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(avroEventSchema()), &schema); err != nil {
+		t.Fatalf("invalid schema: %v", err)
+	}
+	if len(record) < 5 || record[0] != 0 {
+		t.Fatalf("record %x without magic byte and schema ID", record)
+	}
+	r := &avroReader{b: record[5:]}
+	decoded, err := r.read(schema)
+	if err != nil {
+		t.Fatalf("decoding record: %v", err)
+	}
+	if len(r.b) != 0 {
+		t.Errorf("%d bytes left after the record", len(r.b))
+	}
+	return binary.BigEndian.Uint32(record[1:5]), decoded.(map[string]interface{})
+}
+
+func TestEventAvroSchema(t *testing.T) {
+	var schema struct {
+		Fields []map[string]interface{} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(avroEventSchema()), &schema); err != nil {
+		t.Fatalf("invalid schema: %v", err)
+	}
+	// The fields follow proto/event.proto
+	protoFields := readEventProto(t)["Event"]
+	if len(schema.Fields) != len(protoFields) {
+		t.Fatalf("%d Avro fields, %d fields in proto/event.proto", len(schema.Fields), len(protoFields))
+	}
+	for i, field := range schema.Fields {
+		name := field["name"].(string)
+		protoName := protoFields[i].name
+		if protoName == "time_unix_nano" {
+			protoName = "time"
+		}
+		if normalizeFieldName(name) != normalizeFieldName(protoName) {
+			t.Errorf("Avro field %d is %s, %s in proto/event.proto", i, name, protoFields[i].name)
+		}
+		// The defaults keep the schema backward compatible as fields are appended
+		if _, ok := field["default"]; !ok && i > 0 {
+			t.Errorf("Avro field %s has no default", name)
+		}
+	}
+}
+
+func TestMarshalEventAvro(t *testing.T) {
+	defer func(id uint32) { avroSchemaID = id }(avroSchemaID)
+	avroSchemaID = 7
+
+	event := testFullEvent()
+	id, record := decodeEventAvro(t, marshalEventAvro(event))
+	if id != 7 {
+		t.Errorf("schema ID = %d, want 7", id)
+	}
+	want := map[string]interface{}{
+		"time":        event.Time.UnixNano() / 1000,
+		"type":        "exec",
+		"node":        "node-1",
+		"namespace":   "default",
+		"pod":         "web-1",
+		"container":   "web",
+		"containerID": "abc",
+		"workload":    "deployment/web",
+		"image":       "nginx:1.25",
+		"pid":         int64(42),
+		"ppid":        int64(1),
+		"uid":         int64(1000),
+		"comm":        "sh",
+		"path":        "/bin/sh",
+		"args":        []interface{}{"sh", "-c", "id"},
+		"user":        "alice",
+		"auditID":     "audit-1",
+		"errno":       "ENOENT",
+		"operation":   "connect",
+		"src":         "10.0.0.1",
+		"dst":         "10.0.0.2",
+		"sport":       int64(40000),
+		"dport":       int64(443),
+		"dnsName":     "example.com",
+		"queryType":   "A",
+		"rcode":       "NoError",
+		"addresses":   []interface{}{"93.184.216.34", "2606:2800::1"},
+		"nameserver":  "10.96.0.10",
+		"capability":  "NET_ADMIN",
+		"verdict":     "Deny",
+		"drift":       "created",
+		"syscall":     "ptrace",
+		"category":    "exec",
+		"value":       "/bin/sh",
+		"rule":        "shell",
+		"severity":    "warning",
+		"message":     "shell executed",
+		"alertedType": "exec",
+		"truncated":   true,
+		"startup":     true,
+		"gid":         int64(1001),
+		"imageDigest": "sha256:0123",
+		"lineage": []interface{}{
+			map[string]interface{}{"pid": int64(1), "comm": "init", "path": "/sbin/init"},
+			map[string]interface{}{"pid": int64(7), "comm": "bash", "path": ""},
+		},
+		"checkpoint": int64(3),
+		"counters":   map[string]interface{}{"exec": int64(2), "open": int64(5)},
+		"id":         "event-1",
+	}
+	if !reflect.DeepEqual(record, want) {
+		for name, value := range want {
+			if !reflect.DeepEqual(record[name], value) {
+				t.Errorf("field %s = %#v, want %#v", name, record[name], value)
+			}
+		}
+	}
+
+	// The empty arrays and maps are a single zero count, the zero time is year 1
+	_, empty := decodeEventAvro(t, marshalEventAvro(&Event{Type: "open"}))
+	if empty["type"] != "open" || len(empty["args"].([]interface{})) != 0 || len(empty["counters"].(map[string]interface{})) != 0 {
+		t.Errorf("empty event decoded as %v", empty)
+	}
+	if empty["time"] != int64(-62135596800000000) {
+		t.Errorf("zero time encoded as %v, want -62135596800000000", empty["time"])
+	}
+}
+
+func TestAppendAvroLong(t *testing.T) {
+	// Zigzag varints, the small negative numbers stay short
+	for value, want := range map[int64]string{0: "00", -1: "01", 1: "02", -64: "7f", 64: "8001"} {
+		if got := fmt.Sprintf("%x", appendAvroLong(nil, value)); got != want {
+			t.Errorf("appendAvroLong(%d) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestEncodeEventRecordAvro(t *testing.T) {
+	record, err := encodeEventRecord("avro", &Event{Type: "open", Path: "/etc/passwd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, n := binary.Uvarint(record)
+	if n <= 0 || int(size) != len(record)-n {
+		t.Fatalf("record of %d bytes prefixed with size %d", len(record)-n, size)
+	}
+	if _, decoded := decodeEventAvro(t, record[n:]); decoded["path"] != "/etc/passwd" {
+		t.Errorf("record decoded as %v", decoded)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Number of times sending a batch is attempted, and the delay before the first retry, doubled on every attempt
+const batchSendAttempts = 3
+const batchRetryBackoff = time.Second
+
+// Number of events a batcher holds before dropping new ones
+const batcherQueueSize = 8192
+
+// batcher collects events in the background and hands them over in batches, so slow endpoints never block the event worker
+type batcher struct {
+	events   chan *Event
+	size     int
+	interval time.Duration
+	send     func(batch []*Event) error
+	errors   sinkErrorTracker
+	done     chan struct{}
+
+	// Set for the at least once delivery, along with the events which didn't fit in the queue and are spilled next
+	spill        *spillQueue
+	overflowLock sync.Mutex
+	overflow     []*Event
+}
+
+// checkBatching validates the batch size and flush interval of a sink, time.NewTicker panics on an interval which isn't
+// positive
+func checkBatching(size int, interval time.Duration) error {
+	if size < 1 {
+		return fmt.Errorf("batch size must be positive, got %d", size)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("flush interval must be positive, got %s", interval)
+	}
+	return nil
+}
+
+// newBatcher starts a batcher sending at most size events at once, and at least every interval, with the delivery
+// guarantee
+func newBatcher(name string, size int, interval time.Duration, delivery string, send func(batch []*Event) error) *batcher {
+	b := &batcher{
+		events:   make(chan *Event, batcherQueueSize),
+		size:     size,
+		interval: interval,
+		send:     send,
+		errors:   sinkErrorTracker{name: name},
+		done:     make(chan struct{}),
+	}
+	if delivery == deliveryAtLeastOnce {
+		spill, err := newSpillQueue(name)
+		if err != nil {
+			log.Printf("Error setting up the spilling of %s, its events are delivered on a best effort basis: %v\n", name, err)
+		}
+		b.spill = spill
+	}
+	go b.run()
+	return b
+}
+
+// Add queues an event without blocking. If the batcher is lagging behind, the event is dropped or, for the at least
+// once delivery, spilled to disk.
+func (b *batcher) Add(event *Event) {
+	select {
+	case b.events <- event:
+		return
+	default:
+	}
+	if b.spill == nil {
+		metrics.SinkEventsDropped.Add(1)
+		return
+	}
+	b.overflowLock.Lock()
+	b.overflow = append(b.overflow, event)
+	var full []*Event
+	if len(b.overflow) >= b.size {
+		full, b.overflow = b.overflow, nil
+	}
+	b.overflowLock.Unlock()
+	if full != nil {
+		b.spillBatch(full)
+	}
+}
+
+// AddWait queues a past event, waiting for room in the queue so none is dropped, it returns false once stop is closed
+func (b *batcher) AddWait(event *Event, stop <-chan struct{}) bool {
+	select {
+	case b.events <- event:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Close sends the events still queued and stops the batcher, the events spilled are replayed on the next start
+func (b *batcher) Close() {
+	close(b.events)
+	<-b.done
+	b.spillOverflow()
+}
+
+// spillOverflow spills the events which didn't fit in the queue
+func (b *batcher) spillOverflow() {
+	b.overflowLock.Lock()
+	overflow := b.overflow
+	b.overflow = nil
+	b.overflowLock.Unlock()
+	if len(overflow) > 0 {
+		b.spillBatch(overflow)
+	}
+}
+
+// spillBatch spills a batch to be replayed later, it is dropped if it can't be
+func (b *batcher) spillBatch(batch []*Event) {
+	if err := b.spill.Push(batch); err != nil {
+		metrics.SinkBatchesDropped.Add(1)
+		log.Printf("Error spilling %d events of %s, dropping them: %v\n", len(batch), b.errors.name, err)
+	}
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	batch := make([]*Event, 0, b.size)
+	for {
+		select {
+		case event, ok := <-b.events:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= b.size {
+				b.flush(batch)
+				batch = make([]*Event, 0, b.size)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				b.flush(batch)
+				batch = make([]*Event, 0, b.size)
+			}
+			if b.spill != nil {
+				b.spillOverflow()
+				b.spill.Replay(b.send)
+			}
+		}
+	}
+}
+
+// flush sends the batch, retrying with a backoff before giving up on it
+func (b *batcher) flush(batch []*Event) {
+	if len(batch) == 0 {
+		return
+	}
+	backoff := batchRetryBackoff
+	var err error
+	for attempt := 1; attempt <= batchSendAttempts; attempt++ {
+		if err = b.send(batch); err == nil {
+			break
+		}
+		if attempt < batchSendAttempts {
+			metrics.SinkWriteRetries.Add(1)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	if err != nil && b.spill != nil {
+		b.spillBatch(batch)
+	} else if err != nil {
+		metrics.SinkBatchesDropped.Add(1)
+	}
+	if b.errors.Track(err) {
+		log.Printf("Error sending %d events to %s: %v\n", len(batch), b.errors.name, err)
+	}
+}
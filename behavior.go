@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// Maximum number of distinct files remembered per container, the files opened past it are not recorded
+const maxBehaviorFiles = 4096
+
+// behaviorSet collects the processes, files, protocols and connections used by a container
+type behaviorSet struct {
+	processes map[string]bool
+	files     map[string]bool
+	protocols map[string]bool
+	network   map[string]NetworkRule
+}
+
+func newBehaviorSet() *behaviorSet {
+	return &behaviorSet{
+		processes: make(map[string]bool),
+		files:     make(map[string]bool),
+		protocols: make(map[string]bool),
+		network:   make(map[string]NetworkRule),
+	}
+}
+
+// recordBehavior adds the process, file or protocol used by an event to the behavior of its container
+func recordBehavior(event queuedEvent) {
+	path := event.path
+	if event.exec != "" {
+		path = event.executable
+	}
+
+	state, ok := containers.Get(event.key)
+	if !ok {
+		return
+	}
+
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	switch {
+	case event.exec != "":
+		state.behavior.processes[path] = true
+	case event.protocol != "":
+		state.behavior.protocols[event.protocol] = true
+	case filepath.IsAbs(path) && len(state.behavior.files) < maxBehaviorFiles:
+		// Paths relative to a directory descriptor can't be matched by a policy
+		state.behavior.files[path] = true
+	}
+}
+
+// persistBehavior merges the behavior of the container into the one of its workload and regenerates the policy of the workload
+func persistBehavior(state *ContainerState) {
+	if kubeArmorPolicyDir == "" || !state.Learns() {
+		return
+	}
+
+	state.lock.Lock()
+	processes := setToSlice(state.behavior.processes)
+	files := setToSlice(state.behavior.files)
+	protocols := setToSlice(state.behavior.protocols)
+	state.lock.Unlock()
+
+	behavior, err := store.MergeBehavior(state.Workload, state.Labels, processes, files, protocols)
+	if err != nil {
+		log.Printf("Error persisting behavior of %s: %v\n", state.Workload, err)
+		return
+	}
+
+	// Policies are only generated once the workload was learned
+	if time.Since(behavior.FirstSeen) < learningPeriod {
+		return
+	}
+	if err := writeKubeArmorPolicy(kubeArmorPolicyDir, behavior); err != nil {
+		log.Printf("Error writing KubeArmor policy of %s: %v\n", state.Workload, err)
+	}
+}
+
+func setToSlice(set map[string]bool) []string {
+	values := make([]string, 0, len(set))
+	for value := range set {
+		values = append(values, value)
+	}
+	return values
+}
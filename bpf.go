@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+)
+
+// BPFMap is an eBPF map loaded by the agent
+type BPFMap struct {
+	ID         uint32 `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Type       string `json:"type"`
+	KeySize    uint32 `json:"keySize"`
+	ValueSize  uint32 `json:"valueSize"`
+	MaxEntries uint32 `json:"maxEntries"`
+	// Set for the maps with a value per CPU, their memory is multiplied by the number of CPUs
+	PerCPU bool `json:"perCPU,omitempty"`
+	// Memory charged to the agent by the kernel
+	Memlock uint64 `json:"memlock"`
+}
+
+// BPFProgram is an eBPF program loaded by the agent
+type BPFProgram struct {
+	ID      uint32 `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Type    string `json:"type"`
+	Tag     string `json:"tag"`
+	Memlock uint64 `json:"memlock"`
+}
+
+// TracerBPFResources are the eBPF objects loaded by a tracer, along with the perf buffers it reads the events from
+type TracerBPFResources struct {
+	Tracer   string       `json:"tracer"`
+	Programs []BPFProgram `json:"programs"`
+	Maps     []BPFMap     `json:"maps"`
+	Memlock  uint64       `json:"memlock"`
+	// Buffers mapped by the agent to read the perf event arrays, one per CPU
+	PerfBuffers     int    `json:"perfBuffers"`
+	PerfBufferBytes uint64 `json:"perfBufferBytes"`
+}
+
+// BPFResources are the eBPF resources of the agent, by tracer. The objects loaded outside of the tracers, e.g. by the
+// container collection, are reported as the "other" tracer.
+type BPFResources struct {
+	CPUs            int                  `json:"cpus"`
+	Tracers         []TracerBPFResources `json:"tracers"`
+	Memlock         uint64               `json:"memlock"`
+	PerfBufferBytes uint64               `json:"perfBufferBytes"`
+}
+
+// bpfObjects identifies the eBPF objects of the agent: the IDs of its maps and programs, and the address of its perf
+// buffer mappings
+type bpfObjects struct {
+	maps     map[uint32]bool
+	programs map[uint32]bool
+	buffers  map[string]bool
+}
+
+// Objects loaded by each tracer, from the difference of the objects of the agent before and after it was loaded
+var tracerBPFObjects = struct {
+	lock    sync.Mutex
+	tracers map[string]bpfObjects
+}{tracers: make(map[string]bpfObjects)}
+
+// snapshotBPFObjects returns the eBPF objects of the agent
+func snapshotBPFObjects() bpfObjects {
+	objects := bpfObjects{maps: make(map[uint32]bool), programs: make(map[uint32]bool), buffers: make(map[string]bool)}
+	for _, fd := range bpfFileDescriptors() {
+		if id, ok := fd.fields["map_id"]; ok {
+			objects.maps[uint32(id)] = true
+		} else if id, ok := fd.fields["prog_id"]; ok {
+			objects.programs[uint32(id)] = true
+		}
+	}
+	for address := range perfBufferMappings() {
+		objects.buffers[address] = true
+	}
+	return objects
+}
+
+// recordTracerBPFObjects attributes the objects which appeared since the snapshot to the tracer
+func recordTracerBPFObjects(tracer string, before bpfObjects) {
+	after := snapshotBPFObjects()
+	for id := range before.maps {
+		delete(after.maps, id)
+	}
+	for id := range before.programs {
+		delete(after.programs, id)
+	}
+	for address := range before.buffers {
+		delete(after.buffers, address)
+	}
+	tracerBPFObjects.lock.Lock()
+	tracerBPFObjects.tracers[tracer] = after
+	tracerBPFObjects.lock.Unlock()
+}
+
+// forgetTracerBPFObjects drops the objects of a stopped tracer
+func forgetTracerBPFObjects(tracer string) {
+	tracerBPFObjects.lock.Lock()
+	delete(tracerBPFObjects.tracers, tracer)
+	tracerBPFObjects.lock.Unlock()
+}
+
+// bpfFileDescriptor is a file descriptor of an eBPF map or program, with the fields of its fdinfo
+type bpfFileDescriptor struct {
+	fields map[string]uint64
+	tag    string
+}
+
+// bpfFileDescriptors returns the eBPF maps and programs opened by the agent
+func bpfFileDescriptors() []bpfFileDescriptor {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return nil
+	}
+	var fds []bpfFileDescriptor
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name()))
+		if err != nil || (target != "anon_inode:bpf-map" && target != "anon_inode:bpf-prog") {
+			continue
+		}
+		f, err := os.Open(filepath.Join("/proc/self/fdinfo", entry.Name()))
+		if err != nil {
+			continue
+		}
+		fd := bpfFileDescriptor{fields: make(map[string]uint64)}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			name, value, ok := strings.Cut(scanner.Text(), ":")
+			if !ok {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if name == "prog_tag" {
+				fd.tag = value
+			} else if number, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), bpfFieldBase(value), 64); err == nil {
+				fd.fields[name] = number
+			}
+		}
+		f.Close()
+		fds = append(fds, fd)
+	}
+	return fds
+}
+
+func bpfFieldBase(value string) int {
+	if strings.HasPrefix(value, "0x") {
+		return 16
+	}
+	return 10
+}
+
+// perfBufferMappings returns the size of the perf buffers mapped by the agent, by address
+func perfBufferMappings() map[string]uint64 {
+	f, err := os.Open("/proc/self/maps")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	mappings := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasSuffix(line, "anon_inode:[perf_event]") {
+			continue
+		}
+		addresses, _, _ := strings.Cut(line, " ")
+		start, end, _ := strings.Cut(addresses, "-")
+		startAddress, err1 := strconv.ParseUint(start, 16, 64)
+		endAddress, err2 := strconv.ParseUint(end, 16, 64)
+		if err1 == nil && err2 == nil {
+			mappings[start] = endAddress - startAddress
+		}
+	}
+	return mappings
+}
+
+// isPerCPUMap tells whether the maps of the type have a value per CPU
+func isPerCPUMap(mapType ebpf.MapType) bool {
+	switch mapType {
+	case ebpf.PerCPUHash, ebpf.PerCPUArray, ebpf.LRUCPUHash, ebpf.PerCPUCGroupStorage:
+		return true
+	}
+	return false
+}
+
+// collectBPFResources describes the eBPF objects currently loaded by the agent, by tracer
+func collectBPFResources() *BPFResources {
+	tracerBPFObjects.lock.Lock()
+	owners := make(map[string]string)
+	buffers := make(map[string]string)
+	for tracer, objects := range tracerBPFObjects.tracers {
+		for id := range objects.maps {
+			owners[fmt.Sprintf("map:%d", id)] = tracer
+		}
+		for id := range objects.programs {
+			owners[fmt.Sprintf("prog:%d", id)] = tracer
+		}
+		for address := range objects.buffers {
+			buffers[address] = tracer
+		}
+	}
+	tracerBPFObjects.lock.Unlock()
+
+	byTracer := make(map[string]*TracerBPFResources)
+	tracerResources := func(tracer string) *TracerBPFResources {
+		if tracer == "" {
+			tracer = "other"
+		}
+		resources, ok := byTracer[tracer]
+		if !ok {
+			resources = &TracerBPFResources{Tracer: tracer, Programs: []BPFProgram{}, Maps: []BPFMap{}}
+			byTracer[tracer] = resources
+		}
+		return resources
+	}
+
+	resources := &BPFResources{CPUs: runtime.NumCPU(), Tracers: []TracerBPFResources{}}
+	seen := make(map[string]bool)
+	for _, fd := range bpfFileDescriptors() {
+		if id, ok := fd.fields["map_id"]; ok {
+			key := fmt.Sprintf("map:%d", id)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			bpfMap := BPFMap{
+				ID:         uint32(id),
+				Type:       ebpf.MapType(fd.fields["map_type"]).String(),
+				KeySize:    uint32(fd.fields["key_size"]),
+				ValueSize:  uint32(fd.fields["value_size"]),
+				MaxEntries: uint32(fd.fields["max_entries"]),
+				PerCPU:     isPerCPUMap(ebpf.MapType(fd.fields["map_type"])),
+				Memlock:    fd.fields["memlock"],
+			}
+			if m, err := ebpf.NewMapFromID(ebpf.MapID(id)); err == nil {
+				if info, err := m.Info(); err == nil {
+					bpfMap.Name = info.Name
+				}
+				m.Close()
+			}
+			tracer := tracerResources(owners[key])
+			tracer.Maps = append(tracer.Maps, bpfMap)
+			tracer.Memlock += bpfMap.Memlock
+			resources.Memlock += bpfMap.Memlock
+		} else if id, ok := fd.fields["prog_id"]; ok {
+			key := fmt.Sprintf("prog:%d", id)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			program := BPFProgram{
+				ID:      uint32(id),
+				Type:    ebpf.ProgramType(fd.fields["prog_type"]).String(),
+				Tag:     fd.tag,
+				Memlock: fd.fields["memlock"],
+			}
+			if p, err := ebpf.NewProgramFromID(ebpf.ProgramID(id)); err == nil {
+				if info, err := p.Info(); err == nil {
+					program.Name = info.Name
+				}
+				p.Close()
+			}
+			tracer := tracerResources(owners[key])
+			tracer.Programs = append(tracer.Programs, program)
+			tracer.Memlock += program.Memlock
+			resources.Memlock += program.Memlock
+		}
+	}
+	for address, size := range perfBufferMappings() {
+		tracer := tracerResources(buffers[address])
+		tracer.PerfBuffers++
+		tracer.PerfBufferBytes += size
+		resources.PerfBufferBytes += size
+	}
+
+	for _, tracer := range byTracer {
+		sort.Slice(tracer.Maps, func(i, j int) bool { return tracer.Maps[i].ID < tracer.Maps[j].ID })
+		sort.Slice(tracer.Programs, func(i, j int) bool { return tracer.Programs[i].ID < tracer.Programs[j].ID })
+		resources.Tracers = append(resources.Tracers, *tracer)
+	}
+	sort.Slice(resources.Tracers, func(i, j int) bool { return resources.Tracers[i].Tracer < resources.Tracers[j].Tracer })
+	return resources
+}
+
+// bpfDiagnosticsHandler serves the eBPF resources of the agent to the users allowed to read all the Pods, for the
+// capacity planning of the agent
+func bpfDiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	if status, err := authorizeNamespace(r, ""); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, collectBPFResources())
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time range of the canary events compared by default
+const defaultCanaryWindow = 10 * time.Minute
+
+// CanaryResult is the verdict of the behavioral gate of a canary
+type CanaryResult struct {
+	Pass     bool   `json:"pass"`
+	Canary   string `json:"canary"`
+	Baseline string `json:"baseline"`
+	Window   string `json:"window"`
+	// Number of events of the canary in the window
+	Events int `json:"events"`
+	// Items of the inventory categories used by the canary but never by the baseline
+	New      map[string][]string `json:"new"`
+	NewCount int                 `json:"newCount"`
+	Max      int                 `json:"max"`
+}
+
+// canaryParams are the parameters of a gate, from the query of a GET or the metadata of a Flagger webhook
+type canaryParams struct {
+	namespace    string
+	canary       string
+	canaryDigest string
+	stable       string
+	stableDigest string
+	window       time.Duration
+	max          int
+	ignore       map[string]bool
+}
+
+func registerCanaryHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/canary", canaryHandler)
+}
+
+// canaryHandler compares the behavior of a canary in the last window with the baseline learned from the stable
+// version, for the progressive delivery tools to gate the promotion on it. The canary is a workload of the namespace,
+// canary=<kind>/<name>/<container>, optionally restricted to the image canaryDigest=<digest>. The baseline is the
+// inventory of the workload stable=<kind>/<name>/<container>, the canary workload by default, optionally restricted to
+// the image stableDigest=<digest>: a Flagger canary is compared with the primary Deployment, an Argo Rollouts canary
+// with the stable image of the same Rollout. The gate fails if the canary used more than max=<n> binaries, path
+// prefixes, destinations or syscalls outside of the baseline (0 by default) in window=<duration> (10m by default), the
+// categories of ignore=<category>,... aside. Only the events of the node of the agent are compared.
+//
+// A GET with the parameters in the query always answers 200 with the result, for the web metrics of Argo Rollouts
+// (successCondition: result.pass). A POST with the payload of a Flagger webhook, the parameters in its metadata,
+// answers 412 if the gate fails.
+func canaryHandler(w http.ResponseWriter, r *http.Request) {
+	var values url.Values
+	switch r.Method {
+	case http.MethodGet:
+		values = r.URL.Query()
+	case http.MethodPost:
+		payload := struct {
+			Namespace string            `json:"namespace"`
+			Metadata  map[string]string `json:"metadata"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, fmt.Sprintf("decoding webhook: %v", err), http.StatusBadRequest)
+			return
+		}
+		values = url.Values{"namespace": {payload.Namespace}}
+		for key, value := range payload.Metadata {
+			values.Set(key, value)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if inventory == nil || (eventHistory == nil && recentEvents == nil) {
+		http.Error(w, "the canary gate requires --inventory and --backfill-window or --recent-events", http.StatusServiceUnavailable)
+		return
+	}
+	params, err := parseCanaryParams(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if status, err := authorizeNamespace(r, params.namespace); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	result, err := evaluateCanary(params, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	status := http.StatusOK
+	if r.Method == http.MethodPost && !result.Pass {
+		status = http.StatusPreconditionFailed
+	}
+	writeJSONResponse(w, status, result)
+}
+
+func parseCanaryParams(values url.Values) (*canaryParams, error) {
+	params := &canaryParams{
+		namespace:    values.Get("namespace"),
+		canary:       values.Get("canary"),
+		canaryDigest: values.Get("canaryDigest"),
+		stable:       values.Get("stable"),
+		stableDigest: values.Get("stableDigest"),
+		window:       defaultCanaryWindow,
+		ignore:       make(map[string]bool),
+	}
+	if params.namespace == "" {
+		return nil, fmt.Errorf("namespace is required")
+	}
+	if params.stable == "" {
+		params.stable = params.canary
+	}
+	if strings.Count(params.canary, "/") != 2 || strings.Count(params.stable, "/") != 2 {
+		return nil, fmt.Errorf("canary and stable must be <kind>/<name>/<container>")
+	}
+	if params.stable == params.canary && params.stableDigest == "" {
+		return nil, fmt.Errorf("stable or stableDigest is required to tell the canary from its baseline")
+	}
+	if value := values.Get("window"); value != "" {
+		var err error
+		if params.window, err = time.ParseDuration(value); err != nil || params.window <= 0 {
+			return nil, fmt.Errorf("invalid window %q", value)
+		}
+	}
+	if value := values.Get("max"); value != "" {
+		var err error
+		if params.max, err = strconv.Atoi(value); err != nil || params.max < 0 {
+			return nil, fmt.Errorf("invalid max %q", value)
+		}
+	}
+	for _, category := range strings.Split(values.Get("ignore"), ",") {
+		if category = strings.TrimSpace(category); category != "" {
+			params.ignore[category] = true
+		}
+	}
+	return params, nil
+}
+
+// evaluateCanary compares the events of the canary in the window with its baseline
+func evaluateCanary(params *canaryParams, now time.Time) (*CanaryResult, error) {
+	canary := params.namespace + "/" + params.canary
+	baseline := params.namespace + "/" + params.stable
+	if params.stableDigest != "" {
+		baseline = versionInventoryKey(baseline, params.stableDigest)
+	}
+	known := inventory.Query(baseline, "", "")
+	if known == nil {
+		return nil, fmt.Errorf("no inventory of %s", baseline)
+	}
+
+	result := &CanaryResult{Canary: canary, Baseline: baseline, Window: params.window.String(), New: make(map[string][]string), Max: params.max}
+	if params.canaryDigest != "" {
+		result.Canary = versionInventoryKey(canary, params.canaryDigest)
+	}
+	seen := make(map[string]map[string]bool)
+	replayEvents(now.Add(-params.window), now, []EventFilter{{Namespace: params.namespace}}, func(_ int, event *Event) {
+		if event.Workload != canary || (params.canaryDigest != "" && event.ImageDigest != params.canaryDigest) {
+			return
+		}
+		result.Events++
+		category, value := inventoryItem(event)
+		if event.Type == "new-syscall" {
+			category, value = inventorySyscalls, event.Syscall
+		}
+		if value == "" || params.ignore[category] {
+			return
+		}
+		if _, ok := known[category][value]; ok || seen[category][value] {
+			return
+		}
+		if seen[category] == nil {
+			seen[category] = make(map[string]bool)
+		}
+		seen[category][value] = true
+		result.New[category] = append(result.New[category], value)
+		result.NewCount++
+	})
+	for _, values := range result.New {
+		sort.Strings(values)
+	}
+	result.Pass = result.NewCount <= params.max
+	return result, nil
+}
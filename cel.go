@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+)
+
+// Cost past which the evaluation of an expression is aborted, so a costly expression can't stall the event worker
+const celCostLimit = 10000
+
+// EventExpression is a CEL expression on an event, e.g. event.type == 'open' && event.path.startsWith('/etc'). The
+// fields of the event are named as in its JSON form, all of them set, the labels of its Pod are in labels.
+type EventExpression struct {
+	source  string
+	program cel.Program
+}
+
+var celEnv *cel.Env
+
+// celEventFields are the fields of an event by their JSON name, resolved once
+var celEventFields []celEventField
+
+type celEventField struct {
+	name  string
+	index int
+}
+
+func init() {
+	var err error
+	celEnv, err = cel.NewEnv(
+		cel.Variable("event", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("labels", cel.MapType(cel.StringType, cel.StringType)),
+		ext.Strings(),
+	)
+	if err != nil {
+		panic(fmt.Sprintf("creating CEL environment: %v", err))
+	}
+	eventType := reflect.TypeOf(Event{})
+	for i := 0; i < eventType.NumField(); i++ {
+		name, _, _ := strings.Cut(eventType.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			celEventFields = append(celEventFields, celEventField{name: name, index: i})
+		}
+	}
+}
+
+// compileEventExpression compiles an expression, which must evaluate to a bool
+func compileEventExpression(source string) (*EventExpression, error) {
+	ast, issues := celEnv.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("compiling %q: %w", source, issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("%q evaluates to %s, expected bool", source, ast.OutputType())
+	}
+	program, err := celEnv.Program(ast, cel.CostLimit(celCostLimit))
+	if err != nil {
+		return nil, fmt.Errorf("compiling %q: %w", source, err)
+	}
+	return &EventExpression{source: source, program: program}, nil
+}
+
+// celActivation holds the variables of the expressions on an event, built once for all of them
+type celActivation map[string]interface{}
+
+// newCELActivation exposes the event and the labels of its Pod to the expressions, the unset fields with their zero
+// value so event.path.startsWith('/etc') doesn't fail on the events without path
+func newCELActivation(event *Event, labels map[string]string) celActivation {
+	fields := make(map[string]interface{}, len(celEventFields))
+	value := reflect.ValueOf(event).Elem()
+	for _, field := range celEventFields {
+		fields[field.name] = celValue(value.Field(field.index))
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return celActivation{"event": fields, "labels": labels}
+}
+
+// celValue converts a field of the event to a CEL value, the integers to int and the structures to their JSON form
+func celValue(field reflect.Value) interface{} {
+	switch field.Kind() {
+	case reflect.String:
+		return field.String()
+	case reflect.Bool:
+		return field.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return field.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(field.Uint())
+	}
+	if t, ok := field.Interface().(time.Time); ok {
+		return t
+	}
+	if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String {
+		if field.IsNil() {
+			return []string{}
+		}
+		return field.Interface()
+	}
+	var generic interface{}
+	if data, err := json.Marshal(field.Interface()); err == nil {
+		json.Unmarshal(data, &generic)
+	}
+	if generic == nil {
+		if field.Kind() == reflect.Map {
+			return map[string]interface{}{}
+		}
+		return []interface{}{}
+	}
+	return generic
+}
+
+// Matches evaluates the expression, the events it fails on (e.g. a missing label) don't match
+func (e *EventExpression) Matches(activation celActivation) bool {
+	result, _, err := e.program.Eval(map[string]interface{}(activation))
+	if err != nil {
+		metrics.ExpressionErrors.Add(1)
+		return false
+	}
+	matched, ok := result.Value().(bool)
+	return ok && matched
+}
+
+func (e *EventExpression) String() string {
+	return e.source
+}
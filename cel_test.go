@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCompileEventExpressionRejectsInvalidExpressions(t *testing.T) {
+	if _, err := compileEventExpression("event.path.startsWith('/etc') && labels['app'] == 'web'"); err != nil {
+		t.Fatalf("valid expression rejected: %v", err)
+	}
+	// Not a boolean, not parseable, an unknown variable
+	for _, source := range []string{"event.type", "event.type ==", "unknown.type == 'open'"} {
+		if _, err := compileEventExpression(source); err == nil {
+			t.Errorf("%q compiled", source)
+		}
+	}
+}
+
+func TestEventExpressionMatches(t *testing.T) {
+	activation := newCELActivation(&Event{
+		Type: "exec",
+		Path: "/usr/bin/curl",
+		Args: []string{"curl", "-s", "https://example.com"},
+		Pid:  42,
+	}, map[string]string{"app": "web"})
+	matches := func(source string) bool {
+		t.Helper()
+		expression, err := compileEventExpression(source)
+		if err != nil {
+			t.Fatalf("compiling %q: %v", source, err)
+		}
+		return expression.Matches(activation)
+	}
+
+	for _, source := range []string{
+		"event.type == 'exec'",
+		"event.path.startsWith('/usr/bin')",
+		"event.pid == 42 && event.uid == 0",
+		"'-s' in event.args && event.args.size() == 3",
+		"labels['app'] == 'web'",
+		// Unset fields have their zero value
+		"event.dnsName == '' && event.addresses.size() == 0",
+	} {
+		if !matches(source) {
+			t.Errorf("%q doesn't match", source)
+		}
+	}
+
+	if matches("event.type == 'open'") || matches("event.truncated == true") {
+		t.Error("unexpected match")
+	}
+	// A missing label fails the evaluation, which never matches, negated or not
+	if matches("labels['team'] == 'x'") || matches("!(labels['team'] == 'x')") {
+		t.Error("missing label matched")
+	}
+}
+
+func TestEventExpressionWithoutLabels(t *testing.T) {
+	expression, err := compileEventExpression("size(labels) == 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expression.Matches(newCELActivation(&Event{Type: "open"}, nil)) {
+		t.Error("the labels of a container without labels aren't empty")
+	}
+}
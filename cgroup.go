@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	containercollection "github.com/inspektor-gadget/inspektor-gadget/pkg/container-collection"
+	"github.com/inspektor-gadget/inspektor-gadget/pkg/container-utils/cgroups"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Mount points of the cgroup hierarchies, tried in order (e.g. /host/sys/fs/cgroup when the host one is mounted there)
+var cgroupRoots = []string{"/sys/fs/cgroup"}
+
+// Pod UID in the cgroup paths of the cgroupfs (pod<uid>) and systemd (pod<uid with underscores>.slice) drivers
+var cgroupPodUIDPattern = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// Re-evaluates the tracer selectors for the containers enriched here, set once the tracer collection exists
+var cgroupTracerMapsUpdater containercollection.FuncNotify
+
+var cgroupClientOnce sync.Once
+var cgroupClient kubernetes.Interface
+
+// processCgroups is the membership of a process in the cgroup hierarchies, on the hybrid nodes it has both v1 and v2
+// paths
+type processCgroups struct {
+	// Path in the v2 hierarchy, empty if there is none
+	v2 string
+	// Paths in the v1 hierarchies by their controllers (e.g. memory, cpu,cpuacct, name=systemd)
+	v1 map[string]string
+}
+
+// readProcessCgroups parses /proc/<pid>/cgroup, every v1 hierarchy included whatever its ID
+func readProcessCgroups(pid uint32) (*processCgroups, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := &processCgroups{v1: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controllers:path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 || fields[2] == "/" {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			result.v2 = fields[2]
+		} else {
+			result.v1[fields[1]] = fields[2]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// podUID returns the UID of the Pod the cgroups belong to, empty if none
+func (c *processCgroups) podUID() string {
+	paths := []string{c.v2}
+	for _, path := range c.v1 {
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		if match := cgroupPodUIDPattern.FindStringSubmatch(path); match != nil {
+			return strings.ReplaceAll(match[1], "_", "-")
+		}
+	}
+	return ""
+}
+
+// v1Path returns the path in the v1 hierarchy of systemd, or else in the first hierarchy naming the Pod
+func (c *processCgroups) v1Path() string {
+	if path, ok := c.v1["name=systemd"]; ok {
+		return path
+	}
+	fallback := ""
+	for _, path := range c.v1 {
+		if cgroupPodUIDPattern.MatchString(path) {
+			return path
+		}
+		if fallback == "" {
+			fallback = path
+		}
+	}
+	return fallback
+}
+
+// cgroupV2Mountpoint returns the path of a v2 cgroup under the first root it exists in, the unified mount of the hybrid
+// nodes first
+func cgroupV2Mountpoint(path string) (string, bool) {
+	for _, root := range cgroupRoots {
+		for _, candidate := range []string{filepath.Join(root, "unified", path), filepath.Join(root, path)} {
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate, true
+			}
+		}
+	}
+	return "", false
+}
+
+// enrichFromCgroups fills in the cgroups of a container the Kubernetes enrichment missed, on the v1 hierarchies other
+// than systemd or under other mount points, and identifies its Pod from them. It returns false for the pause
+// containers, which aren't traced.
+func enrichFromCgroups(container *containercollection.Container) bool {
+	if container.Pid == 0 {
+		return true
+	}
+	paths, err := readProcessCgroups(container.Pid)
+	if err != nil {
+		log.Printf("Failed to read the cgroups of container %s: %v\n", container.ID, err)
+		return true
+	}
+	if container.CgroupV1 == "" {
+		container.CgroupV1 = paths.v1Path()
+	}
+	if container.CgroupV2 == "" {
+		container.CgroupV2 = paths.v2
+	}
+	if container.CgroupPath == "" && paths.v2 != "" {
+		if path, ok := cgroupV2Mountpoint(paths.v2); ok {
+			container.CgroupPath = path
+			container.CgroupID, _ = cgroups.GetCgroupID(path)
+		}
+	}
+
+	uid := paths.podUID()
+	if uid == "" {
+		return true
+	}
+	pod, err := nodePodByUID(uid)
+	if err != nil {
+		log.Printf("Failed to look up the Pod of container %s: %v\n", container.ID, err)
+		return true
+	}
+	if pod == nil {
+		return true
+	}
+	name := podContainerName(pod, container)
+	if name == "" {
+		return false
+	}
+	container.Namespace = pod.Namespace
+	container.Podname = pod.Name
+	container.PodUID = uid
+	container.Name = name
+	container.Labels = make(map[string]string, len(pod.Labels))
+	for key, value := range pod.Labels {
+		container.Labels[key] = value
+	}
+	metrics.ContainersEnrichedFromCgroups.Add(1)
+	log.Printf("Identified container %s as %s/%s/%s from its cgroups\n", container.ID, container.Namespace, container.Podname, container.Name)
+
+	// The tracer collection skipped the container as it had no name yet
+	if cgroupTracerMapsUpdater != nil {
+		cgroupTracerMapsUpdater(containercollection.PubSubEvent{Type: containercollection.EventTypeAddContainer, Container: container})
+	}
+	return true
+}
+
+// nodePodByUID returns the Pod of the node with the UID, nil if there is none
+func nodePodByUID(uid string) (*corev1.Pod, error) {
+	cgroupClientOnce.Do(func() {
+		client, err := kubernetesClient()
+		if err != nil {
+			log.Printf("Failed to create Kubernetes client: %v\n", err)
+			return
+		}
+		cgroupClient = client
+	})
+	if cgroupClient == nil {
+		return nil, fmt.Errorf("no Kubernetes client")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pods, err := cgroupClient.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", NodeName).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		if string(pods.Items[i].UID) == uid {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// podContainerName returns the name of the container in the Pod, from its status or else from the mounts of its OCI
+// config, empty for the pause container
+func podContainerName(pod *corev1.Pod, container *containercollection.Container) string {
+	var statuses []corev1.ContainerStatus
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.EphemeralContainerStatuses...)
+	for _, status := range statuses {
+		// <runtime>://<id>
+		if _, id, ok := strings.Cut(status.ContainerID, "://"); ok && id == container.ID {
+			return status.Name
+		}
+	}
+	if container.OciConfig == nil {
+		return ""
+	}
+	var names []string
+	for _, c := range pod.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	for _, c := range pod.Spec.InitContainers {
+		names = append(names, c.Name)
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		names = append(names, c.Name)
+	}
+	for _, name := range names {
+		pattern := fmt.Sprintf("pods/%s/containers/%s/", pod.UID, name)
+		for _, mount := range container.OciConfig.Mounts {
+			if strings.Contains(mount.Source, pattern) {
+				return name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+)
+
+// Interval between two checkpoints of each container in the event streams, 0 to not emit any
+var checkpointInterval time.Duration
+
+// checkpointLoop queues a checkpoint of every traced container on each tick until stop is closed
+func checkpointLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			now := clock.Now()
+			for _, state := range containers.States() {
+				// Queued behind the events of the container, so the counters cover all of them
+				eventQueue.Enqueue(queuedEvent{key: state.Key, timestamp: now, checkpoint: true})
+			}
+		}
+	}
+}
+
+// dispatchCheckpoint sends a checkpoint of the container to the sinks, with the number of events of each type sent so
+// far. Consumers tell a quiet container from a broken stream by the checkpoints, and detect lost events by comparing
+// the counters with the events received, and lost checkpoints by their sequence.
+func dispatchCheckpoint(key ContainerKey, timestamp time.Time) {
+	state, ok := containers.Get(key)
+	if !ok || !hasSinks() {
+		return
+	}
+	state.lock.Lock()
+	state.checkpoints++
+	sequence := state.checkpoints
+	state.lock.Unlock()
+
+	event := &Event{
+		Time:       timestamp,
+		Type:       "checkpoint",
+		Namespace:  key.Namespace,
+		Pod:        key.Podname,
+		Container:  key.ContainerName,
+		Checkpoint: sequence,
+		Counters:   activityMetrics.Counts(key),
+	}
+	enrichEvent(key, event)
+	dispatchEvent(event)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Clock places the events on the boot time of the node, which is immune to wall clock adjustments, and identifies the boot they happened in
+type Clock struct {
+	// Boot ID of the node kernel and its position among the boots seen by the agent
+	BootID  string
+	BootSeq int
+	// Time the agent started
+	AgentStart time.Time
+	// Wall clock time minus the boot time, measured once at startup like the tracers do to convert their kernel timestamps
+	offset time.Duration
+}
+
+var clock *Clock
+
+// NewClock measures the boot time offset and registers the current boot in the store
+func NewClock(store *Store) (*Clock, error) {
+	data, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return nil, fmt.Errorf("reading boot ID: %w", err)
+	}
+	bootID := strings.TrimSpace(string(data))
+
+	bootTime, err := bootTimeNow()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	bootSeq, err := store.BootSequence(bootID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Clock{
+		BootID:     bootID,
+		BootSeq:    bootSeq,
+		AgentStart: now,
+		offset:     time.Duration(now.UnixNano()) - bootTime,
+	}, nil
+}
+
+// Now returns the current time derived from the boot time, so it is consistent with the kernel timestamps of the tracers
+func (c *Clock) Now() time.Time {
+	bootTime, err := bootTimeNow()
+	if err != nil {
+		return time.Now()
+	}
+	return time.Unix(0, int64(bootTime+c.offset))
+}
+
+// BootTime returns the time elapsed since the boot of the node for a timestamp
+func (c *Clock) BootTime(timestamp time.Time) time.Duration {
+	return time.Duration(timestamp.UnixNano()) - c.offset
+}
+
+func bootTimeNow() (time.Duration, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts); err != nil {
+		return 0, fmt.Errorf("reading boot time: %w", err)
+	}
+	return time.Duration(ts.Nano()), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec compresses the batches posted by a sink
+type Codec interface {
+	// Name of the codec, which is also the Content-Encoding of the compressed bodies
+	Name() string
+	Compress(data []byte) ([]byte, error)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encoder shared by the zstd codecs, EncodeAll is safe for concurrent use
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return "zstd" }
+
+func (zstdCodec) Compress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+// snappyCodec uses the block format, as the Prometheus remote write protocol does
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string { return "snappy" }
+
+func (snappyCodec) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+// NewCodec returns the codec named by a compression flag, nil for none. supported lists the codecs the destination
+// accepts.
+func NewCodec(name string, supported ...string) (Codec, error) {
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+	found := false
+	for _, codec := range supported {
+		found = found || codec == name
+	}
+	if !found {
+		return nil, fmt.Errorf("unsupported compression %q, expected none or %s", name, strings.Join(supported, ", "))
+	}
+	switch name {
+	case "gzip":
+		return gzipCodec{}, nil
+	case "zstd":
+		return zstdCodec{}, nil
+	case "snappy":
+		return snappyCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", name)
+}
+
+// newCompressedRequest creates a POST request of the body compressed with the codec, if any
+func newCompressedRequest(codec Codec, url string, body []byte) (*http.Request, error) {
+	if codec == nil {
+		return http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	}
+	compressed, err := codec.Compress(body)
+	if err != nil {
+		return nil, fmt.Errorf("compressing with %s: %w", codec.Name(), err)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Encoding", codec.Name())
+	return req, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// versionInventoryKey returns the key of the inventory of a workload while it ran an image, e.g.
+// default/Deployment/web/nginx@sha256:...
+func versionInventoryKey(workload string, digest string) string {
+	return workload + "@" + digest
+}
+
+// CategoryComparison lists the items of an inventory category only seen in one of the versions of a workload
+type CategoryComparison struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// Number of items seen in both versions
+	Unchanged int `json:"unchanged"`
+}
+
+// WorkloadComparison compares the behavior of a workload running two images, from the base to the head
+type WorkloadComparison struct {
+	Workload   string                         `json:"workload"`
+	Base       string                         `json:"base"`
+	Head       string                         `json:"head"`
+	Categories map[string]*CategoryComparison `json:"categories"`
+}
+
+// compareInventories compares the inventories of two versions of a workload
+func compareInventories(base map[string]map[string]InventoryItem, head map[string]map[string]InventoryItem) map[string]*CategoryComparison {
+	categories := make(map[string]*CategoryComparison)
+	for _, category := range []string{inventoryBinaries, inventoryPathPrefixes, inventoryDestinations, inventorySyscalls} {
+		comparison := &CategoryComparison{Added: []string{}, Removed: []string{}}
+		for value := range head[category] {
+			if _, ok := base[category][value]; ok {
+				comparison.Unchanged++
+			} else {
+				comparison.Added = append(comparison.Added, value)
+			}
+		}
+		for value := range base[category] {
+			if _, ok := head[category][value]; !ok {
+				comparison.Removed = append(comparison.Removed, value)
+			}
+		}
+		sort.Strings(comparison.Added)
+		sort.Strings(comparison.Removed)
+		categories[category] = comparison
+	}
+	return categories
+}
+
+// serveComparison compares the behavior of a workload of the namespace running two images, for the release reviews
+// and the canary analysis: ?workload=<kind>/<name>/<container>&base=<digest>&head=<digest>, as JSON or as a Markdown
+// report with ?format=markdown
+func serveComparison(w http.ResponseWriter, r *http.Request, namespace string) {
+	if inventory == nil {
+		http.Error(w, "the inventory is disabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	workload := query.Get("workload")
+	if strings.Count(workload, "/") != 2 {
+		http.Error(w, "workload must be <kind>/<name>/<container>", http.StatusBadRequest)
+		return
+	}
+	comparison := &WorkloadComparison{Workload: namespace + "/" + workload, Base: query.Get("base"), Head: query.Get("head")}
+	if comparison.Base == "" || comparison.Head == "" {
+		http.Error(w, "the base and head image digests are required", http.StatusBadRequest)
+		return
+	}
+	base := inventory.Query(versionInventoryKey(comparison.Workload, comparison.Base), "", "")
+	head := inventory.Query(versionInventoryKey(comparison.Workload, comparison.Head), "", "")
+	for digest, items := range map[string]map[string]map[string]InventoryItem{comparison.Base: base, comparison.Head: head} {
+		if items == nil {
+			http.Error(w, fmt.Sprintf("no inventory of %s running %s", comparison.Workload, digest), http.StatusNotFound)
+			return
+		}
+	}
+	comparison.Categories = compareInventories(base, head)
+
+	if query.Get("format") == "markdown" {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Write([]byte(comparison.Markdown()))
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, comparison)
+}
+
+// Markdown formats the comparison as a report
+func (c *WorkloadComparison) Markdown() string {
+	var report strings.Builder
+	fmt.Fprintf(&report, "# Behavior of %s\n\n- Base: `%s`\n- Head: `%s`\n", c.Workload, c.Base, c.Head)
+	for _, category := range []string{inventoryBinaries, inventoryPathPrefixes, inventoryDestinations, inventorySyscalls} {
+		comparison := c.Categories[category]
+		fmt.Fprintf(&report, "\n## %s\n\n%d added, %d removed, %d unchanged\n", category, len(comparison.Added), len(comparison.Removed), comparison.Unchanged)
+		if len(comparison.Added) == 0 && len(comparison.Removed) == 0 {
+			continue
+		}
+		report.WriteString("\n```diff\n")
+		for _, value := range comparison.Added {
+			fmt.Fprintf(&report, "+ %s\n", value)
+		}
+		for _, value := range comparison.Removed {
+			fmt.Fprintf(&report, "- %s\n", value)
+		}
+		report.WriteString("```\n")
+	}
+	return report.String()
+}
@@ -0,0 +1,332 @@
+//go:build !no_csv_sink
+
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// csvColumn is a column of a CSV export with the value it takes from an event
+type csvColumn struct {
+	name  string
+	value func(event *Event) string
+}
+
+// Columns shared by all the event types, first in every file
+var csvCommonColumns = []csvColumn{
+	{"time", func(e *Event) string { return e.Time.UTC().Format(time.RFC3339Nano) }},
+	{"node", func(e *Event) string { return e.Node }},
+	{"namespace", func(e *Event) string { return e.Namespace }},
+	{"pod", func(e *Event) string { return e.Pod }},
+	{"container", func(e *Event) string { return e.Container }},
+	{"container_id", func(e *Event) string { return e.ContainerID }},
+	{"workload", func(e *Event) string { return e.Workload }},
+	{"image", func(e *Event) string { return e.Image }},
+	{"pid", func(e *Event) string { return formatCSVUint(uint64(e.Pid)) }},
+	{"uid", func(e *Event) string { return strconv.FormatUint(uint64(e.Uid), 10) }},
+	{"comm", func(e *Event) string { return e.Comm }},
+}
+
+// Columns of each event type after the common ones. They are only ever appended to, so the files stay readable by the
+// spreadsheets built on them.
+var csvTypeColumns = map[string][]csvColumn{
+	"exec": {
+		{"ppid", func(e *Event) string { return formatCSVUint(uint64(e.Ppid)) }},
+		{"path", func(e *Event) string { return e.Path }},
+		{"args", func(e *Event) string { return strings.Join(e.Args, " ") }},
+		{"user", func(e *Event) string { return e.User }},
+		{"audit_id", func(e *Event) string { return e.AuditID }},
+		{"truncated", func(e *Event) string { return strconv.FormatBool(e.Truncated) }},
+		{"startup", func(e *Event) string { return strconv.FormatBool(e.Startup) }},
+		{"gid", func(e *Event) string { return strconv.FormatUint(uint64(e.Gid), 10) }},
+		{"lineage", func(e *Event) string { return formatLineage(e.Lineage) }},
+	},
+	"exec-failed": {
+		{"ppid", func(e *Event) string { return formatCSVUint(uint64(e.Ppid)) }},
+		{"path", func(e *Event) string { return e.Path }},
+		{"args", func(e *Event) string { return strings.Join(e.Args, " ") }},
+		{"errno", func(e *Event) string { return e.Errno }},
+		{"startup", func(e *Event) string { return strconv.FormatBool(e.Startup) }},
+	},
+	"open": {
+		{"path", func(e *Event) string { return e.Path }},
+		{"truncated", func(e *Event) string { return strconv.FormatBool(e.Truncated) }},
+		{"startup", func(e *Event) string { return strconv.FormatBool(e.Startup) }},
+		{"ppid", func(e *Event) string { return formatCSVUint(uint64(e.Ppid)) }},
+		{"gid", func(e *Event) string { return strconv.FormatUint(uint64(e.Gid), 10) }},
+		{"lineage", func(e *Event) string { return formatLineage(e.Lineage) }},
+	},
+	"tcp": {
+		{"operation", func(e *Event) string { return e.Operation }},
+		{"src", func(e *Event) string { return e.Src }},
+		{"sport", func(e *Event) string { return formatCSVUint(uint64(e.Sport)) }},
+		{"dst", func(e *Event) string { return e.Dst }},
+		{"dport", func(e *Event) string { return formatCSVUint(uint64(e.Dport)) }},
+		{"ppid", func(e *Event) string { return formatCSVUint(uint64(e.Ppid)) }},
+		{"gid", func(e *Event) string { return strconv.FormatUint(uint64(e.Gid), 10) }},
+		{"lineage", func(e *Event) string { return formatLineage(e.Lineage) }},
+	},
+	"dns": {
+		{"operation", func(e *Event) string { return e.Operation }},
+		{"query_type", func(e *Event) string { return e.QueryType }},
+		{"dns_name", func(e *Event) string { return e.DNSName }},
+		{"rcode", func(e *Event) string { return e.Rcode }},
+		{"addresses", func(e *Event) string { return strings.Join(e.Addresses, " ") }},
+		{"nameserver", func(e *Event) string { return e.Nameserver }},
+	},
+	"capability": {
+		{"capability", func(e *Event) string { return e.Capability }},
+		{"verdict", func(e *Event) string { return e.Verdict }},
+		{"syscall", func(e *Event) string { return e.Syscall }},
+	},
+	"drift": {
+		{"path", func(e *Event) string { return e.Path }},
+		{"drift", func(e *Event) string { return e.Drift }},
+	},
+	"new-syscall": {
+		{"syscall", func(e *Event) string { return e.Syscall }},
+	},
+	"alert": {
+		{"rule", func(e *Event) string { return e.Rule }},
+		{"severity", func(e *Event) string { return e.Severity }},
+		{"message", func(e *Event) string { return e.Message }},
+		{"alerted_type", func(e *Event) string { return e.AlertedType }},
+		{"path", func(e *Event) string { return e.Path }},
+		{"dst", func(e *Event) string { return e.Dst }},
+		{"dport", func(e *Event) string { return formatCSVUint(uint64(e.Dport)) }},
+	},
+	"anomaly": {
+		{"category", func(e *Event) string { return e.Category }},
+		{"value", func(e *Event) string { return e.Value }},
+	},
+}
+
+// Columns of the container summaries, written once a container is gone
+var csvSummaryColumns = []string{"namespace", "pod", "container", "container_id", "workload", "image", "started", "ended", "events", "exec", "exec_failed", "open", "tcp", "dns", "capability", "drift", "new_syscall", "anomaly"}
+
+// Event types counted in the summaries, in the order of their columns
+var csvSummaryTypes = []string{"exec", "exec-failed", "open", "tcp", "dns", "capability", "drift", "new-syscall", "anomaly"}
+
+// csvFile is a CSV file of the export, with its header written once
+type csvFile struct {
+	f *os.File
+	w *csv.Writer
+}
+
+// csvSink writes the events into one CSV file per event type, and a summary of each container once it is gone
+type csvSink struct {
+	dir    string
+	errors sinkErrorTracker
+	// Summaries are written when the containers are finalized, which may happen outside of the event worker
+	lock  sync.Mutex
+	files map[string]*csvFile
+	// Events per container and type, for the summaries
+	counts map[ContainerKey]map[string]int
+}
+
+func init() {
+	var dir *string
+	registerSink(sinkRegistration{
+		name: "CSV",
+		flags: func() {
+			dir = flag.String("csv-dir", "", "Directory to export the events to as CSV, one <type>.csv per event type with stable columns and containers.csv summarizing each finished container, disabled if empty")
+		},
+		create: func() (Sink, error) {
+			if *dir == "" {
+				return nil, nil
+			}
+			return NewCSVSink(*dir)
+		},
+	})
+}
+
+// NewCSVSink creates a sink writing <type>.csv files and containers.csv into the directory
+func NewCSVSink(dir string) (Sink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating CSV directory: %w", err)
+	}
+	return &csvSink{
+		dir:    dir,
+		errors: sinkErrorTracker{name: "csv:" + dir},
+		files:  make(map[string]*csvFile),
+		counts: make(map[ContainerKey]map[string]int),
+	}, nil
+}
+
+func (s *csvSink) Write(event *Event) error {
+	columns, ok := csvTypeColumns[event.Type]
+	if !ok {
+		// The event type has no stable column set
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := ContainerKey{event.Namespace, event.Pod, event.Container}
+	if s.counts[key] == nil {
+		s.counts[key] = make(map[string]int)
+	}
+	s.counts[key][event.Type]++
+
+	file, err := s.file(event.Type, csvHeader(columns))
+	if err == nil {
+		record := make([]string, 0, len(csvCommonColumns)+len(columns))
+		for _, column := range csvCommonColumns {
+			record = append(record, column.value(event))
+		}
+		for _, column := range columns {
+			record = append(record, column.value(event))
+		}
+		err = writeCSVRecord(file, escapeCSVFormulas(record))
+	}
+	if s.errors.Track(err) {
+		return err
+	}
+	return nil
+}
+
+// ContainerRemoved writes the summary of the container
+func (s *csvSink) ContainerRemoved(state *ContainerState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	counts := s.counts[state.Key]
+	delete(s.counts, state.Key)
+
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	started := ""
+	if !state.Started.IsZero() {
+		started = state.Started.UTC().Format(time.RFC3339Nano)
+	}
+	record := []string{state.Key.Namespace, state.Key.Podname, state.Key.ContainerName, state.ID, state.Workload, state.Image,
+		started, clock.Now().UTC().Format(time.RFC3339Nano), strconv.Itoa(total)}
+	for _, eventType := range csvSummaryTypes {
+		record = append(record, strconv.Itoa(counts[eventType]))
+	}
+
+	file, err := s.file("containers", csvSummaryColumns)
+	if err == nil {
+		err = writeCSVRecord(file, escapeCSVFormulas(record))
+	}
+	if s.errors.Track(err) {
+		log.Printf("Error writing the CSV summary of %s: %v\n", state.ID, err)
+	}
+}
+
+// file returns the CSV file of the name, opening it and writing the header if it is new
+func (s *csvSink) file(name string, header []string) (*csvFile, error) {
+	if file, ok := s.files[name]; ok {
+		return file, nil
+	}
+	path := filepath.Join(s.dir, name+".csv")
+	// A file of a previous run with other columns is set aside, rather than mixing two layouts in one file
+	if existing, err := readCSVHeader(path); err == nil && existing != nil && strings.Join(existing, ",") != strings.Join(header, ",") {
+		rotated := filepath.Join(s.dir, fmt.Sprintf("%s-%s.csv", name, time.Now().UTC().Format("20060102T150405Z")))
+		if err := os.Rename(path, rotated); err != nil {
+			return nil, fmt.Errorf("rotating %s: %w", path, err)
+		}
+		log.Printf("Columns of %s changed, moved it to %s\n", path, rotated)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	file := &csvFile{f: f, w: csv.NewWriter(f)}
+	// Appending to a file of a previous run, which has its header already
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		if err := writeCSVRecord(file, header); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	s.files[name] = file
+	return file, nil
+}
+
+func (s *csvSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var firstErr error
+	for _, file := range s.files {
+		file.w.Flush()
+		if err := file.w.Error(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := file.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// csvHeader returns the names of the common columns followed by the columns of the event type
+func csvHeader(columns []csvColumn) []string {
+	header := make([]string, 0, len(csvCommonColumns)+len(columns))
+	for _, column := range csvCommonColumns {
+		header = append(header, column.name)
+	}
+	for _, column := range columns {
+		header = append(header, column.name)
+	}
+	return header
+}
+
+// readCSVHeader returns the header of a CSV file, nil if the file is missing or empty
+func readCSVHeader(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return header, err
+}
+
+// escapeCSVFormulas prefixes the cells a spreadsheet would evaluate as a formula with a quote
+func escapeCSVFormulas(record []string) []string {
+	for i, cell := range record {
+		if cell != "" && strings.ContainsRune("=+-@", rune(cell[0])) {
+			record[i] = "'" + cell
+		}
+	}
+	return record
+}
+
+// writeCSVRecord writes a record and flushes it, so the file is always complete up to the last event
+func writeCSVRecord(file *csvFile, record []string) error {
+	if err := file.w.Write(record); err != nil {
+		return err
+	}
+	file.w.Flush()
+	return file.w.Error()
+}
+
+// formatCSVUint leaves the zero values, meaning unknown, empty
+func formatCSVUint(value uint64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatUint(value, 10)
+}
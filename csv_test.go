@@ -0,0 +1,176 @@
+//go:build !no_csv_sink
+
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The columns are only ever appended to, the spreadsheets built on the files rely on them
+var wantCSVColumns = map[string]string{
+	"exec":        "ppid,path,args,user,audit_id,truncated,startup,gid,lineage",
+	"exec-failed": "ppid,path,args,errno,startup",
+	"open":        "path,truncated,startup,ppid,gid,lineage",
+	"tcp":         "operation,src,sport,dst,dport,ppid,gid,lineage",
+	"dns":         "operation,query_type,dns_name,rcode,addresses,nameserver",
+	"capability":  "capability,verdict,syscall",
+	"drift":       "path,drift",
+	"new-syscall": "syscall",
+	"alert":       "rule,severity,message,alerted_type,path,dst,dport",
+	"anomaly":     "category,value",
+}
+
+const wantCSVCommonColumns = "time,node,namespace,pod,container,container_id,workload,image,pid,uid,comm"
+
+func TestCSVColumns(t *testing.T) {
+	if len(csvTypeColumns) != len(wantCSVColumns) {
+		t.Errorf("CSV columns of %d event types, want %d", len(csvTypeColumns), len(wantCSVColumns))
+	}
+	for eventType, want := range wantCSVColumns {
+		columns, ok := csvTypeColumns[eventType]
+		if !ok {
+			t.Errorf("no CSV columns for %s events", eventType)
+			continue
+		}
+		header := strings.Join(csvHeader(columns), ",")
+		if !strings.HasPrefix(header, wantCSVCommonColumns+",") {
+			t.Errorf("%s header %q doesn't start with the common columns %q", eventType, header, wantCSVCommonColumns)
+		}
+		// Columns may be appended, never renamed, removed or reordered
+		if got := strings.TrimPrefix(header, wantCSVCommonColumns+","); !strings.HasPrefix(got, want) {
+			t.Errorf("%s columns = %q, want them to start with %q", eventType, got, want)
+		}
+	}
+	if len(csvSummaryColumns) != 9+len(csvSummaryTypes) {
+		t.Errorf("%d summary columns for %d event types, want %d", len(csvSummaryColumns), len(csvSummaryTypes), 9+len(csvSummaryTypes))
+	}
+}
+
+func readCSVFile(t *testing.T, path string) [][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	return records
+}
+
+func TestCSVSink(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewCSVSink(dir)
+	if err != nil {
+		t.Fatalf("NewCSVSink() error = %v", err)
+	}
+	eventTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	events := []*Event{
+		{
+			Time: eventTime, Type: "exec", Node: "node-1", Namespace: "default", Pod: "web-1", Container: "web",
+			Pid: 42, Ppid: 1, Comm: "sh", Path: "/bin/sh", Args: []string{"sh", "-c", "=cmd|' /C calc'!A0"},
+			Lineage: []ProcessAncestor{{Pid: 1, Comm: "init"}},
+		},
+		{Time: eventTime, Type: "open", Namespace: "default", Pod: "web-1", Container: "web", Path: "/etc/passwd"},
+		{Time: eventTime, Type: "open", Namespace: "default", Pod: "web-1", Container: "web", Path: "/etc/hosts"},
+		// No stable columns
+		{Time: eventTime, Type: "checkpoint", Namespace: "default", Pod: "web-1", Container: "web"},
+	}
+	for _, event := range events {
+		if err := sink.Write(event); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	exec := readCSVFile(t, filepath.Join(dir, "exec.csv"))
+	wantExec := [][]string{
+		strings.Split(wantCSVCommonColumns+","+wantCSVColumns["exec"], ","),
+		{"2024-05-01T12:00:00Z", "node-1", "default", "web-1", "web", "", "", "", "42", "0", "sh",
+			"1", "/bin/sh", "sh -c =cmd|' /C calc'!A0", "", "", "false", "false", "0", "init(1)"},
+	}
+	if !reflect.DeepEqual(exec, wantExec) {
+		t.Errorf("exec.csv = %q, want %q", exec, wantExec)
+	}
+	open := readCSVFile(t, filepath.Join(dir, "open.csv"))
+	if len(open) != 3 || open[1][11] != "/etc/passwd" || open[2][11] != "/etc/hosts" || open[1][8] != "" {
+		t.Errorf("open.csv = %q", open)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "checkpoint.csv")); !os.IsNotExist(err) {
+		t.Errorf("checkpoint.csv written for an event type without stable columns")
+	}
+
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clock, err = NewClock(s); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { clock = nil }()
+	sink.(*csvSink).ContainerRemoved(&ContainerState{Key: ContainerKey{"default", "web-1", "web"}, ID: "abc", Workload: "deployment/web", Image: "nginx"})
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	summary := readCSVFile(t, filepath.Join(dir, "containers.csv"))
+	if len(summary) != 2 || !reflect.DeepEqual(summary[0], csvSummaryColumns) {
+		t.Fatalf("containers.csv = %q", summary)
+	}
+	row := summary[1]
+	if row[6] != "" || row[7] == "" || row[8] != "3" || row[9] != "1" || row[11] != "2" {
+		t.Errorf("summary = %q, want no start, an end, 3 events, 1 exec and 2 opens", row)
+	}
+}
+
+func TestCSVSinkReopened(t *testing.T) {
+	dir := t.TempDir()
+	// A file of a previous run with the same columns is appended to, one with other columns is set aside
+	header := strings.Join(csvHeader(csvTypeColumns["open"]), ",")
+	if err := os.WriteFile(filepath.Join(dir, "open.csv"), []byte(header+"\nprevious\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dns.csv"), []byte("time,name\nprevious\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewCSVSink(dir)
+	if err != nil {
+		t.Fatalf("NewCSVSink() error = %v", err)
+	}
+	for _, eventType := range []string{"open", "dns"} {
+		if err := sink.Write(&Event{Type: eventType, Namespace: "default", Pod: "web-1", Container: "web"}); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	sink.Close()
+
+	open, err := os.ReadFile(filepath.Join(dir, "open.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(open)), "\n"); len(lines) != 3 || lines[0] != header || lines[1] != "previous" {
+		t.Errorf("open.csv = %q, want the previous lines followed by the new one", open)
+	}
+	dns := readCSVFile(t, filepath.Join(dir, "dns.csv"))
+	if len(dns) != 2 || strings.Join(dns[0], ",") != strings.Join(csvHeader(csvTypeColumns["dns"]), ",") {
+		t.Errorf("dns.csv = %q, want the new header and event", dns)
+	}
+	rotated, _ := filepath.Glob(filepath.Join(dir, "dns-*.csv"))
+	if len(rotated) != 1 {
+		t.Errorf("%d dns files set aside, want 1", len(rotated))
+	}
+}
+
+func TestEscapeCSVFormulas(t *testing.T) {
+	got := escapeCSVFormulas([]string{"", "=1+1", "+1", "-1", "@SUM(A1)", "plain", "a=b"})
+	want := []string{"", "'=1+1", "'+1", "'-1", "'@SUM(A1)", "plain", "a=b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("escapeCSVFormulas() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,326 @@
+//go:build !no_datadog_sink
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DatadogConfig configures the Datadog sink
+type DatadogConfig struct {
+	Enabled bool
+	APIKey  string
+	// Datadog site, e.g. datadoghq.com or datadoghq.eu
+	Site    string
+	Service string
+	// Extra tags added to the logs and metrics, separated by commas
+	Tags            string
+	BatchSize       int
+	FlushInterval   time.Duration
+	MetricsInterval time.Duration
+	// Compression of the payloads: none or gzip
+	Compression string
+	// Delivery guarantee of the logs: best-effort or at-least-once
+	Delivery string
+}
+
+var datadogConfig DatadogConfig
+
+func init() {
+	registerSink(sinkRegistration{
+		name: "Datadog",
+		flags: func() {
+			flag.BoolVar(&datadogConfig.Enabled, "datadog", false, "Ship the events as logs and the counters as metrics to Datadog")
+			flag.StringVar(&datadogConfig.APIKey, "datadog-api-key", os.Getenv("DD_API_KEY"), "Datadog API key, defaults to $DD_API_KEY")
+			flag.StringVar(&datadogConfig.Site, "datadog-site", "datadoghq.com", "Datadog site (e.g. datadoghq.eu, us3.datadoghq.com)")
+			flag.StringVar(&datadogConfig.Service, "datadog-service", "wlftracer", "Service of the logs sent to Datadog")
+			flag.StringVar(&datadogConfig.Tags, "datadog-tags", "", "Extra tags of the logs and metrics sent to Datadog, separated by commas (e.g. env:prod,team:sec)")
+			flag.IntVar(&datadogConfig.BatchSize, "datadog-batch-size", 500, "Maximum number of logs sent to Datadog at once")
+			flag.DurationVar(&datadogConfig.FlushInterval, "datadog-flush-interval", time.Second, "Maximum time logs wait before being sent to Datadog")
+			flag.DurationVar(&datadogConfig.MetricsInterval, "datadog-metrics-interval", time.Minute, "Interval between two submissions of the metrics to Datadog")
+			flag.StringVar(&datadogConfig.Compression, "datadog-compression", "none", "Compression of the payloads sent to Datadog: none or gzip")
+			flag.StringVar(&datadogConfig.Delivery, "datadog-delivery", deliveryBestEffort, "Delivery guarantee of the logs sent to Datadog: best-effort or at-least-once")
+		},
+		create: func() (Sink, error) {
+			if !datadogConfig.Enabled {
+				return nil, nil
+			}
+			return NewDatadogSink(datadogConfig)
+		},
+	})
+}
+
+// datadogLog is an entry of the logs intake
+type datadogLog struct {
+	Source    string `json:"ddsource"`
+	Tags      string `json:"ddtags"`
+	Hostname  string `json:"hostname"`
+	Service   string `json:"service"`
+	Message   string `json:"message"`
+	Timestamp int64  `json:"timestamp"`
+	Event     *Event `json:"wlftracer"`
+}
+
+type datadogPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type datadogResource struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type datadogSeries struct {
+	Metric    string            `json:"metric"`
+	Type      int               `json:"type"`
+	Interval  int64             `json:"interval,omitempty"`
+	Points    []datadogPoint    `json:"points"`
+	Tags      []string          `json:"tags,omitempty"`
+	Resources []datadogResource `json:"resources,omitempty"`
+}
+
+// Metric type of the v2 series API for counts
+const datadogCount = 1
+
+// datadogSink ships the events as logs and the event and agent counters as custom metrics
+type datadogSink struct {
+	config  DatadogConfig
+	codec   Codec
+	client  *http.Client
+	batcher *batcher
+
+	lock sync.Mutex
+	// Events counted since the last metrics flush, by their sorted tags
+	eventCounts map[string]uint64
+	// Agent counters at the last metrics flush
+	lastCounters map[string]uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDatadogSink creates a sink sending the events to the Datadog site
+func NewDatadogSink(config DatadogConfig) (Sink, error) {
+	if config.APIKey == "" {
+		return nil, fmt.Errorf("a Datadog API key is required")
+	}
+	codec, err := NewCodec(config.Compression, "gzip")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDelivery(config.Delivery); err != nil {
+		return nil, err
+	}
+	if err := checkBatching(config.BatchSize, config.FlushInterval); err != nil {
+		return nil, err
+	}
+	if config.MetricsInterval < time.Second {
+		return nil, fmt.Errorf("metrics interval must be at least 1s, got %s", config.MetricsInterval)
+	}
+	s := &datadogSink{
+		config:       config,
+		codec:        codec,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		eventCounts:  make(map[string]uint64),
+		lastCounters: metrics.Counters(),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	s.batcher = newBatcher("datadog", config.BatchSize, config.FlushInterval, config.Delivery, s.sendLogs)
+	go s.metricsLoop()
+	return s, nil
+}
+
+func (s *datadogSink) Write(event *Event) error {
+	s.batcher.Add(event)
+
+	tags := append(datadogMetricTags(event), "event_type:"+event.Type)
+	sort.Strings(tags)
+	s.lock.Lock()
+	s.eventCounts[strings.Join(tags, ",")]++
+	s.lock.Unlock()
+	return nil
+}
+
+// Close sends the remaining logs and a last round of metrics
+func (s *datadogSink) Close() error {
+	s.batcher.Close()
+	close(s.stop)
+	<-s.done
+	return nil
+}
+
+// datadogEventTags returns the Kubernetes tags of an event, named like the ones of the Datadog agent
+func datadogEventTags(event *Event) []string {
+	tags := []string{
+		"kube_namespace:" + event.Namespace,
+		"pod_name:" + event.Pod,
+		"kube_container_name:" + event.Container,
+	}
+	if event.Image != "" {
+		name, tag := splitImage(event.Image)
+		tags = append(tags, "image_name:"+name)
+		if tag != "" {
+			tags = append(tags, "image_tag:"+tag)
+		}
+	}
+	if _, kind, name, _, ok := parseWorkloadKey(event.Workload); ok && kind != "Pod" {
+		tags = append(tags, datadogKindTag(kind)+":"+name)
+	}
+	return tags
+}
+
+// datadogMetricTags returns the tags of the event counts, the ones of the logs without the Pod name when the Pod has an
+// owner, so that the series follow the workload rather than churning with its Pods
+func datadogMetricTags(event *Event) []string {
+	tags := datadogEventTags(event)
+	if _, kind, _, _, ok := parseWorkloadKey(event.Workload); !ok || kind == "Pod" {
+		return tags
+	}
+	metricTags := tags[:0]
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "pod_name:") {
+			metricTags = append(metricTags, tag)
+		}
+	}
+	return metricTags
+}
+
+// datadogKindTag returns the tag of an owner kind, e.g. kube_stateful_set for StatefulSet
+func datadogKindTag(kind string) string {
+	switch kind {
+	case "CronJob":
+		return "kube_cronjob"
+	}
+	var tag strings.Builder
+	tag.WriteString("kube")
+	for _, r := range kind {
+		if r >= 'A' && r <= 'Z' {
+			tag.WriteByte('_')
+			r += 'a' - 'A'
+		}
+		tag.WriteRune(r)
+	}
+	return tag.String()
+}
+
+// commonTags returns the tags added to everything sent
+func (s *datadogSink) commonTags() []string {
+	var tags []string
+	for _, tag := range strings.Split(s.config.Tags, ",") {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func (s *datadogSink) sendLogs(batch []*Event) error {
+	entries := make([]datadogLog, 0, len(batch))
+	common := s.commonTags()
+	for _, event := range batch {
+		entries = append(entries, datadogLog{
+			Source:    "wlftracer",
+			Tags:      strings.Join(append(datadogEventTags(event), common...), ","),
+			Hostname:  event.Node,
+			Service:   s.config.Service,
+			Message:   eventSummary(event),
+			Timestamp: event.Time.UnixMilli(),
+			Event:     event,
+		})
+	}
+	return s.post(fmt.Sprintf("https://http-intake.logs.%s/api/v2/logs", s.config.Site), entries)
+}
+
+func (s *datadogSink) metricsLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.config.MetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			s.sendMetrics()
+			return
+		case <-ticker.C:
+			s.sendMetrics()
+		}
+	}
+}
+
+// sendMetrics sends the event counts and the agent counter increments since the last call
+func (s *datadogSink) sendMetrics() {
+	now := time.Now().Unix()
+	interval := int64(s.config.MetricsInterval.Seconds())
+	common := s.commonTags()
+	host := []datadogResource{{Name: NodeName, Type: "host"}}
+
+	s.lock.Lock()
+	eventCounts := s.eventCounts
+	s.eventCounts = make(map[string]uint64)
+	s.lock.Unlock()
+
+	var series []datadogSeries
+	for tags, count := range eventCounts {
+		series = append(series, datadogSeries{
+			Metric:    "wlftracer.events",
+			Type:      datadogCount,
+			Interval:  interval,
+			Points:    []datadogPoint{{Timestamp: now, Value: float64(count)}},
+			Tags:      append(strings.Split(tags, ","), common...),
+			Resources: host,
+		})
+	}
+	counters := metrics.Counters()
+	for name, value := range counters {
+		series = append(series, datadogSeries{
+			Metric:    "wlftracer.agent." + name,
+			Type:      datadogCount,
+			Interval:  interval,
+			Points:    []datadogPoint{{Timestamp: now, Value: float64(value - s.lastCounters[name])}},
+			Tags:      common,
+			Resources: host,
+		})
+	}
+	s.lastCounters = counters
+
+	if err := s.post(fmt.Sprintf("https://api.%s/api/v2/series", s.config.Site), map[string]interface{}{"series": series}); err != nil {
+		log.Printf("Error sending metrics to Datadog: %v\n", err)
+	}
+}
+
+func (s *datadogSink) post(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encoding payload: %w", err)
+	}
+	req, err := newCompressedRequest(s.codec, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("DD-API-KEY", s.config.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("datadog returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery guarantees of the batching sinks: the events a best effort sink can't send are dropped, the ones of an
+// at least once sink are spilled to disk and replayed once the destination is back
+const (
+	deliveryBestEffort  = "best-effort"
+	deliveryAtLeastOnce = "at-least-once"
+)
+
+// Directory the at least once sinks spill their events to, and the maximum size spilled per sink
+var spillDir string
+var maxSpillBytes int64 = 512 << 20
+
+// Number of spilled batches replayed at once, so the new events aren't held back for too long
+const spillReplayBatches = 16
+
+// checkDelivery validates the delivery guarantee of a sink
+func checkDelivery(delivery string) error {
+	switch delivery {
+	case deliveryBestEffort, deliveryAtLeastOnce:
+		return nil
+	}
+	return fmt.Errorf("unknown delivery guarantee %q, expected %s or %s", delivery, deliveryBestEffort, deliveryAtLeastOnce)
+}
+
+// spillQueue keeps the batches a sink couldn't send on disk, one file per batch, until they are replayed
+type spillQueue struct {
+	dir  string
+	lock sync.Mutex
+	// Size of the spilled files
+	size int64
+	seq  uint64
+}
+
+// newSpillQueue opens the spill directory of a sink, the batches spilled before a restart are replayed too
+func newSpillQueue(name string) (*spillQueue, error) {
+	q := &spillQueue{dir: filepath.Join(spillDir, storeFileName(name))}
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating spill directory: %w", err)
+	}
+	files, err := q.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			q.size += info.Size()
+		}
+	}
+	if len(files) > 0 {
+		log.Printf("Replaying %d batches spilled by %s\n", len(files), name)
+	}
+	return q, nil
+}
+
+// files returns the spilled batches, oldest first
+func (q *spillQueue) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Push spills a batch, it is dropped if the sink already spilled maxSpillBytes
+func (q *spillQueue) Push(batch []*Event) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range batch {
+		if err := encoder.Encode(event); err != nil {
+			return fmt.Errorf("encoding event: %w", err)
+		}
+	}
+	data, err := sealAtRest(body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.size+int64(len(data)) > maxSpillBytes {
+		return fmt.Errorf("spilled %d bytes already", q.size)
+	}
+	q.seq++
+	path := filepath.Join(q.dir, fmt.Sprintf("%020d-%06d.ndjson", time.Now().UnixNano(), q.seq))
+	// Renamed once complete, so a crash never leaves a half written batch behind
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	q.size += int64(len(data))
+	metrics.SinkEventsSpilled.Add(uint64(len(batch)))
+	return nil
+}
+
+// Replay sends the oldest spilled batches, it stops at the first one which can't be sent
+func (q *spillQueue) Replay(send func(batch []*Event) error) {
+	files, err := q.files()
+	if err != nil || len(files) == 0 {
+		return
+	}
+	if len(files) > spillReplayBatches {
+		files = files[:spillReplayBatches]
+	}
+	for _, file := range files {
+		batch, size, err := readSpilledBatch(file)
+		if err != nil {
+			log.Printf("Error reading spilled batch %s, dropping it: %v\n", file, err)
+			metrics.SinkBatchesDropped.Add(1)
+		} else if err := send(batch); err != nil {
+			return
+		} else {
+			metrics.SinkEventsReplayed.Add(uint64(len(batch)))
+		}
+		if err := os.Remove(file); err != nil {
+			log.Printf("Error removing spilled batch %s: %v\n", file, err)
+			return
+		}
+		q.lock.Lock()
+		q.size -= size
+		q.lock.Unlock()
+	}
+}
+
+func readSpilledBatch(path string) ([]*Event, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := int64(len(data))
+	if data, err = openAtRest(data); err != nil {
+		return nil, size, err
+	}
+	var batch []*Event
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		event := &Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			return nil, size, err
+		}
+		batch = append(batch, event)
+	}
+	return batch, size, scanner.Err()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestSpillQueue opens the spill queue of a sink in a temporary spill directory
+func newTestSpillQueue(t *testing.T) *spillQueue {
+	t.Helper()
+	previous := spillDir
+	spillDir = t.TempDir()
+	t.Cleanup(func() { spillDir = previous })
+	q, err := newSpillQueue("http")
+	if err != nil {
+		t.Fatalf("newSpillQueue() error = %v", err)
+	}
+	return q
+}
+
+func testBatch(paths ...string) []*Event {
+	var batch []*Event
+	for _, path := range paths {
+		batch = append(batch, &Event{
+			Time:      time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			Type:      "open",
+			Namespace: "default",
+			Pod:       "web-1",
+			Container: "web",
+			Pid:       42,
+			Path:      path,
+			Args:      []string{"cat", path},
+		})
+	}
+	return batch
+}
+
+// replayAll replays the spilled batches to a sink which always accepts them
+func replayAll(q *spillQueue) [][]*Event {
+	var replayed [][]*Event
+	q.Replay(func(batch []*Event) error {
+		replayed = append(replayed, batch)
+		return nil
+	})
+	return replayed
+}
+
+func TestSpillQueueRoundTrip(t *testing.T) {
+	q := newTestSpillQueue(t)
+	batches := [][]*Event{testBatch("/etc/passwd", "/etc/group"), testBatch("/etc/hosts")}
+	for _, batch := range batches {
+		if err := q.Push(batch); err != nil {
+			t.Fatalf("Push() error = %v", err)
+		}
+	}
+	if q.size == 0 {
+		t.Errorf("size of the spilled batches = 0")
+	}
+
+	// The batches are kept as long as they can't be sent
+	q.Replay(func(batch []*Event) error { return errors.New("unavailable") })
+	if files, _ := q.files(); len(files) != len(batches) {
+		t.Fatalf("%d batches spilled after a failed replay, want %d", len(files), len(batches))
+	}
+
+	replayed := replayAll(q)
+	if !reflect.DeepEqual(replayed, batches) {
+		t.Errorf("Replay() sent %v, want %v", replayed, batches)
+	}
+	if files, _ := q.files(); len(files) != 0 {
+		t.Errorf("%d batches spilled after the replay, want 0", len(files))
+	}
+	if q.size != 0 {
+		t.Errorf("size of the spilled batches = %d after the replay, want 0", q.size)
+	}
+}
+
+func TestSpillQueueReopened(t *testing.T) {
+	q := newTestSpillQueue(t)
+	if err := q.Push(testBatch("/etc/passwd")); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	// Restarted
+	reopened, err := newSpillQueue("http")
+	if err != nil {
+		t.Fatalf("newSpillQueue() error = %v", err)
+	}
+	if reopened.size != q.size {
+		t.Errorf("size of the spilled batches after a restart = %d, want %d", reopened.size, q.size)
+	}
+	replayed := replayAll(reopened)
+	if len(replayed) != 1 || !reflect.DeepEqual(replayed[0], testBatch("/etc/passwd")) {
+		t.Errorf("Replay() after a restart sent %v", replayed)
+	}
+}
+
+func TestSpillQueueLimit(t *testing.T) {
+	q := newTestSpillQueue(t)
+	defer func(max int64) { maxSpillBytes = max }(maxSpillBytes)
+	maxSpillBytes = 1
+	if err := q.Push(testBatch("/etc/passwd")); err == nil {
+		t.Errorf("Push() past the maximum spilled size succeeded")
+	}
+	if files, _ := q.files(); len(files) != 0 {
+		t.Errorf("%d batches spilled past the maximum size, want 0", len(files))
+	}
+}
+
+func TestSpillQueueDropsCorruptBatches(t *testing.T) {
+	q := newTestSpillQueue(t)
+	if err := os.WriteFile(filepath.Join(q.dir, "00000000000000000001-000001.ndjson"), []byte("{not json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(testBatch("/etc/hosts")); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	replayed := replayAll(q)
+	if !reflect.DeepEqual(replayed, [][]*Event{testBatch("/etc/hosts")}) {
+		t.Errorf("Replay() sent %v, want the valid batch only", replayed)
+	}
+	if files, _ := q.files(); len(files) != 0 {
+		t.Errorf("%d batches spilled after the replay, want 0", len(files))
+	}
+}
+
+func TestSpillQueueEncrypted(t *testing.T) {
+	atRestKey = testAtRestKeys(t)["aes"]
+	defer func() { atRestKey = nil }()
+	q := newTestSpillQueue(t)
+	if err := q.Push(testBatch("/etc/shadow")); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	files, _ := q.files()
+	if len(files) != 1 {
+		t.Fatalf("%d batches spilled, want 1", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := atRestKey.Open(data); err != nil {
+		t.Errorf("the spilled batch isn't encrypted: %v", err)
+	}
+	replayed := replayAll(q)
+	if !reflect.DeepEqual(replayed, [][]*Event{testBatch("/etc/shadow")}) {
+		t.Errorf("Replay() sent %v", replayed)
+	}
+}
+
+func TestCheckDelivery(t *testing.T) {
+	if err := checkDelivery(deliveryAtLeastOnce); err != nil {
+		t.Error(err)
+	}
+	if err := checkDelivery("exactly-once"); err == nil {
+		t.Error("exactly-once accepted")
+	}
+}
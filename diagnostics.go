@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// TracerDiagnostics tells whether a tracer captures the events of a container
+type TracerDiagnostics struct {
+	Name string `json:"name"`
+	// The tracer is loaded, see the tracer:<name> component of the health otherwise
+	Loaded bool `json:"loaded"`
+	// The container matches the selector of the tracer
+	Selected bool `json:"selected"`
+	// The mount namespace of the container is in the map filtering the events of the tracer, nil if the tracer has no such map
+	InMountnsMap *bool `json:"inMountnsMap,omitempty"`
+}
+
+// ContainerDiagnostics describes how a tracked container is traced
+type ContainerDiagnostics struct {
+	Namespace   string              `json:"namespace"`
+	Pod         string              `json:"pod"`
+	Container   string              `json:"container"`
+	ContainerID string              `json:"containerID"`
+	Mntns       uint64              `json:"mntns"`
+	Mode        string              `json:"mode"`
+	Started     time.Time           `json:"started"`
+	Tracers     []TracerDiagnostics `json:"tracers"`
+	// Time of the last event by type, and of the last event of any type
+	LastEvents map[string]time.Time `json:"lastEvents"`
+	LastEvent  *time.Time           `json:"lastEvent,omitempty"`
+	// Reasons why events may be missing
+	Problems []string `json:"problems,omitempty"`
+}
+
+// Diagnostics is the state of the tracing, for the "why am I getting no events for this Pod?" questions
+type Diagnostics struct {
+	Containers []ContainerDiagnostics `json:"containers"`
+	// Pods seen but not traced
+	ExcludedPods []string `json:"excludedPods"`
+	// Degraded components with the reason
+	Degraded map[string]string `json:"degraded"`
+	// Support of the tracers by the node
+	Tracing *TracingSupport `json:"tracing,omitempty"`
+}
+
+// Mount namespace maps of the loaded tracers, by tracer
+var tracerMountnsMaps = struct {
+	lock sync.RWMutex
+	maps map[string]*ebpf.Map
+}{maps: make(map[string]*ebpf.Map)}
+
+// setTracerMountnsMap registers the mount namespace map of a tracer, nil once the tracer is removed
+func setTracerMountnsMap(tracer string, mountnsmap *ebpf.Map) {
+	tracerMountnsMaps.lock.Lock()
+	defer tracerMountnsMaps.lock.Unlock()
+
+	if mountnsmap == nil {
+		delete(tracerMountnsMaps.maps, tracer)
+		return
+	}
+	tracerMountnsMaps.maps[tracer] = mountnsmap
+}
+
+// inTracerMountnsMap returns whether the mount namespace is in the map of the tracer, nil if the tracer has no map
+func inTracerMountnsMap(tracer string, mntns uint64) *bool {
+	tracerMountnsMaps.lock.RLock()
+	defer tracerMountnsMaps.lock.RUnlock()
+
+	mountnsmap, ok := tracerMountnsMaps.maps[tracer]
+	if !ok {
+		return nil
+	}
+	var value uint32
+	err := mountnsmap.Lookup(mntns, &value)
+	member := err == nil
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil
+	}
+	return &member
+}
+
+// recordLastEvent remembers the time of the last event of the type in the container
+func recordLastEvent(key ContainerKey, eventType string, timestamp time.Time) {
+	state, ok := containers.Get(key)
+	if !ok {
+		return
+	}
+	state.lock.Lock()
+	state.lastEvents[eventType] = timestamp
+	state.lock.Unlock()
+}
+
+// collectDiagnostics describes the tracked containers of the namespace (all if empty)
+func collectDiagnostics(namespace string) *Diagnostics {
+	var states []*ContainerState
+	for _, state := range containers.States() {
+		if namespace == "" || state.Key.Namespace == namespace {
+			states = append(states, state)
+		}
+	}
+
+	diagnostics := &Diagnostics{
+		Containers:   make([]ContainerDiagnostics, 0, len(states)),
+		ExcludedPods: exclusions.Pods(namespace),
+		Degraded:     health.Degraded(),
+		Tracing:      tracingSupport,
+	}
+	for _, state := range states {
+		container := ContainerDiagnostics{
+			Namespace:   state.Key.Namespace,
+			Pod:         state.Key.Podname,
+			Container:   state.Key.ContainerName,
+			ContainerID: state.ID,
+			Mntns:       state.Mntns,
+			Mode:        state.Mode,
+			Started:     state.Started,
+			LastEvents:  make(map[string]time.Time),
+		}
+		state.lock.Lock()
+		for eventType, timestamp := range state.lastEvents {
+			container.LastEvents[eventType] = timestamp
+			if container.LastEvent == nil || timestamp.After(*container.LastEvent) {
+				last := timestamp
+				container.LastEvent = &last
+			}
+		}
+		state.lock.Unlock()
+
+		for _, name := range []string{execTraceName, openTraceName, tcpTraceName, dnsTraceName, capabilitiesTraceName, syscallTraceName} {
+			if !enabledTracers[name] {
+				continue
+			}
+			tracer := TracerDiagnostics{
+				Name:     name,
+				Loaded:   tracerManager != nil && tracerManager.Loaded(name),
+				Selected: !exclusions.ExcludedPod(name, state.Key.Namespace, state.Key.Podname),
+			}
+			if tracer.Loaded {
+				tracer.InMountnsMap = inTracerMountnsMap(name, state.Mntns)
+			}
+			switch {
+			case !tracer.Loaded:
+				container.Problems = append(container.Problems, fmt.Sprintf("%s is not loaded", name))
+			case !tracer.Selected:
+				container.Problems = append(container.Problems, fmt.Sprintf("%s doesn't select the Pod", name))
+			case tracer.InMountnsMap != nil && !*tracer.InMountnsMap:
+				container.Problems = append(container.Problems, fmt.Sprintf("the mount namespace is missing from the map of %s, the container doesn't match its selector", name))
+			}
+			container.Tracers = append(container.Tracers, tracer)
+		}
+		diagnostics.Containers = append(diagnostics.Containers, container)
+	}
+	sort.Slice(diagnostics.Containers, func(i, j int) bool {
+		a, b := diagnostics.Containers[i], diagnostics.Containers[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Pod != b.Pod {
+			return a.Pod < b.Pod
+		}
+		return a.Container < b.Container
+	})
+	return diagnostics
+}
+
+func registerDiagnosticsHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/diagnostics/containers", diagnosticsHandler)
+	mux.HandleFunc("/api/v1/diagnostics/bpf", bpfDiagnosticsHandler)
+	mux.HandleFunc("/api/v1/diagnostics/node", tracingSupportHandler)
+	mux.HandleFunc("/api/v1/diagnostics/tuning", tuningHandler)
+}
+
+// diagnosticsHandler serves the diagnostics of the containers of a namespace (?namespace=<namespace>) to the users allowed
+// to read its Pods, or of all the containers to the users allowed to read all the Pods
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get("namespace")
+	if status, err := authorizeNamespace(r, namespace); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, collectDiagnostics(namespace))
+}
+
+// runDiagnoseCommand implements "wlftracer diagnose", printing the diagnostics served by the API of a running agent
+func runDiagnoseCommand(args []string) int {
+	flags := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	apiURLPtr := flags.String("api-url", defaultAPIURL, "URL of the API of the agent")
+	caFilePtr := flags.String("ca-file", "", "CA certificates verifying the certificate of the API, the ones of the system if empty")
+	namespacePtr := flags.String("namespace", "", "Only show the containers of this namespace")
+	podPtr := flags.String("pod", "", "Only show the containers of this Pod")
+	tokenFilePtr := flags.String("token-file", "/var/run/secrets/kubernetes.io/serviceaccount/token", "File of the bearer token authorizing the request")
+	jsonPtr := flags.Bool("json", false, "Print the raw JSON diagnostics")
+	flags.Parse(args)
+
+	token, err := os.ReadFile(*tokenFilePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the token: %v\n", err)
+		return 1
+	}
+	endpoint := strings.TrimSuffix(*apiURLPtr, "/") + "/api/v1/diagnostics/containers"
+	if *namespacePtr != "" {
+		endpoint += "?namespace=" + url.QueryEscape(*namespacePtr)
+	}
+	request, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create the request: %v\n", err)
+		return 1
+	}
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	client, err := newAPIClient(*caFilePtr, 30*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up the client: %v\n", err)
+		return 1
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to query the agent: %v\n", err)
+		return 1
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the response: %v\n", err)
+		return 1
+	}
+	if response.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "The agent answered %s: %s\n", response.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+	if *jsonPtr {
+		os.Stdout.Write(body)
+		return 0
+	}
+
+	diagnostics := &Diagnostics{}
+	if err := json.Unmarshal(body, diagnostics); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to decode the diagnostics: %v\n", err)
+		return 1
+	}
+	printDiagnostics(os.Stdout, diagnostics, *podPtr)
+	return 0
+}
+
+// printDiagnostics prints a table of the containers followed by their problems
+func printDiagnostics(out io.Writer, diagnostics *Diagnostics, pod string) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPOD\tCONTAINER\tMNTNS\tTRACERS\tLAST EVENT")
+	var problems []string
+	for _, container := range diagnostics.Containers {
+		if pod != "" && container.Pod != pod {
+			continue
+		}
+		var tracers []string
+		for _, tracer := range container.Tracers {
+			status := "ok"
+			switch {
+			case !tracer.Loaded:
+				status = "not-loaded"
+			case !tracer.Selected:
+				status = "not-selected"
+			case tracer.InMountnsMap != nil && !*tracer.InMountnsMap:
+				status = "not-in-map"
+			}
+			tracers = append(tracers, strings.TrimPrefix(tracer.Name, "trace_")+"="+status)
+		}
+		lastEvent := "never"
+		if container.LastEvent != nil {
+			lastEvent = fmt.Sprintf("%s ago", time.Since(*container.LastEvent).Round(time.Second))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", container.Namespace, container.Pod, container.Container, container.Mntns, strings.Join(tracers, ","), lastEvent)
+		for _, problem := range container.Problems {
+			problems = append(problems, fmt.Sprintf("%s/%s/%s: %s", container.Namespace, container.Pod, container.Container, problem))
+		}
+	}
+	w.Flush()
+
+	for _, problem := range problems {
+		fmt.Fprintln(out, problem)
+	}
+	for _, excluded := range diagnostics.ExcludedPods {
+		if pod == "" || strings.HasSuffix(excluded, "/"+pod) {
+			fmt.Fprintf(out, "%s: excluded from tracing\n", excluded)
+		}
+	}
+	if diagnostics.Tracing != nil && diagnostics.Tracing.MetadataOnly {
+		fmt.Fprintf(out, "metadata-only mode, the node can't run the tracers (kernel %s)\n", diagnostics.Tracing.Kernel)
+	}
+	if diagnostics.Tracing != nil {
+		for _, problem := range diagnostics.Tracing.Problems {
+			fmt.Fprintf(out, "tracing: %s\n", problem.String())
+		}
+	}
+	components := make([]string, 0, len(diagnostics.Degraded))
+	for component := range diagnostics.Degraded {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	for _, component := range components {
+		fmt.Fprintf(out, "degraded %s: %s\n", component, diagnostics.Degraded[component])
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Maximum number of new behaviors and alerts listed per namespace in a digest
+const maxDigestEntries = 100
+
+// The agent runs on every node: each node shares the digests of its period in a ConfigMap of the namespace of the
+// agent, and the node claiming the period on the Lease merges them and delivers a single digest per namespace
+const (
+	digestLeaseName         = "wlftracer-digest"
+	digestShareLabel        = "wlftracer.io/digest-share"
+	digestPeriodAnnotation  = "wlftracer.io/digest-period"
+	digestShareKey          = "share.json"
+	digestShareSettleDelay  = time.Minute
+	digestStoreSection      = "digest"
+	digestStoreKey          = "state"
+	digestKubernetesTimeout = 30 * time.Second
+)
+
+// DigestConfig configures the periodic digests and where they are delivered
+type DigestConfig struct {
+	Interval time.Duration
+	// Directory the digests are written to
+	Dir string
+	// Slack incoming webhook
+	SlackWebhook string
+	// SMTP server (host:port), sender and recipients separated by commas
+	SMTPAddr string
+	From     string
+	To       string
+}
+
+var digestConfig DigestConfig
+
+// namespaceDigest summarizes the activity of a namespace over a digest period
+type namespaceDigest struct {
+	Events        map[string]uint64 `json:"events"`
+	Workloads     map[string]uint64 `json:"workloads"`
+	NewBehaviors  []string          `json:"newBehaviors,omitempty"`
+	Alerts        []string          `json:"alerts,omitempty"`
+	DroppedAlerts int               `json:"droppedAlerts,omitempty"`
+	// Number of nodes the digest was merged from
+	Nodes int `json:"-"`
+}
+
+// digestShare is the part of the digests of a period seen by a node
+type digestShare struct {
+	Node       string                      `json:"node"`
+	Period     time.Time                   `json:"period"`
+	Namespaces map[string]*namespaceDigest `json:"namespaces"`
+}
+
+// digestState is kept in the store so a restart neither loses the period in progress nor delivers a period twice
+type digestState struct {
+	Period     time.Time                   `json:"period"`
+	Namespaces map[string]*namespaceDigest `json:"namespaces,omitempty"`
+	LastSent   time.Time                   `json:"lastSent,omitempty"`
+}
+
+// digestSink collects the activity of each namespace and delivers a digest of it every interval
+type digestSink struct {
+	config DigestConfig
+	client kubernetes.Interface
+	// Namespace of the agent, holding the Lease and the shares
+	agentNamespace string
+	lock           sync.Mutex
+	// Start of the current period, aligned on the interval so every node has the same periods
+	start time.Time
+	// Digests of the current period by namespace
+	namespaces map[string]*namespaceDigest
+	// Start of the last period this node delivered
+	lastSent time.Time
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+var digests *digestSink
+
+// NewDigestSink creates the sink, restores the period in progress from the store and starts delivering the digests
+func NewDigestSink(config DigestConfig, client kubernetes.Interface, agentNamespace string) (Sink, error) {
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("invalid digest interval %s", config.Interval)
+	}
+	if agentNamespace == "" {
+		return nil, fmt.Errorf("the digests require $POD_NAMESPACE")
+	}
+	s := &digestSink{
+		config:         config,
+		client:         client,
+		agentNamespace: agentNamespace,
+		start:          time.Now().Truncate(config.Interval),
+		namespaces:     make(map[string]*namespaceDigest),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	var state digestState
+	if err := store.readJSON(store.path(digestStoreSection, digestStoreKey), &state); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error reading the digest state: %v\n", err)
+	}
+	s.lastSent = state.LastSent
+	if state.Period.Equal(s.start) && state.Namespaces != nil {
+		s.namespaces = state.Namespaces
+	} else if len(state.Namespaces) > 0 {
+		log.Printf("Dropping the digests of the period %s interrupted by the restart\n", state.Period.UTC().Format(time.RFC3339))
+	}
+	go s.deliverLoop()
+	return s, nil
+}
+
+func (s *digestSink) namespace(namespace string) *namespaceDigest {
+	digest, ok := s.namespaces[namespace]
+	if !ok {
+		digest = newNamespaceDigest()
+		s.namespaces[namespace] = digest
+	}
+	return digest
+}
+
+func newNamespaceDigest() *namespaceDigest {
+	return &namespaceDigest{Events: make(map[string]uint64), Workloads: make(map[string]uint64)}
+}
+
+func (s *digestSink) Write(event *Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	digest := s.namespace(event.Namespace)
+	digest.Events[event.Type]++
+	if event.Workload != "" {
+		digest.Workloads[strings.TrimPrefix(event.Workload, event.Namespace+"/")]++
+	}
+
+	var alert string
+	switch event.Type {
+	case "drift":
+		alert = fmt.Sprintf("drift: %s %s (%s at runtime) in %s", event.Operation, event.Path, event.Drift, event.Pod)
+	case "new-syscall":
+		alert = fmt.Sprintf("new syscall %s by %s in %s", event.Syscall, event.Comm, event.Pod)
+	case "anomaly":
+		alert = fmt.Sprintf("new %s %s in %s", event.Category, event.Value, event.Pod)
+	default:
+		return nil
+	}
+	if len(digest.Alerts) >= maxDigestEntries {
+		digest.DroppedAlerts++
+		return nil
+	}
+	digest.Alerts = append(digest.Alerts, event.Time.UTC().Format(time.RFC3339)+" "+alert)
+	return nil
+}
+
+// NewBehavior records an item added to the inventory of a workload, the value is redacted by the inventory already
+func (s *digestSink) NewBehavior(event *Event, category string, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	digest := s.namespace(event.Namespace)
+	if len(digest.NewBehaviors) < maxDigestEntries {
+		digest.NewBehaviors = append(digest.NewBehaviors, fmt.Sprintf("%s: %s %s", strings.TrimPrefix(event.Workload, event.Namespace+"/"), category, value))
+	}
+}
+
+// Close keeps the period in progress in the store, it is delivered at its end by whichever node claims it
+func (s *digestSink) Close() error {
+	close(s.stop)
+	<-s.done
+	s.lock.Lock()
+	state := digestState{Period: s.start, Namespaces: s.namespaces, LastSent: s.lastSent}
+	s.lock.Unlock()
+	return store.writeJSON(store.path(digestStoreSection, digestStoreKey), &state)
+}
+
+func (s *digestSink) deliverLoop() {
+	defer close(s.done)
+
+	for {
+		s.lock.Lock()
+		end := s.start.Add(s.config.Interval)
+		s.lock.Unlock()
+
+		timer := time.NewTimer(time.Until(end))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.endPeriod(end)
+	}
+}
+
+// endPeriod shares the digests of the period which ended, then delivers the merged digests of every node if this node
+// claims the period
+func (s *digestSink) endPeriod(end time.Time) {
+	s.lock.Lock()
+	namespaces := s.namespaces
+	start := s.start
+	s.namespaces = make(map[string]*namespaceDigest)
+	s.start = end
+	s.lock.Unlock()
+
+	if err := s.share(&digestShare{Node: NodeName, Period: start, Namespaces: namespaces}); err != nil {
+		log.Printf("Error sharing the digests of %s: %v\n", start.UTC().Format(time.RFC3339), err)
+	}
+	// Give the other nodes the time to share theirs
+	select {
+	case <-s.stop:
+		return
+	case <-time.After(digestShareSettleDelay):
+	}
+
+	if !s.lastSent.Before(start) {
+		return
+	}
+	claimed, err := s.claim(start)
+	if err != nil {
+		log.Printf("Error claiming the digests of %s: %v\n", start.UTC().Format(time.RFC3339), err)
+		return
+	}
+	if !claimed {
+		return
+	}
+	merged, nodes, err := s.collect(start)
+	if err != nil {
+		log.Printf("Error collecting the digests of %s: %v\n", start.UTC().Format(time.RFC3339), err)
+		return
+	}
+	log.Printf("Delivering the digests of %d namespaces from %d nodes\n", len(merged), nodes)
+	for namespace, digest := range merged {
+		subject := fmt.Sprintf("wlftracer digest of %s", namespace)
+		text := renderDigest(namespace, digest, start, end)
+		s.deliverTo(namespace, subject, text, start)
+	}
+
+	s.lock.Lock()
+	s.lastSent = start
+	state := digestState{Period: s.start, Namespaces: s.namespaces, LastSent: s.lastSent}
+	err = store.writeJSON(store.path(digestStoreSection, digestStoreKey), &state)
+	s.lock.Unlock()
+	if err != nil {
+		log.Printf("Error writing the digest state: %v\n", err)
+	}
+}
+
+// share writes the digests of this node into its share ConfigMap
+func (s *digestSink) share(share *digestShare) error {
+	ctx, cancel := context.WithTimeout(context.Background(), digestKubernetesTimeout)
+	defer cancel()
+
+	data, err := json.Marshal(share)
+	if err != nil {
+		return err
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      resourceName("wlftracer-digest", NodeName),
+			Namespace: s.agentNamespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "wlftracer", digestShareLabel: "true"},
+		},
+		Data: map[string]string{digestShareKey: string(data)},
+	}
+	configMaps := s.client.CoreV1().ConfigMaps(s.agentNamespace)
+	existing, err := configMaps.Get(ctx, configMap.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Data = configMap.Data
+	_, err = configMaps.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// claim records the period on the Lease, only the node which updates it first delivers the period
+func (s *digestSink) claim(period time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), digestKubernetesTimeout)
+	defer cancel()
+
+	value := period.UTC().Format(time.RFC3339)
+	holder := NodeName
+	now := metav1.NewMicroTime(time.Now())
+	leases := s.client.CoordinationV1().Leases(s.agentNamespace)
+	lease, err := leases.Get(ctx, digestLeaseName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        digestLeaseName,
+				Namespace:   s.agentNamespace,
+				Annotations: map[string]string{digestPeriodAnnotation: value},
+			},
+			Spec: coordinationv1.LeaseSpec{HolderIdentity: &holder, AcquireTime: &now, RenewTime: &now},
+		}
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	// The periods in RFC 3339 UTC sort as strings
+	if lease.Annotations[digestPeriodAnnotation] >= value {
+		return false, nil
+	}
+	if lease.Annotations == nil {
+		lease.Annotations = make(map[string]string)
+	}
+	lease.Annotations[digestPeriodAnnotation] = value
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	// The update fails with a conflict if another node claimed the period since the Lease was read
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// collect merges the shares of the nodes for a period into a digest per namespace, and returns the number of nodes
+func (s *digestSink) collect(period time.Time) (map[string]*namespaceDigest, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), digestKubernetesTimeout)
+	defer cancel()
+
+	configMaps, err := s.client.CoreV1().ConfigMaps(s.agentNamespace).List(ctx, metav1.ListOptions{LabelSelector: digestShareLabel + "=true"})
+	if err != nil {
+		return nil, 0, err
+	}
+	var shares []*digestShare
+	for _, configMap := range configMaps.Items {
+		var share digestShare
+		if err := json.Unmarshal([]byte(configMap.Data[digestShareKey]), &share); err != nil {
+			log.Printf("Error reading digest share %s: %v\n", configMap.Name, err)
+			continue
+		}
+		// The shares of the nodes which didn't report this period are older
+		if share.Period.Equal(period) {
+			shares = append(shares, &share)
+		}
+	}
+	return mergeDigestShares(shares), len(shares), nil
+}
+
+// mergeDigestShares sums the activity of the nodes, and lists their new behaviors once and their alerts in order
+func mergeDigestShares(shares []*digestShare) map[string]*namespaceDigest {
+	merged := make(map[string]*namespaceDigest)
+	for _, share := range shares {
+		for namespace, digest := range share.Namespaces {
+			m, ok := merged[namespace]
+			if !ok {
+				m = newNamespaceDigest()
+				merged[namespace] = m
+			}
+			m.Nodes++
+			for eventType, count := range digest.Events {
+				m.Events[eventType] += count
+			}
+			for workload, count := range digest.Workloads {
+				m.Workloads[workload] += count
+			}
+			for _, behavior := range digest.NewBehaviors {
+				if len(m.NewBehaviors) < maxDigestEntries && !containsString(m.NewBehaviors, behavior) {
+					m.NewBehaviors = append(m.NewBehaviors, behavior)
+				}
+			}
+			m.Alerts = append(m.Alerts, digest.Alerts...)
+			m.DroppedAlerts += digest.DroppedAlerts
+		}
+	}
+	for _, digest := range merged {
+		// The alerts start with their time
+		sort.Strings(digest.Alerts)
+		if len(digest.Alerts) > maxDigestEntries {
+			digest.DroppedAlerts += len(digest.Alerts) - maxDigestEntries
+			digest.Alerts = digest.Alerts[:maxDigestEntries]
+		}
+	}
+	return merged
+}
+
+func (s *digestSink) deliverTo(namespace string, subject string, text string, start time.Time) {
+	if s.config.Dir != "" {
+		path := filepath.Join(s.config.Dir, fmt.Sprintf("%s-%s.txt", namespace, start.UTC().Format("20060102T150405Z")))
+		if err := os.MkdirAll(s.config.Dir, 0755); err != nil {
+			log.Printf("Error creating digest directory: %v\n", err)
+		} else if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			log.Printf("Error writing digest %s: %v\n", path, err)
+		}
+	}
+
+	slackWebhook, to := s.config.SlackWebhook, s.config.To
+	// Tenants get their digests delivered to their own targets
+	if tenants != nil {
+		if config, ok := tenants.Config(namespace); ok {
+			if config.DigestSlackWebhook != "" {
+				slackWebhook = config.DigestSlackWebhook
+			}
+			if config.DigestEmailTo != "" {
+				to = config.DigestEmailTo
+			}
+		}
+	}
+	if slackWebhook != "" {
+		if err := postSlackMessage(slackWebhook, "*"+subject+"*\n```"+text+"```"); err != nil {
+			log.Printf("Error sending digest of %s to Slack: %v\n", namespace, err)
+		}
+	}
+	if s.config.SMTPAddr != "" && to != "" {
+		if err := sendEmail(s.config.SMTPAddr, s.config.From, strings.Split(to, ","), subject, text); err != nil {
+			log.Printf("Error emailing digest of %s: %v\n", namespace, err)
+		}
+	}
+}
+
+// renderDigest summarizes the activity volumes, new behaviors and fired alerts of a namespace
+func renderDigest(namespace string, digest *namespaceDigest, start time.Time, end time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Namespace %s, seen by %d nodes\n", namespace, digest.Nodes)
+	fmt.Fprintf(&b, "Period: %s - %s\n\n", start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+
+	b.WriteString("Activity:\n")
+	for _, eventType := range sortedKeys(digest.Events) {
+		fmt.Fprintf(&b, "  %-12s %d\n", eventType, digest.Events[eventType])
+	}
+	workloads := sortedKeys(digest.Workloads)
+	sort.SliceStable(workloads, func(i, j int) bool { return digest.Workloads[workloads[i]] > digest.Workloads[workloads[j]] })
+	if len(workloads) > 10 {
+		workloads = workloads[:10]
+	}
+	b.WriteString("\nBusiest workloads:\n")
+	for _, workload := range workloads {
+		fmt.Fprintf(&b, "  %-50s %d events\n", workload, digest.Workloads[workload])
+	}
+
+	fmt.Fprintf(&b, "\nNew behaviors (%d):\n", len(digest.NewBehaviors))
+	for _, behavior := range digest.NewBehaviors {
+		fmt.Fprintf(&b, "  %s\n", behavior)
+	}
+	fmt.Fprintf(&b, "\nAlerts (%d):\n", len(digest.Alerts)+digest.DroppedAlerts)
+	for _, alert := range digest.Alerts {
+		fmt.Fprintf(&b, "  %s\n", alert)
+	}
+	if digest.DroppedAlerts > 0 {
+		fmt.Fprintf(&b, "  ... and %d more\n", digest.DroppedAlerts)
+	}
+	return b.String()
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// postSlackMessage posts a message to a Slack incoming webhook
+func postSlackMessage(webhook string, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("slack returned %s", resp.Status)
+	}
+	return nil
+}
+
+// sendEmail sends a plain text email, authenticating with $SMTP_USERNAME and $SMTP_PASSWORD when set
+func sendEmail(addr string, from string, to []string, subject string, text string) error {
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	for i := range to {
+		to[i] = strings.TrimSpace(to[i])
+	}
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		from, strings.Join(to, ", "), subject, strings.ReplaceAll(text, "\n", "\r\n"))
+	return smtp.SendMail(addr, auth, from, to, []byte(message))
+}
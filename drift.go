@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Whether the files used in the containers are checked against their image
+var detectDrift bool
+
+// The agent shares the host PID namespace, the host filesystem is reachable through the root of its init
+const hostRoot = "/proc/1/root"
+
+// Maximum number of paths remembered per container with the fingerprint they were checked at
+const maxDriftChecked = 16384
+
+// overlayLayers are the host directories of an overlay root filesystem: the image layers and the layer written at runtime
+type overlayLayers struct {
+	lowers []string
+	upper  string
+}
+
+// containerOverlay returns the layers of the root filesystem of the process, nil if it isn't an overlay
+func containerOverlay(pid uint32) *overlayLayers {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/mountinfo", pid))
+	if err != nil {
+		log.Printf("Error reading mounts of %d, drift detection disabled: %v\n", pid, err)
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mountpoint options [optional fields] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[4] != "/" {
+			continue
+		}
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 0 || len(fields) < separator+4 || fields[separator+1] != "overlay" {
+			continue
+		}
+
+		layers := &overlayLayers{}
+		for _, option := range strings.Split(fields[separator+3], ",") {
+			name, value, _ := strings.Cut(option, "=")
+			switch name {
+			case "lowerdir":
+				layers.lowers = strings.Split(value, ":")
+			case "upperdir":
+				layers.upper = value
+			}
+		}
+		if layers.upper == "" {
+			return nil
+		}
+		return layers
+	}
+	return nil
+}
+
+// layerContains returns true if the path is present in the layer
+func layerContains(layer string, path string) bool {
+	_, err := os.Lstat(filepath.Join(hostRoot, layer, path))
+	return err == nil
+}
+
+// fingerprint identifies the runtime version of the path by the inode and modification time of its copy in the layer
+// written at runtime, empty if the path is only in the image
+func (o *overlayLayers) fingerprint(path string) string {
+	info, err := os.Lstat(filepath.Join(hostRoot, o.upper, path))
+	if err != nil {
+		return ""
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%d:%d", stat.Ino, info.ModTime().UnixNano())
+	}
+	return fmt.Sprint(info.ModTime().UnixNano())
+}
+
+// drift tells whether the path was created or modified at runtime, empty if it comes from the image untouched
+func (o *overlayLayers) drift(path string) string {
+	if !layerContains(o.upper, path) {
+		return ""
+	}
+	for _, lower := range o.lowers {
+		if layerContains(lower, path) {
+			return "modified"
+		}
+	}
+	return "created"
+}
+
+// checkDrift flags the first use of a binary or file which isn't part of the image of the container, again whenever it
+// is replaced or modified
+func checkDrift(event queuedEvent) {
+	path := event.path
+	if event.exec != "" {
+		path = event.executable
+	}
+	if !filepath.IsAbs(path) {
+		return
+	}
+
+	state, ok := containers.Get(event.key)
+	if !ok || state.overlay == nil {
+		return
+	}
+	// Paths are checked again when their runtime version changes, e.g. a binary checked clean and overwritten later
+	fingerprint := state.overlay.fingerprint(path)
+	state.lock.Lock()
+	previous, checked := state.driftChecked[path]
+	if checked || len(state.driftChecked) < maxDriftChecked {
+		state.driftChecked[path] = fingerprint
+	}
+	state.lock.Unlock()
+	if (checked && previous == fingerprint) || fingerprint == "" {
+		return
+	}
+
+	drift := state.overlay.drift(path)
+	if drift == "" {
+		return
+	}
+	operation := "open"
+	if event.exec != "" {
+		operation = "exec"
+	}
+	log.Printf("Drift in container %s: %s %s, %s at runtime\n", state.ID, operation, path, drift)
+	writeContainerEvent(event.key, event.timestamp, fmt.Sprintf("drift: %s %s (%s at runtime)\n", operation, path, drift))
+
+	if state.Alerts() && hasSinks() {
+		driftEvent := *event.event
+		driftEvent.Type = "drift"
+		driftEvent.Operation = operation
+		driftEvent.Path = path
+		driftEvent.Drift = drift
+		enrichEvent(event.key, &driftEvent)
+		dispatchEvent(&driftEvent)
+	}
+}
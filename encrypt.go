@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// Key encrypting the container files and the store at rest, nil if they are written in clear
+var atRestKey *AtRestKey
+
+// Every encrypted file starts with the magic, followed by the size and the wrapped data key of the file, followed by
+// the records: their size, their nonce and the data sealed with AES-256-GCM. The index of each record, and whether it
+// is the last one, are authenticated along with it, so records can't be reordered, dropped or cut off unnoticed. A
+// file closed cleanly ends with an empty final record.
+const atRestMagic = "WLFENC2\n"
+
+// Magic of the files encrypted by the previous versions, whose records weren't authenticated with their index
+const atRestMagicV1 = "WLFENC1\n"
+
+// Whether the files in clear, written before encryption was enabled, are still read once a key is set
+var atRestMigrate bool
+
+// Additional data of the wrapped data keys
+var atRestKeyAAD = []byte("wlftracer data key")
+
+var (
+	errNotEncrypted = errors.New("not encrypted")
+	// The records of the file don't follow each other, or don't decrypt
+	errCorruptRecords = errors.New("corrupt records")
+	// The file has no final record, it is still written or was cut off
+	errUnfinished = errors.New("no final record, the file is still written or was truncated")
+)
+
+const atRestDataKeySize = 32
+
+// AtRestKey wraps the random data key of each encrypted file, either with an age X25519 identity or an AES-256 key
+type AtRestKey struct {
+	identity *age.X25519Identity
+	aead     cipher.AEAD
+}
+
+// LoadAtRestKey reads an age identity (AGE-SECRET-KEY-1...) or an AES-256 key, as 32 raw bytes or hex or base64 encoded,
+// from the file, typically mounted from a Secret
+func LoadAtRestKey(path string) (*AtRestKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading encryption key: %w", err)
+	}
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, "AGE-SECRET-KEY-") {
+		identity, err := age.ParseX25519Identity(text)
+		if err != nil {
+			return nil, fmt.Errorf("parsing age identity: %w", err)
+		}
+		return &AtRestKey{identity: identity}, nil
+	}
+
+	key := data
+	if decoded, err := hex.DecodeString(text); err == nil && len(decoded) == atRestDataKeySize {
+		key = decoded
+	} else if decoded, err := base64.StdEncoding.DecodeString(text); err == nil && len(decoded) == atRestDataKeySize {
+		key = decoded
+	}
+	if len(key) != atRestDataKeySize {
+		return nil, fmt.Errorf("the encryption key must be an age identity or a 32 bytes AES key")
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &AtRestKey{aead: aead}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrap encrypts the data key of a file
+func (k *AtRestKey) wrap(dataKey []byte) ([]byte, error) {
+	if k.identity != nil {
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, k.identity.Recipient())
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(dataKey); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return sealRecord(k.aead, dataKey, atRestKeyAAD)
+}
+
+// unwrap decrypts the data key of a file
+func (k *AtRestKey) unwrap(wrapped []byte) ([]byte, error) {
+	if k.identity != nil {
+		r, err := age.Decrypt(bytes.NewReader(wrapped), k.identity)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+	return openRecord(k.aead, wrapped, atRestKeyAAD)
+}
+
+// newFileHeader generates the data key of a new file and returns its header along with the cipher of its records
+func (k *AtRestKey) newFileHeader() ([]byte, cipher.AEAD, error) {
+	dataKey := make([]byte, atRestDataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := k.wrap(dataKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrapping data key: %w", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := append([]byte(atRestMagic), binary.BigEndian.AppendUint32(nil, uint32(len(wrapped)))...)
+	return append(header, wrapped...), aead, nil
+}
+
+// readFileHeader reads the header of an encrypted file and returns the cipher of its records
+func (k *AtRestKey) readFileHeader(r io.Reader) (cipher.AEAD, error) {
+	magic := make([]byte, len(atRestMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != atRestMagic {
+		if string(magic) == atRestMagicV1 {
+			return nil, fmt.Errorf("encrypted by a previous version without authenticated record order, not supported anymore")
+		}
+		return nil, errNotEncrypted
+	}
+	wrapped, err := readChunk(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading data key: %w", err)
+	}
+	dataKey, err := k.unwrap(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key: %w", err)
+	}
+	return newGCM(dataKey)
+}
+
+// Seal encrypts the data into a complete file
+func (k *AtRestKey) Seal(data []byte) ([]byte, error) {
+	header, aead, err := k.newFileHeader()
+	if err != nil {
+		return nil, err
+	}
+	record, err := sealRecord(aead, data, recordAAD(0, true))
+	if err != nil {
+		return nil, err
+	}
+	return append(header, appendChunk(nil, record)...), nil
+}
+
+// Open decrypts a file. The files in clear are rejected, unless --encryption-migrate lets the files written before
+// encryption was enabled be read.
+func (k *AtRestKey) Open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(atRestMagic)) && !bytes.HasPrefix(data, []byte(atRestMagicV1)) {
+		if atRestMigrate {
+			return data, nil
+		}
+		return nil, fmt.Errorf("the file isn't encrypted, see --encryption-migrate")
+	}
+	var out bytes.Buffer
+	if err := k.decrypt(bytes.NewReader(data), &out, true); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// decrypt writes the records of an encrypted file to w. errUnfinished is returned once all of them are written if the
+// file has no final record, an error if it must have one.
+func (k *AtRestKey) decrypt(r io.Reader, w io.Writer, requireFinal bool) error {
+	r = bufio.NewReader(r)
+	aead, err := k.readFileHeader(r)
+	if err != nil {
+		return err
+	}
+	final := false
+	for index := uint64(0); ; index++ {
+		record, err := readChunk(r)
+		if err == io.EOF {
+			if !final {
+				if requireFinal {
+					return fmt.Errorf("record %d: %w", index, errUnfinished)
+				}
+				return errUnfinished
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading record %d: %w", index, err)
+		}
+		if final {
+			return fmt.Errorf("record %d follows the final record: %w", index, errCorruptRecords)
+		}
+		data, err := openRecord(aead, record, recordAAD(index, false))
+		if err != nil {
+			if data, err = openRecord(aead, record, recordAAD(index, true)); err != nil {
+				return fmt.Errorf("decrypting record %d: %w", index, errCorruptRecords)
+			}
+			final = true
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+// sealAtRest encrypts the content of a file if encryption at rest is enabled
+func sealAtRest(data []byte) ([]byte, error) {
+	if atRestKey == nil {
+		return data, nil
+	}
+	return atRestKey.Seal(data)
+}
+
+// openAtRest decrypts the content of a file if it is encrypted
+func openAtRest(data []byte) ([]byte, error) {
+	if atRestKey == nil {
+		if bytes.HasPrefix(data, []byte(atRestMagic)) || bytes.HasPrefix(data, []byte(atRestMagicV1)) {
+			return nil, fmt.Errorf("the file is encrypted, --encryption-key-file is required")
+		}
+		return data, nil
+	}
+	return atRestKey.Open(data)
+}
+
+// recordWriter appends the data written as encrypted records to a file, each write is a record so the file is valid
+// up to the last complete write
+type recordWriter struct {
+	f    *os.File
+	aead cipher.AEAD
+	// Size of the file, records included
+	size int64
+	// Index of the next record
+	index uint64
+}
+
+// newRecordWriter prepares appending records to the file opened for reading and writing, a header is written if the
+// file is empty. errNotEncrypted is returned if the file isn't empty and wasn't encrypted by the agent, and
+// errCorruptRecords if its records were tampered with. A record torn by a crash is truncated, and so is the final
+// record of a file closed cleanly, so the new records follow the last complete one.
+func (k *AtRestKey) newRecordWriter(f *os.File, size int64) (*recordWriter, error) {
+	if size > 0 {
+		return k.reopenRecords(f, size)
+	}
+	header, aead, err := k.newFileHeader()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(header); err != nil {
+		return nil, err
+	}
+	return &recordWriter{f: f, aead: aead, size: int64(len(header))}, nil
+}
+
+// reopenRecords scans the records of a file to append new ones after the last complete one
+func (k *AtRestKey) reopenRecords(f *os.File, size int64) (*recordWriter, error) {
+	header := io.NewSectionReader(f, 0, size)
+	aead, err := k.readFileHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	// The records follow the header
+	offset, err := header.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	var count uint64
+	lastStart := int64(-1)
+	for offset < size {
+		var prefix [4]byte
+		if _, err := f.ReadAt(prefix[:], offset); err != nil {
+			break
+		}
+		end := offset + 4 + int64(binary.BigEndian.Uint32(prefix[:]))
+		if end > size {
+			break
+		}
+		lastStart, offset = offset, end
+		count++
+	}
+	if offset < size {
+		log.Printf("Truncating the record torn at offset %d of %s\n", offset, f.Name())
+	}
+	if lastStart >= 0 {
+		record, err := readChunk(io.NewSectionReader(f, lastStart, offset-lastStart))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := openRecord(aead, record, recordAAD(count-1, true)); err == nil {
+			// Closed cleanly, the final record goes away as more records follow
+			offset = lastStart
+			count--
+		} else if _, err := openRecord(aead, record, recordAAD(count-1, false)); err != nil {
+			return nil, fmt.Errorf("record %d of %s: %w", count-1, f.Name(), errCorruptRecords)
+		}
+	}
+	if offset < size {
+		if err := f.Truncate(offset); err != nil {
+			return nil, fmt.Errorf("truncating %s: %w", f.Name(), err)
+		}
+	}
+	return &recordWriter{f: f, aead: aead, size: offset, index: count}, nil
+}
+
+// Write appends the data as a single record, a failed write is retried as a whole
+func (w *recordWriter) Write(data []byte) (int, error) {
+	if err := w.append(data, false); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Finish appends the final record, once the file is complete
+func (w *recordWriter) Finish() error {
+	return w.append(nil, true)
+}
+
+func (w *recordWriter) append(data []byte, final bool) error {
+	record, err := sealRecord(w.aead, data, recordAAD(w.index, final))
+	if err != nil {
+		return err
+	}
+	n, err := w.f.Write(appendChunk(nil, record))
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	w.index++
+	return nil
+}
+
+// recordAAD is the additional data authenticated with a record: its index and whether it is the last one
+func recordAAD(index uint64, final bool) []byte {
+	aad := binary.BigEndian.AppendUint64(nil, index)
+	if final {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+func sealRecord(aead cipher.AEAD, data []byte, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, aad), nil
+}
+
+func openRecord(aead cipher.AEAD, record []byte, aad []byte) ([]byte, error) {
+	if len(record) < aead.NonceSize() {
+		return nil, fmt.Errorf("record too short")
+	}
+	return aead.Open(nil, record[:aead.NonceSize()], record[aead.NonceSize():], aad)
+}
+
+func appendChunk(b []byte, chunk []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(chunk)))
+	return append(b, chunk...)
+}
+
+func readChunk(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	chunk := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r, chunk); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return chunk, nil
+}
+
+// runDecryptCommand implements "wlftracer decrypt", printing the content of encrypted container or store files,
+// compressed rotations included
+func runDecryptCommand(args []string) int {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyFilePtr := flags.String("key-file", "", "File of the age identity or AES key the files were encrypted with")
+	flags.Parse(args)
+
+	key, err := LoadAtRestKey(*keyFilePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load the key: %v\n", err)
+		return 1
+	}
+	for _, path := range flags.Args() {
+		err := decryptFile(key, path, os.Stdout)
+		if err == errUnfinished {
+			fmt.Fprintf(os.Stderr, "Warning: %s has no final record, it is still written or its last records are missing\n", path)
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to decrypt %s: %v\n", path, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func decryptFile(key *AtRestKey, path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return key.decrypt(r, w, false)
+}
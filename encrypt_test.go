@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// testAtRestKeys returns an AES key and an age key loaded from files, as given to --encryption-key-file
+func testAtRestKeys(t *testing.T) map[string]*AtRestKey {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{
+		"aes": hex.EncodeToString(bytes.Repeat([]byte{7}, atRestDataKeySize)) + "\n",
+		"age": identity.String() + "\n",
+	}
+	keys := make(map[string]*AtRestKey)
+	for name, content := range contents {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if keys[name], err = LoadAtRestKey(path); err != nil {
+			t.Fatalf("LoadAtRestKey(%s) error = %v", name, err)
+		}
+	}
+	return keys
+}
+
+func TestLoadAtRestKeyInvalid(t *testing.T) {
+	for _, content := range []string{"", "too short", "AGE-SECRET-KEY-1INVALID", strings.Repeat("ab", atRestDataKeySize-1)} {
+		path := filepath.Join(t.TempDir(), "key")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadAtRestKey(path); err == nil {
+			t.Errorf("LoadAtRestKey(%q) accepted an invalid key", content)
+		}
+	}
+}
+
+func TestAtRestKeySealOpen(t *testing.T) {
+	for name, key := range testAtRestKeys(t) {
+		for _, data := range [][]byte{nil, []byte("{\"events\": 1}\n"), bytes.Repeat([]byte("x"), 1<<16)} {
+			sealed, err := key.Seal(data)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if len(data) > 0 && bytes.Contains(sealed, data) {
+				t.Errorf("%s: data left in clear", name)
+			}
+			if opened, err := key.Open(sealed); err != nil || !bytes.Equal(opened, data) {
+				t.Errorf("%s: opened %d bytes out of %d, %v", name, len(opened), len(data), err)
+			}
+		}
+	}
+}
+
+func TestAtRestKeyOpenRejects(t *testing.T) {
+	keys := testAtRestKeys(t)
+	key := keys["aes"]
+	sealed, err := key.Seal([]byte("some data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := key.Open([]byte("some data")); err == nil {
+		t.Error("file in clear opened")
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := key.Open(tampered); err == nil {
+		t.Error("tampered file opened")
+	}
+	if _, err := key.Open(sealed[:len(sealed)-10]); err == nil {
+		t.Error("cut off file opened")
+	}
+	// The final record is the length, nonce and tag of an empty record
+	if _, err := key.Open(sealed[:len(sealed)-len("some data")-4-12-16]); err == nil {
+		t.Error("file without its final record opened")
+	}
+	other, err := keys["age"].Seal([]byte("some data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := key.Open(other); err == nil {
+		t.Error("file of another key opened")
+	}
+}
+
+func TestAtRestKeyOpenMigrate(t *testing.T) {
+	key := testAtRestKeys(t)["aes"]
+	atRestMigrate = true
+	defer func() { atRestMigrate = false }()
+	data, err := key.Open([]byte("written in clear"))
+	if err != nil || string(data) != "written in clear" {
+		t.Errorf("Open() = %q, %v, want the file as is", data, err)
+	}
+}
+
+// openRecordFile opens the file to append records, as the container files and the history are
+func openRecordFile(t *testing.T, key *AtRestKey, path string) (*os.File, *recordWriter, error) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := key.newRecordWriter(f, info.Size())
+	if err != nil {
+		f.Close()
+	}
+	return f, w, err
+}
+
+func writeRecords(t *testing.T, key *AtRestKey, path string, records []string, finish bool) {
+	t.Helper()
+	f, w, err := openRecordFile(t, key, path)
+	if err != nil {
+		t.Fatalf("newRecordWriter() error = %v", err)
+	}
+	defer f.Close()
+	for _, record := range records {
+		if _, err := w.Write([]byte(record)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if finish {
+		if err := w.Finish(); err != nil {
+			t.Fatalf("Finish() error = %v", err)
+		}
+	}
+}
+
+func readRecords(t *testing.T, key *AtRestKey, path string) (string, error) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out bytes.Buffer
+	err = key.decrypt(f, &out, false)
+	return out.String(), err
+}
+
+func TestRecordWriter(t *testing.T) {
+	for name, key := range testAtRestKeys(t) {
+		path := filepath.Join(t.TempDir(), name)
+
+		// Still written
+		writeRecords(t, key, path, []string{"a\n", "b\n"}, false)
+		if data, err := readRecords(t, key, path); data != "a\nb\n" || !errors.Is(err, errUnfinished) {
+			t.Errorf("%s: unfinished file read as %q, %v", name, data, err)
+		}
+
+		// Reopened after a restart, then closed cleanly
+		writeRecords(t, key, path, []string{"c\n"}, true)
+		if data, err := readRecords(t, key, path); data != "a\nb\nc\n" || err != nil {
+			t.Errorf("%s: finished file read as %q, %v", name, data, err)
+		}
+
+		// Reopened after being closed, the final record goes away
+		writeRecords(t, key, path, []string{"d\n"}, true)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opened, err := key.Open(content); string(opened) != "a\nb\nc\nd\n" || err != nil {
+			t.Errorf("%s: reopened file read as %q, %v", name, opened, err)
+		}
+	}
+}
+
+func TestRecordWriterTornRecord(t *testing.T) {
+	key := testAtRestKeys(t)["aes"]
+	path := filepath.Join(t.TempDir(), "events")
+	writeRecords(t, key, path, []string{"a\n", "b\n"}, false)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A crash in the middle of the last record
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, key, path, []string{"c\n"}, true)
+	if data, err := readRecords(t, key, path); data != "a\nc\n" || err != nil {
+		t.Errorf("decrypt() = %q, %v, want a\\nc\\n", data, err)
+	}
+}
+
+func TestRecordWriterRejects(t *testing.T) {
+	key := testAtRestKeys(t)["aes"]
+
+	clear := filepath.Join(t.TempDir(), "clear")
+	if err := os.WriteFile(clear, []byte("written in clear\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if f, _, err := openRecordFile(t, key, clear); !errors.Is(err, errNotEncrypted) {
+		t.Errorf("newRecordWriter() of a file in clear error = %v, want %v", err, errNotEncrypted)
+	} else {
+		f.Close()
+	}
+
+	tampered := filepath.Join(t.TempDir(), "tampered")
+	writeRecords(t, key, tampered, []string{"a\n", "b\n"}, false)
+	content, err := os.ReadFile(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[len(content)-1] ^= 1
+	if err := os.WriteFile(tampered, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if f, _, err := openRecordFile(t, key, tampered); !errors.Is(err, errCorruptRecords) {
+		t.Errorf("newRecordWriter() of a tampered file error = %v, want %v", err, errCorruptRecords)
+	} else {
+		f.Close()
+	}
+}
+
+func TestDecryptReorderedRecords(t *testing.T) {
+	key := testAtRestKeys(t)["aes"]
+	path := filepath.Join(t.TempDir(), "events")
+	writeRecords(t, key, path, []string{"aa\n", "bb\n"}, true)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The records of the same size follow the header, swap the first two
+	recordSize := 4 + 12 + len("aa\n") + 16
+	final := len(content) - (4 + 12 + 16)
+	first, second := final-2*recordSize, final-recordSize
+	swapped := append([]byte{}, content[:first]...)
+	swapped = append(swapped, content[second:final]...)
+	swapped = append(swapped, content[first:second]...)
+	swapped = append(swapped, content[final:]...)
+	if _, err := key.Open(swapped); !errors.Is(err, errCorruptRecords) {
+		t.Errorf("Open() of swapped records error = %v, want %v", err, errCorruptRecords)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Event is the structured form of a traced event, handed over to the sinks
+type Event struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Node        string    `json:"node"`
+	Namespace   string    `json:"namespace"`
+	Pod         string    `json:"pod"`
+	Container   string    `json:"container"`
+	ContainerID string    `json:"containerID,omitempty"`
+	Workload    string    `json:"workload,omitempty"`
+	Image       string    `json:"image,omitempty"`
+	// Digest of the image, if the runtime resolved it
+	ImageDigest string `json:"imageDigest,omitempty"`
+	Pid         uint32 `json:"pid,omitempty"`
+	Ppid        uint32 `json:"ppid,omitempty"`
+	Uid         uint32 `json:"uid"`
+	Gid         uint32 `json:"gid"`
+	Comm        string `json:"comm,omitempty"`
+	// Ancestors of the process of exec, open and tcp events, the parent first
+	Lineage []ProcessAncestor `json:"lineage,omitempty"`
+	// File opened or binary executed
+	Path string   `json:"path,omitempty"`
+	Args []string `json:"args,omitempty"`
+	// User who opened the interactive session of the process, and the ID of the request in the API server audit log
+	User    string `json:"user,omitempty"`
+	AuditID string `json:"auditID,omitempty"`
+	// Error of a failed exec (e.g. ENOENT), for exec-failed events
+	Errno string `json:"errno,omitempty"`
+	// Network events
+	Operation string `json:"operation,omitempty"`
+	Src       string `json:"src,omitempty"`
+	Dst       string `json:"dst,omitempty"`
+	Sport     uint16 `json:"sport,omitempty"`
+	Dport     uint16 `json:"dport,omitempty"`
+	// DNS events: queried name and type, and the answer of the responses
+	DNSName    string   `json:"dnsName,omitempty"`
+	QueryType  string   `json:"queryType,omitempty"`
+	Rcode      string   `json:"rcode,omitempty"`
+	Addresses  []string `json:"addresses,omitempty"`
+	Nameserver string   `json:"nameserver,omitempty"`
+	// Capability events: capability checked and whether it was granted
+	Capability string `json:"capability,omitempty"`
+	Verdict    string `json:"verdict,omitempty"`
+	// Drift events: how the file differs from the image, created or modified at runtime
+	Drift string `json:"drift,omitempty"`
+	// Syscall outside of the learned profile, for new-syscall events
+	Syscall string `json:"syscall,omitempty"`
+	// Anomaly events: category of the inventory and item outside of the baseline
+	Category string `json:"category,omitempty"`
+	Value    string `json:"value,omitempty"`
+	// Alert events: rule matched by the event of the type, with its severity and description
+	Rule        string `json:"rule,omitempty"`
+	Severity    string `json:"severity,omitempty"`
+	Message     string `json:"message,omitempty"`
+	AlertedType string `json:"alertedType,omitempty"`
+	// Set when the tracer truncated the event and it couldn't be completed
+	Truncated bool `json:"truncated,omitempty"`
+	// Set when the event happened during the startup grace period of the container
+	Startup bool `json:"startup,omitempty"`
+	// Checkpoint events: sequence number of the checkpoint of the container and number of events of each type so far
+	Checkpoint uint64            `json:"checkpoint,omitempty"`
+	Counters   map[string]uint64 `json:"counters,omitempty"`
+	// Unique ID of the event, referenced by the exemplars of the metrics
+	ID string `json:"id,omitempty"`
+}
+
+// enrichEvent adds the node and the metadata of the registered container to the event
+func enrichEvent(key ContainerKey, event *Event) {
+	event.Node = NodeName
+
+	state, ok := containers.Get(key)
+	if !ok {
+		return
+	}
+	event.ContainerID = state.ID
+	event.Workload = state.Workload
+	event.Image = state.Image
+	event.ImageDigest = imageDigest(state.ImageRef)
+	enrichLineage(state, event)
+}
+
+// eventSummary summarizes the event in a single line
+func eventSummary(event *Event) string {
+	switch event.Type {
+	case "exec":
+		return fmt.Sprintf("exec: %s", strings.Join(append([]string{event.Path}, execArguments(event)...), " "))
+	case "open":
+		return fmt.Sprintf("open: %s", event.Path)
+	case "drift":
+		return fmt.Sprintf("drift: %s %s (%s at runtime)", event.Operation, event.Path, event.Drift)
+	case "new-syscall":
+		return fmt.Sprintf("new-syscall: %s process: %s", event.Syscall, event.Comm)
+	case "anomaly":
+		return fmt.Sprintf("anomaly: new %s %s", event.Category, event.Value)
+	}
+	return fmt.Sprintf("%s: %s:%d->%s:%d", event.Operation, event.Src, event.Sport, event.Dst, event.Dport)
+}
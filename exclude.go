@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	containercollection "github.com/inspektor-gadget/inspektor-gadget/pkg/container-collection"
+)
+
+// Exclusions keeps the monitor's own Pod, and the Pods of other agents, out of the traced containers
+type Exclusions struct {
+	// Mount namespace of the monitor, identifying its own container (zero if it isn't excluded)
+	selfMntns uint64
+	// Containers with any of these labels are excluded
+	labels map[string]string
+	// Rules selecting the traced containers, the others are excluded
+	selector *SelectorConfig
+
+	lock sync.RWMutex
+	// Excluded Pods, by namespace/name
+	pods map[string]bool
+	// Pods excluded from some of the tracers only, by tracer
+	tracerPods map[string]map[string]bool
+}
+
+var exclusions = &Exclusions{pods: make(map[string]bool), tracerPods: make(map[string]map[string]bool)}
+
+// NewExclusions creates the exclusions, excluding the monitor's own Pod if excludeSelf is set, the Pods with any of the key=value labels (separated by commas) and the containers not matching the selector
+func NewExclusions(excludeSelf bool, labels string, selector *SelectorConfig) (*Exclusions, error) {
+	var err error
+	e := &Exclusions{selector: selector, pods: make(map[string]bool), tracerPods: make(map[string]map[string]bool)}
+	if labels != "" {
+		if e.labels, err = parseLabels(strings.Split(labels, ",")); err != nil {
+			return nil, err
+		}
+	}
+	if !excludeSelf {
+		return e, nil
+	}
+
+	// The mount namespace identifies the container of the monitor even without the downward API
+	info, err := os.Stat("/proc/self/ns/mnt")
+	if err != nil {
+		return nil, fmt.Errorf("finding own mount namespace: %w", err)
+	}
+	e.selfMntns = info.Sys().(*syscall.Stat_t).Ino
+	// Also exclude the Pod right away if it was given, so its other containers are excluded even if they are seen first
+	if namespace, pod := os.Getenv("POD_NAMESPACE"), os.Getenv("POD_NAME"); namespace != "" && pod != "" {
+		e.pods[namespace+"/"+pod] = true
+	}
+	return e, nil
+}
+
+// ExcludeContainer returns true if the container must not be traced, remembering its Pod so the events already in flight are dropped too
+func (e *Exclusions) ExcludeContainer(container *containercollection.Container) bool {
+	pod := container.Namespace + "/" + container.Podname
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.pods[pod] {
+		return true
+	}
+	excluded := e.selfMntns != 0 && container.Mntns == e.selfMntns
+	if excluded {
+		log.Printf("Excluding own Pod %s from tracing\n", pod)
+	}
+	for key, value := range e.labels {
+		if !excluded && container.Labels[key] == value {
+			log.Printf("Excluding Pod %s from tracing, it has the label %s=%s\n", pod, key, value)
+			excluded = true
+		}
+	}
+	if !excluded && e.selector != nil && !e.selector.Matches(container) {
+		excluded = true
+	}
+	if excluded {
+		e.pods[pod] = true
+		return true
+	}
+	if e.selector != nil {
+		for _, tracer := range selectorTracerNames {
+			if e.selector.MatchesTracer(tracer, container) {
+				continue
+			}
+			if e.tracerPods[tracer] == nil {
+				e.tracerPods[tracer] = make(map[string]bool)
+			}
+			e.tracerPods[tracer][pod] = true
+		}
+	}
+	return false
+}
+
+// ExcludedPod returns true if the events of the tracer in the Pod must be dropped
+func (e *Exclusions) ExcludedPod(tracer string, namespace string, pod string) bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return e.pods[namespace+"/"+pod] || e.tracerPods[tracer][namespace+"/"+pod]
+}
+
+// Pods returns the excluded Pods of the namespace (all if empty), as namespace/name
+func (e *Exclusions) Pods(namespace string) []string {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	pods := make([]string, 0, len(e.pods))
+	for pod := range e.pods {
+		if namespace == "" || strings.HasPrefix(pod, namespace+"/") {
+			pods = append(pods, pod)
+		}
+	}
+	sort.Strings(pods)
+	return pods
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Minimum time between two exemplars of a series, a scrape only sees the last one anyway
+const exemplarInterval = time.Second
+
+// Number of events of the replaced exemplars kept, so the exemplars already scraped still resolve for a while
+const retiredExemplarEvents = 4096
+
+// Prefix of the IDs of the events of this run of the agent, followed by their sequence number
+var eventIDPrefix = newEventIDPrefix()
+var eventIDSeq atomic.Uint64
+
+func newEventIDPrefix() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// nextEventID returns a new unique event ID
+func nextEventID() string {
+	return eventIDPrefix + "-" + strconv.FormatUint(eventIDSeq.Add(1), 10)
+}
+
+// exemplar references the last event counted in a series
+type exemplar struct {
+	id        string
+	timestamp time.Time
+}
+
+// format returns the exemplar of a counter sample in the OpenMetrics format, empty if there is none
+func (e exemplar) format() string {
+	if e.id == "" {
+		return ""
+	}
+	return fmt.Sprintf(" # {event_id=%s} 1 %.3f", labelValue(e.id), float64(e.timestamp.UnixMilli())/1e3)
+}
+
+// ExemplarEvents keeps the events referenced by the exemplars, to serve them from the API
+type ExemplarEvents struct {
+	lock   sync.Mutex
+	events map[string]*Event
+	// Events of the replaced exemplars, oldest first
+	retired []string
+}
+
+var exemplarEvents = &ExemplarEvents{events: make(map[string]*Event)}
+
+// Replace keeps a copy of the event of a new exemplar, the event of the previous exemplar of the series is retired
+func (x *ExemplarEvents) Replace(previous string, event *Event) {
+	copied := *event
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.events[event.ID] = &copied
+	if previous != "" {
+		x.retire(previous)
+	}
+}
+
+// Retire keeps the event of an exemplar which isn't exposed anymore until retiredExemplarEvents more are retired
+func (x *ExemplarEvents) Retire(id string) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.retire(id)
+}
+
+func (x *ExemplarEvents) retire(id string) {
+	x.retired = append(x.retired, id)
+	for len(x.retired) > retiredExemplarEvents {
+		delete(x.events, x.retired[0])
+		x.retired = x.retired[1:]
+	}
+}
+
+// Get returns the event of an exemplar
+func (x *ExemplarEvents) Get(id string) (*Event, bool) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	event, ok := x.events[id]
+	return event, ok
+}
+
+func registerEventHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/events/", eventHandler)
+}
+
+// eventHandler serves the event referenced by an exemplar of the metrics, /api/v1/events/<id>, to the users allowed to
+// read the Pods of its namespace
+func eventHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/events/")
+	event, ok := exemplarEvents.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if status, err := authorizeNamespace(r, event.Namespace); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	// Nothing sensitive may leave the node
+	if redactor != nil {
+		event = redactor.Redact(event)
+	}
+	writeJSONResponse(w, http.StatusOK, event)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of events written between two flushes of an export
+const exportFlushEvents = 256
+
+// Trailer of an export with the cursor resuming it, set when the export stopped at its limit
+const exportCursorTrailer = "Wlftracer-Cursor"
+
+func registerExportHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/events/export", eventExportHandler)
+}
+
+// eventExportHandler streams the events of the history as a chunked response, filtered like the event stream by
+// ?namespace=, ?pod=, ?container=, ?type= and ?workload=<kind>/<name>, in the range of ?from= and ?to= (milliseconds
+// since the epoch or RFC 3339), the whole history by default. The events are NDJSON, or protobuf messages prefixed with
+// their size when application/x-protobuf is accepted. They are read from the history as the client receives them, so a
+// slow client slows the export down instead of having the events pile up in memory.
+//
+// At most ?limit= events are exported, the trailer Wlftracer-Cursor then has the ?cursor= of the request exporting
+// the next ones.
+func eventExportHandler(w http.ResponseWriter, r *http.Request) {
+	if eventHistory == nil {
+		http.Error(w, "the event history is disabled, see --backfill-window", http.StatusServiceUnavailable)
+		return
+	}
+	query := r.URL.Query()
+	filter := EventFilter{Namespace: query.Get("namespace"), Pod: query.Get("pod"), Container: query.Get("container")}
+	if filter.Pod != "" && filter.Namespace == "" {
+		http.Error(w, "pod requires namespace", http.StatusBadRequest)
+		return
+	}
+	if types := query.Get("type"); types != "" {
+		filter.Types = make(map[string]bool)
+		for _, eventType := range strings.Split(types, ",") {
+			filter.Types[strings.TrimSpace(eventType)] = true
+		}
+	}
+	var kind, name string
+	if workload := query.Get("workload"); workload != "" {
+		var ok bool
+		if kind, name, ok = strings.Cut(workload, "/"); !ok || filter.Namespace == "" {
+			http.Error(w, "workload is <kind>/<name> and requires namespace", http.StatusBadRequest)
+			return
+		}
+	}
+	to, err := parseGrafanaTime(query.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseGrafanaTime(query.Get("from"), time.Time{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var cursor historyCursor
+	if value := query.Get("cursor"); value != "" {
+		if cursor, err = parseHistoryCursor(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			http.Error(w, "limit must be positive", http.StatusBadRequest)
+			return
+		}
+	}
+	if status, err := authorizeNamespace(r, filter.Namespace); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	encoding := "json"
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if strings.Contains(r.Header.Get("Accept"), "application/x-protobuf") {
+		encoding = "protobuf"
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}
+	w.Header().Set("Trailer", exportCursorTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	exported := 0
+	var next historyCursor
+	eventHistory.ReplayFrom(from, cursor, eventHistory.Position(), func(event *Event, following historyCursor) bool {
+		if event.Time.After(to) || !filter.Matches(event) {
+			return true
+		}
+		if kind != "" {
+			if _, eventKind, eventName, _, ok := parseWorkloadKey(event.Workload); !ok || eventKind != kind || eventName != name {
+				return true
+			}
+		}
+		if limit > 0 && exported == limit {
+			// The event is the first of the next export
+			next = historyCursor{segment: following.segment, index: following.index - 1}
+			return false
+		}
+		data, err := encodeEventRecord(encoding, event)
+		if err != nil {
+			log.Printf("Error exporting event: %v\n", err)
+			return true
+		}
+		// Blocks while the client doesn't keep up, the client is gone if it fails
+		if _, err := w.Write(data); err != nil {
+			return false
+		}
+		exported++
+		metrics.EventsExported.Add(1)
+		if exported%exportFlushEvents == 0 {
+			flusher.Flush()
+		}
+		return true
+	})
+	if next.segment != "" {
+		w.Header().Set(exportCursorTrailer, next.String())
+	}
+}
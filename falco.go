@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// falcoEvent follows the JSON output of Falco, see https://falco.org/docs/outputs/formatting/
+type falcoEvent struct {
+	Time         string                 `json:"time"`
+	Rule         string                 `json:"rule"`
+	Priority     string                 `json:"priority"`
+	Source       string                 `json:"source"`
+	Output       string                 `json:"output"`
+	OutputFields map[string]interface{} `json:"output_fields"`
+	Tags         []string               `json:"tags"`
+	Hostname     string                 `json:"hostname"`
+}
+
+// Falco rule names of the event types
+var falcoRules = map[string]string{
+	"exec":        "Process executed in container",
+	"exec-failed": "Failed execution attempt in container",
+	"open":        "File opened in container",
+	"tcp":         "TCP activity in container",
+	// Drift events follow Falco's "Drop and execute new binary in container"
+	"drift":       "File not in container image used",
+	"new-syscall": "Syscall outside of learned profile",
+	"anomaly":     "Behavior outside of learned baseline",
+}
+
+func formatFalcoEvent(event *Event) ([]byte, error) {
+	if event.Type == "checkpoint" {
+		// Falco has no equivalent of the checkpoints
+		return nil, nil
+	}
+	repository, tag := splitImage(event.Image)
+	fields := map[string]interface{}{
+		"evt.time":                   event.Time.UnixNano(),
+		"evt.type":                   falcoEventType(event),
+		"proc.pid":                   event.Pid,
+		"proc.name":                  event.Comm,
+		"user.uid":                   event.Uid,
+		"group.gid":                  event.Gid,
+		"container.id":               shortContainerID(event.ContainerID),
+		"container.name":             event.Container,
+		"container.image.repository": repository,
+		"container.image.tag":        tag,
+		"k8s.ns.name":                event.Namespace,
+		"k8s.pod.name":               event.Pod,
+	}
+	if event.Ppid != 0 {
+		fields["proc.ppid"] = event.Ppid
+	}
+	// proc.aname[1] is the parent, proc.aname[2] the grandparent and so on
+	for i, ancestor := range event.Lineage {
+		if i == 0 {
+			fields["proc.pname"] = ancestor.Comm
+		}
+		fields[fmt.Sprintf("proc.aname[%d]", i+1)] = ancestor.Comm
+	}
+
+	var details string
+	switch event.Type {
+	case "exec":
+		fields["proc.exepath"] = event.Path
+		fields["proc.cmdline"] = strings.Join(append([]string{event.Comm}, execArguments(event)...), " ")
+		details = fmt.Sprintf("proc.exepath=%s proc.cmdline=%s", event.Path, fields["proc.cmdline"])
+	case "exec-failed":
+		fields["proc.exepath"] = event.Path
+		fields["evt.res"] = event.Errno
+		details = fmt.Sprintf("proc.exepath=%s evt.res=%s", event.Path, event.Errno)
+	case "open":
+		fields["fd.name"] = event.Path
+		details = fmt.Sprintf("fd.name=%s", event.Path)
+	case "drift":
+		fields["fd.name"] = event.Path
+		fields["proc.is_exe_upper_layer"] = event.Operation == "exec"
+		details = fmt.Sprintf("fd.name=%s drift=%s", event.Path, event.Drift)
+	case "anomaly":
+		fields["wlftracer.category"] = event.Category
+		fields["wlftracer.value"] = event.Value
+		details = fmt.Sprintf("category=%s value=%s", event.Category, event.Value)
+	case "new-syscall":
+		fields["evt.type"] = event.Syscall
+		details = fmt.Sprintf("evt.type=%s", event.Syscall)
+	case "tcp":
+		fields["fd.name"] = fmt.Sprintf("%s:%d->%s:%d", event.Src, event.Sport, event.Dst, event.Dport)
+		fields["fd.l4proto"] = "tcp"
+		details = fmt.Sprintf("fd.name=%s", fields["fd.name"])
+	}
+
+	priority := "Informational"
+	if event.Type == "drift" || event.Type == "new-syscall" || event.Type == "anomaly" {
+		priority = "Warning"
+	} else if event.Type == "exec-failed" {
+		priority = "Notice"
+	}
+	return json.Marshal(falcoEvent{
+		Time:     event.Time.UTC().Format(time.RFC3339Nano),
+		Rule:     falcoRules[event.Type],
+		Priority: priority,
+		Source:   "syscall",
+		Output: fmt.Sprintf("%s %s (user.uid=%d proc.name=%s %s container.id=%s container.name=%s k8s.ns.name=%s k8s.pod.name=%s)",
+			event.Time.Local().Format("15:04:05.000000000"), falcoRules[event.Type], event.Uid, event.Comm, details,
+			fields["container.id"], event.Container, event.Namespace, event.Pod),
+		OutputFields: fields,
+		Tags:         []string{"wlftracer", event.Type},
+		Hostname:     event.Node,
+	})
+}
+
+// falcoEventType returns the syscall Falco reports for the event
+func falcoEventType(event *Event) string {
+	switch event.Type {
+	case "exec", "exec-failed":
+		return "execve"
+	case "open":
+		return "openat"
+	case "drift":
+		if event.Operation == "exec" {
+			return "execve"
+		}
+		return "openat"
+	}
+	return event.Operation
+}
+
+// execArguments returns the arguments of an exec event, without the program name
+func execArguments(event *Event) []string {
+	if len(event.Args) < 2 {
+		return nil
+	}
+	return event.Args[1:]
+}
+
+// shortContainerID returns the 12 characters ID used by Falco
+func shortContainerID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// splitImage splits an image reference into its repository and tag (or digest)
+func splitImage(image string) (string, string) {
+	if i := strings.LastIndex(image, "@"); i >= 0 {
+		return image[:i], image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, ""
+}
@@ -0,0 +1,65 @@
+package main
+
+import "sync"
+
+// finalizingContainer is an unregistered container waiting to be finalized
+type finalizingContainer struct {
+	key   ContainerKey
+	state *ContainerState
+}
+
+// ContainerFinalizer finalizes the unregistered containers one at a time, in the order they were removed, so the retries
+// and store writes of a finalization hold up neither the event worker nor the container notifications. Its queue is
+// unbounded: the finalizations may wait for room in the event queue to send their alerts, the worker never waits for
+// the finalizer.
+type ContainerFinalizer struct {
+	lock       sync.Mutex
+	containers []finalizingContainer
+	wake       chan struct{}
+	pending    sync.WaitGroup
+}
+
+var finalizer *ContainerFinalizer
+
+// NewContainerFinalizer starts a finalizer
+func NewContainerFinalizer() *ContainerFinalizer {
+	f := &ContainerFinalizer{wake: make(chan struct{}, 1)}
+	go f.run()
+	return f
+}
+
+// Finalize queues the finalization of an unregistered container. The events it already handled were written to its
+// file, the later ones are in the pending buffer, which the finalization drains before closing the file.
+func (f *ContainerFinalizer) Finalize(key ContainerKey, state *ContainerState) {
+	f.pending.Add(1)
+	f.lock.Lock()
+	f.containers = append(f.containers, finalizingContainer{key: key, state: state})
+	f.lock.Unlock()
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Wait returns once the finalizations queued so far are done
+func (f *ContainerFinalizer) Wait() {
+	f.pending.Wait()
+}
+
+func (f *ContainerFinalizer) run() {
+	for range f.wake {
+		for {
+			f.lock.Lock()
+			if len(f.containers) == 0 {
+				f.lock.Unlock()
+				break
+			}
+			c := f.containers[0]
+			f.containers = f.containers[1:]
+			f.lock.Unlock()
+
+			finalizeContainer(c.key, c.state)
+			f.pending.Done()
+		}
+	}
+}
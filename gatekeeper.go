@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Gatekeeper external data provider protocol, see https://open-policy-agent.github.io/gatekeeper/website/docs/externaldata
+const gatekeeperAPIVersion = "externaldata.gatekeeper.sh/v1beta1"
+
+type gatekeeperProviderRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Request    struct {
+		Keys []string `json:"keys"`
+	} `json:"request"`
+}
+
+type gatekeeperItem struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+type gatekeeperProviderResponse struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Response   struct {
+		Idempotent  bool             `json:"idempotent"`
+		Items       []gatekeeperItem `json:"items"`
+		SystemError string           `json:"systemError,omitempty"`
+	} `json:"response"`
+}
+
+// workloadProfileStatus is returned for workload keys
+type workloadProfileStatus struct {
+	Known      bool      `json:"known"`
+	Stabilized bool      `json:"stabilized"`
+	Syscalls   int       `json:"syscalls,omitempty"`
+	FirstSeen  time.Time `json:"firstSeen,omitempty"`
+	UpdatedAt  time.Time `json:"updatedAt,omitempty"`
+}
+
+// imageProfileStatus is returned for image keys
+type imageProfileStatus struct {
+	Known bool `json:"known"`
+}
+
+// CA certificates the client certificate of Gatekeeper is verified against, the provider isn't served if nil
+var gatekeeperClientCAs *x509.CertPool
+
+// A workload profile is stabilized once its learning period is over and it didn't change for this long
+var profileStabilizationWindow time.Duration
+
+// profileStabilized returns true once the learning period of the workload is over and its profile stopped changing
+func profileStabilized(state *WorkloadSyscalls) bool {
+	return time.Since(state.FirstSeen) >= learningPeriod && time.Since(state.UpdatedAt) >= profileStabilizationWindow
+}
+
+func registerGatekeeperHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/gatekeeper/provider", gatekeeperProviderHandler)
+}
+
+// gatekeeperProviderHandler answers Gatekeeper external data requests. Keys are either workloads
+// ("<namespace>/<kind>/<name>/<container>") or images prefixed with "image:". The workloads are known cluster-wide
+// once their profiles are shared with every node (--seccomp-profiles), only the ones which ran on this node otherwise.
+func gatekeeperProviderHandler(w http.ResponseWriter, r *http.Request) {
+	response := gatekeeperProviderResponse{APIVersion: gatekeeperAPIVersion, Kind: "ProviderResponse"}
+	// Gatekeeper presents a client certificate signed by its CA
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		response.Response.SystemError = "a client certificate is required"
+		writeJSONResponse(w, http.StatusUnauthorized, response)
+		return
+	}
+	if r.Method != http.MethodPost {
+		response.Response.SystemError = "only POST is supported"
+		writeJSONResponse(w, http.StatusMethodNotAllowed, response)
+		return
+	}
+
+	var request gatekeeperProviderRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		response.Response.SystemError = fmt.Sprintf("decoding request: %v", err)
+		writeJSONResponse(w, http.StatusBadRequest, response)
+		return
+	}
+
+	// Profiles evolve over time, so the answers are not idempotent
+	response.Response.Idempotent = false
+	for _, key := range request.Request.Keys {
+		response.Response.Items = append(response.Response.Items, gatekeeperLookup(key))
+	}
+	writeJSONResponse(w, http.StatusOK, response)
+}
+
+// learnedSyscalls returns the profile of a workload container as shared with every node if the profiles are installed,
+// as learned on this node otherwise
+func learnedSyscalls(workload string) (*WorkloadSyscalls, error) {
+	if seccompProfiles != nil {
+		return seccompProfiles.Installed(workload), nil
+	}
+	return store.LoadSyscalls(workload)
+}
+
+func gatekeeperLookup(key string) gatekeeperItem {
+	if image := strings.TrimPrefix(key, "image:"); image != key {
+		return gatekeeperItem{Key: key, Value: imageProfileStatus{Known: store.HasImageProfile(image)}}
+	}
+
+	state, err := learnedSyscalls(key)
+	if err != nil {
+		return gatekeeperItem{Key: key, Error: err.Error()}
+	}
+	if state == nil {
+		return gatekeeperItem{Key: key, Value: workloadProfileStatus{}}
+	}
+	return gatekeeperItem{Key: key, Value: workloadProfileStatus{
+		Known:      true,
+		Stabilized: profileStabilized(state),
+		Syscalls:   len(state.Syscalls),
+		FirstSeen:  state.FirstSeen,
+		UpdatedAt:  state.UpdatedAt,
+	}}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGatekeeperProviderRequiresClientCertificate(t *testing.T) {
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	defer func() { store = nil }()
+	const workload = "default/Deployment/web/nginx"
+	if _, _, err := s.MergeSyscalls(workload, []string{"read", "write"}, false, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"apiVersion": "externaldata.gatekeeper.sh/v1beta1", "kind": "ProviderRequest", "request": {"keys": ["` + workload + `", "default/Deployment/db/postgres"]}}`
+	request := httptest.NewRequest(http.MethodPost, "/gatekeeper/provider", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	gatekeeperProviderHandler(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("request without client certificate answered with %d", recorder.Code)
+	}
+
+	// Verified against --gatekeeper-client-ca-file by the TLS handshake
+	request = httptest.NewRequest(http.MethodPost, "/gatekeeper/provider", strings.NewReader(body))
+	request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	recorder = httptest.NewRecorder()
+	gatekeeperProviderHandler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("answered with %d: %s", recorder.Code, recorder.Body)
+	}
+	var response struct {
+		Response struct {
+			Items []struct {
+				Key   string                `json:"key"`
+				Value workloadProfileStatus `json:"value"`
+			} `json:"items"`
+		} `json:"response"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	items := response.Response.Items
+	if len(items) != 2 || !items[0].Value.Known || items[0].Value.Syscalls != 2 || items[1].Value.Known {
+		t.Errorf("items = %+v", items)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	containercollection "github.com/inspektor-gadget/inspektor-gadget/pkg/container-collection"
+)
+
+// gcLoop periodically reconciles the registered containers with the container collection until stop is closed
+func gcLoop(containerCollection *containercollection.ContainerCollection, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			collectStaleContainers(containerCollection)
+			if sessionRecorder != nil {
+				sessionRecorder.EndExitedSessions()
+				sessionRecorder.ExpireRecordings()
+			}
+			policies := loadRetentionPolicies()
+			if fileRetention > 0 || len(policies.files) > 0 {
+				cleanupExpiredFiles(policies)
+			}
+			if profileRetention > 0 || len(policies.profiles) > 0 || tenants != nil {
+				cleanupExpiredProfiles(policies)
+			}
+		}
+	}
+}
+
+// collectStaleContainers removes the containers which vanished without a remove notification, closing their files
+func collectStaleContainers(containerCollection *containercollection.ContainerCollection) {
+	stale := make(map[ContainerKey]string)
+	for _, state := range containers.States() {
+		if containerCollection.GetContainer(state.ID) == nil {
+			stale[state.Key] = state.ID
+		}
+	}
+
+	for key, id := range stale {
+		log.Printf("Container %v vanished without a remove notification, cleaning it up\n", id)
+		metrics.StaleContainersCollected.Add(1)
+		// Removed through the queue, like a regular notification, so its queued events are written first
+		eventQueue.EnqueueRemove(key, id)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event types offered by the Grafana datasource
+var grafanaEventTypes = []string{"exec", "exec-failed", "open", "tcp", "dns", "capability", "drift", "new-syscall", "anomaly", "alert"}
+
+// Maximum number of rows of a table, and of points of a series, the most recent are kept
+const grafanaMaxRows = 10000
+const grafanaMaxPoints = 10000
+
+// Time range of the Infinity queries without one
+const grafanaDefaultRange = time.Hour
+
+func registerGrafanaHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/grafana/", grafanaTestHandler)
+	mux.HandleFunc("/api/v1/grafana/search", grafanaSearchHandler)
+	mux.HandleFunc("/api/v1/grafana/query", grafanaQueryHandler)
+	mux.HandleFunc("/api/v1/grafana/annotations", grafanaAnnotationsHandler)
+	mux.HandleFunc("/api/v1/grafana/tag-keys", grafanaTagKeysHandler)
+	mux.HandleFunc("/api/v1/grafana/tag-values", grafanaTagValuesHandler)
+	mux.HandleFunc("/api/v1/grafana/events", grafanaEventsHandler)
+}
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaTarget struct {
+	Target string `json:"target"`
+	// timeserie (the default) or table
+	Type string `json:"type"`
+}
+
+type grafanaAdhocFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+// grafanaQuery is the body of the queries of the SimpleJSON datasource
+type grafanaQuery struct {
+	Range         grafanaRange         `json:"range"`
+	IntervalMs    int64                `json:"intervalMs"`
+	MaxDataPoints int                  `json:"maxDataPoints"`
+	Targets       []grafanaTarget      `json:"targets"`
+	AdhocFilters  []grafanaAdhocFilter `json:"adhocFilters"`
+	Annotation    struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	} `json:"annotation"`
+	Key string `json:"key"`
+}
+
+type grafanaSeries struct {
+	Target     string      `json:"target"`
+	Datapoints [][2]uint64 `json:"datapoints"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type grafanaAnnotation struct {
+	Time  int64    `json:"time"`
+	Title string   `json:"title"`
+	Text  string   `json:"text"`
+	Tags  []string `json:"tags"`
+}
+
+var grafanaTableColumns = []grafanaColumn{
+	{"Time", "time"}, {"Namespace", "string"}, {"Pod", "string"}, {"Container", "string"}, {"Type", "string"},
+	{"Comm", "string"}, {"Pid", "number"}, {"Detail", "string"}, {"ID", "string"},
+}
+
+// grafanaTestHandler answers the test of the datasource
+func grafanaTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/grafana/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !grafanaEventsKept(w) {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// grafanaEventsKept tells whether events are kept to answer the queries, in the history or in memory, it fails the
+// request otherwise
+func grafanaEventsKept(w http.ResponseWriter) bool {
+	if eventHistory == nil && recentEvents == nil {
+		http.Error(w, "the event history is disabled, see --backfill-window or --recent-events", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// grafanaSearchHandler lists the targets: an event type, or all, optionally followed by :<namespace>
+func grafanaSearchHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, http.StatusOK, append([]string{"all"}, grafanaEventTypes...))
+}
+
+// parseGrafanaTarget returns the filter of a target, <type>[:<namespace>], refined by the ad hoc filters
+func parseGrafanaTarget(target string, adhocFilters []grafanaAdhocFilter) (EventFilter, error) {
+	eventType, namespace, _ := strings.Cut(strings.TrimSpace(target), ":")
+	filter := EventFilter{Namespace: namespace}
+	if eventType != "" && eventType != "all" && eventType != "*" {
+		filter.Types = map[string]bool{eventType: true}
+	}
+	for _, adhoc := range adhocFilters {
+		if adhoc.Operator != "=" {
+			return filter, fmt.Errorf("unsupported operator %q of the ad hoc filter on %s", adhoc.Operator, adhoc.Key)
+		}
+		switch adhoc.Key {
+		case "namespace":
+			filter.Namespace = adhoc.Value
+		case "pod":
+			filter.Pod = adhoc.Value
+		case "container":
+			filter.Container = adhoc.Value
+		case "type":
+			filter.Types = map[string]bool{adhoc.Value: true}
+		default:
+			return filter, fmt.Errorf("unsupported ad hoc filter key %q", adhoc.Key)
+		}
+	}
+	if filter.Pod != "" && filter.Namespace == "" {
+		return filter, fmt.Errorf("pod requires namespace")
+	}
+	return filter, nil
+}
+
+// authorizeGrafanaFilters checks that the user may read the Pods of the namespaces of the filters, all the namespaces
+// for the filters without one
+func authorizeGrafanaFilters(w http.ResponseWriter, r *http.Request, filters []EventFilter) bool {
+	authorized := make(map[string]bool)
+	for _, filter := range filters {
+		if authorized[filter.Namespace] {
+			continue
+		}
+		if status, err := authorizeNamespace(r, filter.Namespace); err != nil {
+			http.Error(w, err.Error(), status)
+			return false
+		}
+		authorized[filter.Namespace] = true
+	}
+	return true
+}
+
+// decodeGrafanaQuery decodes the body of a request, it fails if no events are kept
+func decodeGrafanaQuery(w http.ResponseWriter, r *http.Request) (*grafanaQuery, bool) {
+	if !grafanaEventsKept(w) {
+		return nil, false
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	query := &grafanaQuery{}
+	if err := json.NewDecoder(r.Body).Decode(query); err != nil {
+		http.Error(w, fmt.Sprintf("decoding query: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+	return query, true
+}
+
+// grafanaQueryHandler answers the queries of the panels: the number of events of each target per interval, or the
+// events themselves as a table
+func grafanaQueryHandler(w http.ResponseWriter, r *http.Request) {
+	query, ok := decodeGrafanaQuery(w, r)
+	if !ok {
+		return
+	}
+	from, to := query.Range.From, query.Range.To
+	filters := make([]EventFilter, 0, len(query.Targets))
+	for _, target := range query.Targets {
+		filter, err := parseGrafanaTarget(target.Target, query.AdhocFilters)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filters = append(filters, filter)
+	}
+	if !authorizeGrafanaFilters(w, r, filters) {
+		return
+	}
+
+	interval := time.Duration(query.IntervalMs) * time.Millisecond
+	if interval <= 0 && query.MaxDataPoints > 0 {
+		interval = to.Sub(from) / time.Duration(query.MaxDataPoints)
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if to.Sub(from)/interval > grafanaMaxPoints {
+		interval = to.Sub(from) / grafanaMaxPoints
+	}
+	points := int(to.Sub(from)/interval) + 1
+	if points < 1 {
+		points = 1
+	}
+
+	counts := make([][]uint64, len(filters))
+	rows := make([][][]interface{}, len(filters))
+	for i, target := range query.Targets {
+		if target.Type != "table" {
+			counts[i] = make([]uint64, points)
+		}
+	}
+	replayEvents(from, to, filters, func(i int, event *Event) {
+		if counts[i] != nil {
+			if bucket := int(event.Time.Sub(from) / interval); bucket >= 0 && bucket < points {
+				counts[i][bucket]++
+			}
+			return
+		}
+		rows[i] = append(rows[i], []interface{}{
+			event.Time.UnixMilli(), event.Namespace, event.Pod, event.Container, event.Type, event.Comm, event.Pid,
+			eventSummary(event), event.ID,
+		})
+		if len(rows[i]) > grafanaMaxRows {
+			rows[i] = rows[i][1:]
+		}
+	})
+
+	response := make([]interface{}, 0, len(query.Targets))
+	for i, target := range query.Targets {
+		if counts[i] == nil {
+			table := grafanaTable{Type: "table", Columns: grafanaTableColumns, Rows: rows[i]}
+			if table.Rows == nil {
+				table.Rows = [][]interface{}{}
+			}
+			response = append(response, table)
+			continue
+		}
+		series := grafanaSeries{Target: target.Target, Datapoints: make([][2]uint64, points)}
+		for bucket, count := range counts[i] {
+			series.Datapoints[bucket] = [2]uint64{count, uint64(from.Add(time.Duration(bucket) * interval).UnixMilli())}
+		}
+		response = append(response, series)
+	}
+	writeJSONResponse(w, http.StatusOK, response)
+}
+
+// grafanaAnnotationsHandler marks the events of the target of the annotation query, the alerts by default
+func grafanaAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	query, ok := decodeGrafanaQuery(w, r)
+	if !ok {
+		return
+	}
+	target := query.Annotation.Query
+	if target == "" {
+		target = "alert"
+	}
+	filter, err := parseGrafanaTarget(target, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeGrafanaFilters(w, r, []EventFilter{filter}) {
+		return
+	}
+	annotations := []grafanaAnnotation{}
+	replayEvents(query.Range.From, query.Range.To, []EventFilter{filter}, func(_ int, event *Event) {
+		title := event.Type
+		if event.Rule != "" {
+			title = fmt.Sprintf("%s %s (%s)", event.Type, event.Rule, event.Severity)
+		}
+		annotations = append(annotations, grafanaAnnotation{
+			Time:  event.Time.UnixMilli(),
+			Title: title,
+			Text:  fmt.Sprintf("%s/%s/%s: %s", event.Namespace, event.Pod, event.Container, eventSummary(event)),
+			Tags:  []string{event.Type, event.Namespace},
+		})
+		if len(annotations) > grafanaMaxRows {
+			annotations = annotations[1:]
+		}
+	})
+	writeJSONResponse(w, http.StatusOK, annotations)
+}
+
+// grafanaTagKeysHandler lists the keys of the ad hoc filters
+func grafanaTagKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys := []map[string]string{}
+	for _, key := range []string{"namespace", "pod", "container", "type"} {
+		keys = append(keys, map[string]string{"type": "string", "text": key})
+	}
+	writeJSONResponse(w, http.StatusOK, keys)
+}
+
+// grafanaTagValuesHandler lists the values of a key of the ad hoc filters, from the containers currently traced
+func grafanaTagValuesHandler(w http.ResponseWriter, r *http.Request) {
+	query, ok := decodeGrafanaQuery(w, r)
+	if !ok {
+		return
+	}
+	seen := make(map[string]bool)
+	if query.Key == "type" {
+		for _, eventType := range grafanaEventTypes {
+			seen[eventType] = true
+		}
+	} else {
+		if status, err := authorizeNamespace(r, ""); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		for _, state := range containers.States() {
+			switch query.Key {
+			case "namespace":
+				seen[state.Key.Namespace] = true
+			case "pod":
+				seen[state.Key.Podname] = true
+			case "container":
+				seen[state.Key.ContainerName] = true
+			}
+		}
+	}
+	values := make([]string, 0, len(seen))
+	for value := range seen {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	response := make([]map[string]string, 0, len(values))
+	for _, value := range values {
+		response = append(response, map[string]string{"text": value})
+	}
+	writeJSONResponse(w, http.StatusOK, response)
+}
+
+// grafanaEventsHandler serves the events of the history as a JSON array for the Infinity datasource, filtered like the
+// event stream by ?namespace=, ?pod=, ?container= and ?type=, in the range of ?from= and ?to= (milliseconds since the
+// epoch as in ${__from}, or RFC 3339), the last hour by default, and at most ?limit= of the most recent ones
+func grafanaEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !grafanaEventsKept(w) {
+		return
+	}
+	query := r.URL.Query()
+	filter := EventFilter{Namespace: query.Get("namespace"), Pod: query.Get("pod"), Container: query.Get("container")}
+	if filter.Pod != "" && filter.Namespace == "" {
+		http.Error(w, "pod requires namespace", http.StatusBadRequest)
+		return
+	}
+	if types := query.Get("type"); types != "" {
+		filter.Types = make(map[string]bool)
+		for _, eventType := range strings.Split(types, ",") {
+			filter.Types[strings.TrimSpace(eventType)] = true
+		}
+	}
+	to, err := parseGrafanaTime(query.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseGrafanaTime(query.Get("from"), to.Add(-grafanaDefaultRange))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := grafanaMaxRows
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > grafanaMaxRows {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", grafanaMaxRows), http.StatusBadRequest)
+			return
+		}
+	}
+	if !authorizeGrafanaFilters(w, r, []EventFilter{filter}) {
+		return
+	}
+
+	events := []*Event{}
+	replayEvents(from, to, []EventFilter{filter}, func(_ int, event *Event) {
+		events = append(events, event)
+		if len(events) > limit {
+			events = events[1:]
+		}
+	})
+	writeJSONResponse(w, http.StatusOK, events)
+}
+
+// parseGrafanaTime parses a time in milliseconds since the epoch or in RFC 3339, the default if empty
+func parseGrafanaTime(value string, defaultTime time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultTime, nil
+	}
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected milliseconds since the epoch or RFC 3339", value)
+	}
+	return t, nil
+}
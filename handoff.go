@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// containerHandoff is the in-memory state of a container handed over to the next instance of the agent
+type containerHandoff struct {
+	ID           string   `json:"id"`
+	Seq          uint64   `json:"seq"`
+	LastExec     string   `json:"lastExec,omitempty"`
+	RootObserved bool     `json:"rootObserved,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Syscalls     []string `json:"syscalls,omitempty"`
+	// Syscalls already written to the container file
+	WrittenSyscalls []string `json:"writtenSyscalls,omitempty"`
+	// Syscalls already recorded in the inventory
+	InventoriedSyscalls []string `json:"inventoriedSyscalls,omitempty"`
+
+	Relevant    []SBOMComponent `json:"relevant,omitempty"`
+	Executables []string        `json:"executables,omitempty"`
+	Libraries   []string        `json:"libraries,omitempty"`
+	Processes   []string        `json:"processes,omitempty"`
+	Files       []string        `json:"files,omitempty"`
+	Protocols   []string        `json:"protocols,omitempty"`
+	// Fingerprints of the paths checked for drift
+	DriftChecked map[string]string `json:"driftFingerprints,omitempty"`
+
+	Opens     []ProfileOpen     `json:"opens,omitempty"`
+	Execs     []ProfileExec     `json:"execs,omitempty"`
+	Endpoints []ProfileEndpoint `json:"endpoints,omitempty"`
+	Dropped   uint64            `json:"dropped,omitempty"`
+}
+
+// agentHandoff is the state saved by an agent stopping for a restart
+type agentHandoff struct {
+	BootID     string             `json:"bootID"`
+	SavedAt    time.Time          `json:"savedAt"`
+	Containers []containerHandoff `json:"containers"`
+}
+
+// File the state is handed over through, empty if the agent doesn't hand over its state
+var handoffPath string
+
+var handoffLock sync.Mutex
+
+// States handed over by the previous instance of the agent by container ID, consumed as the containers are added again
+var handoffStates map[string]*containerHandoff
+
+// loadHandoff reads the state saved by the previous instance of the agent, the file is removed so it is used only once
+func loadHandoff(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("reading handoff: %w", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("removing handoff: %w", err)
+	}
+	if data, err = openAtRest(data); err != nil {
+		return fmt.Errorf("decrypting handoff: %w", err)
+	}
+	handoff := &agentHandoff{}
+	if err := json.Unmarshal(data, handoff); err != nil {
+		return fmt.Errorf("decoding handoff: %w", err)
+	}
+	// The containers don't survive a reboot
+	if handoff.BootID != clock.BootID {
+		log.Printf("Ignoring the state handed over before the reboot of the node\n")
+		return nil
+	}
+
+	handoffLock.Lock()
+	defer handoffLock.Unlock()
+	handoffStates = make(map[string]*containerHandoff, len(handoff.Containers))
+	for i := range handoff.Containers {
+		handoffStates[handoff.Containers[i].ID] = &handoff.Containers[i]
+	}
+	log.Printf("Resuming the state of %d containers handed over at %s\n", len(handoffStates), handoff.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// restoreHandoff restores the state handed over for the container, if any, before its registration
+func restoreHandoff(state *ContainerState) {
+	handoffLock.Lock()
+	handoff, ok := handoffStates[state.ID]
+	delete(handoffStates, state.ID)
+	handoffLock.Unlock()
+	if !ok {
+		return
+	}
+
+	state.seq = handoff.Seq
+	state.lastExec = handoff.LastExec
+	state.rootObserved = handoff.RootObserved
+	addToSet(state.capabilities, handoff.Capabilities)
+	state.restoredSyscalls = handoff.Syscalls
+	state.lastSyscalls = handoff.Syscalls
+	addToSet(state.writtenSyscalls, handoff.WrittenSyscalls)
+	addToSet(state.inventoriedSyscalls, handoff.InventoriedSyscalls)
+	for _, component := range handoff.Relevant {
+		state.relevant[component] = true
+	}
+	addToSet(state.executables, handoff.Executables)
+	addToSet(state.libraries, handoff.Libraries)
+	addToSet(state.behavior.processes, handoff.Processes)
+	addToSet(state.behavior.files, handoff.Files)
+	addToSet(state.behavior.protocols, handoff.Protocols)
+	for path, fingerprint := range handoff.DriftChecked {
+		state.driftChecked[path] = fingerprint
+	}
+	if state.profile != nil {
+		state.profile.dropped = handoff.Dropped
+		for i := range handoff.Opens {
+			state.profile.opens[handoff.Opens[i].Path] = &handoff.Opens[i]
+		}
+		for i := range handoff.Execs {
+			state.profile.execs[handoff.Execs[i].Path] = &handoff.Execs[i]
+		}
+		for i := range handoff.Endpoints {
+			endpoint := &handoff.Endpoints[i]
+			state.profile.endpoints[profileEndpointKey(endpoint.Operation, endpoint.Address, endpoint.Port)] = endpoint
+		}
+	}
+	log.Printf("Resumed tracking container %s\n", state.ID)
+}
+
+func addToSet(set map[string]bool, values []string) {
+	for _, value := range values {
+		set[value] = true
+	}
+}
+
+// discardHandoff drops the state of the containers which were removed while the agent was restarting
+func discardHandoff() {
+	handoffLock.Lock()
+	defer handoffLock.Unlock()
+
+	if len(handoffStates) > 0 {
+		log.Printf("%d containers handed over are gone, discarding their state\n", len(handoffStates))
+	}
+	handoffStates = nil
+}
+
+// withRestoredSyscalls adds the syscalls seen by the previous instance of the agent to a snapshot, the kernel only knows the ones since the restart
+func withRestoredSyscalls(state *ContainerState, syscalls []string) []string {
+	if len(state.restoredSyscalls) == 0 {
+		return syscalls
+	}
+	merged := append([]string(nil), state.restoredSyscalls...)
+	mergeStrings(&merged, syscalls)
+	return merged
+}
+
+// handOffAllContainers persists what was learned about the registered containers and saves their in-memory state for the next instance of the agent
+func handOffAllContainers(path string) {
+	states := containers.TakeAll()
+
+	handoff := agentHandoff{BootID: clock.BootID, SavedAt: time.Now()}
+	for key, state := range states {
+		for _, event := range pendingBuffer.Take(key) {
+			state.WriteEvent(event.timestamp, event.line)
+		}
+		if syscalls, err := peekSyscalls(state); err == nil {
+			state.lock.Lock()
+			state.lastSyscalls = withRestoredSyscalls(state, syscalls)
+			state.lock.Unlock()
+		}
+		// The profiles on disk are merged, they are simply updated as if the container went on
+		state.lock.Lock()
+		syscalls := state.lastSyscalls
+		state.lock.Unlock()
+		if syscalls != nil {
+			writeNewSyscalls(state, syscalls)
+			persistSyscalls(state, syscalls)
+		}
+		persistProfile(state, syscalls)
+		persistRelevantComponents(state)
+		persistReachability(state)
+		persistBehavior(state)
+		persistNetworkPolicy(state)
+		if sessionRecorder != nil {
+			sessionRecorder.ContainerRemoved(key, state.ID)
+		}
+
+		state.lock.Lock()
+		handoff.Containers = append(handoff.Containers, state.handoff())
+		state.lock.Unlock()
+		state.WriteEvent(clock.Now(), "agent: handing over\n")
+		state.Close()
+	}
+
+	data, err := json.Marshal(handoff)
+	if err == nil {
+		data, err = sealAtRest(data)
+	}
+	if err == nil {
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Error handing over the state of the containers: %v\n", err)
+		return
+	}
+	log.Printf("Handed over the state of %d containers\n", len(handoff.Containers))
+}
+
+// handoff returns the in-memory state of the container, the state lock must be held
+func (s *ContainerState) handoff() containerHandoff {
+	handoff := containerHandoff{
+		ID:                  s.ID,
+		Seq:                 s.seq,
+		LastExec:            s.lastExec,
+		RootObserved:        s.rootObserved,
+		Capabilities:        setToSlice(s.capabilities),
+		Syscalls:            s.lastSyscalls,
+		WrittenSyscalls:     setToSlice(s.writtenSyscalls),
+		InventoriedSyscalls: setToSlice(s.inventoriedSyscalls),
+		Executables:         setToSlice(s.executables),
+		Libraries:           setToSlice(s.libraries),
+		Processes:           setToSlice(s.behavior.processes),
+		Files:               setToSlice(s.behavior.files),
+		Protocols:           setToSlice(s.behavior.protocols),
+	}
+	if len(s.driftChecked) > 0 {
+		handoff.DriftChecked = make(map[string]string, len(s.driftChecked))
+		for path, fingerprint := range s.driftChecked {
+			handoff.DriftChecked[path] = fingerprint
+		}
+	}
+	for component := range s.relevant {
+		handoff.Relevant = append(handoff.Relevant, component)
+	}
+	sort.Slice(handoff.Relevant, func(i, j int) bool { return handoff.Relevant[i].Name < handoff.Relevant[j].Name })
+	if s.profile != nil {
+		profile := s.profile.Profile(s, nil)
+		handoff.Opens, handoff.Execs, handoff.Endpoints, handoff.Dropped = profile.Opens, profile.Execs, profile.Endpoints, profile.Dropped
+	}
+	return handoff
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// Health tracks the components of the service which are currently degraded
+type Health struct {
+	lock     sync.Mutex
+	degraded map[string]string
+}
+
+var health = &Health{degraded: make(map[string]string)}
+
+// SetDegraded marks a component as degraded for the given reason
+func (h *Health) SetDegraded(component string, reason string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, ok := h.degraded[component]; !ok {
+		log.Printf("Component %s is degraded: %s\n", component, reason)
+	}
+	h.degraded[component] = reason
+}
+
+// SetHealthy clears the degraded state of a component
+func (h *Health) SetHealthy(component string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, ok := h.degraded[component]; ok {
+		log.Printf("Component %s recovered\n", component)
+		delete(h.degraded, component)
+	}
+}
+
+// Degraded returns the degraded components along with the reason
+func (h *Health) Degraded() map[string]string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	degraded := make(map[string]string, len(h.degraded))
+	for component, reason := range h.degraded {
+		degraded[component] = reason
+	}
+	return degraded
+}
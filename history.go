@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the events dispatched to the sinks are kept on disk, to backfill the sinks added by a reload of the tenant
+// configurations and to serve the Grafana datasource, 0 to not keep any. The history never grows past maxHistoryBytes.
+var backfillWindow time.Duration
+var maxHistoryBytes int64 = 1 << 30
+
+// Time covered by each file of the history
+const historySegmentDuration = 10 * time.Minute
+
+// EventHistory journals the events dispatched to the sinks, one file per historySegmentDuration, and deletes the files
+// once their events are older than backfillWindow
+type EventHistory struct {
+	dir    string
+	lock   sync.Mutex
+	file   *os.File
+	errors sinkErrorTracker
+	// Set when the history is encrypted at rest
+	records *recordWriter
+	// When the current file was started, and its size
+	started time.Time
+	size    int64
+}
+
+var eventHistory *EventHistory
+
+// historyPosition is the end of the history at some point, the events recorded later are after it
+type historyPosition struct {
+	segment string
+	size    int64
+}
+
+// NewEventHistory keeps the history in the directory, the events recorded before a restart are kept too
+func NewEventHistory(dir string) (*EventHistory, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating history directory: %w", err)
+	}
+	h := &EventHistory{dir: dir, errors: sinkErrorTracker{name: "history"}}
+	h.prune(time.Now())
+	return h, nil
+}
+
+// segments returns the files of the history, oldest first
+func (h *EventHistory) segments() []string {
+	segments, _ := filepath.Glob(filepath.Join(h.dir, "*.ndjson"))
+	sort.Strings(segments)
+	return segments
+}
+
+// segmentStart returns when the events of a file of the history start, from its name
+func segmentStart(segment string) time.Time {
+	nanos, _ := strconv.ParseInt(strings.TrimSuffix(filepath.Base(segment), ".ndjson"), 10, 64)
+	return time.Unix(0, nanos)
+}
+
+// Record appends an event to the history, it is called from the event worker only
+func (h *EventHistory) Record(event *Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	if h.file == nil || now.Sub(h.started) >= historySegmentDuration {
+		if err := h.rotate(now); err != nil {
+			h.errors.Track(err)
+			return
+		}
+	}
+	if h.records != nil {
+		err = writeWithRetry(h.records, string(data)+"\n")
+		h.size = h.records.size
+	} else if err = writeWithRetry(h.file, string(data)+"\n"); err == nil {
+		h.size += int64(len(data) + 1)
+	}
+	h.errors.Track(err)
+}
+
+// rotate starts a new file and deletes the expired ones
+func (h *EventHistory) rotate(now time.Time) error {
+	if h.file != nil {
+		h.finish()
+		h.file.Close()
+		h.file, h.records = nil, nil
+	}
+	f, err := os.OpenFile(filepath.Join(h.dir, fmt.Sprintf("%020d.ndjson", now.UnixNano())), os.O_CREATE|os.O_RDWR|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("creating history file: %w", err)
+	}
+	h.file, h.started, h.size = f, now, 0
+	if atRestKey != nil {
+		if h.records, err = atRestKey.newRecordWriter(f, 0); err != nil {
+			return fmt.Errorf("encrypting history file: %w", err)
+		}
+		h.size = h.records.size
+	}
+	h.prune(now)
+	return nil
+}
+
+// prune deletes the files whose events are all older than backfillWindow, and the oldest ones past maxHistoryBytes
+func (h *EventHistory) prune(now time.Time) {
+	segments := h.segments()
+	sizes := make([]int64, len(segments))
+	var total int64
+	for i, segment := range segments {
+		if info, err := os.Stat(segment); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	for i, segment := range segments {
+		if h.file != nil && segment == h.file.Name() {
+			break
+		}
+		// The events of a file end where the next one starts
+		expired := i+1 < len(segments) && now.Sub(segmentStart(segments[i+1])) > backfillWindow
+		if !expired && total <= maxHistoryBytes {
+			break
+		}
+		if err := os.Remove(segment); err != nil {
+			log.Printf("Error deleting history file %s: %v\n", segment, err)
+			return
+		}
+		total -= sizes[i]
+	}
+}
+
+// Position returns the end of the history, it is called from the event worker only so no event is being recorded
+func (h *EventHistory) Position() historyPosition {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.file == nil {
+		return historyPosition{}
+	}
+	return historyPosition{segment: h.file.Name(), size: h.size}
+}
+
+// historyCursor is where a replay of the history stopped: the file, and the number of its events already replayed
+type historyCursor struct {
+	segment string
+	index   int
+}
+
+// String returns the cursor as it is handed over to the clients, the start of its file and the index separated by a dot
+func (c historyCursor) String() string {
+	return fmt.Sprintf("%s.%d", strings.TrimSuffix(c.segment, ".ndjson"), c.index)
+}
+
+// parseHistoryCursor parses a cursor returned by String
+func parseHistoryCursor(value string) (historyCursor, error) {
+	start, index, ok := strings.Cut(value, ".")
+	if !ok {
+		return historyCursor{}, fmt.Errorf("invalid cursor %q", value)
+	}
+	if _, err := strconv.ParseUint(start, 10, 64); err != nil || len(start) != 20 {
+		return historyCursor{}, fmt.Errorf("invalid cursor %q", value)
+	}
+	cursor := historyCursor{segment: start + ".ndjson"}
+	var err error
+	if cursor.index, err = strconv.Atoi(index); err != nil || cursor.index < 0 {
+		return historyCursor{}, fmt.Errorf("invalid cursor %q", value)
+	}
+	return cursor, nil
+}
+
+// Replay hands the events recorded since the time and up to the position over to write, oldest first, until it
+// returns false
+func (h *EventHistory) Replay(since time.Time, until historyPosition, write func(event *Event) bool) error {
+	return h.ReplayFrom(since, historyCursor{}, until, func(event *Event, _ historyCursor) bool {
+		return write(event)
+	})
+}
+
+// ReplayFrom is Replay resuming after the cursor, if any, write gets the cursor following each event. The events are
+// read from the files as they are written, so only one of them is held in memory at a time. If the file of the cursor
+// was deleted in the meantime, the replay resumes from the oldest file left.
+func (h *EventHistory) ReplayFrom(since time.Time, cursor historyCursor, until historyPosition, write func(event *Event, next historyCursor) bool) error {
+	if until.segment == "" {
+		return nil
+	}
+	segments := h.segments()
+	for i, segment := range segments {
+		if segment > until.segment {
+			break
+		}
+		name := filepath.Base(segment)
+		if cursor.segment != "" && name < cursor.segment {
+			continue
+		}
+		if i+1 < len(segments) && segmentStart(segments[i+1]).Before(since) {
+			continue
+		}
+		size := int64(-1)
+		if segment == until.segment {
+			size = until.size
+		}
+		skip := 0
+		if name == cursor.segment {
+			skip = cursor.index
+		}
+		stopped, err := scanHistorySegment(segment, size, skip, func(event *Event, index int) bool {
+			return event.Time.Before(since) || write(event, historyCursor{segment: name, index: index})
+		})
+		if err != nil {
+			// Deleted or damaged, the other files still have their events
+			log.Printf("Error reading history file %s: %v\n", segment, err)
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// replayEvents hands the events in the range over to match, with the index of each filter they match. The
+// recent events in memory answer the ranges they cover, the history the older ones.
+func replayEvents(from time.Time, to time.Time, filters []EventFilter, match func(i int, event *Event)) {
+	replay := func(event *Event) bool {
+		if event.Time.After(to) {
+			return true
+		}
+		for i := range filters {
+			if filters[i].Matches(event) {
+				match(i, event)
+			}
+		}
+		return true
+	}
+	if recentEvents != nil && (eventHistory == nil || recentEvents.Covers(from)) {
+		for _, event := range recentEvents.Query(EventFilter{}, from) {
+			replay(event)
+		}
+		return
+	}
+	eventHistory.Replay(from, eventHistory.Position(), replay)
+}
+
+// Maximum size of an event of the history
+const maxHistoryLine = 16 << 20
+
+// scanHistorySegment hands the events of a file of the history, up to size if it isn't negative, over to write along
+// with the number of events read so far, after skipping the first ones. It returns true if write returned false.
+func scanHistorySegment(path string, size int64, skip int, write func(event *Event, index int) bool) (bool, error) {
+	r, err := openHistorySegment(path, size)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxHistoryLine)
+	index := 0
+	for scanner.Scan() {
+		index++
+		if index <= skip {
+			continue
+		}
+		event := &Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			continue
+		}
+		if !write(event, index) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// segmentReader is the clear content of a file of the history
+type segmentReader struct {
+	io.Reader
+	close func() error
+}
+
+func (r segmentReader) Close() error {
+	return r.close()
+}
+
+// openHistorySegment opens a file of the history, up to size if it isn't negative, an encrypted file is decrypted as it
+// is read
+func openHistorySegment(path string, size int64) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = f
+	if size >= 0 {
+		r = io.LimitReader(f, size)
+	}
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(len(atRestMagic)); string(magic) != atRestMagic && string(magic) != atRestMagicV1 {
+		if atRestKey != nil && !atRestMigrate {
+			f.Close()
+			return nil, fmt.Errorf("%s isn't encrypted, see --encryption-migrate", path)
+		}
+		return segmentReader{buffered, f.Close}, nil
+	}
+	if atRestKey == nil {
+		f.Close()
+		return nil, fmt.Errorf("the file is encrypted, --encryption-key-file is required")
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		// The segment being written has no final record yet
+		err := atRestKey.decrypt(buffered, pw, false)
+		if err == errUnfinished {
+			err = nil
+		}
+		pw.CloseWithError(err)
+	}()
+	return segmentReader{pr, func() error {
+		pr.Close()
+		return f.Close()
+	}}, nil
+}
+
+// Close closes the file being written
+func (h *EventHistory) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.file != nil {
+		h.finish()
+		h.file.Close()
+		h.file, h.records = nil, nil
+	}
+}
+
+// finish ends the encrypted records of the current file
+func (h *EventHistory) finish() {
+	if h.records == nil {
+		return
+	}
+	if err := h.records.Finish(); err != nil {
+		log.Printf("Error finishing history file %s: %v\n", h.file.Name(), err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpSink posts batches of events, as newline delimited JSON, an EventBatch protobuf message or size prefixed Avro
+// records, to an HTTP endpoint
+type httpSink struct {
+	url      string
+	encoding string
+	codec    Codec
+	client   *http.Client
+	batcher  *batcher
+}
+
+// NewHTTPSink creates a sink posting at most batchSize events at once to the URL, in the encoding (json, protobuf or
+// avro), compressed with the codec unless it is nil, with the delivery guarantee
+func NewHTTPSink(url string, encoding string, codec Codec, batchSize int, flushInterval time.Duration, delivery string) Sink {
+	s := &httpSink{url: url, encoding: encoding, codec: codec, client: &http.Client{Timeout: 30 * time.Second}}
+	s.batcher = newBatcher("http:"+url, batchSize, flushInterval, delivery, s.send)
+	return s
+}
+
+func (s *httpSink) Write(event *Event) error {
+	s.batcher.Add(event)
+	return nil
+}
+
+func (s *httpSink) Backfill(event *Event, stop <-chan struct{}) bool {
+	return s.batcher.AddWait(event, stop)
+}
+
+func (s *httpSink) Close() error {
+	s.batcher.Close()
+	return nil
+}
+
+func (s *httpSink) send(batch []*Event) error {
+	switch s.encoding {
+	case "protobuf":
+		return s.post("application/x-protobuf", marshalEventBatchProto(batch))
+	case "avro":
+		var body []byte
+		for _, event := range batch {
+			record, _ := encodeEventRecord("avro", event)
+			body = append(body, record...)
+		}
+		return s.post("application/vnd.wlftracer.avro", body)
+	}
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range batch {
+		if err := encoder.Encode(event); err != nil {
+			return fmt.Errorf("encoding event: %w", err)
+		}
+	}
+
+	return s.post("application/x-ndjson", body.Bytes())
+}
+
+func (s *httpSink) post(contentType string, body []byte) error {
+	req, err := newCompressedRequest(s.codec, s.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	containercollection "github.com/inspektor-gadget/inspektor-gadget/pkg/container-collection"
+)
+
+// OCI annotations set by the container runtimes with the image of a container
+var imageNameAnnotations = []string{
+	"io.kubernetes.cri.image-name",  // containerd
+	"io.kubernetes.cri-o.ImageName", // CRI-O
+}
+
+var imageRefAnnotations = []string{
+	"io.kubernetes.cri-o.ImageRef", // CRI-O
+}
+
+// containerImage returns the image name of a container ("" if the runtime didn't provide it)
+func containerImage(container *containercollection.Container) string {
+	return ociAnnotation(container, imageNameAnnotations)
+}
+
+// containerImageRef returns the resolved image reference (usually the digest) of a container, falling back to the image name
+func containerImageRef(container *containercollection.Container) string {
+	if ref := ociAnnotation(container, imageRefAnnotations); ref != "" {
+		return ref
+	}
+	return containerImage(container)
+}
+
+func ociAnnotation(container *containercollection.Container, names []string) string {
+	if container.OciConfig == nil {
+		return ""
+	}
+	for _, name := range names {
+		if value, ok := container.OciConfig.Annotations[name]; ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
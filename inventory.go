@@ -0,0 +1,264 @@
+package main
+
+import (
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Categories of the behavioral inventory
+const (
+	inventoryBinaries     = "binaries"
+	inventoryPathPrefixes = "pathPrefixes"
+	inventoryDestinations = "destinations"
+	inventorySyscalls     = "syscalls"
+)
+
+// Maximum number of items kept per category of a workload
+const maxInventoryItems = 10000
+
+// Number of leading components of the paths kept as prefixes
+var inventoryPathDepth int
+
+// InventoryItem tells when a binary, path prefix, destination or syscall was first and last seen in a workload
+type InventoryItem struct {
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	// Number of times the item was seen
+	Count uint64 `json:"count"`
+}
+
+// WorkloadInventory is the behavioral inventory of a workload, by category then item
+type WorkloadInventory struct {
+	Workload string `json:"workload"`
+	// Start of the learning window of the workload
+	FirstSeen  time.Time                            `json:"firstSeen"`
+	Categories map[string]map[string]*InventoryItem `json:"categories"`
+	UpdatedAt  time.Time                            `json:"updatedAt"`
+}
+
+// Inventory keeps the inventories of the workloads in memory and persists the changed ones periodically
+type Inventory struct {
+	lock      sync.Mutex
+	workloads map[string]*WorkloadInventory
+	dirty     map[string]bool
+	// Categories of the workloads found full, by workload then category
+	full map[string]map[string]bool
+	// Held while flushing, so an older copy is never written over a newer one
+	flushLock sync.Mutex
+}
+
+var inventory *Inventory
+
+// NewInventory creates an empty inventory, the workloads are loaded from the store when first seen
+func NewInventory() *Inventory {
+	return &Inventory{workloads: make(map[string]*WorkloadInventory), dirty: make(map[string]bool), full: make(map[string]map[string]bool)}
+}
+
+// workload returns the inventory of the workload, loading it from the store the first time
+func (i *Inventory) workload(workload string) *WorkloadInventory {
+	if inv, ok := i.workloads[workload]; ok {
+		return inv
+	}
+	inv, err := store.LoadInventory(workload)
+	if err != nil {
+		log.Printf("Error loading inventory of %s: %v\n", workload, err)
+	}
+	if inv == nil {
+		inv = &WorkloadInventory{Workload: workload}
+	}
+	if inv.FirstSeen.IsZero() {
+		inv.FirstSeen = time.Now()
+	}
+	if inv.Categories == nil {
+		inv.Categories = make(map[string]map[string]*InventoryItem)
+	}
+	i.workloads[workload] = inv
+	return inv
+}
+
+// Record marks an item of a category as seen in the workload at the given time. It returns how many times the item
+// was seen and whether it appeared once the learning window of the workload was over, outside of its baseline. The
+// count is 0 if the category is full and the item is new.
+func (i *Inventory) Record(workload string, category string, value string, seen time.Time) (uint64, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	inv := i.workload(workload)
+	items, ok := inv.Categories[category]
+	if !ok {
+		items = make(map[string]*InventoryItem)
+		inv.Categories[category] = items
+	}
+	item, ok := items[value]
+	if !ok {
+		if len(items) >= maxInventoryItems {
+			metrics.InventoryItemsDropped.Add(1)
+			return 0, false
+		}
+		item = &InventoryItem{FirstSeen: seen}
+		items[value] = item
+	}
+	item.Count++
+	if seen.After(item.LastSeen) {
+		item.LastSeen = seen
+	}
+	i.dirty[workload] = true
+	return item.Count, item.FirstSeen.Sub(inv.FirstSeen) >= learningPeriod
+}
+
+// RecordEvent adds the binary, path prefix or destination used by an event to the inventory of its workload and
+// returns it, along with the result of Record
+func (i *Inventory) RecordEvent(event *Event) (category string, value string, count uint64, outsideBaseline bool) {
+	if event.Workload == "" {
+		return "", "", 0, false
+	}
+	if category, value = inventoryItem(event); value == "" {
+		return "", "", 0, false
+	}
+	count, outsideBaseline = i.Record(event.Workload, category, value, event.Time)
+	i.RecordVersion(event.Workload, event.ImageDigest, category, value, event.Time)
+	return category, value, count, outsideBaseline
+}
+
+// inventoryItem returns the binary, path prefix or destination used by an event, if any
+func inventoryItem(event *Event) (category string, value string) {
+	switch event.Type {
+	case "exec":
+		category, value = inventoryBinaries, event.Path
+	case "open":
+		category, value = inventoryPathPrefixes, pathPrefix(event.Path, inventoryPathDepth)
+	case "tcp":
+		switch event.Operation {
+		case "connect":
+			category, value = inventoryDestinations, net.JoinHostPort(event.Dst, strconv.Itoa(int(event.Dport)))
+		case "accept":
+			// The port of an accepted peer is ephemeral
+			category, value = inventoryDestinations, event.Dst
+		}
+	}
+	return category, value
+}
+
+// RecordVersion marks an item as seen in the workload while it ran the image, to compare the versions of the workload
+func (i *Inventory) RecordVersion(workload string, digest string, category string, value string, seen time.Time) {
+	if digest != "" {
+		i.Record(versionInventoryKey(workload, digest), category, value, seen)
+	}
+}
+
+// Flush persists the inventories which changed since the last flush, writing copies so the events aren't held up by
+// the disk
+func (i *Inventory) Flush() {
+	i.flushLock.Lock()
+	defer i.flushLock.Unlock()
+
+	i.lock.Lock()
+	now := time.Now()
+	copies := make([]*WorkloadInventory, 0, len(i.dirty))
+	for workload := range i.dirty {
+		inv := i.workloads[workload]
+		inv.UpdatedAt = now
+		copies = append(copies, inv.copy())
+		delete(i.dirty, workload)
+	}
+	i.lock.Unlock()
+
+	for _, inv := range copies {
+		if err := store.SaveInventory(inv); err != nil {
+			log.Printf("Error persisting inventory of %s: %v\n", inv.Workload, err)
+			// Written again at the next flush, unless the workload was forgotten meanwhile
+			i.lock.Lock()
+			if _, ok := i.workloads[inv.Workload]; ok {
+				i.dirty[inv.Workload] = true
+			}
+			i.lock.Unlock()
+		}
+	}
+}
+
+// copy returns a deep copy of the inventory
+func (inv *WorkloadInventory) copy() *WorkloadInventory {
+	c := *inv
+	c.Categories = make(map[string]map[string]*InventoryItem, len(inv.Categories))
+	for category, items := range inv.Categories {
+		c.Categories[category] = make(map[string]*InventoryItem, len(items))
+		for value, item := range items {
+			copied := *item
+			c.Categories[category][value] = &copied
+		}
+	}
+	return &c
+}
+
+// MarkFull records that a category of the workload is full, it returns true the first time
+func (i *Inventory) MarkFull(workload string, category string) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.full[workload][category] {
+		return false
+	}
+	if i.full[workload] == nil {
+		i.full[workload] = make(map[string]bool)
+	}
+	i.full[workload][category] = true
+	return true
+}
+
+// Forget drops a workload whose inventory was deleted from the store
+func (i *Inventory) Forget(workload string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	delete(i.workloads, workload)
+	delete(i.dirty, workload)
+	delete(i.full, workload)
+}
+
+// Query returns the items of a workload inventory, optionally restricted to a category and to values starting with a prefix
+func (i *Inventory) Query(workload string, category string, prefix string) map[string]map[string]InventoryItem {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	inv, ok := i.workloads[workload]
+	if !ok {
+		// Don't keep the inventories of the workloads only queried
+		var err error
+		if inv, err = store.LoadInventory(workload); err != nil || inv == nil {
+			return nil
+		}
+	}
+	result := make(map[string]map[string]InventoryItem)
+	for name, items := range inv.Categories {
+		if category != "" && name != category {
+			continue
+		}
+		for value, item := range items {
+			if !strings.HasPrefix(value, prefix) {
+				continue
+			}
+			if result[name] == nil {
+				result[name] = make(map[string]InventoryItem)
+			}
+			result[name][value] = *item
+		}
+	}
+	return result
+}
+
+// pathPrefix returns the first depth components of an absolute path, e.g. /etc/nginx for /etc/nginx/nginx.conf
+func pathPrefix(p string, depth int) string {
+	if !path.IsAbs(p) {
+		return ""
+	}
+	components := strings.Split(strings.TrimPrefix(path.Clean(p), "/"), "/")
+	if len(components) > depth {
+		components = components[:depth]
+	}
+	return "/" + strings.Join(components, "/")
+}
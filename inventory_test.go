@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathPrefix(t *testing.T) {
+	const conf = "/etc/nginx/nginx.conf"
+	if got := pathPrefix(conf, 2); got != "/etc/nginx" {
+		t.Errorf("depth 2 = %q", got)
+	}
+	if got := pathPrefix(conf, 1); got != "/etc" {
+		t.Errorf("depth 1 = %q", got)
+	}
+	if got := pathPrefix(conf, 5); got != conf {
+		t.Errorf("depth over the path length = %q", got)
+	}
+	// Cleaned before being cut
+	if got := pathPrefix("/etc//nginx/../ssl/cert.pem", 2); got != "/etc/ssl" {
+		t.Errorf("uncleaned path = %q", got)
+	}
+	if got := pathPrefix("/", 2); got != "/" {
+		t.Errorf("root = %q", got)
+	}
+	if got := pathPrefix("relative/path", 2); got != "" {
+		t.Errorf("relative path = %q", got)
+	}
+}
+
+func TestInventoryRecordEvent(t *testing.T) {
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, inventoryPathDepth = s, 2
+	defer func() { store, inventoryPathDepth = nil, 0 }()
+
+	const workload = "default/Deployment/web/nginx"
+	inv := NewInventory()
+	first, later := time.Now().Add(-time.Minute), time.Now()
+	for _, event := range []*Event{
+		{Type: "exec", Workload: workload, Time: first, Path: "/usr/sbin/nginx"},
+		{Type: "open", Workload: workload, Time: first, Path: "/etc/nginx/nginx.conf"},
+		{Type: "open", Workload: workload, Time: later, Path: "/etc/nginx/conf.d/default.conf"},
+		{Type: "tcp", Workload: workload, Time: later, Operation: "connect", Dst: "10.0.0.1", Dport: 5432},
+		{Type: "tcp", Workload: workload, Time: later, Operation: "accept", Dst: "10.0.0.2", Dport: 41234},
+		// Not part of a workload
+		{Type: "exec", Time: later, Path: "/bin/sh"},
+	} {
+		inv.RecordEvent(event)
+	}
+
+	items := inv.Query(workload, "", "")
+	if _, ok := items[inventoryBinaries]["/usr/sbin/nginx"]; !ok || len(items[inventoryBinaries]) != 1 {
+		t.Errorf("binaries = %v", items[inventoryBinaries])
+	}
+	prefix, ok := items[inventoryPathPrefixes]["/etc/nginx"]
+	if !ok || prefix.Count != 2 || !prefix.FirstSeen.Equal(first) || !prefix.LastSeen.Equal(later) {
+		t.Errorf("path prefixes = %v", items[inventoryPathPrefixes])
+	}
+	// The ports of the accepted peers are ephemeral
+	destinations := items[inventoryDestinations]
+	if _, ok := destinations["10.0.0.1:5432"]; !ok || len(destinations) != 2 {
+		t.Errorf("destinations = %v", destinations)
+	}
+	if _, ok := destinations["10.0.0.2"]; !ok {
+		t.Errorf("accepted peer missing from %v", destinations)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Directory the KubeArmor policies are written to, empty if they are not generated
+var kubeArmorPolicyDir string
+
+// Directories with more files accessed than this are allowed as a whole instead of file by file
+const kubeArmorDirectoryThreshold = 8
+
+// Pod labels which differ between the instances of a workload and can't be used to select it
+var instanceLabels = map[string]bool{
+	"pod-template-hash":                  true,
+	"controller-revision-hash":           true,
+	"pod-template-generation":            true,
+	"statefulset.kubernetes.io/pod-name": true,
+	"controller-uid":                     true,
+	"job-name":                           true,
+	"batch.kubernetes.io/controller-uid": true,
+	"batch.kubernetes.io/job-name":       true,
+}
+
+// kubeArmorPolicyTemplate renders an allow-list policy of a single workload container
+var kubeArmorPolicyTemplate = template.Must(template.New("kubearmor").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(`# Generated by wlftracer from the behavior observed in {{ .Workload }}, review before enforcing
+apiVersion: security.kubearmor.com/v1
+kind: KubeArmorPolicy
+metadata:
+  name: {{ .Name }}
+  namespace: {{ .Namespace }}
+spec:
+  selector:
+    matchLabels:
+{{- range $key, $value := .Labels }}
+      {{ quote $key }}: {{ quote $value }}
+{{- end }}
+{{- if .Processes }}
+  process:
+    matchPaths:
+{{- range .Processes }}
+    - path: {{ quote . }}
+{{- end }}
+{{- end }}
+{{- if or .Files .Directories }}
+  file:
+{{- if .Files }}
+    matchPaths:
+{{- range .Files }}
+    - path: {{ quote . }}
+{{- end }}
+{{- end }}
+{{- if .Directories }}
+    matchDirectories:
+{{- range .Directories }}
+    - dir: {{ quote . }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- if .Protocols }}
+  network:
+    matchProtocols:
+{{- range .Protocols }}
+    - protocol: {{ . }}
+{{- end }}
+{{- end }}
+  action: Allow
+`))
+
+// writeKubeArmorPolicy renders the allow-list policy of a workload into the directory, leaving the file untouched if it didn't change
+func writeKubeArmorPolicy(dir string, behavior *WorkloadBehavior) error {
+	namespace, kind, name, container, ok := parseWorkloadKey(behavior.Workload)
+	if !ok {
+		return fmt.Errorf("invalid workload key %q", behavior.Workload)
+	}
+
+	labels := map[string]string{"kubearmor.io/container.name": container}
+	for key, value := range behavior.Labels {
+		if !instanceLabels[key] {
+			labels[key] = value
+		}
+	}
+	files, directories := groupFilesByDirectory(behavior.Files)
+
+	var buf bytes.Buffer
+	err := kubeArmorPolicyTemplate.Execute(&buf, map[string]interface{}{
+		"Workload":    behavior.Workload,
+		"Name":        resourceName("wlftracer", kind, name, container),
+		"Namespace":   namespace,
+		"Labels":      labels,
+		"Processes":   behavior.Processes,
+		"Files":       files,
+		"Directories": directories,
+		"Protocols":   kubeArmorProtocols(behavior.Protocols),
+	})
+	if err != nil {
+		return fmt.Errorf("rendering policy: %w", err)
+	}
+
+	return writeIfChanged(filepath.Join(dir, storeFileName(behavior.Workload)+".yaml"), buf.Bytes())
+}
+
+// kubeArmorProtocols returns the protocols KubeArmor can match among the recorded ones. The behaviors persisted by the
+// previous versions recorded the DNS events as dns, which is matched as udp.
+func kubeArmorProtocols(protocols []string) []string {
+	var matched []string
+	for _, protocol := range protocols {
+		if protocol == "dns" {
+			protocol = "udp"
+		}
+		switch protocol {
+		case "tcp", "udp", "icmp", "raw":
+			if !containsString(matched, protocol) {
+				matched = append(matched, protocol)
+			}
+		}
+	}
+	sort.Strings(matched)
+	return matched
+}
+
+// groupFilesByDirectory replaces the files of the directories with many accessed files by the directories themselves
+func groupFilesByDirectory(paths []string) ([]string, []string) {
+	byDirectory := make(map[string][]string)
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		byDirectory[dir] = append(byDirectory[dir], path)
+	}
+
+	var files, directories []string
+	for dir, dirFiles := range byDirectory {
+		if len(dirFiles) > kubeArmorDirectoryThreshold {
+			// KubeArmor expects directories to end with a slash
+			directories = append(directories, strings.TrimSuffix(dir, "/")+"/")
+		} else {
+			files = append(files, dirFiles...)
+		}
+	}
+	sort.Strings(files)
+	sort.Strings(directories)
+	return files, directories
+}
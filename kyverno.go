@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Directory the Kyverno policies are written to, empty if they are not generated
+var kyvernoPolicyDir string
+
+// Seccomp profiles generated by the agent live in this directory of the kubelet seccomp root
+const seccompProfileDir = "wlftracer"
+
+// seccompProfileName returns the localhost seccomp profile of a workload, relative to the kubelet seccomp root
+func seccompProfileName(workload string) string {
+	return seccompProfileDir + "/" + storeFileName(workload) + ".json"
+}
+
+var invalidResourceNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// resourceName turns the parts into a valid Kubernetes resource name, hashing the overflow of long names
+func resourceName(parts ...string) string {
+	name := invalidResourceNameChars.ReplaceAllString(strings.ToLower(strings.Join(parts, "-")), "-")
+	if len(name) > 63 {
+		hash := fnv.New32a()
+		hash.Write([]byte(name))
+		name = fmt.Sprintf("%s-%08x", strings.TrimRight(name[:54], "-"), hash.Sum32())
+	}
+	return strings.Trim(name, "-")
+}
+
+// kyvernoPolicyTemplate renders a namespaced policy validating the Pods of a single workload container
+var kyvernoPolicyTemplate = template.Must(template.New("kyverno").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(`# Generated by wlftracer from the behavior observed in {{ .Workload }}, review before enforcing
+apiVersion: kyverno.io/v1
+kind: Policy
+metadata:
+  name: {{ .Name }}
+  namespace: {{ .Namespace }}
+  annotations:
+    policies.kyverno.io/title: Runtime profile of {{ quote .Workload }}
+    policies.kyverno.io/description: >-
+      Generated from {{ .Syscalls }} syscalls observed between {{ .FirstSeen }} and {{ .UpdatedAt }}.
+    pod-policies.kyverno.io/autogen-controllers: none
+spec:
+  validationFailureAction: Audit
+  background: true
+  rules:
+  - name: require-seccomp-profile
+    match:
+      any:
+      - resources:
+          kinds:
+          - Pod
+          names:
+          - {{ quote .PodName }}
+    validate:
+      message: "Container {{ .Container }} must run with the seccomp profile learned by wlftracer."
+      pattern:
+        spec:
+          containers:
+          - (name): {{ quote .Container }}
+            securityContext:
+              seccompProfile:
+                type: Localhost
+                localhostProfile: {{ quote .SeccompProfile }}
+{{- if .CapabilitiesTraced }}
+  # The container drops all the capabilities and only adds back the ones its processes were granted when checked
+  - name: restrict-capabilities
+    match:
+      any:
+      - resources:
+          kinds:
+          - Pod
+          names:
+          - {{ quote .PodName }}
+    validate:
+      message: "Container {{ .Container }} must drop all capabilities{{ if .Capabilities }} and only add {{ .CapabilityList }}{{ end }}."
+      pattern:
+        spec:
+          containers:
+          - (name): {{ quote .Container }}
+            securityContext:
+              capabilities:
+                drop:
+                - ALL
+{{- if .Capabilities }}
+                =(add):
+                - {{ quote .CapabilityPattern }}
+{{- else }}
+                X(add): "null"
+{{- end }}
+{{- else }}
+  # restrict-capabilities skipped: the capability checks of the workload weren't traced, see --tracers
+{{- end }}
+{{- if not .RootObserved }}
+  # No process of the workload was observed running as root
+  - name: require-run-as-non-root
+    match:
+      any:
+      - resources:
+          kinds:
+          - Pod
+          names:
+          - {{ quote .PodName }}
+    validate:
+      message: "Container {{ .Container }} must run as non-root."
+      pattern:
+        spec:
+          containers:
+          - (name): {{ quote .Container }}
+            securityContext:
+              runAsNonRoot: true
+{{- end }}
+`))
+
+// capabilitiesTraced returns whether the capability checks of the container are traced, the capabilities tracer isn't
+// enabled by default
+func capabilitiesTraced(state *ContainerState) bool {
+	return tracerManager != nil && tracerManager.Loaded(capabilitiesTraceName) &&
+		!exclusions.ExcludedPod(capabilitiesTraceName, state.Key.Namespace, state.Key.Podname)
+}
+
+// writeKyvernoPolicy renders the policy of a learned workload into the directory, leaving the file untouched if it didn't change
+func writeKyvernoPolicy(dir string, workload *WorkloadSyscalls) error {
+	namespace, kind, name, container, ok := parseWorkloadKey(workload.Workload)
+	if !ok {
+		return fmt.Errorf("invalid workload key %q", workload.Workload)
+	}
+
+	// Pods of a controller are named after it
+	podName := name
+	if kind != "Pod" {
+		podName = name + "-*"
+	}
+
+	var buf bytes.Buffer
+	err := kyvernoPolicyTemplate.Execute(&buf, map[string]interface{}{
+		"Workload":           workload.Workload,
+		"Name":               resourceName("wlftracer", kind, name, container),
+		"Namespace":          namespace,
+		"PodName":            podName,
+		"Container":          container,
+		"SeccompProfile":     seccompProfileName(workload.Workload),
+		"Syscalls":           len(workload.Syscalls),
+		"FirstSeen":          workload.FirstSeen.UTC().Format("2006-01-02T15:04:05Z"),
+		"UpdatedAt":          workload.UpdatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+		"RootObserved":       workload.RootObserved,
+		"CapabilitiesTraced": workload.CapabilitiesTraced,
+		"Capabilities":       workload.Capabilities,
+		"CapabilityList":     strings.Join(workload.Capabilities, ", "),
+		"CapabilityPattern":  strings.Join(workload.Capabilities, " | "),
+	})
+	if err != nil {
+		return fmt.Errorf("rendering policy: %w", err)
+	}
+
+	return writeIfChanged(filepath.Join(dir, storeFileName(workload.Workload)+".yaml"), buf.Bytes())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// kyvernoRules renders the policy of the workload and returns the names of its rules
+func kyvernoRules(t *testing.T, workload *WorkloadSyscalls) []string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := writeKyvernoPolicy(dir, workload); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, storeFileName(workload.Workload)+".yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var policy struct {
+		Spec struct {
+			Rules []struct {
+				Name string `json:"name"`
+			} `json:"rules"`
+		} `json:"spec"`
+	}
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		t.Fatalf("invalid policy: %v\n%s", err, data)
+	}
+	var names []string
+	for _, rule := range policy.Spec.Rules {
+		names = append(names, rule.Name)
+	}
+	return names
+}
+
+func TestKyvernoPolicyCapabilities(t *testing.T) {
+	workload := &WorkloadSyscalls{
+		Workload:     "default/Deployment/web/nginx",
+		Syscalls:     []string{"read", "write"},
+		FirstSeen:    time.Now().Add(-time.Hour),
+		UpdatedAt:    time.Now(),
+		RootObserved: true,
+	}
+
+	// Without the capabilities tracer, no capability was seen because none was checked
+	if rules := kyvernoRules(t, workload); containsString(rules, "restrict-capabilities") {
+		t.Errorf("capabilities restricted without being traced: %v", rules)
+	}
+
+	workload.CapabilitiesTraced = true
+	if rules := kyvernoRules(t, workload); !containsString(rules, "restrict-capabilities") {
+		t.Errorf("traced capabilities not restricted: %v", rules)
+	}
+	workload.Capabilities = []string{"NET_BIND_SERVICE"}
+	if rules := kyvernoRules(t, workload); !containsString(rules, "restrict-capabilities") {
+		t.Errorf("granted capabilities not restricted: %v", rules)
+	}
+}
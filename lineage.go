@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Number of ancestors added to the exec, open and tcp events, 0 to not reconstruct the process lineage
+var lineageDepth = 8
+
+// Number of processes remembered per container, the oldest execs are forgotten first
+const maxTrackedProcesses = 4096
+
+// ProcessAncestor is a process in the ancestry of the process of an event
+type ProcessAncestor struct {
+	Pid  uint32 `json:"pid"`
+	Comm string `json:"comm,omitempty"`
+	// Binary executed, unknown for the processes which weren't executed while the container was traced
+	Path string `json:"path,omitempty"`
+}
+
+type trackedProcess struct {
+	ppid uint32
+	comm string
+	path string
+}
+
+// processTable reconstructs the process tree of a container from its exec events
+type processTable struct {
+	lock      sync.Mutex
+	processes map[uint32]*trackedProcess
+	// Pids in the order they were executed, to forget the oldest ones
+	order []uint32
+}
+
+func newProcessTable() *processTable {
+	return &processTable{processes: make(map[uint32]*trackedProcess)}
+}
+
+// RecordExec remembers the binary executed by the process and its parent, a reused pid replaces the previous process
+func (t *processTable) RecordExec(pid uint32, ppid uint32, comm string, path string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.processes[pid]; !ok {
+		t.order = append(t.order, pid)
+	}
+	t.processes[pid] = &trackedProcess{ppid: ppid, comm: comm, path: path}
+	for len(t.order) > maxTrackedProcesses {
+		delete(t.processes, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// Lineage returns the parent of the process and up to depth of its ancestors, the parent first. The processes which
+// weren't executed while the container was traced are looked up in /proc, as long as they are in its mount namespace.
+func (t *processTable) Lineage(pid uint32, mntns uint64, depth int) (uint32, []ProcessAncestor) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ppid, _, ok := t.parent(pid, mntns)
+	if !ok {
+		return 0, nil
+	}
+	var lineage []ProcessAncestor
+	for current := ppid; current != 0 && len(lineage) < depth; {
+		next, ancestor, ok := t.parent(current, mntns)
+		if !ok {
+			break
+		}
+		lineage = append(lineage, ancestor)
+		if next == current {
+			break
+		}
+		current = next
+	}
+	return ppid, lineage
+}
+
+// parent returns the parent of a process along with the process itself
+func (t *processTable) parent(pid uint32, mntns uint64) (uint32, ProcessAncestor, bool) {
+	if process, ok := t.processes[pid]; ok {
+		return process.ppid, ProcessAncestor{Pid: pid, Comm: process.comm, Path: process.path}, true
+	}
+	if mntns != 0 && procMntns(pid) != mntns {
+		// The process left the container, or the walk reached the container runtime
+		return 0, ProcessAncestor{}, false
+	}
+	ppid, comm, ok := procParent(pid)
+	if !ok {
+		return 0, ProcessAncestor{}, false
+	}
+	return ppid, ProcessAncestor{Pid: pid, Comm: comm}, true
+}
+
+// procParent returns the parent and the command name of a process, from /proc/<pid>/stat
+func procParent(pid uint32) (uint32, string, bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, "", false
+	}
+	// pid (comm) state ppid ...
+	stat := string(data)
+	start, end := strings.Index(stat, "("), strings.LastIndex(stat, ")")
+	if start < 0 || end < start {
+		return 0, "", false
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 2 {
+		return 0, "", false
+	}
+	ppid, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return 0, "", false
+	}
+	return uint32(ppid), stat[start+1 : end], true
+}
+
+// procMntns returns the inode of the mount namespace of a process, 0 if it is gone
+func procMntns(pid uint32) uint64 {
+	link, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/mnt", pid))
+	if err != nil {
+		return 0
+	}
+	// mnt:[4026531840]
+	inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "mnt:["), "]"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return inode
+}
+
+// recordProcess adds the process executed by an exec event to the process tree of its container
+func recordProcess(key ContainerKey, event *Event) {
+	state, ok := containers.Get(key)
+	if !ok {
+		return
+	}
+	state.processes.RecordExec(event.Pid, event.Ppid, event.Comm, event.Path)
+}
+
+// enrichLineage adds the parent and the ancestry of the process to the exec, open and tcp events
+func enrichLineage(state *ContainerState, event *Event) {
+	if lineageDepth <= 0 || event.Lineage != nil {
+		return
+	}
+	switch event.Type {
+	case "exec", "open", "tcp":
+	default:
+		return
+	}
+	ppid, lineage := state.processes.Lineage(event.Pid, state.Mntns, lineageDepth)
+	if event.Ppid == 0 {
+		event.Ppid = ppid
+	}
+	event.Lineage = lineage
+}
+
+// imageDigest returns the digest of a resolved image reference (e.g. docker.io/library/nginx@sha256:...), empty if the
+// reference isn't resolved
+func imageDigest(ref string) string {
+	if i := strings.Index(ref, "sha256:"); i >= 0 {
+		return ref[i:]
+	}
+	return ""
+}
+
+// formatLineage formats the ancestry of a process, the parent first (e.g. sh(42) < bash(12))
+func formatLineage(lineage []ProcessAncestor) string {
+	ancestors := make([]string, 0, len(lineage))
+	for _, ancestor := range lineage {
+		ancestors = append(ancestors, fmt.Sprintf("%s(%d)", ancestor.Comm, ancestor.Pid))
+	}
+	return strings.Join(ancestors, " < ")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Number of events queued for a socket client before its new events are dropped
+const socketClientQueueSize = 4096
+
+// socketSink streams the encoded events to every client connected to a Unix domain socket
+type socketSink struct {
+	listener net.Listener
+	lock     sync.Mutex
+	clients  map[net.Conn]chan []byte
+	wg       sync.WaitGroup
+}
+
+// NewSocketSink listens on the Unix domain socket, replacing the socket left behind by a previous run
+func NewSocketSink(path string) (Sink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("creating socket directory: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("removing stale socket: %w", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", path, err)
+	}
+	// Only the local agents running as the same user (or root) may read the events
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("restricting socket permissions: %w", err)
+	}
+	s := &socketSink{listener: listener, clients: make(map[net.Conn]chan []byte)}
+	go s.accept()
+	log.Printf("Streaming events to the clients of %s\n", path)
+	return s, nil
+}
+
+func (s *socketSink) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error accepting socket client: %v\n", err)
+			}
+			return
+		}
+		queue := make(chan []byte, socketClientQueueSize)
+		s.lock.Lock()
+		s.clients[conn] = queue
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go s.serve(conn, queue)
+	}
+}
+
+// serve writes the events queued for a client until it disconnects or the sink is closed
+func (s *socketSink) serve(conn net.Conn, queue chan []byte) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	for data := range queue {
+		if _, err := conn.Write(data); err != nil {
+			// The client went away, stop queuing for it
+			s.lock.Lock()
+			if _, ok := s.clients[conn]; ok {
+				delete(s.clients, conn)
+				close(queue)
+			}
+			s.lock.Unlock()
+			for range queue {
+			}
+			return
+		}
+	}
+}
+
+func (s *socketSink) Write(event *Event) error {
+	data, err := encodeEventRecord(eventEncoding, event)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, queue := range s.clients {
+		select {
+		case queue <- data:
+		default:
+			// A slow client never blocks the event worker
+			metrics.SinkEventsDropped.Add(1)
+		}
+	}
+	return nil
+}
+
+// Close stops accepting clients and disconnects them once their queued events are written
+func (s *socketSink) Close() error {
+	err := s.listener.Close()
+	s.lock.Lock()
+	for conn, queue := range s.clients {
+		close(queue)
+		delete(s.clients, conn)
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// fifoSink writes the encoded events to a named pipe from its own goroutine. The events are dropped once its queue is
+// full while no reader keeps up, so a missing or slow reader never blocks the event worker.
+type fifoSink struct {
+	f      *os.File
+	queue  chan []byte
+	done   chan struct{}
+	errors sinkErrorTracker
+}
+
+// NewFIFOSink creates the named pipe if it doesn't exist yet and opens it
+func NewFIFOSink(path string) (Sink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("creating FIFO directory: %w", err)
+	}
+	if err := syscall.Mkfifo(path, 0600); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("creating FIFO: %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("checking FIFO: %w", err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return nil, fmt.Errorf("%s exists and is not a FIFO", path)
+	}
+	// Opening for reading too never blocks waiting for a reader, and keeps the pipe open when the reader restarts
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening FIFO: %w", err)
+	}
+	s := &fifoSink{f: f, queue: make(chan []byte, socketClientQueueSize), done: make(chan struct{}), errors: sinkErrorTracker{name: "fifo:" + path}}
+	go s.run()
+	return s, nil
+}
+
+// run writes the queued events, waiting for the pipe to drain while it is full. The records are written whole, the
+// goroutine being the only writer.
+func (s *fifoSink) run() {
+	defer close(s.done)
+	for data := range s.queue {
+		_, err := s.f.Write(data)
+		if errors.Is(err, os.ErrClosed) {
+			return
+		}
+		if s.errors.Track(err) {
+			log.Printf("Error writing to %s: %v\n", s.errors.name, err)
+		}
+	}
+}
+
+func (s *fifoSink) Write(event *Event) error {
+	data, err := encodeEventRecord(eventEncoding, event)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.queue <- data:
+	default:
+		// The pipe and the queue are full, no reader keeps up
+		metrics.SinkEventsDropped.Add(1)
+	}
+	return nil
+}
+
+// Close writes the queued events the reader takes within a second, then closes the pipe
+func (s *fifoSink) Close() error {
+	close(s.queue)
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+	}
+	return s.f.Close()
+}
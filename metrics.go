@@ -0,0 +1,166 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics holds the counters describing the health of the service itself
+type Metrics struct {
+	// Writes to a sink which failed after all the retries
+	SinkWriteErrors atomic.Uint64
+	// Writes to a sink which were retried because of a transient error
+	SinkWriteRetries atomic.Uint64
+
+	// Events handed over by the tracer callbacks
+	EventsEnqueued atomic.Uint64
+	// Events dropped because the event queue was full
+	EventsDropped atomic.Uint64
+	// Total and maximum time the tracer callbacks spent enqueuing events
+	EnqueueLatencyNanos    atomic.Uint64
+	EnqueueLatencyMaxNanos atomic.Uint64
+	// Histogram of the enqueue latencies, the last bucket counts the ones above all the bounds
+	EnqueueLatencyBuckets [len(enqueueLatencyBuckets) + 1]atomic.Uint64
+
+	// Events whose path or arguments were truncated by the tracers, and how many of them were completed from /proc
+	TruncatedEvents          atomic.Uint64
+	TruncatedEventsCompleted atomic.Uint64
+
+	// Events dropped because they happened during the startup grace period of their container
+	StartupEventsSuppressed atomic.Uint64
+
+	// Events dropped because a batching sink couldn't keep up, and batches dropped after all the retries
+	SinkEventsDropped  atomic.Uint64
+	SinkBatchesDropped atomic.Uint64
+	// Events spilled to disk by the at least once sinks, and events replayed from there
+	SinkEventsSpilled  atomic.Uint64
+	SinkEventsReplayed atomic.Uint64
+	// Events of the history sent to the sinks added by a reload of the tenant configurations
+	SinkEventsBackfilled atomic.Uint64
+
+	// Events dropped because their namespace held more than its share of the queue, and events neither written nor
+	// sent because their namespace was over its quota
+	EventsDroppedFairShare atomic.Uint64
+	EventsOverQuota        atomic.Uint64
+
+	// Events dropped by the auto-tuning of the noisy containers, and changes of the tuning
+	EventsDeduplicated  atomic.Uint64
+	EventsSampled       atomic.Uint64
+	AutoTuneAdjustments atomic.Uint64
+
+	// Containers the Kubernetes enrichment missed which were identified from their cgroups
+	ContainersEnrichedFromCgroups atomic.Uint64
+
+	// Runs of the saved queries
+	SavedQueriesRun atomic.Uint64
+
+	// Events of the history streamed by the exports
+	EventsExported atomic.Uint64
+
+	// Events recorded by the trace sessions, once per session
+	TraceSessionEvents atomic.Uint64
+
+	// Workloads whose profiles were deleted from the store after their retention
+	ProfilesExpired atomic.Uint64
+
+	// Credentials found in the arguments of the processes executed
+	ArgSecretsDetected atomic.Uint64
+
+	// Items left out of the inventory because their category was full
+	InventoryItemsDropped atomic.Uint64
+
+	// Events dropped by the filter of the rules, and evaluations of the CEL expressions which failed
+	EventsFilteredOut atomic.Uint64
+	ExpressionErrors  atomic.Uint64
+
+	// Recent events dropped from memory because their container had too many, or because they were too old
+	RecentEventsEvicted atomic.Uint64
+	RecentEventsExpired atomic.Uint64
+
+	// Failed attempts to load a tracer, tracers which failed once loaded, and number of tracers currently not loaded
+	TracerLoadFailures    atomic.Uint64
+	TracerRuntimeFailures atomic.Uint64
+	TracersDegraded       atomic.Uint64
+
+	// Containers cleaned up because they vanished without a remove notification
+	StaleContainersCollected atomic.Uint64
+
+	// Container files rotated because of their size, and deleted after their retention
+	FilesRotated atomic.Uint64
+	FilesExpired atomic.Uint64
+
+	// Open events dropped by the path filters
+	OpenEventsFiltered atomic.Uint64
+
+	// Process spans not started because their container had too many running
+	OTelSpansDropped atomic.Uint64
+}
+
+var metrics = &Metrics{}
+
+// Upper bounds of the enqueue latency histogram buckets
+var enqueueLatencyBuckets = [...]time.Duration{
+	time.Microsecond, 5 * time.Microsecond, 10 * time.Microsecond, 50 * time.Microsecond,
+	100 * time.Microsecond, 500 * time.Microsecond, time.Millisecond, 10 * time.Millisecond,
+}
+
+// ObserveEnqueueLatency records the time a tracer callback spent handing an event over
+func (m *Metrics) ObserveEnqueueLatency(latency time.Duration) {
+	nanos := uint64(latency.Nanoseconds())
+	m.EnqueueLatencyNanos.Add(nanos)
+	bucket := len(enqueueLatencyBuckets)
+	for i, bound := range enqueueLatencyBuckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+	m.EnqueueLatencyBuckets[bucket].Add(1)
+	for {
+		current := m.EnqueueLatencyMaxNanos.Load()
+		if nanos <= current || m.EnqueueLatencyMaxNanos.CompareAndSwap(current, nanos) {
+			return
+		}
+	}
+}
+
+// Counters returns the current value of the counters by name
+func (m *Metrics) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"sink_write_errors":                m.SinkWriteErrors.Load(),
+		"sink_write_retries":               m.SinkWriteRetries.Load(),
+		"sink_events_dropped":              m.SinkEventsDropped.Load(),
+		"sink_batches_dropped":             m.SinkBatchesDropped.Load(),
+		"sink_events_spilled":              m.SinkEventsSpilled.Load(),
+		"sink_events_replayed":             m.SinkEventsReplayed.Load(),
+		"sink_events_backfilled":           m.SinkEventsBackfilled.Load(),
+		"events_exported":                  m.EventsExported.Load(),
+		"trace_session_events":             m.TraceSessionEvents.Load(),
+		"profiles_expired":                 m.ProfilesExpired.Load(),
+		"events_filtered_out":              m.EventsFilteredOut.Load(),
+		"arg_secrets_detected":             m.ArgSecretsDetected.Load(),
+		"inventory_items_dropped":          m.InventoryItemsDropped.Load(),
+		"otel_spans_dropped":               m.OTelSpansDropped.Load(),
+		"expression_errors":                m.ExpressionErrors.Load(),
+		"saved_queries_run":                m.SavedQueriesRun.Load(),
+		"containers_enriched_from_cgroups": m.ContainersEnrichedFromCgroups.Load(),
+		"events_dropped_fair_share":        m.EventsDroppedFairShare.Load(),
+		"events_over_quota":                m.EventsOverQuota.Load(),
+		"events_deduplicated":              m.EventsDeduplicated.Load(),
+		"events_sampled":                   m.EventsSampled.Load(),
+		"auto_tune_adjustments":            m.AutoTuneAdjustments.Load(),
+		"recent_events_evicted":            m.RecentEventsEvicted.Load(),
+		"recent_events_expired":            m.RecentEventsExpired.Load(),
+		"events_enqueued":                  m.EventsEnqueued.Load(),
+		"events_dropped":                   m.EventsDropped.Load(),
+		"truncated_events":                 m.TruncatedEvents.Load(),
+		"truncated_events_completed":       m.TruncatedEventsCompleted.Load(),
+		"stale_containers_collected":       m.StaleContainersCollected.Load(),
+		"startup_events_suppressed":        m.StartupEventsSuppressed.Load(),
+		"tracer_load_failures":             m.TracerLoadFailures.Load(),
+		"tracer_runtime_failures":          m.TracerRuntimeFailures.Load(),
+		"files_rotated":                    m.FilesRotated.Load(),
+		"files_expired":                    m.FilesExpired.Load(),
+		"open_events_filtered":             m.OpenEventsFiltered.Load(),
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	containercollection "github.com/inspektor-gadget/inspektor-gadget/pkg/container-collection"
+)
+
+// Modes of a workload, so detections can be rolled out quietly and promoted gradually
+const (
+	// Events are recorded, no profile is learned
+	modeObserve = "observe"
+	// Profiles are learned and detections are recorded in the container file only
+	modeLearn = "learn"
+	// Detections are also sent to the sinks
+	modeAlert = "alert"
+)
+
+// Pod label overriding the mode of a workload
+const modeLabel = "wlftracer.io/mode"
+
+// Mode of the workloads without the label
+var defaultMode string
+
+func validMode(mode string) bool {
+	return mode == modeObserve || mode == modeLearn || mode == modeAlert
+}
+
+// workloadMode returns the mode of the container, from the label of its Pod or the default one
+func workloadMode(container *containercollection.Container) string {
+	mode, ok := container.Labels[modeLabel]
+	if !ok {
+		return defaultMode
+	}
+	if !validMode(mode) {
+		log.Printf("Invalid %s label %q on %s/%s, using %s\n", modeLabel, mode, container.Namespace, container.Podname, defaultMode)
+		return defaultMode
+	}
+	return mode
+}
+
+// Learns returns true if the profiles of the container are learned
+func (s *ContainerState) Learns() bool {
+	return s.Mode != modeObserve
+}
+
+// Alerts returns true if the detections in the container are sent to the sinks
+func (s *ContainerState) Alerts() bool {
+	return s.Mode == modeAlert
+}
+
+// Name of the alerts raised for the syscalls outside of the learned profile
+const newSyscallRule = "new-syscall"
+
+// alertNewSyscall sends a syscall outside of the learned profile of the container to the sinks, and raises an alert
+func alertNewSyscall(state *ContainerState, timestamp time.Time, syscall string, process string) {
+	event := &Event{
+		Time:      timestamp,
+		Type:      "new-syscall",
+		Namespace: state.Key.Namespace,
+		Pod:       state.Key.Podname,
+		Container: state.Key.ContainerName,
+		Comm:      process,
+		Syscall:   syscall,
+	}
+	enrichEvent(state.Key, event)
+	alert := *event
+	alert.Type = "alert"
+	alert.Rule = newSyscallRule
+	alert.Severity = "warning"
+	alert.Message = fmt.Sprintf("syscall %s outside of the learned profile, process %s", syscall, process)
+	alert.AlertedType = event.Type
+	alert.ID = nextEventID()
+
+	// The event worker is the only caller of the sinks, so hand both over to it. The event is limited by the quota of
+	// the namespace like any other, the alert never is. The syscalls are persisted by the peek loop, the finalizer and
+	// the handoff, never by the worker itself.
+	if hasSinks() {
+		eventQueue.EnqueueAlert(queuedEvent{key: state.Key, timestamp: timestamp, event: event})
+	}
+	eventQueue.EnqueueAlert(queuedEvent{key: state.Key, timestamp: timestamp, event: &alert, alert: true})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// recordingSink keeps the events written to it
+type recordingSink struct {
+	events []*Event
+}
+
+func (s *recordingSink) Write(event *Event) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func TestAlertNewSyscallOverQuota(t *testing.T) {
+	quotas, err := NewNamespaceQuotas(0, "noisy=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for quotas.Allow("noisy", now) {
+	}
+	eventSink, alertSink := &recordingSink{}, &recordingSink{}
+	namespaceQuotas, sinks, alertSinks = quotas, []Sink{eventSink}, []Sink{alertSink}
+	eventQueue = NewEventQueue(1, false)
+	defer func() {
+		namespaceQuotas, sinks, alertSinks, eventQueue = nil, nil, nil, nil
+	}()
+
+	state := &ContainerState{Key: ContainerKey{"noisy", "web-1", "web"}, Mode: modeAlert}
+	alertNewSyscall(state, now, "ptrace", "/bin/sh(42)")
+	eventQueue.Drain()
+
+	if len(eventSink.events) != 0 {
+		t.Errorf("the new-syscall event of a namespace over its quota was sent: %+v", eventSink.events)
+	}
+	if len(alertSink.events) != 1 {
+		t.Fatalf("%d alerts sent, want 1", len(alertSink.events))
+	}
+	alert := alertSink.events[0]
+	if alert.Type != "alert" || alert.Rule != newSyscallRule || alert.Severity != "warning" || alert.AlertedType != "new-syscall" || alert.Syscall != "ptrace" {
+		t.Errorf("alert = %+v", alert)
+	}
+}
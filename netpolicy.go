@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+// Directory the advised NetworkPolicies are written to, empty if they are not written to files
+var networkPolicyDir string
+
+// Client writing the advised NetworkPolicies into a ConfigMap per workload, nil if they are not
+var networkPolicyConfigMapClient kubernetes.Interface
+
+// Resolves the peers of the TCP connections, nil if no NetworkPolicy is advised
+var peerResolver *PeerResolver
+
+// Maximum number of distinct network rules remembered per container
+const maxNetworkRules = 1024
+
+// NetworkPeer is the other end of a connection: Pods selected by their labels, or an IP block outside of the cluster
+type NetworkPeer struct {
+	Namespace string            `json:"namespace,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	CIDR      string            `json:"cidr,omitempty"`
+}
+
+// NetworkRule is a connection observed in a workload
+type NetworkRule struct {
+	// ingress for the accepted connections, egress for the initiated ones
+	Direction string      `json:"direction"`
+	Peer      NetworkPeer `json:"peer"`
+	// Port of the Pods accepting the connection, a number or a named port
+	Port string `json:"port"`
+}
+
+// key identifies the rule regardless of the order of the labels
+func (r NetworkRule) key() string {
+	labels := make([]string, 0, len(r.Peer.Labels))
+	for key, value := range r.Peer.Labels {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+	return strings.Join([]string{r.Direction, r.Peer.Namespace, strings.Join(labels, ","), r.Peer.CIDR, r.Port}, "|")
+}
+
+// PeerResolver resolves the IP addresses to the Pods and Services of the cluster, from informer caches
+type PeerResolver struct {
+	pods     cache.Indexer
+	services cache.Indexer
+}
+
+// NewPeerResolver starts the Pod and Service informers and waits for their caches to be synced
+func NewPeerResolver(client kubernetes.Interface, stop <-chan struct{}) (*PeerResolver, error) {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	podInformer := factory.Core().V1().Pods().Informer()
+	serviceInformer := factory.Core().V1().Services().Informer()
+
+	// Only what resolving needs is cached, the informers watch the whole cluster
+	err := podInformer.SetTransform(func(obj interface{}) (interface{}, error) {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			return obj, nil
+		}
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace, Labels: pod.Labels, ResourceVersion: pod.ResourceVersion},
+			Spec:       corev1.PodSpec{HostNetwork: pod.Spec.HostNetwork},
+			Status:     corev1.PodStatus{Phase: pod.Status.Phase, PodIPs: pod.Status.PodIPs},
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = podInformer.AddIndexers(cache.Indexers{"ip": func(obj interface{}) ([]string, error) {
+		pod := obj.(*corev1.Pod)
+		if pod.Spec.HostNetwork {
+			// The node addresses are shared by all the host network Pods
+			return nil, nil
+		}
+		ips := make([]string, 0, len(pod.Status.PodIPs))
+		for _, ip := range pod.Status.PodIPs {
+			ips = append(ips, ip.IP)
+		}
+		return ips, nil
+	}})
+	if err != nil {
+		return nil, err
+	}
+	err = serviceInformer.AddIndexers(cache.Indexers{"ip": func(obj interface{}) ([]string, error) {
+		return obj.(*corev1.Service).Spec.ClusterIPs, nil
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	factory.Start(stop)
+	for informerType, synced := range factory.WaitForCacheSync(stop) {
+		if !synced {
+			return nil, fmt.Errorf("syncing the %v cache", informerType)
+		}
+	}
+	return &PeerResolver{pods: podInformer.GetIndexer(), services: serviceInformer.GetIndexer()}, nil
+}
+
+// Resolve returns the peer of a connection to or from the IP address, and the port the NetworkPolicy allows. The
+// connections to a Service are allowed to the Pods it selects on its target port. ok is false for the peers which
+// can't be expressed in a NetworkPolicy, like loopback connections.
+func (r *PeerResolver) Resolve(address string, port uint16, egress bool) (peer NetworkPeer, allowedPort string, ok bool) {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return NetworkPeer{}, "", false
+	}
+	allowedPort = strconv.Itoa(int(port))
+
+	if egress {
+		services, _ := r.services.ByIndex("ip", ip.String())
+		for _, obj := range services {
+			service := obj.(*corev1.Service)
+			if len(service.Spec.Selector) == 0 {
+				// The endpoints of the Services without selector can't be selected
+				return NetworkPeer{}, "", false
+			}
+			for _, servicePort := range service.Spec.Ports {
+				if servicePort.Port != int32(port) {
+					continue
+				}
+				switch {
+				case servicePort.TargetPort.Type == intstr.String:
+					allowedPort = servicePort.TargetPort.StrVal
+				case servicePort.TargetPort.IntVal != 0:
+					allowedPort = strconv.Itoa(int(servicePort.TargetPort.IntVal))
+				}
+			}
+			return NetworkPeer{Namespace: service.Namespace, Labels: service.Spec.Selector}, allowedPort, true
+		}
+	}
+
+	pods, _ := r.pods.ByIndex("ip", ip.String())
+	for _, obj := range pods {
+		pod := obj.(*corev1.Pod)
+		// The addresses of the terminated Pods are reused
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		labels := make(map[string]string, len(pod.Labels))
+		for key, value := range pod.Labels {
+			if !instanceLabels[key] {
+				labels[key] = value
+			}
+		}
+		return NetworkPeer{Namespace: pod.Namespace, Labels: labels}, allowedPort, true
+	}
+
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	return NetworkPeer{CIDR: fmt.Sprintf("%s/%d", ip, bits)}, allowedPort, true
+}
+
+// recordNetworkRule adds the connection of a TCP event to the network rules of its container
+func recordNetworkRule(key ContainerKey, event *Event) {
+	var rule NetworkRule
+	var ok bool
+	switch event.Operation {
+	case "connect":
+		rule.Direction = "egress"
+		rule.Peer, rule.Port, ok = peerResolver.Resolve(event.Dst, event.Dport, true)
+	case "accept":
+		// The destination of an accepted connection is the client, the source port is the one listening
+		rule.Direction = "ingress"
+		rule.Peer, rule.Port, ok = peerResolver.Resolve(event.Dst, event.Sport, false)
+	}
+	if !ok {
+		return
+	}
+
+	state, found := containers.Get(key)
+	if !found {
+		return
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if len(state.behavior.network) < maxNetworkRules {
+		state.behavior.network[rule.key()] = rule
+	}
+}
+
+// persistNetworkPolicy merges the network rules of the container into the ones of its workload and writes the
+// NetworkPolicy advised for the workload once it was learned
+func persistNetworkPolicy(state *ContainerState) {
+	if peerResolver == nil || !state.Learns() {
+		return
+	}
+
+	state.lock.Lock()
+	rules := make([]NetworkRule, 0, len(state.behavior.network))
+	for _, rule := range state.behavior.network {
+		rules = append(rules, rule)
+	}
+	state.lock.Unlock()
+
+	network, err := store.MergeNetwork(state.Workload, state.Labels, rules)
+	if err != nil {
+		log.Printf("Error persisting network rules of %s: %v\n", state.Workload, err)
+		return
+	}
+	if time.Since(network.FirstSeen) < learningPeriod {
+		return
+	}
+
+	policy, err := advisedNetworkPolicy(network)
+	if err != nil {
+		log.Printf("Error advising NetworkPolicy of %s: %v\n", state.Workload, err)
+		return
+	}
+	data, err := yaml.Marshal(policy)
+	if err != nil {
+		log.Printf("Error encoding NetworkPolicy of %s: %v\n", state.Workload, err)
+		return
+	}
+	data = append([]byte(fmt.Sprintf("# Generated by wlftracer from the connections observed in %s, review before applying\n", state.Workload)), data...)
+	if networkPolicyDir != "" {
+		if err := writeIfChanged(filepath.Join(networkPolicyDir, storeFileName(state.Workload)+".yaml"), data); err != nil {
+			log.Printf("Error writing NetworkPolicy of %s: %v\n", state.Workload, err)
+		}
+	}
+	if networkPolicyConfigMapClient != nil {
+		if err := writeNetworkPolicyConfigMap(networkPolicyConfigMapClient, policy, data); err != nil {
+			log.Printf("Error writing NetworkPolicy ConfigMap of %s: %v\n", state.Workload, err)
+		}
+	}
+}
+
+// advisedNetworkPolicy returns the least privilege NetworkPolicy allowing the connections observed in the workload.
+// Both directions are restricted, the directions without any observed connection are denied. The DNS resolution the
+// TCP tracer doesn't see is allowed along with the egress connections.
+func advisedNetworkPolicy(network *WorkloadNetwork) (*networkingv1.NetworkPolicy, error) {
+	namespace, kind, name, container, ok := parseWorkloadKey(network.Workload)
+	if !ok {
+		return nil, fmt.Errorf("invalid workload key %q", network.Workload)
+	}
+	selector := make(map[string]string)
+	for key, value := range network.Labels {
+		if !instanceLabels[key] {
+			selector[key] = value
+		}
+	}
+
+	policy := &networkingv1.NetworkPolicy{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "NetworkPolicy"},
+		ObjectMeta: metav1.ObjectMeta{Name: resourceName("wlftracer", kind, name, container), Namespace: namespace},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: selector},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+		},
+	}
+
+	// One rule per port, with all its peers
+	ports := map[string][]NetworkRule{}
+	var keys []string
+	for _, rule := range network.Rules {
+		key := rule.Direction + "|" + rule.Port
+		if _, ok := ports[key]; !ok {
+			keys = append(keys, key)
+		}
+		ports[key] = append(ports[key], rule)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		rules := ports[key]
+		sort.Slice(rules, func(i, j int) bool { return rules[i].key() < rules[j].key() })
+		policyPorts := []networkingv1.NetworkPolicyPort{networkPolicyPort(corev1.ProtocolTCP, rules[0].Port)}
+		peers := make([]networkingv1.NetworkPolicyPeer, 0, len(rules))
+		for _, rule := range rules {
+			peers = append(peers, networkPolicyPeer(rule.Peer, namespace))
+		}
+		if rules[0].Direction == "ingress" {
+			policy.Spec.Ingress = append(policy.Spec.Ingress, networkingv1.NetworkPolicyIngressRule{Ports: policyPorts, From: peers})
+		} else {
+			policy.Spec.Egress = append(policy.Spec.Egress, networkingv1.NetworkPolicyEgressRule{Ports: policyPorts, To: peers})
+		}
+	}
+	if len(policy.Spec.Egress) > 0 {
+		policy.Spec.Egress = append(policy.Spec.Egress, networkingv1.NetworkPolicyEgressRule{
+			Ports: []networkingv1.NetworkPolicyPort{networkPolicyPort(corev1.ProtocolUDP, "53"), networkPolicyPort(corev1.ProtocolTCP, "53")},
+			To: []networkingv1.NetworkPolicyPeer{{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/metadata.name": "kube-system"}},
+				PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"k8s-app": "kube-dns"}},
+			}},
+		})
+	}
+	return policy, nil
+}
+
+func networkPolicyPort(protocol corev1.Protocol, port string) networkingv1.NetworkPolicyPort {
+	value := intstr.Parse(port)
+	return networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &value}
+}
+
+func networkPolicyPeer(peer NetworkPeer, namespace string) networkingv1.NetworkPolicyPeer {
+	if peer.CIDR != "" {
+		return networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: peer.CIDR}}
+	}
+	policyPeer := networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchLabels: peer.Labels}}
+	if peer.Namespace != namespace {
+		policyPeer.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/metadata.name": peer.Namespace}}
+	}
+	return policyPeer
+}
+
+// writeNetworkPolicyConfigMap writes the advised NetworkPolicy into a ConfigMap of the namespace of the workload
+func writeNetworkPolicyConfigMap(client kubernetes.Interface, policy *networkingv1.NetworkPolicy, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      policy.Name,
+			Namespace: policy.Namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "wlftracer", "wlftracer.io/advice": "networkpolicy"},
+		},
+		Data: map[string]string{"networkpolicy.yaml": string(data)},
+	}
+	configMaps := client.CoreV1().ConfigMaps(policy.Namespace)
+	existing, err := configMaps.Get(ctx, configMap.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Data["networkpolicy.yaml"] == configMap.Data["networkpolicy.yaml"] {
+		return nil
+	}
+	existing.Data = configMap.Data
+	_, err = configMaps.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// OpenFilter drops the open events of the noisy paths in the tracer callback, before they are queued. The tracer
+// reports every open of the traced containers, its BPF program has no path filter. Whether a system file was opened
+// read-only is only known from /proc, which is read by the event worker rather than the callback.
+type OpenFilter struct {
+	// Only the opens under these prefixes are recorded if any, the opens under the exclude prefixes never are
+	Include []string
+	Exclude []string
+	// Ignore the read-only opens under the system directories
+	IgnoreSystemReads bool
+}
+
+// Filter of the open events, nil to record them all
+var openFilter *OpenFilter
+
+// Directories holding the system binaries and libraries, whose reads are loader noise
+var systemPathPrefixes = []string{"/usr", "/lib", "/lib64", "/lib32"}
+
+// NewOpenFilter parses comma separated include and exclude path prefixes, nil if nothing is filtered
+func NewOpenFilter(include string, exclude string, ignoreSystemReads bool) (*OpenFilter, error) {
+	filter := &OpenFilter{IgnoreSystemReads: ignoreSystemReads}
+	var err error
+	if filter.Include, err = parsePathPrefixes(include); err != nil {
+		return nil, err
+	}
+	if filter.Exclude, err = parsePathPrefixes(exclude); err != nil {
+		return nil, err
+	}
+	if len(filter.Include) == 0 && len(filter.Exclude) == 0 && !ignoreSystemReads {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+func parsePathPrefixes(value string) ([]string, error) {
+	var prefixes []string
+	for _, prefix := range strings.Split(value, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("path prefix %q is not absolute", prefix)
+		}
+		if prefix != "/" {
+			prefix = strings.TrimSuffix(prefix, "/")
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// Allows returns whether the open of the path is recorded, as far as its path tells
+func (f *OpenFilter) Allows(path string) bool {
+	if len(f.Include) > 0 && !hasAnyPathPrefix(path, f.Include) {
+		return false
+	}
+	return !hasAnyPathPrefix(path, f.Exclude)
+}
+
+// ChecksReadOnly returns whether the open of the path is dropped if it was read-only
+func (f *OpenFilter) ChecksReadOnly(path string) bool {
+	return f.IgnoreSystemReads && hasAnyPathPrefix(path, systemPathPrefixes)
+}
+
+// DropsRead returns whether the open on the file descriptor of the process is dropped as a read, called from the event
+// worker. The descriptor may be closed by then, the libraries are mapped and closed right away, the unknown opens are
+// only kept when looking for drift, which modified system files are.
+func (f *OpenFilter) DropsRead(pid uint32, fd int) bool {
+	readOnly, known := fdReadOnly(pid, fd)
+	return readOnly || (!known && !detectDrift)
+}
+
+// hasAnyPathPrefix returns whether the path is one of the prefixes or under one of them
+func hasAnyPathPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if path == prefix || prefix == "/" || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// fdReadOnly returns whether the file descriptor of the process was opened read-only, known is false once it is closed
+func fdReadOnly(pid uint32, fd int) (readOnly bool, known bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/fdinfo/%d", pid, fd))
+	if err != nil {
+		return false, false
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if !bytes.HasPrefix(line, []byte("flags:")) {
+			continue
+		}
+		flags, err := strconv.ParseUint(string(bytes.TrimSpace(line[len("flags:"):])), 8, 32)
+		if err != nil {
+			return false, false
+		}
+		return flags&syscall.O_ACCMODE == syscall.O_RDONLY, true
+	}
+	return false, false
+}
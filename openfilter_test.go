@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePathPrefixes(t *testing.T) {
+	got, err := parsePathPrefixes("/app/, /data ,/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/app", "/data", "/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, err := parsePathPrefixes(" , "); err != nil || got != nil {
+		t.Errorf("blank list = %q, %v", got, err)
+	}
+	if _, err := parsePathPrefixes("/app,tmp"); err == nil {
+		t.Error("relative prefix accepted")
+	}
+}
+
+func TestOpenFilterAllows(t *testing.T) {
+	if filter, err := NewOpenFilter("", "", false); err != nil || filter != nil {
+		t.Fatalf("filter without prefixes = %v, %v, want none", filter, err)
+	}
+
+	filter, err := NewOpenFilter("/app,/etc", "/app/cache,/proc", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/app", "/app/config.yaml", "/etc/passwd", "/app/cache-config"} {
+		if !filter.Allows(path) {
+			t.Errorf("%s filtered", path)
+		}
+	}
+	for _, path := range []string{"/app/cache", "/app/cache/x", "/application/x", "/proc/self/status", "/var/log/x"} {
+		if filter.Allows(path) {
+			t.Errorf("%s allowed", path)
+		}
+	}
+
+	// The root is a prefix of every path
+	everything, err := NewOpenFilter("", "/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if everything.Allows("/etc/passwd") {
+		t.Error("excluding / let /etc/passwd through")
+	}
+}
+
+func TestOpenFilterChecksReadOnly(t *testing.T) {
+	filter, err := NewOpenFilter("", "", true)
+	if err != nil || filter == nil {
+		t.Fatalf("filter ignoring the system reads = %v, %v", filter, err)
+	}
+	for path, want := range map[string]bool{
+		"/usr/lib/libc.so.6":          true,
+		"/lib64/ld-linux-x86-64.so.2": true,
+		"/usr":                        true,
+		"/usrdata/x":                  false,
+		"/etc/passwd":                 false,
+	} {
+		if got := filter.ChecksReadOnly(path); got != want {
+			t.Errorf("ChecksReadOnly(%q) = %v, want %v", path, got, want)
+		}
+	}
+	if (&OpenFilter{}).ChecksReadOnly("/usr/lib/libc.so.6") {
+		t.Error("system reads checked without IgnoreSystemReads")
+	}
+}
+
+func TestFdReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	writer, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pid := uint32(os.Getpid())
+	if readOnly, known := fdReadOnly(pid, int(reader.Fd())); !readOnly || !known {
+		t.Errorf("read-only descriptor = %v, %v", readOnly, known)
+	}
+	fd := int(writer.Fd())
+	if readOnly, known := fdReadOnly(pid, fd); readOnly || !known {
+		t.Errorf("writable descriptor = %v, %v", readOnly, known)
+	}
+	writer.Close()
+	if _, known := fdReadOnly(pid, fd); known {
+		t.Error("closed descriptor known")
+	}
+}
@@ -0,0 +1,404 @@
+//go:build !no_otel_sink
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds of OTLP
+const (
+	otelSpanKindInternal = 1
+	otelSpanKindServer   = 2
+	otelSpanKindClient   = 3
+)
+
+// Maximum number of running process spans kept per container
+const maxOTelProcessSpans = 4096
+
+// otelSpan is a span of the trace of a container
+type otelSpan struct {
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+}
+
+// otelResource describes the container the spans come from
+type otelResource struct {
+	attributes map[string]interface{}
+}
+
+// otelContainerTrace is the trace of a container: a root span for the container run, with the processes as children
+type otelContainerTrace struct {
+	resource *otelResource
+	root     *otelSpan
+	// Running process spans by pid
+	processes map[uint32]*otelSpan
+}
+
+// otelEndedSpan is a span waiting to be exported, along with the resource it belongs to
+type otelEndedSpan struct {
+	resource *otelResource
+	span     *otelSpan
+}
+
+// otelSink models the exec chains of the containers and their network calls as traces, exported over OTLP/HTTP
+type otelSink struct {
+	endpoint string
+	codec    Codec
+	client   *http.Client
+	errors   sinkErrorTracker
+
+	lock   sync.Mutex
+	traces map[string]*otelContainerTrace
+	ended  []otelEndedSpan
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func init() {
+	var endpoint, compression *string
+	var flushInterval *time.Duration
+	registerSink(sinkRegistration{
+		name: "OTLP",
+		flags: func() {
+			endpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint to export the process chains to as traces (e.g. http://tempo:4318), disabled if empty")
+			flushInterval = flag.Duration("otlp-flush-interval", 5*time.Second, "Interval between two exports of the ended spans")
+			compression = flag.String("otlp-compression", "none", "Compression of the spans exported to the OTLP endpoint: none or gzip")
+		},
+		create: func() (Sink, error) {
+			if *endpoint == "" {
+				return nil, nil
+			}
+			if *flushInterval <= 0 {
+				return nil, fmt.Errorf("flush interval must be positive, got %s", *flushInterval)
+			}
+			codec, err := NewCodec(*compression, "gzip")
+			if err != nil {
+				return nil, err
+			}
+			return NewOTelSink(*endpoint, *flushInterval, codec), nil
+		},
+	})
+}
+
+// NewOTelSink creates a sink exporting the ended spans to the endpoint every interval, compressed with the codec unless
+// it is nil
+func NewOTelSink(endpoint string, interval time.Duration, codec Codec) Sink {
+	s := &otelSink{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		codec:    codec,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		errors:   sinkErrorTracker{name: "otlp"},
+		traces:   make(map[string]*otelContainerTrace),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.exportLoop(interval)
+	return s
+}
+
+func (s *otelSink) Write(event *Event) error {
+	// Events of unregistered containers can't be attached to a trace
+	if event.ContainerID == "" || (event.Type != "exec" && event.Type != "tcp") {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	trace := s.trace(event)
+	switch event.Type {
+	case "exec":
+		parent := trace.root
+		if previous, ok := trace.processes[event.Pid]; ok {
+			// The process replaced its image, the new one continues the chain
+			s.endSpan(trace, previous, event.Time)
+			delete(trace.processes, event.Pid)
+			parent = previous
+		} else if parentProcess, ok := trace.processes[event.Ppid]; ok {
+			parent = parentProcess
+		}
+		if len(trace.processes) >= maxOTelProcessSpans {
+			metrics.OTelSpansDropped.Add(1)
+			return nil
+		}
+		trace.processes[event.Pid] = newOTelSpan(parent, event.Path, otelSpanKindInternal, event.Time, map[string]interface{}{
+			"process.pid":             int64(event.Pid),
+			"process.parent_pid":      int64(event.Ppid),
+			"process.executable.path": event.Path,
+			"process.command_line":    strings.Join(append([]string{event.Path}, execArguments(event)...), " "),
+			"process.user.id":         int64(event.Uid),
+		})
+	case "tcp":
+		if event.Operation != "connect" && event.Operation != "accept" {
+			return nil
+		}
+		parent := trace.root
+		if process, ok := trace.processes[event.Pid]; ok {
+			parent = process
+		}
+		kind, peer, peerPort, local, localPort := otelSpanKindClient, event.Dst, event.Dport, event.Src, event.Sport
+		if event.Operation == "accept" {
+			kind = otelSpanKindServer
+		}
+		span := newOTelSpan(parent, fmt.Sprintf("%s %s:%d", event.Operation, peer, peerPort), kind, event.Time, map[string]interface{}{
+			"network.transport":     "tcp",
+			"network.peer.address":  peer,
+			"network.peer.port":     int64(peerPort),
+			"network.local.address": local,
+			"network.local.port":    int64(localPort),
+			"process.pid":           int64(event.Pid),
+		})
+		s.endSpan(trace, span, event.Time)
+	}
+	return nil
+}
+
+// trace returns the trace of the container of the event, starting it with the first event
+func (s *otelSink) trace(event *Event) *otelContainerTrace {
+	trace, ok := s.traces[event.ContainerID]
+	if ok {
+		return trace
+	}
+
+	serviceName := event.Pod
+	if _, _, name, _, ok := parseWorkloadKey(event.Workload); ok {
+		serviceName = name
+	}
+	trace = &otelContainerTrace{
+		resource: &otelResource{attributes: map[string]interface{}{
+			"service.name":         serviceName,
+			"k8s.node.name":        event.Node,
+			"k8s.namespace.name":   event.Namespace,
+			"k8s.pod.name":         event.Pod,
+			"k8s.container.name":   event.Container,
+			"container.id":         event.ContainerID,
+			"container.image.name": event.Image,
+		}},
+		root:      newOTelSpan(nil, "container "+event.Container, otelSpanKindInternal, event.Time, map[string]interface{}{"wlftracer.workload": event.Workload}),
+		processes: make(map[uint32]*otelSpan),
+	}
+	s.traces[event.ContainerID] = trace
+	return trace
+}
+
+// endSpan ends a span and queues it for export
+func (s *otelSink) endSpan(trace *otelContainerTrace, span *otelSpan, end time.Time) {
+	span.end = end
+	s.ended = append(s.ended, otelEndedSpan{resource: trace.resource, span: span})
+}
+
+// ContainerRemoved ends the spans of the container run and its processes still running
+func (s *otelSink) ContainerRemoved(state *ContainerState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	trace, ok := s.traces[state.ID]
+	if !ok {
+		return
+	}
+	now := clock.Now()
+	for _, process := range trace.processes {
+		s.endSpan(trace, process, now)
+	}
+	s.endSpan(trace, trace.root, now)
+	delete(s.traces, state.ID)
+}
+
+// otelProcessRef is a running process span of a container
+type otelProcessRef struct {
+	containerID string
+	pid         uint32
+	span        *otelSpan
+}
+
+// endExitedProcesses ends the spans of the processes which exited, or whose pid was reused by a process started after
+// them, as there is no exit event the spans end when the exit is noticed
+func (s *otelSink) endExitedProcesses() {
+	s.lock.Lock()
+	var running []otelProcessRef
+	for containerID, trace := range s.traces {
+		for pid, span := range trace.processes {
+			running = append(running, otelProcessRef{containerID: containerID, pid: pid, span: span})
+		}
+	}
+	s.lock.Unlock()
+
+	// /proc is read without holding the lock
+	var exited []otelProcessRef
+	for _, process := range running {
+		started, err := processStartTime(process.pid)
+		if err != nil || started.After(process.span.start) {
+			exited = append(exited, process)
+		}
+	}
+	if len(exited) == 0 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := clock.Now()
+	for _, process := range exited {
+		trace, ok := s.traces[process.containerID]
+		if !ok || trace.processes[process.pid] != process.span {
+			continue
+		}
+		s.endSpan(trace, process.span, now)
+		delete(trace.processes, process.pid)
+	}
+}
+
+// Close exports the spans still queued
+func (s *otelSink) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
+
+func (s *otelSink) exportLoop(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			s.export()
+			return
+		case <-ticker.C:
+			s.endExitedProcesses()
+			s.export()
+		}
+	}
+}
+
+// export sends the ended spans, grouped by container, to the collector
+func (s *otelSink) export() {
+	s.lock.Lock()
+	ended := s.ended
+	s.ended = nil
+	s.lock.Unlock()
+	if len(ended) == 0 {
+		return
+	}
+
+	// Group the spans by container
+	var resources []*otelResource
+	spans := make(map[*otelResource][]interface{})
+	for _, e := range ended {
+		if _, ok := spans[e.resource]; !ok {
+			resources = append(resources, e.resource)
+		}
+		spans[e.resource] = append(spans[e.resource], e.span.otlp())
+	}
+	resourceSpans := make([]interface{}, 0, len(resources))
+	for _, resource := range resources {
+		resourceSpans = append(resourceSpans, map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(resource.attributes)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "wlftracer"},
+				"spans": spans[resource],
+			}},
+		})
+	}
+
+	err := s.post(map[string]interface{}{"resourceSpans": resourceSpans})
+	if err != nil {
+		metrics.SinkBatchesDropped.Add(1)
+	}
+	if s.errors.Track(err) {
+		log.Printf("Error exporting %d spans: %v\n", len(ended), err)
+	}
+}
+
+func (s *otelSink) post(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encoding spans: %w", err)
+	}
+	req, err := newCompressedRequest(s.codec, s.endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("collector returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// newOTelSpan starts a span, as a child of parent or as the root span of a new trace
+func newOTelSpan(parent *otelSpan, name string, kind int, start time.Time, attributes map[string]interface{}) *otelSpan {
+	span := &otelSpan{spanID: randomHex(8), name: name, kind: kind, start: start, attributes: attributes}
+	if parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		span.traceID = randomHex(16)
+	}
+	return span
+}
+
+// otlp returns the span in the OTLP JSON encoding, where ids are hex strings and 64 bits integers are strings
+func (span *otelSpan) otlp() map[string]interface{} {
+	return map[string]interface{}{
+		"traceId":           span.traceID,
+		"spanId":            span.spanID,
+		"parentSpanId":      span.parentID,
+		"name":              span.name,
+		"kind":              span.kind,
+		"startTimeUnixNano": strconv.FormatInt(span.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(span.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(span.attributes),
+	}
+}
+
+// otlpAttributes encodes attributes as OTLP key values
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	values := make([]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		var encoded map[string]interface{}
+		switch v := value.(type) {
+		case int64:
+			encoded = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		default:
+			encoded = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		values = append(values, map[string]interface{}{"key": key, "value": encoded})
+	}
+	return values
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Error generating span id: %v\n", err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Maximum number of events kept for a single container which is not registered yet
+const maxPendingEventsPerContainer = 1024
+
+// pendingEvent is an event line waiting for its container to be registered
+type pendingEvent struct {
+	timestamp time.Time
+	line      string
+}
+
+// pendingEvents holds the events of a container received before the container was registered
+type pendingEvents struct {
+	since  time.Time
+	events []pendingEvent
+}
+
+// PendingBuffer keeps events that arrive before their container is registered, until the registration completes or they expire
+type PendingBuffer struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	pending map[ContainerKey]*pendingEvents
+}
+
+// NewPendingBuffer creates a buffer keeping events for at most ttl
+func NewPendingBuffer(ttl time.Duration) *PendingBuffer {
+	return &PendingBuffer{
+		ttl:     ttl,
+		pending: make(map[ContainerKey]*pendingEvents),
+	}
+}
+
+// Add buffers an event line of a container which is not registered yet
+func (b *PendingBuffer) Add(key ContainerKey, timestamp time.Time, line string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	events, ok := b.pending[key]
+	if !ok {
+		events = &pendingEvents{since: time.Now()}
+		b.pending[key] = events
+	}
+	if len(events.events) >= maxPendingEventsPerContainer {
+		// Keep the oldest events, they are the ones closest to the container start
+		return
+	}
+	events.events = append(events.events, pendingEvent{timestamp: timestamp, line: line})
+}
+
+// Take removes and returns the events buffered for the container
+func (b *PendingBuffer) Take(key ContainerKey) []pendingEvent {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	events, ok := b.pending[key]
+	if !ok {
+		return nil
+	}
+	delete(b.pending, key)
+	return events.events
+}
+
+// Expire drops the events of containers which didn't get registered within the ttl
+func (b *PendingBuffer) Expire() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for key, events := range b.pending {
+		if time.Since(events.since) > b.ttl {
+			log.Printf("Container not found: %s/%s/%s, dropping %d events\n", key.Namespace, key.Podname, key.ContainerName, len(events.events))
+			delete(b.pending, key)
+		}
+	}
+}
+
+// expireLoop periodically drops the expired events until stop is closed
+func (b *PendingBuffer) expireLoop(stop chan struct{}) {
+	ticker := time.NewTicker(b.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			b.Expire()
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time the event worker may go without finishing any queued event before the agent is reported not alive
+const workerStallTimeout = time.Minute
+
+// Interval between two checks that the Kubernetes API is reachable
+const kubernetesCheckInterval = 30 * time.Second
+
+// Set once the container collection is initialized, and once the tracers are being loaded
+var containerCollectionReady atomic.Bool
+var probedTracers atomic.Pointer[TracerManager]
+
+// kubernetesReachability is the result of the last check of the Kubernetes API
+type kubernetesReachability struct {
+	lock    sync.Mutex
+	checked bool
+	err     error
+}
+
+var kubernetesReachable = &kubernetesReachability{}
+
+func (k *kubernetesReachability) set(err error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if err != nil && (!k.checked || k.err == nil) {
+		log.Printf("Kubernetes API unreachable: %v\n", err)
+	} else if err == nil && k.checked && k.err != nil {
+		log.Printf("Kubernetes API reachable again\n")
+	}
+	k.checked = true
+	k.err = err
+}
+
+func (k *kubernetesReachability) get() (bool, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.checked, k.err
+}
+
+// kubernetesCheckLoop checks that the Kubernetes API is reachable on every tick until stop is closed
+func kubernetesCheckLoop(stop chan struct{}) {
+	ticker := time.NewTicker(kubernetesCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		kubernetesReachable.set(pingKubernetes())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pingKubernetes sends the cheapest request there is to the API server
+func pingKubernetes() error {
+	clientset, err := kubernetesClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return clientset.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+}
+
+// probeCheck is the outcome of one of the checks of a probe
+type probeCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// probeReport is the body of the probe responses
+type probeReport struct {
+	Status  string                  `json:"status"`
+	Checks  map[string]probeCheck   `json:"checks"`
+	Tracers map[string]TracerStatus `json:"tracers,omitempty"`
+	// Problems preventing tracers from running on the node, with their remediation
+	TracingProblems []TracingProblem `json:"tracingProblems,omitempty"`
+}
+
+// livenessReport tells whether the agent still processes its events, a stuck agent is restarted
+func livenessReport() probeReport {
+	report := probeReport{Checks: make(map[string]probeCheck)}
+	worker := probeCheck{OK: true}
+	if eventQueue != nil && eventQueue.Stalled(workerStallTimeout) {
+		worker = probeCheck{Detail: "no queued event processed for " + workerStallTimeout.String()}
+	}
+	report.Checks["event-worker"] = worker
+	if tracingSupport != nil {
+		report.TracingProblems = tracingSupport.Problems
+	}
+	return report
+}
+
+// readinessReport tells whether the agent traces the containers: the container collection is initialized, every
+// enabled tracer is loaded and the Kubernetes API is reachable
+func readinessReport() probeReport {
+	report := livenessReport()
+
+	collection := probeCheck{OK: containerCollectionReady.Load()}
+	if !collection.OK {
+		collection.Detail = "not initialized"
+	}
+	report.Checks["container-collection"] = collection
+
+	manager := probedTracers.Load()
+	tracers := probeCheck{OK: manager != nil}
+	if manager == nil {
+		tracers.Detail = "not loaded yet"
+	} else {
+		report.Tracers = manager.Status()
+		for name, tracer := range report.Tracers {
+			if !tracer.Loaded {
+				tracers = probeCheck{Detail: "tracer " + name + " not loaded"}
+			}
+		}
+	}
+	if metadataOnly {
+		tracers.Detail = "metadata-only mode, the node can't run the tracers"
+	} else if tracers.OK && tracingSupport != nil && len(tracingSupport.Disabled) > 0 {
+		tracers.Detail = "left out as the node can't run them: " + strings.Join(tracingSupport.Disabled, ", ")
+	}
+	report.Checks["tracers"] = tracers
+
+	checked, err := kubernetesReachable.get()
+	kubernetes := probeCheck{OK: checked && err == nil}
+	if !checked {
+		kubernetes.Detail = "not checked yet"
+	} else if err != nil {
+		kubernetes.Detail = err.Error()
+	}
+	report.Checks["kubernetes-api"] = kubernetes
+	return report
+}
+
+// startProbeServer serves the liveness probe on /healthz and the readiness probe on /readyz
+func startProbeServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbeReport(w, livenessReport())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbeReport(w, readinessReport())
+	})
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Probe server failed: %v\n", err)
+			health.SetDegraded("probes", err.Error())
+		}
+	}()
+	log.Printf("Probe server listening on %s\n", addr)
+}
+
+// writeProbeReport answers 200 if every check passed, 503 otherwise
+func writeProbeReport(w http.ResponseWriter, report probeReport) {
+	status := http.StatusOK
+	report.Status = "ok"
+	for _, check := range report.Checks {
+		if !check.OK {
+			status = http.StatusServiceUnavailable
+			report.Status = "failing"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
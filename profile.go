@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Whether the open, exec and tcp events are aggregated into a profile per container instead of being streamed to the container files
+var aggregateProfiles bool
+
+// Maximum number of files, binaries and endpoints in the profile of a container, the new ones are counted as dropped beyond
+const (
+	maxProfileOpens     = 16384
+	maxProfileExecs     = 4096
+	maxProfileEndpoints = 10000
+)
+
+// ProfileEntry is a deduplicated activity of a container
+type ProfileEntry struct {
+	Count     uint64    `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// ProfileOpen is a file opened in the container
+type ProfileOpen struct {
+	Path string `json:"path"`
+	ProfileEntry
+}
+
+// ProfileExec is a binary executed in the container with the arguments of its first execution
+type ProfileExec struct {
+	Path string   `json:"path"`
+	Args []string `json:"args,omitempty"`
+	ProfileEntry
+}
+
+// ProfileEndpoint is a TCP endpoint the container connected to or accepted connections on
+type ProfileEndpoint struct {
+	Operation string `json:"operation"`
+	Address   string `json:"address"`
+	Port      uint16 `json:"port"`
+	ProfileEntry
+}
+
+// ContainerProfile is the application profile of a container, the deduplicated form of its events
+type ContainerProfile struct {
+	Namespace   string            `json:"namespace"`
+	Pod         string            `json:"pod"`
+	Container   string            `json:"container"`
+	ContainerID string            `json:"containerID"`
+	Workload    string            `json:"workload"`
+	Image       string            `json:"image"`
+	Opens       []ProfileOpen     `json:"opens"`
+	Execs       []ProfileExec     `json:"execs"`
+	Endpoints   []ProfileEndpoint `json:"endpoints"`
+	Syscalls    []string          `json:"syscalls"`
+	// Files, binaries and endpoints left out of the profile once full
+	Dropped   uint64    `json:"dropped,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// profileAggregator deduplicates the events of a container
+type profileAggregator struct {
+	lock      sync.Mutex
+	opens     map[string]*ProfileOpen
+	execs     map[string]*ProfileExec
+	endpoints map[string]*ProfileEndpoint
+	dropped   uint64
+	// Activity last queued for the ApplicationActivityProfile of the Pod, to skip the unchanged ones
+	published []byte
+}
+
+func newProfileAggregator() *profileAggregator {
+	return &profileAggregator{
+		opens:     make(map[string]*ProfileOpen),
+		execs:     make(map[string]*ProfileExec),
+		endpoints: make(map[string]*ProfileEndpoint),
+	}
+}
+
+func (e *ProfileEntry) observe(t time.Time) {
+	if e.Count == 0 || t.Before(e.FirstSeen) {
+		e.FirstSeen = t
+	}
+	if t.After(e.LastSeen) {
+		e.LastSeen = t
+	}
+	e.Count++
+}
+
+// Add aggregates an event, it returns false if the event isn't part of the profile
+func (p *profileAggregator) Add(event *Event) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch event.Type {
+	case "open":
+		open, ok := p.opens[event.Path]
+		if !ok {
+			if len(p.opens) >= maxProfileOpens {
+				p.dropped++
+				return true
+			}
+			open = &ProfileOpen{Path: event.Path}
+			p.opens[event.Path] = open
+		}
+		open.observe(event.Time)
+	case "exec":
+		// Keyed by binary, the arguments of a shell loop or a cron job would grow the profile with every execution
+		exec, ok := p.execs[event.Path]
+		if !ok {
+			if len(p.execs) >= maxProfileExecs {
+				p.dropped++
+				return true
+			}
+			exec = &ProfileExec{Path: event.Path, Args: event.Args}
+			p.execs[event.Path] = exec
+		}
+		exec.observe(event.Time)
+	case "tcp":
+		// The remote end of the connection
+		address, port := event.Dst, event.Dport
+		if event.Operation == "accept" {
+			address, port = event.Src, event.Sport
+		}
+		key := profileEndpointKey(event.Operation, address, port)
+		endpoint, ok := p.endpoints[key]
+		if !ok {
+			if len(p.endpoints) >= maxProfileEndpoints {
+				p.dropped++
+				return true
+			}
+			endpoint = &ProfileEndpoint{Operation: event.Operation, Address: address, Port: port}
+			p.endpoints[key] = endpoint
+		}
+		endpoint.observe(event.Time)
+	default:
+		return false
+	}
+	return true
+}
+
+func profileEndpointKey(operation string, address string, port uint16) string {
+	return fmt.Sprintf("%s %s %d", operation, address, port)
+}
+
+// Profile returns the sorted profile aggregated so far
+func (p *profileAggregator) Profile(state *ContainerState, syscalls []string) *ContainerProfile {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	profile := &ContainerProfile{
+		Namespace:   state.Key.Namespace,
+		Pod:         state.Key.Podname,
+		Container:   state.Key.ContainerName,
+		ContainerID: state.ID,
+		Workload:    state.Workload,
+		Image:       state.Image,
+		Opens:       make([]ProfileOpen, 0, len(p.opens)),
+		Execs:       make([]ProfileExec, 0, len(p.execs)),
+		Endpoints:   make([]ProfileEndpoint, 0, len(p.endpoints)),
+		Syscalls:    syscalls,
+		Dropped:     p.dropped,
+		UpdatedAt:   time.Now(),
+	}
+	for _, open := range p.opens {
+		profile.Opens = append(profile.Opens, *open)
+	}
+	for _, exec := range p.execs {
+		profile.Execs = append(profile.Execs, *exec)
+	}
+	for _, endpoint := range p.endpoints {
+		profile.Endpoints = append(profile.Endpoints, *endpoint)
+	}
+	sort.Slice(profile.Opens, func(i, j int) bool { return profile.Opens[i].Path < profile.Opens[j].Path })
+	sort.Slice(profile.Execs, func(i, j int) bool { return profile.Execs[i].Path < profile.Execs[j].Path })
+	sort.Slice(profile.Endpoints, func(i, j int) bool {
+		a, b := profile.Endpoints[i], profile.Endpoints[j]
+		if a.Operation != b.Operation {
+			return a.Operation < b.Operation
+		}
+		if a.Address != b.Address {
+			return a.Address < b.Address
+		}
+		return a.Port < b.Port
+	})
+	return profile
+}
+
+// recordProfile aggregates the event into the profile of its container, it returns false if the event has to be streamed
+func recordProfile(key ContainerKey, event *Event) bool {
+	state, ok := containers.Get(key)
+	if !ok || state.profile == nil {
+		return false
+	}
+	return state.profile.Add(event)
+}
+
+// persistProfile writes the profile of the container next to its file, and into the ApplicationActivityProfile of its Pod
+func persistProfile(state *ContainerState, syscalls []string) {
+	if state.profile == nil {
+		return
+	}
+	if activityProfiles != nil {
+		activityProfiles.Update(state, syscalls)
+	}
+	if !aggregateProfiles {
+		return
+	}
+	data, err := json.MarshalIndent(state.profile.Profile(state, syscalls), "", "  ")
+	if err != nil {
+		log.Printf("Error encoding profile of %s: %v\n", state.File.Name(), err)
+		return
+	}
+	path := strings.TrimSuffix(state.File.Name(), ".log") + ".profile.json"
+	if err := writeIfChanged(path, append(data, '\n')); err != nil {
+		log.Printf("Error writing profile %s: %v\n", path, err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// Group, version and resource of the activity profiles, see dev/applicationactivityprofile-crd.yaml
+var activityProfileGroupVersion = schema.GroupVersion{Group: "wlftracer.io", Version: "v1alpha1"}
+
+const activityProfileResource = "applicationactivityprofiles"
+
+// Maximum number of files, execs and endpoints of a container in a profile, keeping it well below the size limit of
+// the resources
+const maxActivityProfileItems = 1000
+
+// How long a Pod whose profile was last written is remembered as having one
+const activityProfileCreatedTTL = time.Hour
+
+// ContainerActivity is the activity observed in a container of a Pod
+type ContainerActivity struct {
+	ContainerID string             `json:"containerID"`
+	Image       string             `json:"image,omitempty"`
+	Files       []string           `json:"files"`
+	Execs       []ActivityExec     `json:"execs"`
+	Endpoints   []ActivityEndpoint `json:"endpoints"`
+	Syscalls    []string           `json:"syscalls"`
+	// Set when the files, execs or endpoints were cut at maxActivityProfileItems
+	Truncated bool        `json:"truncated,omitempty"`
+	UpdatedAt metav1.Time `json:"updatedAt"`
+}
+
+// ActivityExec is a binary executed with its arguments
+type ActivityExec struct {
+	Path string   `json:"path"`
+	Args []string `json:"args,omitempty"`
+}
+
+// ActivityEndpoint is a TCP endpoint the container connected to or accepted connections on
+type ActivityEndpoint struct {
+	Operation string `json:"operation"`
+	Address   string `json:"address"`
+	Port      uint16 `json:"port"`
+}
+
+// ApplicationActivityProfileSpec holds the activity of the containers of a Pod by container name
+type ApplicationActivityProfileSpec struct {
+	Containers map[string]ContainerActivity `json:"containers"`
+}
+
+// ApplicationActivityProfile is the activity observed in a Pod, owned by the Pod so it is garbage collected with it
+type ApplicationActivityProfile struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              ApplicationActivityProfileSpec `json:"spec"`
+}
+
+// ActivityProfileClient is a typed client of the ApplicationActivityProfile resources
+type ActivityProfileClient struct {
+	client rest.Interface
+}
+
+// NewActivityProfileClient creates a client limited to qps requests per second
+func NewActivityProfileClient(config *rest.Config, qps float32) (*ActivityProfileClient, error) {
+	config = rest.CopyConfig(config)
+	config.GroupVersion = &activityProfileGroupVersion
+	config.APIPath = "/apis"
+	config.ContentType = "application/json"
+	config.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
+	config.RateLimiter = flowcontrol.NewTokenBucketRateLimiter(qps, int(qps)+1)
+	client, err := rest.RESTClientFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("creating REST client: %w", err)
+	}
+	return &ActivityProfileClient{client: client}, nil
+}
+
+// Create creates a profile
+func (c *ActivityProfileClient) Create(ctx context.Context, profile *ApplicationActivityProfile) error {
+	body, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	return c.client.Post().Namespace(profile.Namespace).Resource(activityProfileResource).Body(body).Do(ctx).Error()
+}
+
+// Patch merges the activity of containers into a profile
+func (c *ActivityProfileClient) Patch(ctx context.Context, namespace string, name string, containers map[string]ContainerActivity) error {
+	body, err := json.Marshal(map[string]interface{}{"spec": ApplicationActivityProfileSpec{Containers: containers}})
+	if err != nil {
+		return err
+	}
+	return c.client.Patch(types.MergePatchType).Namespace(namespace).Resource(activityProfileResource).Name(name).Body(body).Do(ctx).Error()
+}
+
+// podRef identifies a Pod and the owner reference its profile gets
+type podRef struct {
+	namespace string
+	name      string
+	uid       string
+}
+
+// ActivityProfileSyncer writes the activity of the containers into the profiles of their Pods in the background
+type ActivityProfileSyncer struct {
+	client *ActivityProfileClient
+	lock   sync.Mutex
+	// Activity not written yet, by Pod and container
+	pending map[podRef]map[string]ContainerActivity
+	// Pods whose profile is known to exist, with the time it was last written
+	created map[podRef]time.Time
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+var activityProfiles *ActivityProfileSyncer
+
+// NewActivityProfileSyncer starts writing the profiles with the client
+func NewActivityProfileSyncer(client *ActivityProfileClient) *ActivityProfileSyncer {
+	s := &ActivityProfileSyncer{
+		client:  client,
+		pending: make(map[podRef]map[string]ContainerActivity),
+		created: make(map[podRef]time.Time),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Update queues the current activity of a container, superseding the activity queued before
+func (s *ActivityProfileSyncer) Update(state *ContainerState, syscalls []string) {
+	if state.profile == nil || state.PodUID == "" {
+		return
+	}
+	profile := state.profile.Profile(state, syscalls)
+	opens, execs, endpoints := profile.Opens, profile.Execs, profile.Endpoints
+	truncated := false
+	if len(opens) > maxActivityProfileItems {
+		opens, truncated = opens[:maxActivityProfileItems], true
+	}
+	if len(execs) > maxActivityProfileItems {
+		execs, truncated = execs[:maxActivityProfileItems], true
+	}
+	if len(endpoints) > maxActivityProfileItems {
+		endpoints, truncated = endpoints[:maxActivityProfileItems], true
+	}
+	activity := ContainerActivity{
+		ContainerID: state.ID,
+		Image:       state.Image,
+		Files:       make([]string, 0, len(opens)),
+		Execs:       make([]ActivityExec, 0, len(execs)),
+		Endpoints:   make([]ActivityEndpoint, 0, len(endpoints)),
+		Syscalls:    syscalls,
+		Truncated:   truncated,
+	}
+	for _, open := range opens {
+		activity.Files = append(activity.Files, redactValue(open.Path))
+	}
+	for _, exec := range execs {
+		activity.Execs = append(activity.Execs, ActivityExec{Path: redactValue(exec.Path), Args: redactArgs(exec.Args)})
+	}
+	for _, endpoint := range endpoints {
+		activity.Endpoints = append(activity.Endpoints, ActivityEndpoint{Operation: endpoint.Operation, Address: endpoint.Address, Port: endpoint.Port})
+	}
+
+	if !state.profile.changed(activity) {
+		return
+	}
+	activity.UpdatedAt = metav1.NewTime(profile.UpdatedAt)
+
+	pod := podRef{namespace: state.Key.Namespace, name: state.Key.Podname, uid: state.PodUID}
+	s.lock.Lock()
+	if s.pending[pod] == nil {
+		s.pending[pod] = make(map[string]ContainerActivity)
+	}
+	s.pending[pod][state.Key.ContainerName] = activity
+	s.lock.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close writes the pending activity and stops the syncer
+func (s *ActivityProfileSyncer) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *ActivityProfileSyncer) run() {
+	defer close(s.done)
+
+	for {
+		select {
+		case <-s.wake:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *ActivityProfileSyncer) flush() {
+	s.lock.Lock()
+	pending := s.pending
+	s.pending = make(map[podRef]map[string]ContainerActivity)
+	s.lock.Unlock()
+
+	for pod, containers := range pending {
+		if err := s.write(pod, containers); err != nil {
+			log.Printf("Error writing activity profile of %s/%s: %v\n", pod.namespace, pod.name, err)
+		}
+	}
+	// Forget the Pods not written for a while, mostly gone, the others create their profile again on their next write
+	for pod, written := range s.created {
+		if time.Since(written) > activityProfileCreatedTTL {
+			delete(s.created, pod)
+		}
+	}
+}
+
+// write merges the activity into the profile of the Pod, creating it if needed
+func (s *ActivityProfileSyncer) write(pod podRef, containers map[string]ContainerActivity) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	name := resourceName(pod.name)
+	if _, ok := s.created[pod]; ok {
+		err := s.client.Patch(ctx, pod.namespace, name, containers)
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		// The profile was deleted, create it again
+		delete(s.created, pod)
+	}
+
+	controller := false
+	err := s.client.Create(ctx, &ApplicationActivityProfile{
+		TypeMeta: metav1.TypeMeta{APIVersion: activityProfileGroupVersion.String(), Kind: "ApplicationActivityProfile"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: pod.namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "wlftracer"},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Name:       pod.name,
+				UID:        types.UID(pod.uid),
+				Controller: &controller,
+			}},
+		},
+		Spec: ApplicationActivityProfileSpec{Containers: containers},
+	})
+	if errors.IsAlreadyExists(err) {
+		// Another container of the Pod, or a previous instance of the agent, created it
+		err = s.client.Patch(ctx, pod.namespace, name, containers)
+	}
+	if err != nil {
+		return err
+	}
+	s.created[pod] = time.Now()
+	return nil
+}
+
+// changed returns true if the activity differs from the one last published, and records it as published
+func (p *profileAggregator) changed(activity ContainerActivity) bool {
+	data, err := json.Marshal(activity)
+	if err != nil {
+		return true
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if bytes.Equal(data, p.published) {
+		return false
+	}
+	p.published = data
+	return true
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// activityKey identifies the events of one type of a container
+type activityKey struct {
+	container ContainerKey
+	eventType string
+}
+
+// alertKey identifies the alerts of one rule in a namespace
+type alertKey struct {
+	namespace string
+	rule      string
+	severity  string
+}
+
+// activityCounter is the count of a series along with its exemplar
+type activityCounter struct {
+	count    uint64
+	exemplar exemplar
+}
+
+// ActivityMetrics counts the events of the traced containers, by container and type, and the alerts
+type ActivityMetrics struct {
+	lock   sync.Mutex
+	events map[activityKey]*activityCounter
+	alerts map[alertKey]*activityCounter
+}
+
+var activityMetrics = &ActivityMetrics{events: make(map[activityKey]*activityCounter), alerts: make(map[alertKey]*activityCounter)}
+
+// Observe counts an event of a container
+func (a *ActivityMetrics) Observe(key ContainerKey, event *Event) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	activity := activityKey{key, event.Type}
+	counter, ok := a.events[activity]
+	if !ok {
+		counter = &activityCounter{}
+		a.events[activity] = counter
+	}
+	counter.observe(event)
+}
+
+// ObserveAlert counts an alert
+func (a *ActivityMetrics) ObserveAlert(alert *Event) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := alertKey{alert.Namespace, alert.Rule, alert.Severity}
+	counter, ok := a.alerts[key]
+	if !ok {
+		counter = &activityCounter{}
+		a.alerts[key] = counter
+	}
+	counter.observe(alert)
+}
+
+// observe counts the event, and makes it the exemplar of the series unless the exemplar is recent
+func (c *activityCounter) observe(event *Event) {
+	c.count++
+	if event.ID == "" || time.Since(c.exemplar.timestamp) < exemplarInterval {
+		return
+	}
+	exemplarEvents.Replace(c.exemplar.id, event)
+	c.exemplar = exemplar{id: event.ID, timestamp: time.Now()}
+}
+
+// Counts returns the number of events of each type of the container so far
+func (a *ActivityMetrics) Counts(key ContainerKey) map[string]uint64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	counts := make(map[string]uint64)
+	for activity, counter := range a.events {
+		if activity.container == key {
+			counts[activity.eventType] = counter.count
+		}
+	}
+	return counts
+}
+
+// ContainerRemoved drops the series of a removed container, so they don't pile up
+func (a *ActivityMetrics) ContainerRemoved(key ContainerKey) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for activity, counter := range a.events {
+		if activity.container == key {
+			if counter.exemplar.id != "" {
+				exemplarEvents.Retire(counter.exemplar.id)
+			}
+			delete(a.events, activity)
+		}
+	}
+}
+
+// startMetricsServer serves the Prometheus metrics on addr
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics server failed: %v\n", err)
+			health.SetDegraded("metrics", err.Error())
+		}
+	}()
+	log.Printf("Metrics server listening on %s\n", addr)
+}
+
+// openMetricsWriter writes the metrics in the OpenMetrics format, which has the exemplars
+type openMetricsWriter struct {
+	io.Writer
+}
+
+// metricsHandler writes the metrics in the Prometheus text exposition format, or in the OpenMetrics format with the
+// exemplars of the event and alert counters when the scraper accepts it
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	var out io.Writer = w
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		out = openMetricsWriter{w}
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	writeMetrics(out, openMetrics)
+	if openMetrics {
+		fmt.Fprintf(w, "# EOF\n")
+	}
+}
+
+func writeMetrics(w io.Writer, openMetrics bool) {
+	// Activity of the traced containers, and the alerts
+	activityMetrics.lock.Lock()
+	activities := make([]activityKey, 0, len(activityMetrics.events))
+	counts := make(map[activityKey]activityCounter, len(activityMetrics.events))
+	for activity, counter := range activityMetrics.events {
+		activities = append(activities, activity)
+		counts[activity] = *counter
+	}
+	alerts := make([]alertKey, 0, len(activityMetrics.alerts))
+	alertCounts := make(map[alertKey]activityCounter, len(activityMetrics.alerts))
+	for alert, counter := range activityMetrics.alerts {
+		alerts = append(alerts, alert)
+		alertCounts[alert] = *counter
+	}
+	activityMetrics.lock.Unlock()
+	sort.Slice(activities, func(i, j int) bool {
+		a, b := activities[i], activities[j]
+		if a.container != b.container {
+			if a.container.Namespace != b.container.Namespace {
+				return a.container.Namespace < b.container.Namespace
+			}
+			if a.container.Podname != b.container.Podname {
+				return a.container.Podname < b.container.Podname
+			}
+			return a.container.ContainerName < b.container.ContainerName
+		}
+		return a.eventType < b.eventType
+	})
+	writeMetricHeader(w, "wlftracer_container_events_total", "counter", "Events traced in the containers, by type")
+	for _, activity := range activities {
+		counter := counts[activity]
+		fmt.Fprintf(w, "wlftracer_container_events_total{namespace=%s,pod=%s,container=%s,type=%s} %d%s\n",
+			labelValue(activity.container.Namespace), labelValue(activity.container.Podname), labelValue(activity.container.ContainerName),
+			labelValue(activity.eventType), counter.count, exemplarOf(counter, openMetrics))
+	}
+
+	sort.Slice(alerts, func(i, j int) bool {
+		a, b := alerts[i], alerts[j]
+		if a.namespace != b.namespace {
+			return a.namespace < b.namespace
+		}
+		if a.rule != b.rule {
+			return a.rule < b.rule
+		}
+		return a.severity < b.severity
+	})
+	writeMetricHeader(w, "wlftracer_alerts_total", "counter", "Alerts raised by the rules, by namespace")
+	for _, alert := range alerts {
+		counter := alertCounts[alert]
+		fmt.Fprintf(w, "wlftracer_alerts_total{namespace=%s,rule=%s,severity=%s} %d%s\n",
+			labelValue(alert.namespace), labelValue(alert.rule), labelValue(alert.severity), counter.count, exemplarOf(counter, openMetrics))
+	}
+
+	if namespaceQuotas != nil {
+		namespaceQuotas.writeMetrics(w)
+	}
+
+	if riskScores != nil {
+		riskScores.writeMetrics(w)
+	}
+
+	if names, counts := savedQueryCounts(); len(names) > 0 {
+		writeMetricHeader(w, "wlftracer_saved_query_events", "gauge", "Events counted by the last run of the saved queries")
+		for _, name := range names {
+			fmt.Fprintf(w, "wlftracer_saved_query_events{query=%s} %d\n", labelValue(name), counts[name])
+		}
+	}
+
+	if recentEvents != nil {
+		writeMetricHeader(w, "wlftracer_recent_events", "gauge", "Recent events kept in memory")
+		fmt.Fprintf(w, "wlftracer_recent_events %d\n", recentEvents.Len())
+	}
+
+	traced := containers.Len()
+	writeMetricHeader(w, "wlftracer_traced_containers", "gauge", "Containers currently traced")
+	fmt.Fprintf(w, "wlftracer_traced_containers %d\n", traced)
+
+	// Health of the monitor itself
+	counters := metrics.Counters()
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeMetricHeader(w, "wlftracer_"+name+"_total", "counter", strings.ReplaceAll(name, "_", " "))
+		fmt.Fprintf(w, "wlftracer_%s_total %d\n", name, counters[name])
+	}
+
+	writeMetricHeader(w, "wlftracer_enqueue_latency_seconds", "histogram", "Time the tracer callbacks spent handing the events over")
+	cumulative := uint64(0)
+	for i, bound := range enqueueLatencyBuckets {
+		cumulative += metrics.EnqueueLatencyBuckets[i].Load()
+		fmt.Fprintf(w, "wlftracer_enqueue_latency_seconds_bucket{le=\"%g\"} %d\n", bound.Seconds(), cumulative)
+	}
+	cumulative += metrics.EnqueueLatencyBuckets[len(enqueueLatencyBuckets)].Load()
+	fmt.Fprintf(w, "wlftracer_enqueue_latency_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(w, "wlftracer_enqueue_latency_seconds_sum %g\n", float64(metrics.EnqueueLatencyNanos.Load())/1e9)
+	fmt.Fprintf(w, "wlftracer_enqueue_latency_seconds_count %d\n", cumulative)
+
+	writeMetricHeader(w, "wlftracer_event_queue_length", "gauge", "Events waiting to be processed")
+	fmt.Fprintf(w, "wlftracer_event_queue_length %d\n", eventQueue.Len())
+
+	if tracingSupport != nil {
+		supported := 0
+		if tracingSupport.Supported {
+			supported = 1
+		}
+		writeMetricHeader(w, "wlftracer_tracing_supported", "gauge", "Whether the node can run all the eBPF tracers, see /api/v1/diagnostics/node otherwise")
+		fmt.Fprintf(w, "wlftracer_tracing_supported{kernel=%s} %d\n", labelValue(tracingSupport.Kernel), supported)
+	}
+
+	writeMetricHeader(w, "wlftracer_tracers_degraded", "gauge", "Tracers which couldn't be loaded")
+	fmt.Fprintf(w, "wlftracer_tracers_degraded %d\n", metrics.TracersDegraded.Load())
+
+	degraded := health.Degraded()
+	components := make([]string, 0, len(degraded))
+	for component := range degraded {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	writeMetricHeader(w, "wlftracer_component_degraded", "gauge", "Components of the monitor currently degraded")
+	for _, component := range components {
+		fmt.Fprintf(w, "wlftracer_component_degraded{component=%s} 1\n", labelValue(component))
+	}
+
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		writeMetricHeader(w, "process_open_fds", "gauge", "Number of open file descriptors")
+		fmt.Fprintf(w, "process_open_fds %d\n", len(entries))
+	}
+}
+
+// exemplarOf returns the exemplar of a counter sample, only the OpenMetrics format has them
+func exemplarOf(counter activityCounter, openMetrics bool) string {
+	if !openMetrics {
+		return ""
+	}
+	return counter.exemplar.format()
+}
+
+func writeMetricHeader(w io.Writer, name string, metricType string, help string) {
+	// The OpenMetrics counters are named without the suffix of their samples
+	if _, ok := w.(openMetricsWriter); ok && metricType == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// labelValue quotes and escapes a label value
+func labelValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
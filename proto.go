@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Encoding of the events sent to --sink: json, protobuf (see proto/event.proto) or avro
+var eventEncoding = "json"
+
+// encodeEventRecord encodes an event as a record of a stream in the encoding: a JSON line, or a protobuf message or
+// Avro record prefixed with its size
+func encodeEventRecord(encoding string, event *Event) ([]byte, error) {
+	switch encoding {
+	case "protobuf":
+		message := marshalEventProto(nil, event)
+		return append(protowire.AppendVarint(nil, uint64(len(message))), message...), nil
+	case "avro":
+		record := marshalEventAvro(event)
+		return append(protowire.AppendVarint(nil, uint64(len(record))), record...), nil
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("encoding event: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// marshalEventBatchProto encodes the events as an EventBatch message
+func marshalEventBatchProto(events []*Event) []byte {
+	var b []byte
+	for _, event := range events {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalEventProto(nil, event))
+	}
+	return b
+}
+
+// marshalEventProto appends the Event message of proto/event.proto to b, the fields with their zero value are omitted
+func marshalEventProto(b []byte, e *Event) []byte {
+	if !e.Time.IsZero() {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(e.Time.UnixNano()))
+	}
+	b = appendProtoString(b, 2, e.Type)
+	b = appendProtoString(b, 3, e.Node)
+	b = appendProtoString(b, 4, e.Namespace)
+	b = appendProtoString(b, 5, e.Pod)
+	b = appendProtoString(b, 6, e.Container)
+	b = appendProtoString(b, 7, e.ContainerID)
+	b = appendProtoString(b, 8, e.Workload)
+	b = appendProtoString(b, 9, e.Image)
+	b = appendProtoUint(b, 10, uint64(e.Pid))
+	b = appendProtoUint(b, 11, uint64(e.Ppid))
+	b = appendProtoUint(b, 12, uint64(e.Uid))
+	b = appendProtoString(b, 13, e.Comm)
+	b = appendProtoString(b, 14, e.Path)
+	for _, arg := range e.Args {
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendString(b, arg)
+	}
+	b = appendProtoString(b, 16, e.User)
+	b = appendProtoString(b, 17, e.AuditID)
+	b = appendProtoString(b, 18, e.Errno)
+	b = appendProtoString(b, 19, e.Operation)
+	b = appendProtoString(b, 20, e.Src)
+	b = appendProtoString(b, 21, e.Dst)
+	b = appendProtoUint(b, 22, uint64(e.Sport))
+	b = appendProtoUint(b, 23, uint64(e.Dport))
+	b = appendProtoString(b, 24, e.DNSName)
+	b = appendProtoString(b, 25, e.QueryType)
+	b = appendProtoString(b, 26, e.Rcode)
+	for _, address := range e.Addresses {
+		b = protowire.AppendTag(b, 27, protowire.BytesType)
+		b = protowire.AppendString(b, address)
+	}
+	b = appendProtoString(b, 28, e.Nameserver)
+	b = appendProtoString(b, 29, e.Capability)
+	b = appendProtoString(b, 30, e.Verdict)
+	b = appendProtoString(b, 31, e.Drift)
+	b = appendProtoString(b, 32, e.Syscall)
+	b = appendProtoString(b, 33, e.Category)
+	b = appendProtoString(b, 34, e.Value)
+	b = appendProtoString(b, 35, e.Rule)
+	b = appendProtoString(b, 36, e.Severity)
+	b = appendProtoString(b, 37, e.Message)
+	b = appendProtoString(b, 38, e.AlertedType)
+	b = appendProtoBool(b, 39, e.Truncated)
+	b = appendProtoBool(b, 40, e.Startup)
+	b = appendProtoUint(b, 41, uint64(e.Gid))
+	b = appendProtoString(b, 42, e.ImageDigest)
+	for _, ancestor := range e.Lineage {
+		var m []byte
+		m = appendProtoUint(m, 1, uint64(ancestor.Pid))
+		m = appendProtoString(m, 2, ancestor.Comm)
+		m = appendProtoString(m, 3, ancestor.Path)
+		b = protowire.AppendTag(b, 43, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	b = appendProtoUint(b, 44, e.Checkpoint)
+	// Map entries are messages of a key and a value, in no particular order
+	for name, count := range e.Counters {
+		var m []byte
+		m = appendProtoString(m, 1, name)
+		m = appendProtoUint(m, 2, count)
+		b = protowire.AppendTag(b, 45, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	b = appendProtoString(b, 46, e.ID)
+	return b
+}
+
+func appendProtoString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendProtoUint(b []byte, num protowire.Number, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, value)
+}
+
+func appendProtoBool(b []byte, num protowire.Number, value bool) []byte {
+	if !value {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+// unmarshalEventProto decodes an Event message, the unknown fields written by newer agents are skipped
+func unmarshalEventProto(b []byte) (*Event, error) {
+	e := &Event{}
+	strings := eventProtoStrings(e)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("decoding event: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var value uint64
+		var bytes []byte
+		switch typ {
+		case protowire.VarintType:
+			value, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("decoding field %d of event: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if field, ok := strings[num]; ok && typ == protowire.BytesType {
+			*field = string(bytes)
+			continue
+		}
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			e.Time = time.Unix(0, int64(value))
+		case num == 10 && typ == protowire.VarintType:
+			e.Pid = uint32(value)
+		case num == 11 && typ == protowire.VarintType:
+			e.Ppid = uint32(value)
+		case num == 12 && typ == protowire.VarintType:
+			e.Uid = uint32(value)
+		case num == 15 && typ == protowire.BytesType:
+			e.Args = append(e.Args, string(bytes))
+		case num == 22 && typ == protowire.VarintType:
+			e.Sport = uint16(value)
+		case num == 23 && typ == protowire.VarintType:
+			e.Dport = uint16(value)
+		case num == 27 && typ == protowire.BytesType:
+			e.Addresses = append(e.Addresses, string(bytes))
+		case num == 39 && typ == protowire.VarintType:
+			e.Truncated = value != 0
+		case num == 40 && typ == protowire.VarintType:
+			e.Startup = value != 0
+		case num == 41 && typ == protowire.VarintType:
+			e.Gid = uint32(value)
+		case num == 43 && typ == protowire.BytesType:
+			ancestor, err := unmarshalProcessAncestorProto(bytes)
+			if err != nil {
+				return nil, err
+			}
+			e.Lineage = append(e.Lineage, ancestor)
+		case num == 44 && typ == protowire.VarintType:
+			e.Checkpoint = value
+		case num == 45 && typ == protowire.BytesType:
+			name, count, err := unmarshalCounterProto(bytes)
+			if err != nil {
+				return nil, err
+			}
+			if e.Counters == nil {
+				e.Counters = make(map[string]uint64)
+			}
+			e.Counters[name] = count
+		}
+	}
+	return e, nil
+}
+
+// unmarshalProcessAncestorProto decodes a ProcessAncestor message
+func unmarshalProcessAncestorProto(b []byte) (ProcessAncestor, error) {
+	var ancestor ProcessAncestor
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ancestor, fmt.Errorf("decoding process ancestor: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			var value uint64
+			value, n = protowire.ConsumeVarint(b)
+			ancestor.Pid = uint32(value)
+		case num == 2 && typ == protowire.BytesType:
+			ancestor.Comm, n = protowire.ConsumeString(b)
+		case num == 3 && typ == protowire.BytesType:
+			ancestor.Path, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return ancestor, fmt.Errorf("decoding field %d of process ancestor: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return ancestor, nil
+}
+
+// unmarshalCounterProto decodes an entry of the counters map
+func unmarshalCounterProto(b []byte) (string, uint64, error) {
+	var name string
+	var count uint64
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", 0, fmt.Errorf("decoding counter: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			name, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.VarintType:
+			count, n = protowire.ConsumeVarint(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return "", 0, fmt.Errorf("decoding field %d of counter: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return name, count, nil
+}
+
+// eventProtoStrings returns the string fields of the event by field number
+func eventProtoStrings(e *Event) map[protowire.Number]*string {
+	return map[protowire.Number]*string{
+		2: &e.Type, 3: &e.Node, 4: &e.Namespace, 5: &e.Pod, 6: &e.Container, 7: &e.ContainerID, 8: &e.Workload,
+		9: &e.Image, 13: &e.Comm, 14: &e.Path, 16: &e.User, 17: &e.AuditID, 18: &e.Errno, 19: &e.Operation,
+		20: &e.Src, 21: &e.Dst, 24: &e.DNSName, 25: &e.QueryType, 26: &e.Rcode, 28: &e.Nameserver,
+		29: &e.Capability, 30: &e.Verdict, 31: &e.Drift, 32: &e.Syscall, 33: &e.Category, 34: &e.Value,
+		35: &e.Rule, 36: &e.Severity, 37: &e.Message, 38: &e.AlertedType, 42: &e.ImageDigest, 46: &e.ID,
+	}
+}
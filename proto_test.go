@@ -0,0 +1,228 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoField is a field of a message of proto/event.proto
+type protoField struct {
+	name     string
+	typ      string
+	number   protowire.Number
+	repeated bool
+}
+
+var protoFieldPattern = regexp.MustCompile(`^\s*(repeated\s+)?(map<[^>]+>|\w+)\s+(\w+)\s*=\s*(\d+);`)
+
+// readEventProto returns the fields of the messages of proto/event.proto by message name
+func readEventProto(t *testing.T) map[string][]protoField {
+	t.Helper()
+	data, err := os.ReadFile("proto/event.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(map[string][]protoField)
+	message := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "message ") {
+			message = strings.Fields(line)[1]
+			continue
+		}
+		if match := protoFieldPattern.FindStringSubmatch(line); match != nil && message != "" {
+			number, _ := strconv.Atoi(match[4])
+			messages[message] = append(messages[message], protoField{name: match[3], typ: match[2], number: protowire.Number(number), repeated: match[1] != ""})
+		}
+	}
+	return messages
+}
+
+// testFullEvent returns an event with all its fields set
+func testFullEvent() *Event {
+	return &Event{
+		Time:        time.Unix(0, 1714564800123456789),
+		Type:        "exec",
+		Node:        "node-1",
+		Namespace:   "default",
+		Pod:         "web-1",
+		Container:   "web",
+		ContainerID: "abc",
+		Workload:    "deployment/web",
+		Image:       "nginx:1.25",
+		ImageDigest: "sha256:0123",
+		Pid:         42,
+		Ppid:        1,
+		Uid:         1000,
+		Gid:         1001,
+		Comm:        "sh",
+		Lineage:     []ProcessAncestor{{Pid: 1, Comm: "init", Path: "/sbin/init"}, {Pid: 7, Comm: "bash"}},
+		Path:        "/bin/sh",
+		Args:        []string{"sh", "-c", "id"},
+		User:        "alice",
+		AuditID:     "audit-1",
+		Errno:       "ENOENT",
+		Operation:   "connect",
+		Src:         "10.0.0.1",
+		Dst:         "10.0.0.2",
+		Sport:       40000,
+		Dport:       443,
+		DNSName:     "example.com",
+		QueryType:   "A",
+		Rcode:       "NoError",
+		Addresses:   []string{"93.184.216.34", "2606:2800::1"},
+		Nameserver:  "10.96.0.10",
+		Capability:  "NET_ADMIN",
+		Verdict:     "Deny",
+		Drift:       "created",
+		Syscall:     "ptrace",
+		Category:    "exec",
+		Value:       "/bin/sh",
+		Rule:        "shell",
+		Severity:    "warning",
+		Message:     "shell executed",
+		AlertedType: "exec",
+		Truncated:   true,
+		Startup:     true,
+		Checkpoint:  3,
+		Counters:    map[string]uint64{"exec": 2, "open": 5},
+		ID:          "event-1",
+	}
+}
+
+func TestFullEventSetsEveryField(t *testing.T) {
+	value := reflect.ValueOf(testFullEvent()).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if value.Field(i).IsZero() {
+			t.Errorf("testFullEvent() doesn't set %s, add it to the encodings and to the test", value.Type().Field(i).Name)
+		}
+	}
+}
+
+// normalizeFieldName lowercases a field name without underscores, so the JSON and proto names compare
+func normalizeFieldName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+func TestEventProtoSchema(t *testing.T) {
+	fields := readEventProto(t)["Event"]
+	if len(fields) == 0 {
+		t.Fatal("no Event message in proto/event.proto")
+	}
+	// Every field of the JSON form of the events is in the schema
+	byName := make(map[string]protoField)
+	for _, field := range fields {
+		byName[normalizeFieldName(field.name)] = field
+	}
+	byName["time"] = byName["timeunixnano"]
+	for _, field := range celEventFields {
+		if _, ok := byName[normalizeFieldName(field.name)]; !ok {
+			t.Errorf("field %s of the events is missing from proto/event.proto", field.name)
+		}
+	}
+
+	// Every field of the schema is encoded, with its wire type
+	message := marshalEventProto(nil, testFullEvent())
+	encoded := make(map[protowire.Number]int)
+	for b := message; len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		encoded[num]++
+		for _, field := range fields {
+			if field.number != num {
+				continue
+			}
+			want := protowire.BytesType
+			switch field.typ {
+			case "int64", "uint64", "uint32", "int32", "bool":
+				want = protowire.VarintType
+			}
+			if typ != want {
+				t.Errorf("field %s (%d) encoded with wire type %d, want %d", field.name, num, typ, want)
+			}
+		}
+	}
+	for _, field := range fields {
+		count := encoded[field.number]
+		if count == 0 {
+			t.Errorf("field %s (%d) of proto/event.proto isn't encoded", field.name, field.number)
+		}
+		if count > 1 && !field.repeated && !strings.HasPrefix(field.typ, "map<") {
+			t.Errorf("field %s (%d) encoded %d times, it isn't repeated", field.name, field.number, count)
+		}
+		delete(encoded, field.number)
+	}
+	for num := range encoded {
+		t.Errorf("field %d encoded but missing from proto/event.proto", num)
+	}
+
+	ancestor := readEventProto(t)["ProcessAncestor"]
+	if len(ancestor) != 3 || ancestor[0].number != 1 || ancestor[1].number != 2 || ancestor[2].number != 3 {
+		t.Errorf("ProcessAncestor fields = %v, want pid = 1, comm = 2, path = 3", ancestor)
+	}
+}
+
+func TestEventProtoRoundTrip(t *testing.T) {
+	for _, event := range []*Event{
+		testFullEvent(),
+		{},
+		{Time: time.Unix(0, 1714564800000000000), Type: "open", Pid: 42, Path: "/etc/passwd"},
+	} {
+		got, err := unmarshalEventProto(marshalEventProto(nil, event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, event) {
+			t.Errorf("decoded %+v, want %+v", got, event)
+		}
+	}
+}
+
+func TestEventProtoSkipsUnknownFields(t *testing.T) {
+	message := marshalEventProto(nil, &Event{Type: "open", Path: "/etc/passwd"})
+	// Fields of a newer agent
+	message = protowire.AppendTag(message, 100, protowire.BytesType)
+	message = protowire.AppendString(message, "new")
+	message = protowire.AppendTag(message, 101, protowire.Fixed64Type)
+	message = protowire.AppendFixed64(message, 1)
+	got, err := unmarshalEventProto(message)
+	if err != nil {
+		t.Fatalf("unmarshalEventProto() error = %v", err)
+	}
+	if got.Type != "open" || got.Path != "/etc/passwd" {
+		t.Errorf("unmarshalEventProto() = %+v", got)
+	}
+	if _, err := unmarshalEventProto(message[:len(message)-3]); err == nil {
+		t.Errorf("unmarshalEventProto() accepted a truncated message")
+	}
+}
+
+func TestEncodeEventRecord(t *testing.T) {
+	event := &Event{Type: "open", Path: "/etc/passwd"}
+	record, err := encodeEventRecord("protobuf", event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Delimited by the size of the message
+	if size, n := protowire.ConsumeVarint(record); n < 0 || int(size) != len(record)-n {
+		t.Errorf("message of %d bytes prefixed with size %d", len(record)-n, size)
+	}
+	record, err = encodeEventRecord("json", event)
+	if err != nil || !strings.HasSuffix(string(record), "}\n") {
+		t.Errorf("encodeEventRecord(json) = %q, %v, want a JSON line", record, err)
+	}
+}
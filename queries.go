@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SavedQuery counts the events matching its conditions on a schedule, and raises an alert when the count crosses one of
+// its thresholds. The events are counted in the history, or in the recent events kept in memory.
+type SavedQuery struct {
+	// Conditions on the events, the labels of the Pods aren't kept with the events so they can't be used
+	Rule `json:",inline"`
+	// Interval between two runs of the query (e.g. 5m)
+	Every string `json:"every"`
+	// Time range counted by each run, the interval by default
+	Window string `json:"window,omitempty"`
+	// The alert is raised when more events than above match, or less than below
+	Above *int `json:"above,omitempty"`
+	Below *int `json:"below,omitempty"`
+
+	every  time.Duration
+	window time.Duration
+}
+
+// validateQuery checks a saved query of the rules file and parses its durations
+func validateQuery(query *SavedQuery) error {
+	if len(query.Labels) > 0 || len(query.ExceptLabels) > 0 {
+		return fmt.Errorf("query %s: labels aren't supported by the queries", query.Name)
+	}
+	if query.Above == nil && query.Below == nil {
+		return fmt.Errorf("query %s: above or below is required", query.Name)
+	}
+	var err error
+	if query.every, err = time.ParseDuration(query.Every); err != nil || query.every <= 0 {
+		return fmt.Errorf("query %s: invalid every %q", query.Name, query.Every)
+	}
+	query.window = query.every
+	if query.Window != "" {
+		if query.window, err = time.ParseDuration(query.Window); err != nil || query.window <= 0 {
+			return fmt.Errorf("query %s: invalid window %q", query.Name, query.Window)
+		}
+	}
+	return nil
+}
+
+// savedQueryResult is the outcome of the last run of a saved query
+type savedQueryResult struct {
+	count  int
+	firing bool
+}
+
+// Results of the last run of each saved query, by name
+var savedQueryResults = struct {
+	lock    sync.Mutex
+	results map[string]savedQueryResult
+}{results: make(map[string]savedQueryResult)}
+
+// startSavedQueries runs each saved query on its schedule until stop is closed
+func startSavedQueries(config *RulesConfig, stop chan struct{}) {
+	for i := range config.Queries {
+		query := &config.Queries[i]
+		if eventHistory == nil && (recentEvents == nil || query.window > recentEventsTTL) {
+			log.Printf("Query %s covers %s but the events are kept for less, see --backfill-window\n", query.Name, query.window)
+		} else if eventHistory != nil && query.window > backfillWindow {
+			log.Printf("Query %s covers %s but the history is kept for %s\n", query.Name, query.window, backfillWindow)
+		}
+		go savedQueryLoop(config, query, stop)
+	}
+}
+
+func savedQueryLoop(config *RulesConfig, query *SavedQuery, stop chan struct{}) {
+	ticker := time.NewTicker(query.every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			runSavedQuery(config, query, now)
+		}
+	}
+}
+
+// runSavedQuery counts the events of the query in its window, and raises an alert when the count crosses a threshold.
+// The alert is raised once, until the count is back within the thresholds.
+func runSavedQuery(config *RulesConfig, query *SavedQuery, now time.Time) {
+	count := 0
+	var last *Event
+	replayEvents(now.Add(-query.window), now, []EventFilter{{}}, func(_ int, event *Event) {
+		// The alerts raised by the rules aren't counted again
+		if event.Type != "alert" && event.Type != "checkpoint" && config.matches(&query.Rule, event, nil) {
+			count++
+			last = event
+		}
+	})
+	metrics.SavedQueriesRun.Add(1)
+
+	firing := (query.Above != nil && count > *query.Above) || (query.Below != nil && count < *query.Below)
+	savedQueryResults.lock.Lock()
+	wasFiring := savedQueryResults.results[query.Name].firing
+	savedQueryResults.results[query.Name] = savedQueryResult{count: count, firing: firing}
+	savedQueryResults.lock.Unlock()
+
+	if !firing {
+		if wasFiring {
+			log.Printf("Query %s back within its thresholds: %d events in %s\n", query.Name, count, query.window)
+		}
+		return
+	}
+	if wasFiring {
+		return
+	}
+	message := query.Description
+	if message == "" {
+		message = query.Name
+	}
+	message = fmt.Sprintf("%s: %d events in %s", message, count, query.window)
+	log.Printf("Alert %s: %s\n", query.Name, message)
+
+	// The last event matched tells where to look, there is none if too few events matched
+	alert := &Event{Time: now}
+	if last != nil {
+		// The recent events are shared with the other queries
+		copied := *last
+		alert = &copied
+		alert.Time = now
+		alert.AlertedType = last.Type
+	}
+	alert.Type = "alert"
+	alert.Rule = query.Name
+	alert.Severity = query.Severity
+	alert.Message = message
+	alert.Node = NodeName
+	alert.ID = nextEventID()
+	// The alert sinks are written by the event worker only
+	eventQueue.Enqueue(queuedEvent{event: alert, alert: true})
+}
+
+// savedQueryCounts returns the number of events counted by the last run of each saved query
+func savedQueryCounts() ([]string, map[string]int) {
+	savedQueryResults.lock.Lock()
+	defer savedQueryResults.lock.Unlock()
+
+	names := make([]string, 0, len(savedQueryResults.results))
+	counts := make(map[string]int, len(savedQueryResults.results))
+	for name, result := range savedQueryResults.results {
+		names = append(names, name)
+		counts[name] = result.count
+	}
+	sort.Strings(names)
+	return names, counts
+}
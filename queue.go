@@ -0,0 +1,335 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// queuedEvent is a unit of work handed over from the tracer callbacks to the event worker
+type queuedEvent struct {
+	key ContainerKey
+	// ID of the container, only set for removals
+	id string
+	// Kernel timestamp of the event
+	timestamp time.Time
+	// Line to write to the container file, empty for the events only sent to the sinks
+	line string
+	// File which was opened or executed, if any, and the process which did it
+	path string
+	pid  uint32
+	// Process which was executed, if the event is an exec, and its session when the sessions are recorded
+	exec    string
+	session *execSession
+	// Absolute path of the executed binary, read from /proc when the event is reported if the tracer gave a relative one
+	executable string
+	// File descriptor of an open, and whether the open is dropped if it turns out to be read-only
+	fd        int
+	checkRead bool
+	// Set when the process ran as root
+	root bool
+	// Network protocol used, if the event is a network one
+	protocol string
+	// Set when the container was removed and its file has to be finalized
+	remove bool
+	// Set when the tracer truncated the event, complete may recover the full line from what was read from /proc when
+	// the event was reported
+	truncated bool
+	complete  func() (string, bool)
+	// Structured form of the event for the sinks, nil for the events only written to the container file
+	event *Event
+	// Set when the event happened during the initialization of the container
+	startup bool
+	// Set for the periodic checkpoints of the container in the event streams
+	checkpoint bool
+	// Set to start the backfills of the tenant sinks added by a reload of the configurations
+	backfill bool
+	// Set for the alerts raised outside of the worker (saved queries, new syscalls), only sent to the alert sinks
+	alert bool
+}
+
+// EventQueue decouples the tracer callbacks from the I/O done for their events
+type EventQueue struct {
+	events chan queuedEvent
+	// Time the worker last finished an event, in Unix nanoseconds
+	lastProgress atomic.Int64
+	// Events queued by namespace, nil if the namespaces don't get a fair share of the queue
+	shares *queueShares
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewEventQueue creates a queue holding at most size events and starts its worker. With fairShare, a namespace can't
+// hold more than its share of the queue once it is half full.
+func NewEventQueue(size int, fairShare bool) *EventQueue {
+	q := &EventQueue{
+		events: make(chan queuedEvent, size),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if fairShare {
+		q.shares = &queueShares{queued: make(map[string]int)}
+	}
+	q.lastProgress.Store(time.Now().UnixNano())
+	go q.worker()
+	return q
+}
+
+// Stalled tells whether events are queued but the worker didn't finish any for the timeout
+func (q *EventQueue) Stalled(timeout time.Duration) bool {
+	return q.Len() > 0 && time.Since(time.Unix(0, q.lastProgress.Load())) > timeout
+}
+
+// Enqueue hands an event over to the worker without ever blocking, the event is dropped if the queue is full
+func (q *EventQueue) Enqueue(event queuedEvent) {
+	if autoTuner != nil && event.event != nil && !event.alert && !autoTuner.Admit(event.key, event.event) {
+		return
+	}
+	start := time.Now()
+	if q.shares != nil && !q.shares.Admit(event.key.Namespace, len(q.events), cap(q.events)) {
+		metrics.EventsDropped.Add(1)
+		metrics.EventsDroppedFairShare.Add(1)
+		metrics.ObserveEnqueueLatency(time.Since(start))
+		return
+	}
+	q.queued(event)
+	select {
+	case q.events <- event:
+		metrics.EventsEnqueued.Add(1)
+	default:
+		q.processed(event)
+		metrics.EventsDropped.Add(1)
+	}
+	metrics.ObserveEnqueueLatency(time.Since(start))
+}
+
+// queued counts an event about to be queued in the share of its namespace
+func (q *EventQueue) queued(event queuedEvent) {
+	if q.shares != nil {
+		q.shares.add(event.key.Namespace)
+	}
+}
+
+// processed counts an event out of the share of its namespace
+func (q *EventQueue) processed(event queuedEvent) {
+	if q.shares != nil {
+		q.shares.done(event.key.Namespace)
+	}
+}
+
+// Len returns the number of events waiting for the worker
+func (q *EventQueue) Len() int {
+	return len(q.events)
+}
+
+// EnqueueAlert queues an alert, it blocks until there is room as alerts are never dropped, so it must not be called
+// from the worker. Once the worker stopped the alert is processed by the caller, the only one left writing to the sinks.
+func (q *EventQueue) EnqueueAlert(event queuedEvent) {
+	q.queued(event)
+	select {
+	case q.events <- event:
+		metrics.EventsEnqueued.Add(1)
+	case <-q.done:
+		processEvent(event)
+		q.processed(event)
+	}
+}
+
+// EnqueueRemove queues the removal of a container behind its pending events, it blocks until there is room
+func (q *EventQueue) EnqueueRemove(key ContainerKey, id string) {
+	event := queuedEvent{key: key, id: id, remove: true}
+	q.queued(event)
+	q.events <- event
+}
+
+// EnqueueRemoveAfter queues the removal of a container once delay elapsed, so the events still in flight in the tracers
+// when the container was removed are written before its file is finalized
+func (q *EventQueue) EnqueueRemoveAfter(key ContainerKey, id string, delay time.Duration) {
+	if delay <= 0 {
+		q.EnqueueRemove(key, id)
+		return
+	}
+	time.AfterFunc(delay, func() {
+		event := queuedEvent{key: key, id: id, remove: true}
+		q.queued(event)
+		select {
+		case <-q.stop:
+			// All the containers are finalized on shutdown
+			q.processed(event)
+		case q.events <- event:
+		}
+	})
+}
+
+// Drain processes the events already queued and stops the worker
+func (q *EventQueue) Drain() {
+	close(q.stop)
+	<-q.done
+}
+
+func (q *EventQueue) worker() {
+	defer close(q.done)
+
+	for {
+		select {
+		case event := <-q.events:
+			processEvent(event)
+			q.processed(event)
+			q.lastProgress.Store(time.Now().UnixNano())
+		case <-q.stop:
+			for {
+				select {
+				case event := <-q.events:
+					processEvent(event)
+					q.processed(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func processEvent(event queuedEvent) {
+	if event.remove {
+		// Finalize and close the file, duplicate notifications find nothing to remove
+		if !removeContainer(event.key, event.id) && !containers.IsRemoved(event.id) {
+			log.Printf("Container not found: %v\n", event.id)
+		}
+		return
+	}
+	if event.backfill {
+		tenants.startBackfills()
+		return
+	}
+	if event.alert {
+		dispatchAlert(event.event)
+		activityMetrics.ObserveAlert(event.event)
+		if riskScores != nil {
+			riskScores.ObserveAlert(event.event)
+		}
+		return
+	}
+	if event.checkpoint {
+		dispatchCheckpoint(event.key, event.timestamp)
+		return
+	}
+	if event.checkRead && openFilter.DropsRead(event.pid, event.fd) {
+		metrics.OpenEventsFiltered.Add(1)
+		return
+	}
+	// The events of a namespace over its quota still go through the detections, they are only neither written nor sent
+	stored := namespaceQuotas == nil || namespaceQuotas.Allow(event.key.Namespace, time.Now())
+	if isStartupEvent(event) {
+		if suppressStartup {
+			metrics.StartupEventsSuppressed.Add(1)
+			return
+		}
+		event.startup = true
+		event.event.Startup = true
+	}
+	if detectArgSecrets && event.event != nil && (event.event.Type == "exec" || event.event.Type == "exec-failed") {
+		// The full arguments are scanned, and masked before anything records them
+		if event.truncated {
+			completeTruncatedEvent(&event)
+			event.truncated = false
+		}
+		detectExecSecrets(&event)
+	}
+	if event.exec != "" {
+		recordExecInPod(event.key, event.exec)
+		recordProcess(event.key, event.event)
+	}
+	if event.root {
+		recordRootActivity(event.key)
+	}
+	if event.event != nil && event.event.Type == "capability" && event.event.Verdict == "Allow" {
+		recordCapability(event.key, event.event.Capability)
+	}
+	if event.exec != "" && sessionRecorder != nil {
+		enrichEvent(event.key, event.event)
+		sessionRecorder.RecordExec(event.key, event.event, event.session)
+	}
+	if event.truncated {
+		completeTruncatedEvent(&event)
+	}
+	if detectDrift && event.event != nil && event.path != "" {
+		checkDrift(event)
+	}
+	if event.path != "" && sbomLoader != nil {
+		markRelevantPath(event.key, event.path)
+	}
+	if event.path != "" && trackReachability {
+		if event.exec != "" {
+			recordReachability(event.key, event.executable, true)
+		} else {
+			recordReachability(event.key, event.path, false)
+		}
+	}
+	if kubeArmorPolicyDir != "" {
+		recordBehavior(event)
+	}
+	if peerResolver != nil && event.protocol == "tcp" {
+		recordNetworkRule(event.key, event.event)
+	}
+	if inventory != nil && event.event != nil {
+		enrichEvent(event.key, event.event)
+		// The inventory and the digests are served off the node, they hold the redacted values
+		category, value, count, outsideBaseline := inventory.RecordEvent(redactEvent(event.event))
+		if digests != nil && category != "" && count == 1 {
+			digests.NewBehavior(event.event, category, value)
+		}
+		// The initialization of a container is no steady state behavior
+		if anomalyThresholds != nil && category != "" && !event.startup {
+			detectAnomaly(event.key, event.event, category, value, count, outsideBaseline)
+		}
+	}
+	// Alerts were already written to the container file when detected
+	if event.event != nil && recordProfile(event.key, event.event) && aggregateProfiles {
+		// The event is part of the profile of the container, its line isn't written
+		event.line = ""
+	}
+	if event.line != "" && stored {
+		if event.startup {
+			event.line = strings.TrimSuffix(event.line, "\n") + " (startup)\n"
+		}
+		writeContainerEvent(event.key, event.timestamp, event.line)
+	}
+	if event.event != nil {
+		event.event.ID = nextEventID()
+	}
+	if rulesConfig != nil && event.event != nil {
+		evaluateRules(event.key, event.event)
+	}
+	if event.event != nil {
+		recordLastEvent(event.key, event.event.Type, event.timestamp)
+	}
+	if event.event != nil && hasSinks() && stored {
+		enrichEvent(event.key, event.event)
+		dispatchEvent(event.event)
+	}
+	if event.event != nil {
+		// Counted once enriched, the event of the exemplar is served as it is
+		activityMetrics.Observe(event.key, event.event)
+	}
+	if riskScores != nil && event.event != nil {
+		riskScores.Observe(event.key, event.event)
+	}
+}
+
+// completeTruncatedEvent recovers the full line of a truncated event if possible, otherwise it marks the line as truncated
+func completeTruncatedEvent(event *queuedEvent) {
+	metrics.TruncatedEvents.Add(1)
+	if completeTruncated && event.complete != nil {
+		if line, ok := event.complete(); ok {
+			metrics.TruncatedEventsCompleted.Add(1)
+			event.line = line
+			return
+		}
+	}
+	event.line = strings.TrimSuffix(event.line, "\n") + " (truncated)\n"
+	if event.event != nil {
+		event.event.Truncated = true
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Seconds of quota a quiet namespace may save up for a burst
+const namespaceQuotaBurst = 10
+
+// Interval between two logs of a namespace over its quota
+const namespaceQuotaLogInterval = time.Minute
+
+// namespaceBucket is the quota left to a namespace, refilled at its rate
+type namespaceBucket struct {
+	tokens float64
+	last   time.Time
+	// Events over the quota so far, and when it was last logged
+	over   uint64
+	logged time.Time
+}
+
+// NamespaceQuotas limits the rate of the events of each namespace written to the container files and sent to the sinks
+// and the history, so a noisy namespace doesn't use the disk and the bandwidth of all the others. The events over the
+// quota still go through the detections, and the alerts are never limited.
+type NamespaceQuotas struct {
+	lock sync.Mutex
+	// Events per second of the namespaces without their own quota, 0 for no limit
+	defaultRate float64
+	rates       map[string]float64
+	buckets     map[string]*namespaceBucket
+}
+
+var namespaceQuotas *NamespaceQuotas
+
+// NewNamespaceQuotas creates the quotas from the default rate and the comma separated <namespace>=<rate> overrides, nil
+// if there is no quota at all
+func NewNamespaceQuotas(defaultRate float64, overrides string) (*NamespaceQuotas, error) {
+	q := &NamespaceQuotas{defaultRate: defaultRate, rates: make(map[string]float64), buckets: make(map[string]*namespaceBucket)}
+	for _, override := range strings.Split(overrides, ",") {
+		if override = strings.TrimSpace(override); override == "" {
+			continue
+		}
+		namespace, value, ok := strings.Cut(override, "=")
+		rate, err := strconv.ParseFloat(value, 64)
+		if !ok || namespace == "" || err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid namespace quota %q, expected <namespace>=<events per second>", override)
+		}
+		q.rates[namespace] = rate
+	}
+	if defaultRate <= 0 && len(q.rates) == 0 {
+		return nil, nil
+	}
+	return q, nil
+}
+
+// Allow consumes an event of the quota of the namespace, it returns false if the namespace is over its quota
+func (q *NamespaceQuotas) Allow(namespace string, now time.Time) bool {
+	rate, ok := q.rates[namespace]
+	if !ok {
+		rate = q.defaultRate
+	}
+	if rate <= 0 {
+		return true
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	bucket, ok := q.buckets[namespace]
+	if !ok {
+		bucket = &namespaceBucket{tokens: rate * namespaceQuotaBurst, last: now}
+		q.buckets[namespace] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+	if bucket.tokens > rate*namespaceQuotaBurst {
+		bucket.tokens = rate * namespaceQuotaBurst
+	}
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true
+	}
+	bucket.over++
+	metrics.EventsOverQuota.Add(1)
+	if now.Sub(bucket.logged) >= namespaceQuotaLogInterval {
+		bucket.logged = now
+		log.Printf("Namespace %s is over its quota of %g events/s, its events are neither stored nor exported (%d so far)\n", namespace, rate, bucket.over)
+	}
+	return false
+}
+
+// writeMetrics writes the number of events of each namespace over its quota
+func (q *NamespaceQuotas) writeMetrics(w io.Writer) {
+	q.lock.Lock()
+	namespaces := make([]string, 0, len(q.buckets))
+	over := make(map[string]uint64, len(q.buckets))
+	for namespace, bucket := range q.buckets {
+		namespaces = append(namespaces, namespace)
+		over[namespace] = bucket.over
+	}
+	q.lock.Unlock()
+	sort.Strings(namespaces)
+
+	writeMetricHeader(w, "wlftracer_namespace_events_over_quota_total", "counter", "Events neither stored nor exported because their namespace was over its quota")
+	for _, namespace := range namespaces {
+		fmt.Fprintf(w, "wlftracer_namespace_events_over_quota_total{namespace=%s} %d\n", labelValue(namespace), over[namespace])
+	}
+}
+
+// queueShares counts the events of each namespace in the event queue, so a namespace can't fill the queue and have the
+// events of the others dropped
+type queueShares struct {
+	lock   sync.Mutex
+	queued map[string]int
+}
+
+// Admit tells whether an event of the namespace may be queued. Once the queue is half full, each namespace with events
+// in the queue gets an equal share of its capacity.
+func (s *queueShares) Admit(namespace string, length int, capacity int) bool {
+	if length < capacity/2 {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	active := len(s.queued)
+	if s.queued[namespace] == 0 {
+		active++
+	}
+	return s.queued[namespace] < capacity/active
+}
+
+// add counts an event of the namespace queued
+func (s *queueShares) add(namespace string) {
+	s.lock.Lock()
+	s.queued[namespace]++
+	s.lock.Unlock()
+}
+
+// done counts an event of the namespace processed
+func (s *queueShares) done(namespace string) {
+	s.lock.Lock()
+	if s.queued[namespace]--; s.queued[namespace] <= 0 {
+		delete(s.queued, namespace)
+	}
+	s.lock.Unlock()
+}
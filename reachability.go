@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Whether the executed binaries and loaded libraries are recorded per image
+var trackReachability bool
+
+// isSharedLibrary returns true for paths like libssl.so or libssl.so.1.1
+func isSharedLibrary(path string) bool {
+	base := filepath.Base(path)
+	return strings.HasSuffix(base, ".so") || strings.Contains(base, ".so.")
+}
+
+// executablePath returns the absolute path of an executed binary, resolving it from /proc when the process is still alive
+func executablePath(path string, pid uint32) string {
+	if filepath.IsAbs(path) || pid == 0 {
+		return path
+	}
+	if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
+		return exe
+	}
+	return path
+}
+
+// recordReachability records an executed binary or a loaded library of the container
+func recordReachability(key ContainerKey, path string, exec bool) {
+	if !exec && !isSharedLibrary(path) {
+		return
+	}
+
+	state, ok := containers.Get(key)
+	if !ok {
+		return
+	}
+
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if exec {
+		state.executables[path] = true
+	} else {
+		state.libraries[path] = true
+	}
+}
+
+// persistReachability merges the binaries and libraries used by the container into the report of its image. The reports
+// are keyed by digest, a tag can be moved to another image, the containers whose digest is unknown are left out.
+func persistReachability(state *ContainerState) {
+	if !trackReachability || !state.Learns() {
+		return
+	}
+	digest := imageDigest(state.ImageRef)
+	if digest == "" {
+		return
+	}
+
+	state.lock.Lock()
+	executables := make([]string, 0, len(state.executables))
+	for executable := range state.executables {
+		executables = append(executables, executable)
+	}
+	libraries := make([]string, 0, len(state.libraries))
+	for library := range state.libraries {
+		libraries = append(libraries, library)
+	}
+	state.lock.Unlock()
+
+	if err := store.MergeReachability(digest, state.Image, executables, libraries); err != nil {
+		log.Printf("Error persisting reachability of %s: %v\n", digest, err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of events kept in memory per container, 0 to not keep any, and how long they are kept
+var recentEventsPerContainer int
+var recentEventsTTL = 15 * time.Minute
+
+// Interval between two sweeps of the expired events of the containers which are quiet or gone
+const recentEventsSweepInterval = time.Minute
+
+// RecentEvents keeps the last events of each container in memory, to answer the queries on the last minutes without
+// reading the history
+type RecentEvents struct {
+	lock       sync.Mutex
+	containers map[ContainerKey]*eventRing
+	lastSweep  time.Time
+	// Time the events started to be kept, the older ones are only in the history
+	started time.Time
+}
+
+// eventRing holds the last events of a container, oldest first
+type eventRing struct {
+	events []*Event
+	start  int
+	count  int
+}
+
+var recentEvents *RecentEvents
+
+// NewRecentEvents creates the in-memory store of the recent events
+func NewRecentEvents() *RecentEvents {
+	now := time.Now()
+	return &RecentEvents{containers: make(map[ContainerKey]*eventRing), lastSweep: now, started: now}
+}
+
+// Covers tells whether all the events since the time are still in memory, unless their container had too many
+func (r *RecentEvents) Covers(since time.Time) bool {
+	return !since.Before(r.started) && time.Since(since) < recentEventsTTL
+}
+
+// Record keeps an event of a container, the oldest one is evicted once the container has recentEventsPerContainer
+func (r *RecentEvents) Record(event *Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	key := ContainerKey{event.Namespace, event.Pod, event.Container}
+	ring, ok := r.containers[key]
+	if !ok {
+		ring = &eventRing{events: make([]*Event, recentEventsPerContainer)}
+		r.containers[key] = ring
+	}
+	ring.expire(now)
+	if ring.count == len(ring.events) {
+		ring.start = (ring.start + 1) % len(ring.events)
+		ring.count--
+		metrics.RecentEventsEvicted.Add(1)
+	}
+	ring.events[(ring.start+ring.count)%len(ring.events)] = event
+	ring.count++
+
+	if now.Sub(r.lastSweep) >= recentEventsSweepInterval {
+		r.sweep(now)
+	}
+}
+
+// expire drops the events older than recentEventsTTL. The events are ordered by when they were recorded, their time is
+// close enough to stop at the first recent one.
+func (ring *eventRing) expire(now time.Time) {
+	for ring.count > 0 && now.Sub(ring.events[ring.start].Time) > recentEventsTTL {
+		ring.events[ring.start] = nil
+		ring.start = (ring.start + 1) % len(ring.events)
+		ring.count--
+		metrics.RecentEventsExpired.Add(1)
+	}
+}
+
+// sweep expires the events of all the containers, and forgets the ones without any event left
+func (r *RecentEvents) sweep(now time.Time) {
+	r.lastSweep = now
+	for key, ring := range r.containers {
+		ring.expire(now)
+		if ring.count == 0 {
+			delete(r.containers, key)
+		}
+	}
+}
+
+// Query returns the events matching the filter since the time, oldest first
+func (r *RecentEvents) Query(filter EventFilter, since time.Time) []*Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var events []*Event
+	for key, ring := range r.containers {
+		if (filter.Namespace != "" && key.Namespace != filter.Namespace) || (filter.Pod != "" && key.Podname != filter.Pod) ||
+			(filter.Container != "" && key.ContainerName != filter.Container) {
+			continue
+		}
+		for i := 0; i < ring.count; i++ {
+			event := ring.events[(ring.start+i)%len(ring.events)]
+			if !event.Time.Before(since) && filter.Matches(event) {
+				events = append(events, event)
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events
+}
+
+// Len returns the number of events held
+func (r *RecentEvents) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	count := 0
+	for _, ring := range r.containers {
+		count += ring.count
+	}
+	return count
+}
+
+func registerRecentEventHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/events", recentEventsHandler)
+}
+
+// recentEventsHandler serves the recent events kept in memory as a JSON array, filtered like the event stream by
+// ?namespace=, ?pod=, ?container= and ?type=, since ?since= ago (e.g. 5m, up to --recent-events-ttl), and at most
+// ?limit= of the most recent ones
+func recentEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if recentEvents == nil {
+		http.Error(w, "the recent events aren't kept, see --recent-events", http.StatusServiceUnavailable)
+		return
+	}
+	query := r.URL.Query()
+	filter := EventFilter{Namespace: query.Get("namespace"), Pod: query.Get("pod"), Container: query.Get("container")}
+	if filter.Pod != "" && filter.Namespace == "" {
+		http.Error(w, "pod requires namespace", http.StatusBadRequest)
+		return
+	}
+	if types := query.Get("type"); types != "" {
+		filter.Types = make(map[string]bool)
+		for _, eventType := range strings.Split(types, ",") {
+			filter.Types[strings.TrimSpace(eventType)] = true
+		}
+	}
+	since := recentEventsTTL
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = time.ParseDuration(value); err != nil || since <= 0 {
+			http.Error(w, fmt.Sprintf("invalid since %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	if status, err := authorizeNamespace(r, filter.Namespace); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	events := recentEvents.Query(filter, time.Now().Add(-since))
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	if events == nil {
+		events = []*Event{}
+	}
+	writeJSONResponse(w, http.StatusOK, events)
+}
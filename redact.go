@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RedactionConfig is the file configuring how events are redacted before being sent to the sinks
+type RedactionConfig struct {
+	// Path rules, applied to the paths and the arguments of the events
+	Paths []RedactionRule `json:"paths"`
+	// Replace what follows the ? of URL-like arguments
+	StripQueries bool `json:"stripQueries"`
+	// Replace the values of NAME=value arguments
+	DropEnvValues bool `json:"dropEnvValues"`
+	// Salt of the hashes, so hashed values can't be recovered from a dictionary
+	Salt string `json:"salt"`
+}
+
+// RedactionRule replaces the capture groups of the pattern (the whole match if it has none) with their hash or a mask
+type RedactionRule struct {
+	Pattern string `json:"pattern"`
+	// hash or mask
+	Action string `json:"action"`
+
+	regexp *regexp.Regexp
+}
+
+const redactedMask = "<redacted>"
+
+var envAssignment = regexp.MustCompile(`^(-[-\w]*=)?([A-Za-z_][A-Za-z0-9_]*)=(.+)$`)
+
+// Redaction rules applied to the events, nil if they are not redacted
+var redactor *RedactionConfig
+
+// LoadRedactionConfig reads and compiles the redaction rules of the file
+func LoadRedactionConfig(path string) (*RedactionConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading redaction rules: %w", err)
+	}
+	config := &RedactionConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("decoding redaction rules: %w", err)
+	}
+	for i := range config.Paths {
+		rule := &config.Paths[i]
+		if rule.Action != "hash" && rule.Action != "mask" {
+			return nil, fmt.Errorf("invalid action %q of rule %q, expected hash or mask", rule.Action, rule.Pattern)
+		}
+		if rule.regexp, err = regexp.Compile(rule.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", rule.Pattern, err)
+		}
+	}
+	return config, nil
+}
+
+// Redact returns a copy of the event with the sensitive content replaced
+func (c *RedactionConfig) Redact(event *Event) *Event {
+	redacted := *event
+	redacted.Path = c.redactPath(event.Path)
+	if event.Args != nil {
+		redacted.Args = make([]string, len(event.Args))
+		for i, arg := range event.Args {
+			redacted.Args[i] = c.redactArg(arg)
+		}
+	}
+	if event.Lineage != nil {
+		redacted.Lineage = make([]ProcessAncestor, len(event.Lineage))
+		for i, ancestor := range event.Lineage {
+			ancestor.Path = c.redactPath(ancestor.Path)
+			redacted.Lineage[i] = ancestor
+		}
+	}
+	redacted.Value = c.redactPath(event.Value)
+	redacted.Message = c.redactPath(event.Message)
+	redacted.DNSName = c.redactPath(event.DNSName)
+	return &redacted
+}
+
+// redactEvent returns the event redacted for the records derived from it, as is if the events aren't redacted
+func redactEvent(event *Event) *Event {
+	if redactor == nil {
+		return event
+	}
+	return redactor.Redact(event)
+}
+
+// redactValue applies the path rules to a value derived from an event
+func redactValue(value string) string {
+	if redactor == nil {
+		return value
+	}
+	return redactor.redactPath(value)
+}
+
+// redactArgs redacts the arguments of a process
+func redactArgs(args []string) []string {
+	if redactor == nil || args == nil {
+		return args
+	}
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = redactor.redactArg(arg)
+	}
+	return redacted
+}
+
+func (c *RedactionConfig) redactArg(arg string) string {
+	if c.DropEnvValues {
+		if match := envAssignment.FindStringSubmatch(arg); match != nil {
+			return match[1] + match[2] + "=" + redactedMask
+		}
+	}
+	if c.StripQueries {
+		if i := strings.Index(arg, "?"); i >= 0 && strings.Contains(arg[:i], "/") {
+			arg = arg[:i+1] + redactedMask
+		}
+	}
+	return c.redactPath(arg)
+}
+
+// redactPath applies the path rules to a value. The matches are found in the whole value, so the anchors and the
+// context of the patterns hold for their capture groups too.
+func (c *RedactionConfig) redactPath(value string) string {
+	for _, rule := range c.Paths {
+		matches := rule.regexp.FindAllStringSubmatchIndex(value, -1)
+		if matches == nil {
+			continue
+		}
+		var out strings.Builder
+		last := 0
+		for _, groups := range matches {
+			if len(groups) <= 2 {
+				out.WriteString(value[last:groups[0]])
+				out.WriteString(c.replace(rule, value[groups[0]:groups[1]]))
+				last = groups[1]
+				continue
+			}
+			// Replace the capture groups only, keeping the rest of the match
+			for i := 2; i+1 < len(groups); i += 2 {
+				if groups[i] < 0 || groups[i] < last {
+					continue
+				}
+				out.WriteString(value[last:groups[i]])
+				out.WriteString(c.replace(rule, value[groups[i]:groups[i+1]]))
+				last = groups[i+1]
+			}
+		}
+		out.WriteString(value[last:])
+		value = out.String()
+	}
+	return value
+}
+
+func (c *RedactionConfig) replace(rule RedactionRule, value string) string {
+	if rule.Action == "mask" {
+		return redactedMask
+	}
+	sum := sha256.Sum256([]byte(c.Salt + value))
+	return "sha256:" + hex.EncodeToString(sum[:])[:12]
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadTestRedaction writes the configuration to a file and loads it as the agent does
+func loadTestRedaction(t *testing.T, content string) (*RedactionConfig, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "redaction.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadRedactionConfig(path)
+}
+
+func TestRedactPath(t *testing.T) {
+	config, err := loadTestRedaction(t, `{"salt": "salt", "paths": [
+		{"pattern": "^/home/([^/]+)/", "action": "hash"},
+		{"pattern": "\\.ssh/[^/]+", "action": "mask"},
+		{"pattern": "user-(\\d+)", "action": "mask"},
+		{"pattern": "/tmp/(x)?y", "action": "mask"}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := config.replace(RedactionRule{Action: "hash"}, "alice")
+
+	for value, want := range map[string]string{
+		"/etc/passwd":             "/etc/passwd",
+		"/home/alice/.bashrc":     "/home/" + alice + "/.bashrc",
+		"/home/alice/.ssh/id_rsa": "/home/" + alice + "/<redacted>",
+		"/srv/home/alice/.bashrc": "/srv/home/alice/.bashrc",
+		"/data/user-1/user-22":    "/data/user-<redacted>/user-<redacted>",
+		"/tmp/y":                  "/tmp/y",
+	} {
+		if got := config.redactPath(value); got != want {
+			t.Errorf("redactPath(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestRedactHashIsSalted(t *testing.T) {
+	config := &RedactionConfig{Salt: "salt"}
+	rule := RedactionRule{Action: "hash"}
+
+	hash := config.replace(rule, "alice")
+	if !strings.HasPrefix(hash, "sha256:") || len(hash) != len("sha256:")+12 {
+		t.Fatalf("got %q, want sha256: and 12 hex digits", hash)
+	}
+	if again := config.replace(rule, "alice"); again != hash {
+		t.Errorf("hash changed from %q to %q", hash, again)
+	}
+	config.Salt = "other"
+	if config.replace(rule, "alice") == hash {
+		t.Error("the salt isn't part of the hash")
+	}
+}
+
+func TestRedactLeavesEventUntouched(t *testing.T) {
+	config, err := loadTestRedaction(t, `{"paths": [{"pattern": "/home/([^/]+)", "action": "mask"}], "stripQueries": true, "dropEnvValues": true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &Event{
+		Type:    "exec",
+		Path:    "/home/alice/bin/tool",
+		Args:    []string{"/home/alice/bin/tool", "https://example.com/api?token=abc", "--env=PASSWORD=hunter2", "-v"},
+		Lineage: []ProcessAncestor{{Pid: 1, Comm: "sh", Path: "/home/bob/sh"}},
+		Message: "ran /home/dave/x",
+		DNSName: "example.com",
+	}
+
+	redacted := config.Redact(event)
+
+	wantArgs := []string{"/home/<redacted>/bin/tool", "https://example.com/api?<redacted>", "--env=PASSWORD=<redacted>", "-v"}
+	if !reflect.DeepEqual(redacted.Args, wantArgs) {
+		t.Errorf("args = %q, want %q", redacted.Args, wantArgs)
+	}
+	if redacted.Path != "/home/<redacted>/bin/tool" || redacted.Lineage[0].Path != "/home/<redacted>/sh" || redacted.Message != "ran /home/<redacted>/x" {
+		t.Errorf("paths not redacted: %+v", redacted)
+	}
+	if redacted.DNSName != "example.com" {
+		t.Errorf("DNS name changed to %q", redacted.DNSName)
+	}
+	// The sinks getting the raw events share the original
+	if event.Args[1] != "https://example.com/api?token=abc" || event.Lineage[0].Path != "/home/bob/sh" {
+		t.Errorf("original event modified: %+v", event)
+	}
+}
+
+func TestLoadRedactionConfigRejectsInvalidRules(t *testing.T) {
+	for _, content := range []string{
+		`{"paths": [{"pattern": "x", "action": "drop"}]}`,
+		`{"paths": [{"pattern": "(", "action": "mask"}]}`,
+		`{`,
+	} {
+		if _, err := loadTestRedaction(t, content); err == nil {
+			t.Errorf("%s accepted", content)
+		}
+	}
+}
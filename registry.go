@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// How long the ID of a removed container is remembered
+const removedContainerTTL = 5 * time.Minute
+
+// ContainerRegistry holds the state of the registered containers. Writers of the container files hold its read lock, so
+// once a container is unregistered no write is in flight anymore and its file can be finalized safely.
+type ContainerRegistry struct {
+	lock       sync.RWMutex
+	containers map[ContainerKey]*ContainerState
+	// IDs of the containers removed recently, to ignore duplicate notifications
+	removed map[string]time.Time
+}
+
+var containers = NewContainerRegistry()
+
+// NewContainerRegistry creates an empty registry
+func NewContainerRegistry() *ContainerRegistry {
+	return &ContainerRegistry{
+		containers: make(map[ContainerKey]*ContainerState),
+		removed:    make(map[string]time.Time),
+	}
+}
+
+// Get returns the state of a registered container
+func (r *ContainerRegistry) Get(key ContainerKey) (*ContainerState, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	state, ok := r.containers[key]
+	return state, ok
+}
+
+// HasPod returns true if a container of the Pod is registered
+func (r *ContainerRegistry) HasPod(namespace string, pod string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for key := range r.containers {
+		if key.Namespace == namespace && key.Podname == pod {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of registered containers
+func (r *ContainerRegistry) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return len(r.containers)
+}
+
+// States returns the states of the registered containers, so they can be used without holding the lock
+func (r *ContainerRegistry) States() []*ContainerState {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	states := make([]*ContainerState, 0, len(r.containers))
+	for _, state := range r.containers {
+		states = append(states, state)
+	}
+	return states
+}
+
+// Register registers the state created by create, unless the container is already registered or was removed. It
+// returns the new state, nil if the container was ignored, along with the state of the container it replaces, if any.
+// create opens the file of the container without holding the lock, the events of the container are buffered until it is
+// registered, and the events buffered before the registration are flushed before any other.
+func (r *ContainerRegistry) Register(key ContainerKey, id string, create func() (*ContainerState, error)) (*ContainerState, *ContainerState, error) {
+	if !r.registrable(key, id) {
+		return nil, nil, nil
+	}
+	state, err := create()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// A duplicate notification may have registered the container, or a removal may have come, in the meantime
+	existing, ok := r.containers[key]
+	_, removed := r.removed[id]
+	if (ok && existing.ID == id) || removed {
+		if err := state.File.Close(); err != nil {
+			log.Printf("Error closing %s: %v\n", state.File.Name(), err)
+		}
+		return nil, nil, nil
+	}
+	r.containers[key] = state
+	// Record which agent and boot the following events come from
+	state.WriteEvent(clock.Now(), fmt.Sprintf("agent: boot_id=%s started=%s\n", clock.BootID, clock.AgentStart.UTC().Format(time.RFC3339Nano)))
+	for _, event := range pendingBuffer.Take(key) {
+		state.WriteEvent(event.timestamp, event.line)
+	}
+	return state, existing, nil
+}
+
+// registrable returns false if the container is already registered or was removed
+func (r *ContainerRegistry) registrable(key ContainerKey, id string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	existing, ok := r.containers[key]
+	if ok && existing.ID == id {
+		return false
+	}
+	_, removed := r.removed[id]
+	return !removed
+}
+
+// Unregister removes the container if it is the registered one and remembers its ID, it returns false otherwise
+func (r *ContainerRegistry) Unregister(key ContainerKey, id string) (*ContainerState, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	state, ok := r.containers[key]
+	if !ok || state.ID != id {
+		return nil, false
+	}
+	delete(r.containers, key)
+
+	now := time.Now()
+	for removedID, removedAt := range r.removed {
+		if now.Sub(removedAt) > removedContainerTTL {
+			delete(r.removed, removedID)
+		}
+	}
+	r.removed[id] = now
+	return state, true
+}
+
+// IsRemoved returns true if the container was removed recently
+func (r *ContainerRegistry) IsRemoved(id string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	_, ok := r.removed[id]
+	return ok
+}
+
+// TakeAll unregisters all the containers and returns them
+func (r *ContainerRegistry) TakeAll() map[ContainerKey]*ContainerState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	states := r.containers
+	r.containers = make(map[ContainerKey]*ContainerState)
+	return states
+}
+
+// WriteEvent writes a line to the file of the container, buffering it if the container is not registered yet
+func (r *ContainerRegistry) WriteEvent(key ContainerKey, timestamp time.Time, line string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	state, ok := r.containers[key]
+	if !ok {
+		// The container may not be registered yet, keep the event until it is
+		pendingBuffer.Add(key, timestamp, line)
+		return
+	}
+	state.WriteEvent(timestamp, line)
+}
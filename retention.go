@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Pod annotations overriding how long the events (the container files) and the profiles of a workload are kept
+const (
+	eventRetentionAnnotation   = "wlftracer.io/event-retention"
+	profileRetentionAnnotation = "wlftracer.io/profile-retention"
+)
+
+// How long the profiles of the workloads without a running container are kept in the store, 0 to keep them forever
+var profileRetention time.Duration
+
+// Reads the retention annotations of the Pods, nil if they are ignored
+var retentionClient kubernetes.Interface
+
+// Store sections keyed by workload, whose entries expire with the profile retention
+var profileSections = []string{"syscalls", "behavior", "network", "inventory"}
+
+// WorkloadRetention is the retention a workload set with the annotations of its Pods, zero durations fall back to the
+// tenant of its namespace and then to the flags
+type WorkloadRetention struct {
+	Workload string        `json:"workload"`
+	Events   time.Duration `json:"events,omitempty"`
+	Profiles time.Duration `json:"profiles,omitempty"`
+	// Container files of the workload, by base name, the containers may be gone when they expire
+	Files     []string  `json:"files"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// lookupRetention reads the retention annotations of the Pod of a container and persists them for its workload, so
+// they still apply once the container is gone
+func lookupRetention(key ContainerKey, workload string, file string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pod, err := retentionClient.CoreV1().Pods(key.Namespace).Get(ctx, key.Podname, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("Failed to read the retention annotations of %s/%s: %v\n", key.Namespace, key.Podname, err)
+		return
+	}
+	events, err := parseRetentionAnnotation(pod.Annotations, eventRetentionAnnotation)
+	if err != nil {
+		log.Printf("Invalid %s annotation on %s/%s: %v\n", eventRetentionAnnotation, key.Namespace, key.Podname, err)
+	}
+	profiles, err := parseRetentionAnnotation(pod.Annotations, profileRetentionAnnotation)
+	if err != nil {
+		log.Printf("Invalid %s annotation on %s/%s: %v\n", profileRetentionAnnotation, key.Namespace, key.Podname, err)
+	}
+	if err := store.MergeRetention(workload, events, profiles, filepath.Base(file)); err != nil {
+		log.Printf("Error persisting the retention of %s: %v\n", workload, err)
+	}
+}
+
+// parseRetentionAnnotation returns the retention set by an annotation, 0 if it isn't set. It is clamped to the
+// maximum when the annotations are loaded, as the tenant setting it may change.
+func parseRetentionAnnotation(annotations map[string]string, name string) (time.Duration, error) {
+	value, ok := annotations[name]
+	if !ok {
+		return 0, nil
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention <= 0 {
+		return 0, fmt.Errorf("expected a positive duration, got %q", value)
+	}
+	return retention, nil
+}
+
+// MergeRetention records the retention of a workload along with one of its container files
+func (s *Store) MergeRetention(workload string, events time.Duration, profiles time.Duration, file string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path := s.path("retention", workload)
+	retention := &WorkloadRetention{}
+	if err := s.readJSON(path, retention); err != nil {
+		return fmt.Errorf("reading retention of %s: %w", workload, err)
+	}
+	retention.Workload = workload
+	retention.Events = events
+	retention.Profiles = profiles
+	mergeStrings(&retention.Files, []string{file})
+	retention.UpdatedAt = time.Now()
+	if err := s.writeJSON(path, retention); err != nil {
+		return fmt.Errorf("writing retention of %s: %w", workload, err)
+	}
+	return nil
+}
+
+// PruneRetentionFiles drops the container files which no longer exist from the retentions of the workloads
+func (s *Store) PruneRetentionFiles(exists func(file string) bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, "retention"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("listing retentions: %w", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.dir, "retention", entry.Name())
+		retention := &WorkloadRetention{}
+		if err := s.readJSON(path, retention); err != nil {
+			return fmt.Errorf("reading %s: %w", entry.Name(), err)
+		}
+		files := retention.Files[:0]
+		for _, file := range retention.Files {
+			if exists(file) {
+				files = append(files, file)
+			}
+		}
+		if len(files) == len(retention.Files) {
+			continue
+		}
+		retention.Files = files
+		if err := s.writeJSON(path, retention); err != nil {
+			return fmt.Errorf("writing retention of %s: %w", retention.Workload, err)
+		}
+	}
+	return nil
+}
+
+// ListRetentions returns the retentions set by the workloads
+func (s *Store) ListRetentions() ([]*WorkloadRetention, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, "retention"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("listing retentions: %w", err)
+	}
+	var retentions []*WorkloadRetention
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		retention := &WorkloadRetention{}
+		if err := s.readJSON(filepath.Join(s.dir, "retention", entry.Name()), retention); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", entry.Name(), err)
+		}
+		retentions = append(retentions, retention)
+	}
+	return retentions, nil
+}
+
+// ExpireProfiles deletes the profiles of the workloads which weren't updated for their retention, skipping the
+// running ones. The retention of their workloads goes along with them. It returns the expired workloads.
+func (s *Store) ExpireProfiles(retention func(workload string) time.Duration, running map[string]bool, now time.Time) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The workload is expired once none of its sections was updated for the retention
+	updated := make(map[string]time.Time)
+	files := make(map[string][]string)
+	for _, section := range append(profileSections, "retention") {
+		entries, err := os.ReadDir(filepath.Join(s.dir, section))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("listing %s: %w", section, err)
+		}
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".json") {
+				continue
+			}
+			path := filepath.Join(s.dir, section, entry.Name())
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			// The key stored in the file is the reference, the names of the files of the previous versions are lossy
+			key := struct {
+				Workload string `json:"workload"`
+			}{}
+			if err := s.readJSON(path, &key); err != nil || key.Workload == "" {
+				continue
+			}
+			files[key.Workload] = append(files[key.Workload], path)
+			if section != "retention" && info.ModTime().After(updated[key.Workload]) {
+				updated[key.Workload] = info.ModTime()
+			}
+		}
+	}
+
+	var expired []string
+	for workload, last := range updated {
+		keep := retention(workload)
+		if keep == 0 || running[workload] || now.Sub(last) < keep {
+			continue
+		}
+		for _, path := range files[workload] {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return expired, fmt.Errorf("deleting %s: %w", path, err)
+			}
+		}
+		expired = append(expired, workload)
+	}
+	return expired, nil
+}
+
+// retentionPolicies are the retentions of the workloads, indexed for the janitor
+type retentionPolicies struct {
+	// Event retention by container file base name
+	files map[string]time.Duration
+	// Profile retention by workload
+	profiles map[string]time.Duration
+}
+
+func loadRetentionPolicies() *retentionPolicies {
+	policies := &retentionPolicies{files: make(map[string]time.Duration), profiles: make(map[string]time.Duration)}
+	retentions, err := store.ListRetentions()
+	if err != nil {
+		log.Printf("Error loading the retentions of the workloads: %v\n", err)
+	}
+	for _, retention := range retentions {
+		// The Pods may shorten the retention of their namespace, never extend it
+		namespace, _, _, _, _ := parseWorkloadKey(retention.Workload)
+		if events := clampRetention(retention.Events, eventRetentionLimit(namespace)); events > 0 {
+			for _, file := range retention.Files {
+				policies.files[file] = events
+			}
+		}
+		if profiles := clampRetention(retention.Profiles, profileRetentionLimit(namespace)); profiles > 0 {
+			policies.profiles[retention.Workload] = profiles
+		}
+	}
+	return policies
+}
+
+// clampRetention returns the retention, at most the limit unless the limit is 0 (forever)
+func clampRetention(retention time.Duration, limit time.Duration) time.Duration {
+	if limit > 0 && retention > limit {
+		return limit
+	}
+	return retention
+}
+
+// eventRetentionLimit returns the longest the Pods of a namespace may keep their events: the retention of the tenant
+// or --file-retention
+func eventRetentionLimit(namespace string) time.Duration {
+	if tenants != nil {
+		if config, ok := tenants.Config(namespace); ok && config.Retention > 0 {
+			return config.Retention
+		}
+	}
+	return fileRetention
+}
+
+// profileRetentionLimit returns the longest the Pods of a namespace may keep their profiles: the profile retention of
+// the tenant or --profile-retention
+func profileRetentionLimit(namespace string) time.Duration {
+	if tenants != nil {
+		if config, ok := tenants.Config(namespace); ok && config.ProfileRetention > 0 {
+			return config.ProfileRetention
+		}
+	}
+	return profileRetention
+}
+
+// fileRetentionOf returns how long a container file, or one of its rotations, is kept once it isn't written anymore:
+// the retention of its workload or --file-retention, 0 to keep it forever. The tenants expire their own files.
+func (p *retentionPolicies) fileRetentionOf(path string) time.Duration {
+	name := filepath.Base(path)
+	if retention, ok := p.files[name[:strings.LastIndex(name, ".log")+len(".log")]]; ok {
+		return retention
+	}
+	return fileRetention
+}
+
+// overridesFile returns true if the workload of the container file set its own retention
+func (p *retentionPolicies) overridesFile(path string) bool {
+	_, ok := p.files[filepath.Base(path)]
+	return ok
+}
+
+// profileRetentionOf returns how long the profiles of a workload are kept once it stopped running: the retention of
+// the workload, of its tenant or --profile-retention, 0 to keep them forever
+func (p *retentionPolicies) profileRetentionOf(workload string) time.Duration {
+	if retention, ok := p.profiles[workload]; ok {
+		return retention
+	}
+	namespace, _, _, _, _ := parseWorkloadKey(workload)
+	if tenants != nil {
+		if config, ok := tenants.Config(namespace); ok && config.ProfileRetention > 0 {
+			return config.ProfileRetention
+		}
+	}
+	return profileRetention
+}
+
+// cleanupExpiredProfiles deletes the profiles of the workloads which stopped running longer than their retention ago
+func cleanupExpiredProfiles(policies *retentionPolicies) {
+	running := make(map[string]bool)
+	for _, state := range containers.States() {
+		running[state.Workload] = true
+	}
+	expired, err := store.ExpireProfiles(policies.profileRetentionOf, running, time.Now())
+	if err != nil {
+		log.Printf("Error expiring profiles: %v\n", err)
+	}
+	for _, workload := range expired {
+		log.Printf("Profiles of %s expired, deleting them\n", workload)
+		if inventory != nil {
+			inventory.Forget(workload)
+		}
+		metrics.ProfilesExpired.Add(1)
+	}
+}
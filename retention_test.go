@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionAnnotation(t *testing.T) {
+	const name = "example.com/retention"
+	if retention, err := parseRetentionAnnotation(map[string]string{name: "72h"}, name); err != nil || retention != 72*time.Hour {
+		t.Errorf("72h = %v, %v", retention, err)
+	}
+	if retention, err := parseRetentionAnnotation(map[string]string{"other": "1h"}, name); err != nil || retention != 0 {
+		t.Errorf("without the annotation = %v, %v", retention, err)
+	}
+	// Durations only, and positive ones
+	for _, value := range []string{"0s", "-1h", "7d", ""} {
+		if _, err := parseRetentionAnnotation(map[string]string{name: value}, name); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
+
+func TestExpireProfiles(t *testing.T) {
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		stale   = "default/Deployment/old/app"
+		running = "default/Deployment/web/app"
+		kept    = "default/Deployment/db/app"
+	)
+	for _, workload := range []string{stale, running, kept} {
+		if _, _, err := s.MergeSyscalls(workload, []string{"read"}, false, nil, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.MergeRetention(stale, 0, time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	retention := func(workload string) time.Duration {
+		if workload == kept {
+			return 0
+		}
+		return time.Hour
+	}
+	expired, err := s.ExpireProfiles(retention, map[string]bool{running: true}, time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expired, []string{stale}) {
+		t.Errorf("expired %v, want %s", expired, stale)
+	}
+	// The retention of the workload goes along with its profile
+	for _, section := range []string{"syscalls", "retention"} {
+		if _, err := os.Stat(s.path(section, stale)); !os.IsNotExist(err) {
+			t.Errorf("%s of %s still present: %v", section, stale, err)
+		}
+	}
+	for _, workload := range []string{running, kept} {
+		if state, err := s.LoadSyscalls(workload); err != nil || state == nil {
+			t.Errorf("profile of %s removed: %v", workload, err)
+		}
+	}
+}
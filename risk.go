@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Time after which the weight of a signal is halved, and a repeated signal counts again
+var riskHalfLife time.Duration
+
+// Signals raising the risk of a workload
+const (
+	riskPrivilegedSyscall    = "privileged-syscall"
+	riskPrivilegedCapability = "privileged-capability"
+	riskExternalEgress       = "external-egress"
+	riskSensitiveWrite       = "sensitive-write"
+	riskAlert                = "alert"
+)
+
+// Syscalls a workload rarely needs unless it manipulates the kernel, other processes or the namespaces
+var privilegedSyscalls = map[string]bool{
+	"bpf": true, "chroot": true, "delete_module": true, "finit_module": true, "init_module": true, "kexec_file_load": true,
+	"kexec_load": true, "keyctl": true, "mount": true, "open_by_handle_at": true, "perf_event_open": true, "pivot_root": true,
+	"process_vm_writev": true, "ptrace": true, "setns": true, "umount2": true, "unshare": true,
+}
+
+// Capabilities granting control over the node
+var privilegedCapabilities = map[string]bool{
+	"SYS_ADMIN": true, "SYS_MODULE": true, "SYS_PTRACE": true, "SYS_RAWIO": true, "BPF": true, "NET_ADMIN": true,
+	"DAC_READ_SEARCH": true,
+}
+
+// Files whose modification at runtime persists or escalates an intrusion
+var sensitivePathPrefixes = []string{"/etc/", "/bin/", "/sbin/", "/usr/bin/", "/usr/sbin/", "/lib/", "/usr/lib/", "/root/.ssh/", "/var/run/secrets/"}
+
+// Weight of each signal, and of the alerts by severity
+var riskWeights = map[string]float64{
+	riskPrivilegedSyscall:    10,
+	riskPrivilegedCapability: 5,
+	riskExternalEgress:       2,
+	riskSensitiveWrite:       8,
+}
+var riskAlertWeights = map[string]float64{"info": 1, "warning": 5, "critical": 15}
+
+// Number of signals kept per workload for the API
+const riskRecentSignals = 20
+
+// Score below which a workload is forgotten
+const riskForgetScore = 0.01
+
+// RiskSignal is an observation raising the risk of a workload
+type RiskSignal struct {
+	Time   time.Time `json:"time"`
+	Signal string    `json:"signal"`
+	// What was observed, e.g. the syscall, destination or path
+	Detail string  `json:"detail"`
+	Weight float64 `json:"weight"`
+}
+
+// WorkloadRisk is the rolling risk score of a workload, the signals weighing less as they get older
+type WorkloadRisk struct {
+	Workload  string `json:"workload"`
+	Namespace string `json:"namespace"`
+	// Sum of the decayed weights of the signals
+	Score float64 `json:"score"`
+	// Score by signal
+	Signals map[string]float64 `json:"signals"`
+	// Last signals, the latest first
+	Recent []RiskSignal `json:"recent"`
+}
+
+// workloadRisk is the score of a workload as of its last update
+type workloadRisk struct {
+	namespace string
+	updated   time.Time
+	signals   map[string]float64
+	// When each signal detail last counted, a repeated detail counts once per half-life
+	seen   map[string]time.Time
+	recent []RiskSignal
+}
+
+// RiskScores ranks the workloads by the risk of their observed behavior
+type RiskScores struct {
+	lock      sync.Mutex
+	workloads map[string]*workloadRisk
+}
+
+var riskScores *RiskScores
+
+// NewRiskScores creates the scores, empty until the workloads show risky behavior
+func NewRiskScores() *RiskScores {
+	return &RiskScores{workloads: make(map[string]*workloadRisk)}
+}
+
+// riskDecay returns the factor applied to a weight after the elapsed time
+func riskDecay(elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, float64(elapsed)/float64(riskHalfLife))
+}
+
+// decayTo brings the scores of the workload to the time
+func (w *workloadRisk) decayTo(now time.Time) {
+	factor := riskDecay(now.Sub(w.updated))
+	for signal, score := range w.signals {
+		w.signals[signal] = score * factor
+	}
+	if now.After(w.updated) {
+		w.updated = now
+	}
+}
+
+func (w *workloadRisk) score() float64 {
+	total := 0.0
+	for _, score := range w.signals {
+		total += score
+	}
+	return total
+}
+
+// add raises the score of a workload, unless the detail of the signal already counted within the half-life
+func (r *RiskScores) add(workload string, namespace string, now time.Time, signal string, detail string, weight float64, dedup bool) {
+	if workload == "" {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	w, ok := r.workloads[workload]
+	if !ok {
+		w = &workloadRisk{namespace: namespace, updated: now, signals: make(map[string]float64), seen: make(map[string]time.Time)}
+		r.workloads[workload] = w
+	}
+	if dedup {
+		key := signal + " " + detail
+		if last, ok := w.seen[key]; ok && now.Sub(last) < riskHalfLife {
+			return
+		}
+		w.seen[key] = now
+		// The details past the half-life count again anyway
+		if len(w.seen) > maxInventoryItems {
+			for key, last := range w.seen {
+				if now.Sub(last) >= riskHalfLife {
+					delete(w.seen, key)
+				}
+			}
+		}
+	}
+	w.decayTo(now)
+	w.signals[signal] += weight
+	w.recent = append([]RiskSignal{{Time: now, Signal: signal, Detail: detail, Weight: weight}}, w.recent...)
+	if len(w.recent) > riskRecentSignals {
+		w.recent = w.recent[:riskRecentSignals]
+	}
+}
+
+// Observe scores the event of a container
+func (r *RiskScores) Observe(key ContainerKey, event *Event) {
+	state, ok := containers.Get(key)
+	if !ok {
+		return
+	}
+	switch event.Type {
+	case "new-syscall":
+		if privilegedSyscalls[event.Syscall] {
+			r.add(state.Workload, key.Namespace, event.Time, riskPrivilegedSyscall, event.Syscall, riskWeights[riskPrivilegedSyscall], true)
+		}
+	case "capability":
+		if event.Verdict == "Allow" && privilegedCapabilities[event.Capability] {
+			r.add(state.Workload, key.Namespace, event.Time, riskPrivilegedCapability, event.Capability, riskWeights[riskPrivilegedCapability], true)
+		}
+	case "tcp":
+		if event.Operation == "connect" && externalAddress(event.Dst) {
+			r.add(state.Workload, key.Namespace, event.Time, riskExternalEgress, fmt.Sprintf("%s:%d", event.Dst, event.Dport), riskWeights[riskExternalEgress], true)
+		}
+	case "drift":
+		if hasAnyPathPrefix(event.Path, sensitivePathPrefixes) {
+			r.add(state.Workload, key.Namespace, event.Time, riskSensitiveWrite, event.Path, riskWeights[riskSensitiveWrite], true)
+		}
+	}
+}
+
+// ObserveSyscalls scores the syscalls a container did for the first time
+func (r *RiskScores) ObserveSyscalls(state *ContainerState, syscalls []string, now time.Time) {
+	for _, syscall := range syscalls {
+		if privilegedSyscalls[syscall] {
+			r.add(state.Workload, state.Key.Namespace, now, riskPrivilegedSyscall, syscall, riskWeights[riskPrivilegedSyscall], true)
+		}
+	}
+}
+
+// ObserveAlert scores an alert, every one of them counts
+func (r *RiskScores) ObserveAlert(alert *Event) {
+	workload := alert.Workload
+	if workload == "" {
+		state, ok := containers.Get(ContainerKey{alert.Namespace, alert.Pod, alert.Container})
+		if !ok {
+			return
+		}
+		workload = state.Workload
+	}
+	r.add(workload, alert.Namespace, alert.Time, riskAlert, alert.Rule, riskAlertWeights[alert.Severity], false)
+}
+
+// externalAddress returns true for the addresses outside of the cluster CIDRs of the rules, and of the private ranges
+func externalAddress(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return false
+	}
+	if rulesConfig != nil {
+		for _, network := range rulesConfig.clusterNets {
+			if network.Contains(ip) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Scores returns the risk of the workloads of the namespace (all of them if empty) as of now, the riskiest first. The
+// workloads whose score decayed away are forgotten.
+func (r *RiskScores) Scores(namespace string, now time.Time) []WorkloadRisk {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var scores []WorkloadRisk
+	for workload, w := range r.workloads {
+		w.decayTo(now)
+		score := w.score()
+		if score < riskForgetScore {
+			delete(r.workloads, workload)
+			continue
+		}
+		if namespace != "" && w.namespace != namespace {
+			continue
+		}
+		risk := WorkloadRisk{Workload: workload, Namespace: w.namespace, Score: math.Round(score*100) / 100, Signals: make(map[string]float64, len(w.signals)), Recent: append([]RiskSignal{}, w.recent...)}
+		for signal, value := range w.signals {
+			risk.Signals[signal] = math.Round(value*100) / 100
+		}
+		scores = append(scores, risk)
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score > scores[j].Score
+		}
+		return scores[i].Workload < scores[j].Workload
+	})
+	return scores
+}
+
+func (r *RiskScores) writeMetrics(w io.Writer) {
+	scores := r.Scores("", time.Now())
+	writeMetricHeader(w, "wlftracer_workload_risk_score", "gauge", "Rolling risk score of the workloads from their privileged syscalls and capabilities, external egress, writes to sensitive paths and alerts")
+	for _, risk := range scores {
+		fmt.Fprintf(w, "wlftracer_workload_risk_score{namespace=%s,workload=%s} %g\n", labelValue(risk.Namespace), labelValue(risk.Workload), risk.Score)
+	}
+}
+
+func registerRiskHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/risk", riskHandler)
+}
+
+// riskHandler ranks the workloads of a namespace (?namespace=<namespace>, all the namespaces if empty) by their risk
+// score, optionally the ?limit= riskiest only, so the teams know where to enforce the profiles first
+func riskHandler(w http.ResponseWriter, r *http.Request) {
+	if riskScores == nil {
+		http.Error(w, "the risk scoring is disabled, see --risk-scoring", http.StatusServiceUnavailable)
+		return
+	}
+	namespace := r.URL.Query().Get("namespace")
+	if status, err := authorizeNamespace(r, namespace); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	scores := riskScores.Scores(namespace, time.Now())
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, "limit must be positive", http.StatusBadRequest)
+			return
+		}
+		if len(scores) > limit {
+			scores = scores[:limit]
+		}
+	}
+	if scores == nil {
+		scores = []WorkloadRisk{}
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"namespace": namespace, "halfLife": riskHalfLife.String(), "workloads": scores})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Directory of the container files
+var outputDir = "/tmp"
+
+// Size above which a container file is rotated, 0 to never rotate
+var maxFileSize int64
+
+// Number of rotated files kept per container, and whether they are compressed with gzip
+var maxRotatedFiles int
+var compressRotated bool
+
+// How long the files of the containers which are gone are kept, 0 to keep them forever
+var fileRetention time.Duration
+
+// Names of the container files and of their rotations
+var containerFileRegex = regexp.MustCompile(`\.log(\.[0-9]+(\.gz)?)?$`)
+
+// rotatingFile is a container file rotated once it reaches maxFileSize: <file>.log is renamed <file>.log.1, which is
+// renamed <file>.log.2 on the next rotation and so on, up to maxRotatedFiles
+type rotatingFile struct {
+	path string
+	f    *os.File
+	size int64
+	// Set when the file is encrypted at rest
+	records *recordWriter
+	// Closed once the last rotated file is compressed, nil if there is none being compressed
+	compressing chan struct{}
+}
+
+// openContainerFile opens the file of a container, appending so a restarted container doesn't clobber it
+func openContainerFile(key ContainerKey) (*rotatingFile, error) {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("creating output directory: %w", err)
+	}
+	r := &rotatingFile{path: filepath.Join(outputDir, fmt.Sprintf("%s-%s-%s.log", key.Namespace, key.Podname, key.ContainerName))}
+	err := r.open()
+	if errors.Is(err, errNotEncrypted) || errors.Is(err, errCorruptRecords) {
+		// Encrypted records can't be appended to a file in clear, nor after records which were tampered with
+		log.Printf("%s isn't encrypted or its records are corrupt, rotating it\n", r.path)
+		err = r.rotate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the file, errNotEncrypted (errCorruptRecords) is returned with the file open if it has to be encrypted but
+// was written in clear (its records were tampered with)
+func (r *rotatingFile) open() error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if atRestKey != nil {
+		// The data key is read back from the header of the file
+		flags = os.O_CREATE | os.O_RDWR | os.O_APPEND
+	}
+	f, err := os.OpenFile(r.path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.records = f, info.Size(), nil
+	if atRestKey == nil {
+		return nil
+	}
+	records, err := atRestKey.newRecordWriter(f, r.size)
+	if errors.Is(err, errNotEncrypted) || errors.Is(err, errCorruptRecords) {
+		return err
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("encrypting %s: %w", r.path, err)
+	}
+	r.records, r.size = records, records.size
+	return nil
+}
+
+// Name returns the path of the file currently written
+func (r *rotatingFile) Name() string {
+	return r.path
+}
+
+func (r *rotatingFile) Write(data []byte) (int, error) {
+	if maxFileSize > 0 && r.size > 0 && r.size+int64(len(data)) > maxFileSize {
+		if err := r.rotate(); err != nil {
+			return 0, fmt.Errorf("rotating: %w", err)
+		}
+	}
+	if r.records != nil {
+		n, err := r.records.Write(data)
+		r.size = r.records.size
+		return n, err
+	}
+	n, err := r.f.Write(data)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the rotated files, dropping the oldest one, and starts a new file
+func (r *rotatingFile) rotate() error {
+	r.waitCompression()
+	r.finish()
+	if err := r.f.Close(); err != nil {
+		log.Printf("Error closing %s: %v\n", r.path, err)
+	}
+	if maxRotatedFiles > 0 {
+		removeRotation(r.path, maxRotatedFiles)
+		for i := maxRotatedFiles - 1; i > 0; i-- {
+			for _, suffix := range []string{"", ".gz"} {
+				err := os.Rename(fmt.Sprintf("%s.%d%s", r.path, i, suffix), fmt.Sprintf("%s.%d%s", r.path, i+1, suffix))
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	metrics.FilesRotated.Add(1)
+
+	if maxRotatedFiles > 0 && compressRotated {
+		// Compressed in the background, the event worker doesn't wait for it
+		done := make(chan struct{})
+		r.compressing = done
+		go func() {
+			defer close(done)
+			if err := gzipFile(r.path + ".1"); err != nil {
+				log.Printf("Error compressing %s.1: %v\n", r.path, err)
+			}
+		}()
+	}
+	return nil
+}
+
+func (r *rotatingFile) waitCompression() {
+	if r.compressing != nil {
+		<-r.compressing
+		r.compressing = nil
+	}
+}
+
+func (r *rotatingFile) Sync() error {
+	return r.f.Sync()
+}
+
+// Close closes the file once the last rotated file is compressed
+func (r *rotatingFile) Close() error {
+	r.waitCompression()
+	r.finish()
+	return r.f.Close()
+}
+
+// finish ends the encrypted records of the file, they are appended to after the last complete one if it is reopened
+func (r *rotatingFile) finish() {
+	if r.records == nil {
+		return
+	}
+	if err := r.records.Finish(); err != nil {
+		log.Printf("Error finishing %s: %v\n", r.path, err)
+	}
+	r.records = nil
+}
+
+// gzipFile replaces the file with its gzip compressed <file>.gz
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz.tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".gz.tmp", path+".gz")
+	}
+	if err != nil {
+		os.Remove(path + ".gz.tmp")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// removeRotation removes the i-th rotated file of a container file, compressed or not
+func removeRotation(path string, i int) {
+	for _, suffix := range []string{"", ".gz"} {
+		rotated := fmt.Sprintf("%s.%d%s", path, i, suffix)
+		if err := os.Remove(rotated); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error deleting %s: %v\n", rotated, err)
+		}
+	}
+}
+
+// removeContainerFiles deletes a container file and its rotated files
+func removeContainerFiles(path string) error {
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(path), globEscape(filepath.Base(path))+".*"))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		if containerFileRegex.MatchString(match) {
+			if err := os.Remove(match); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func globEscape(name string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`).Replace(name)
+}
+
+// cleanupExpiredFiles deletes the container files of the output directory, and their rotations, which weren't written
+// for the retention period of their workload and don't belong to a running container
+func cleanupExpiredFiles(policies *retentionPolicies) {
+	running := make(map[string]bool)
+	for _, state := range containers.States() {
+		running[state.File.Name()] = true
+	}
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		log.Printf("Error listing %s: %v\n", outputDir, err)
+		return
+	}
+	defer pruneRetentionFiles()
+	for _, entry := range entries {
+		if entry.IsDir() || !containerFileRegex.MatchString(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(outputDir, entry.Name())
+		if running[path[:strings.LastIndex(path, ".log")+len(".log")]] {
+			continue
+		}
+		retention := policies.fileRetentionOf(path)
+		if retention == 0 {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < retention {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error deleting %s: %v\n", path, err)
+			continue
+		}
+		metrics.FilesExpired.Add(1)
+	}
+}
+
+// pruneRetentionFiles drops the container files deleted, with all their rotations, from the retentions of the workloads
+func pruneRetentionFiles() {
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		log.Printf("Error listing %s: %v\n", outputDir, err)
+		return
+	}
+	remaining := make(map[string]bool)
+	for _, entry := range entries {
+		if !entry.IsDir() && containerFileRegex.MatchString(entry.Name()) {
+			remaining[entry.Name()[:strings.LastIndex(entry.Name(), ".log")+len(".log")]] = true
+		}
+	}
+	if err := store.PruneRetentionFiles(func(file string) bool { return remaining[file] }); err != nil {
+		log.Printf("Error pruning the retentions: %v\n", err)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// Rule raises an alert for the events matching all its conditions, the empty conditions match everything
+type Rule struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// info, warning or critical
+	Severity string `json:"severity,omitempty"`
+
+	// Event types (exec, open, tcp, dns, capability...)
+	Types []string `json:"types,omitempty"`
+	// Glob patterns of the path of the file opened or executed
+	Paths []string `json:"paths,omitempty"`
+	// Names of the file opened or executed, without directory (e.g. sh, bash)
+	Basenames []string `json:"basenames,omitempty"`
+	Comms     []string `json:"comms,omitempty"`
+	// Operations of the network events (e.g. connect, accept)
+	Operations []string `json:"operations,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Labels the Pod must have, and labels it must not have (e.g. debug: "true")
+	Labels       map[string]string `json:"labels,omitempty"`
+	ExceptLabels map[string]string `json:"exceptLabels,omitempty"`
+	// Matches the TCP events whose destination is outside of the cluster CIDRs of the rules file
+	DstOutsideCluster bool `json:"dstOutsideCluster,omitempty"`
+	// CEL expression the event must match, e.g. event.type == 'open' && event.path.startsWith('/etc')
+	Expression string `json:"expression,omitempty"`
+
+	expression *EventExpression
+}
+
+// RulesConfig is the YAML file of the rules
+type RulesConfig struct {
+	// CIDRs of the Pods and Services of the cluster
+	ClusterCIDRs []string `json:"clusterCIDRs,omitempty"`
+	Rules        []Rule   `json:"rules"`
+	// Queries run on a schedule against the events kept
+	Queries []SavedQuery `json:"queries,omitempty"`
+	// CEL expression the events must match to be dispatched, the others are dropped before the sinks, the history
+	// and the API
+	Filter string `json:"filter,omitempty"`
+	// CEL expressions selecting the events of the sinks by name (e.g. http, splunk, datadog), the sinks without a route
+	// get all the events
+	Routes map[string]string `json:"routes,omitempty"`
+
+	clusterNets []*net.IPNet
+	filter      *EventExpression
+	routes      map[string]*EventExpression
+}
+
+// Evaluates the events against the rules, nil if there are none
+var rulesConfig *RulesConfig
+
+// Sinks the alerts are sent to, apart from the other events
+var alertSinks []Sink
+
+// LoadRulesConfig reads and validates the rules of a YAML (or JSON) file
+func LoadRulesConfig(file string) (*RulesConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading rules: %w", err)
+	}
+	config := &RulesConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("decoding rules: %w", err)
+	}
+	for _, cidr := range config.ClusterCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster CIDR %q: %w", cidr, err)
+		}
+		config.clusterNets = append(config.clusterNets, network)
+	}
+	names := make(map[string]bool, len(config.Rules)+len(config.Queries))
+	rules := make([]*Rule, 0, len(config.Rules)+len(config.Queries))
+	for i := range config.Rules {
+		rules = append(rules, &config.Rules[i])
+	}
+	for i := range config.Queries {
+		rules = append(rules, &config.Queries[i].Rule)
+	}
+	for i, rule := range rules {
+		if rule.Name == "" || names[rule.Name] {
+			return nil, fmt.Errorf("rule %d: the rules need a unique name", i+1)
+		}
+		names[rule.Name] = true
+		if rule.Severity == "" {
+			rule.Severity = "warning"
+		}
+		if rule.Severity != "info" && rule.Severity != "warning" && rule.Severity != "critical" {
+			return nil, fmt.Errorf("rule %s: invalid severity %q, expected info, warning or critical", rule.Name, rule.Severity)
+		}
+		for _, pattern := range rule.Paths {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %s: invalid path pattern %q: %w", rule.Name, pattern, err)
+			}
+		}
+		if rule.DstOutsideCluster && len(config.clusterNets) == 0 {
+			return nil, fmt.Errorf("rule %s: dstOutsideCluster requires clusterCIDRs", rule.Name)
+		}
+		if rule.Expression != "" {
+			if rule.expression, err = compileEventExpression(rule.Expression); err != nil {
+				return nil, fmt.Errorf("rule %s: invalid expression: %w", rule.Name, err)
+			}
+		}
+	}
+	if config.Filter != "" {
+		if config.filter, err = compileEventExpression(config.Filter); err != nil {
+			return nil, fmt.Errorf("invalid filter: %w", err)
+		}
+	}
+	config.routes = make(map[string]*EventExpression, len(config.Routes))
+	for sink, expression := range config.Routes {
+		if config.routes[sink], err = compileEventExpression(expression); err != nil {
+			return nil, fmt.Errorf("invalid route of sink %s: %w", sink, err)
+		}
+	}
+	for i := range config.Queries {
+		if err := validateQuery(&config.Queries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Evaluate returns the rules matched by the event of a container with the labels
+func (c *RulesConfig) Evaluate(event *Event, labels map[string]string) []*Rule {
+	var matched []*Rule
+	for i := range c.Rules {
+		if c.matches(&c.Rules[i], event, labels) {
+			matched = append(matched, &c.Rules[i])
+		}
+	}
+	return matched
+}
+
+func (c *RulesConfig) matches(rule *Rule, event *Event, labels map[string]string) bool {
+	if len(rule.Types) > 0 && !containsString(rule.Types, event.Type) {
+		return false
+	}
+	if len(rule.Namespaces) > 0 && !containsString(rule.Namespaces, event.Namespace) {
+		return false
+	}
+	if len(rule.Comms) > 0 && !containsString(rule.Comms, event.Comm) {
+		return false
+	}
+	if len(rule.Operations) > 0 && !containsString(rule.Operations, event.Operation) {
+		return false
+	}
+	if len(rule.Basenames) > 0 && (event.Path == "" || !containsString(rule.Basenames, filepath.Base(event.Path))) {
+		return false
+	}
+	if len(rule.Paths) > 0 {
+		found := false
+		for _, pattern := range rule.Paths {
+			if ok, _ := path.Match(pattern, event.Path); ok && event.Path != "" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for key, value := range rule.Labels {
+		if labels[key] != value {
+			return false
+		}
+	}
+	for key, value := range rule.ExceptLabels {
+		if labels[key] == value {
+			return false
+		}
+	}
+	if rule.DstOutsideCluster {
+		ip := net.ParseIP(event.Dst)
+		if event.Type != "tcp" || ip == nil || ip.IsLoopback() {
+			return false
+		}
+		for _, network := range c.clusterNets {
+			if network.Contains(ip) {
+				return false
+			}
+		}
+	}
+	// Evaluated last, it is the costliest condition
+	if rule.expression != nil && !rule.expression.Matches(newCELActivation(event, labels)) {
+		return false
+	}
+	return true
+}
+
+// checkRoutes checks the routes name sinks the events are dispatched to, once they are all created
+func (c *RulesConfig) checkRoutes() error {
+	for sink := range c.routes {
+		if !containsString(sinkNames, sink) {
+			return fmt.Errorf("route of sink %s: no such sink, expected one of %s", sink, strings.Join(sinkNames, ", "))
+		}
+	}
+	return nil
+}
+
+// rulesActivation exposes the event and the labels of its container to the filter and the routes
+func rulesActivation(event *Event) celActivation {
+	var labels map[string]string
+	if state, ok := containers.Get(ContainerKey{event.Namespace, event.Pod, event.Container}); ok {
+		labels = state.Labels
+	}
+	return newCELActivation(event, labels)
+}
+
+// evaluateRules raises the alerts of the rules matched by an event, called from the event worker. The workloads which
+// aren't in alert mode only record them in their container file.
+func evaluateRules(key ContainerKey, event *Event) {
+	state, ok := containers.Get(key)
+	if !ok {
+		return
+	}
+	for _, rule := range rulesConfig.Evaluate(event, state.Labels) {
+		message := rule.Description
+		if message == "" {
+			message = rule.Name
+		}
+		log.Printf("Alert %s in %s/%s/%s: %s\n", rule.Name, key.Namespace, key.Podname, key.ContainerName, message)
+		writeContainerEvent(key, event.Time, fmt.Sprintf("alert: %s severity: %s\n", rule.Name, rule.Severity))
+		if !state.Alerts() {
+			continue
+		}
+
+		alert := *event
+		alert.Type = "alert"
+		alert.Rule = rule.Name
+		alert.Severity = rule.Severity
+		alert.Message = message
+		alert.AlertedType = event.Type
+		alert.ID = nextEventID()
+		enrichEvent(key, &alert)
+		dispatchAlert(&alert)
+		activityMetrics.ObserveAlert(&alert)
+		if riskScores != nil {
+			riskScores.ObserveAlert(&alert)
+		}
+	}
+}
+
+// dispatchAlert hands the alert over to the alert sinks
+func dispatchAlert(alert *Event) {
+	if redactor != nil {
+		alert = redactor.Redact(alert)
+	}
+	for _, sink := range alertSinks {
+		if err := sink.Write(alert); err != nil {
+			log.Printf("Error writing alert to sink: %v\n", err)
+		}
+	}
+}
+
+// closeAlertSinks flushes and closes the alert sinks
+func closeAlertSinks() {
+	for _, sink := range alertSinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("Error closing alert sink: %v\n", err)
+		}
+	}
+}
+
+// Time during which the same alert of a Pod is reported by a single Kubernetes Event
+const kubeEventDedupWindow = time.Minute
+
+// kubeEventSink reports the alerts as Kubernetes Events of their Pod. The Events are created from the goroutine of its
+// batcher, so a slow API server never stalls the event worker.
+type kubeEventSink struct {
+	client  kubernetes.Interface
+	batcher *batcher
+	lock    sync.Mutex
+	// Last time an alert was reported, by Pod and rule
+	reported map[string]time.Time
+	pruned   time.Time
+}
+
+// NewKubeEventSink creates a sink creating the Events with the client
+func NewKubeEventSink(client kubernetes.Interface) Sink {
+	s := &kubeEventSink{client: client, reported: make(map[string]time.Time), pruned: time.Now()}
+	s.batcher = newBatcher("kube-events", 1, time.Second, deliveryBestEffort, s.send)
+	return s
+}
+
+// Write queues a Warning Event on the Pod, once per rule within the dedup window
+func (s *kubeEventSink) Write(alert *Event) error {
+	// The alerts of the saved queries which matched no event have no Pod
+	if alert.Pod == "" {
+		return nil
+	}
+	key := alert.Namespace + "/" + alert.Pod + "/" + alert.Rule
+	s.lock.Lock()
+	now := time.Now()
+	if now.Sub(s.pruned) > kubeEventDedupWindow {
+		for reportedKey, reportedAt := range s.reported {
+			if now.Sub(reportedAt) > kubeEventDedupWindow {
+				delete(s.reported, reportedKey)
+			}
+		}
+		s.pruned = now
+	}
+	if reportedAt, ok := s.reported[key]; ok && now.Sub(reportedAt) <= kubeEventDedupWindow {
+		s.lock.Unlock()
+		return nil
+	}
+	s.reported[key] = now
+	s.lock.Unlock()
+
+	s.batcher.Add(alert)
+	return nil
+}
+
+// send creates the Events of the alerts
+func (s *kubeEventSink) send(alerts []*Event) error {
+	for _, alert := range alerts {
+		if err := s.create(alert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *kubeEventSink) create(alert *Event) error {
+	var podUID string
+	if state, ok := containers.Get(ContainerKey{alert.Namespace, alert.Pod, alert.Container}); ok {
+		podUID = state.PodUID
+	}
+	timestamp := metav1.NewTime(alert.Time)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := s.client.CoreV1().Events(alert.Namespace).Create(ctx, &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: alert.Pod + "-wlftracer-"},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  alert.Namespace,
+			Name:       alert.Pod,
+			UID:        types.UID(podUID),
+			FieldPath:  fmt.Sprintf("spec.containers{%s}", alert.Container),
+		},
+		Reason:              "RuntimeAlert",
+		Message:             fmt.Sprintf("%s (%s): %s", alert.Rule, alert.Severity, alertDetails(alert)),
+		Type:                corev1.EventTypeWarning,
+		Source:              corev1.EventSource{Component: "wlftracer", Host: NodeName},
+		FirstTimestamp:      timestamp,
+		LastTimestamp:       timestamp,
+		Count:               1,
+		ReportingController: "wlftracer",
+		ReportingInstance:   NodeName,
+	}, metav1.CreateOptions{})
+	return err
+}
+
+// Close creates the Events of the queued alerts
+func (s *kubeEventSink) Close() error {
+	s.batcher.Close()
+	return nil
+}
+
+// alertDetails describes the event which raised the alert
+func alertDetails(alert *Event) string {
+	switch alert.AlertedType {
+	case "tcp":
+		return fmt.Sprintf("%s %s %s -> %s:%d", alert.Message, alert.Operation, alert.Comm, alert.Dst, alert.Dport)
+	case "dns":
+		return fmt.Sprintf("%s %s resolved %s", alert.Message, alert.Comm, alert.DNSName)
+	case "capability":
+		return fmt.Sprintf("%s %s used %s", alert.Message, alert.Comm, alert.Capability)
+	default:
+		return strings.TrimSpace(fmt.Sprintf("%s %s %s %s", alert.Message, alert.AlertedType, alert.Comm, alert.Path))
+	}
+}
+
+// containsString returns true if the value is one of the values
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestRules loads the rules of a YAML document
+func loadTestRules(t *testing.T, content string) (*RulesConfig, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadRulesConfig(file)
+}
+
+const testRules = `
+clusterCIDRs: ["10.0.0.0/8"]
+rules:
+- name: shell
+  types: [exec]
+  basenames: [sh, bash]
+- name: etc
+  types: [open]
+  paths: ["/etc/*"]
+- name: prod-curl
+  comms: [curl]
+  namespaces: [prod]
+- name: egress
+  operations: [connect]
+  dstOutsideCluster: true
+- name: expression
+  expression: event.type == 'dns' && event.dnsName.endsWith('.example.com')
+`
+
+func TestRulesConfigMatches(t *testing.T) {
+	config, err := loadTestRules(t, testRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matched := func(event Event) []string {
+		var names []string
+		for _, rule := range config.Evaluate(&event, nil) {
+			names = append(names, rule.Name)
+		}
+		return names
+	}
+
+	for _, event := range []Event{
+		{Type: "exec", Path: "/bin/sh"},
+		{Type: "exec", Path: "/usr/bin/bash"},
+		{Type: "open", Path: "/etc/passwd"},
+		{Type: "exec", Comm: "curl", Namespace: "prod"},
+		{Type: "tcp", Operation: "connect", Dst: "93.184.216.34"},
+		{Type: "dns", DNSName: "api.example.com"},
+	} {
+		if names := matched(event); len(names) != 1 {
+			t.Errorf("%+v matched %v, want one rule", event, names)
+		}
+	}
+
+	for _, event := range []Event{
+		{Type: "exec", Path: "/bin/ls"},
+		{Type: "open", Path: "/bin/sh"},
+		{Type: "exec"},
+		{Type: "open", Path: "/etc/ssl/cert.pem"},
+		{Type: "exec", Comm: "curl", Namespace: "dev"},
+		{Type: "tcp", Operation: "connect", Dst: "10.1.2.3"},
+		{Type: "tcp", Operation: "connect", Dst: "127.0.0.1"},
+		{Type: "tcp", Operation: "accept", Dst: "93.184.216.34"},
+		{Type: "tcp", Operation: "connect", Dst: "not an address"},
+		{Type: "dns", DNSName: "example.org"},
+	} {
+		if names := matched(event); len(names) != 0 {
+			t.Errorf("%+v matched %v", event, names)
+		}
+	}
+}
+
+func TestRulesConfigMatchesLabels(t *testing.T) {
+	config, err := loadTestRules(t, "rules:\n- name: labeled\n  labels: {app: web}\n  exceptLabels: {debug: \"true\"}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &Event{Type: "open"}
+	if len(config.Evaluate(event, map[string]string{"app": "web"})) != 1 {
+		t.Error("labeled Pod not matched")
+	}
+	if len(config.Evaluate(event, map[string]string{"app": "web", "debug": "true"})) != 0 {
+		t.Error("excepted Pod matched")
+	}
+	if len(config.Evaluate(event, nil)) != 0 {
+		t.Error("Pod without labels matched")
+	}
+}
+
+func TestLoadRulesConfig(t *testing.T) {
+	config, err := loadTestRules(t, "rules:\n- name: a\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Rules[0].Severity != "warning" {
+		t.Errorf("default severity = %q, want warning", config.Rules[0].Severity)
+	}
+
+	for _, content := range []string{
+		"rules:\n- types: [exec]\n",
+		"rules:\n- name: a\n- name: a\n",
+		"rules:\n- name: a\n  severity: high\n",
+		"rules:\n- name: a\n  paths: [\"[\"]\n",
+		"rules:\n- name: a\n  dstOutsideCluster: true\n",
+		"clusterCIDRs: [\"10.0.0.0\"]\nrules: []\n",
+		"rules:\n- name: a\n  expression: event.type ==\n",
+		"rules:\n- name: a\n  kind: exec\n",
+		"rules: []\nfilter: \"event.type\"\n",
+	} {
+		if _, err := loadTestRules(t, content); err == nil {
+			t.Errorf("accepted %q", content)
+		}
+	}
+}
+
+func TestEvaluateRulesOnlyAlertsInAlertMode(t *testing.T) {
+	config, err := loadTestRules(t, testRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alertSink := &recordingSink{}
+	rulesConfig, alertSinks = config, []Sink{alertSink}
+	defer func() { rulesConfig, alertSinks = nil, nil }()
+
+	learning := registerTestContainer(t, ContainerKey{"prod", "api-0", "api"}, modeLearn)
+	alerting := registerTestContainer(t, ContainerKey{"prod", "api-1", "api"}, modeAlert)
+	for _, state := range []*ContainerState{learning, alerting} {
+		evaluateRules(state.Key, &Event{Type: "exec", Time: time.Now(), Path: "/bin/sh", Namespace: "prod"})
+		if file := containerFile(t, state); !strings.Contains(file, "alert: shell severity: warning") {
+			t.Errorf("alert not written to the file of %s: %q", state.Key.Podname, file)
+		}
+	}
+
+	if len(alertSink.events) != 1 {
+		t.Fatalf("%d alerts sent, want the one of the alerting Pod", len(alertSink.events))
+	}
+	if alert := alertSink.events[0]; alert.Rule != "shell" || alert.AlertedType != "exec" {
+		t.Errorf("alert = %+v", alert)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SBOMComponent is a package described by an SBOM
+type SBOMComponent struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl,omitempty"`
+}
+
+// SBOMIndex maps the files of an image to the components owning them
+type SBOMIndex struct {
+	components []SBOMComponent
+	files      map[string][]int
+}
+
+// Components returns the components owning a file
+func (i *SBOMIndex) Components(file string) []SBOMComponent {
+	var components []SBOMComponent
+	for _, c := range i.files[normalizeSBOMPath(file)] {
+		components = append(components, i.components[c])
+	}
+	return components
+}
+
+// SBOMLoader loads the SBOMs of images from a directory, the file of an image is named after its reference with '/', ':' and '@' replaced by '_'
+type SBOMLoader struct {
+	dir     string
+	lock    sync.Mutex
+	indexes map[string]*SBOMIndex
+}
+
+var sbomLoader *SBOMLoader
+
+// NewSBOMLoader creates a loader reading SBOMs from the directory
+func NewSBOMLoader(dir string) *SBOMLoader {
+	return &SBOMLoader{dir: dir, indexes: make(map[string]*SBOMIndex)}
+}
+
+// ForImage returns the index of the image SBOM, or nil when there is none
+func (l *SBOMLoader) ForImage(image string) *SBOMIndex {
+	if image == "" {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if index, ok := l.indexes[image]; ok {
+		return index
+	}
+
+	// The SBOMs are named by the users after the scheme documented in --sbom-dir
+	name := legacyStoreFileName(image)
+	var index *SBOMIndex
+	for _, suffix := range []string{".spdx.json", ".cdx.json", ".json"} {
+		data, err := os.ReadFile(filepath.Join(l.dir, name+suffix))
+		if err != nil {
+			continue
+		}
+		index, err = parseSBOM(data)
+		if err != nil {
+			log.Printf("Error parsing SBOM of %s: %v\n", image, err)
+		}
+		break
+	}
+	// Also cache misses, so the directory isn't hit for every container of the image
+	l.indexes[image] = index
+	return index
+}
+
+// parseSBOM builds an index from an SPDX or CycloneDX JSON document
+func parseSBOM(data []byte) (*SBOMIndex, error) {
+	var doc struct {
+		SPDXVersion string `json:"spdxVersion"`
+		BOMFormat   string `json:"bomFormat"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	switch {
+	case doc.SPDXVersion != "":
+		return parseSPDX(data)
+	case doc.BOMFormat == "CycloneDX":
+		return parseCycloneDX(data)
+	}
+	return nil, fmt.Errorf("unknown SBOM format")
+}
+
+func parseSPDX(data []byte) (*SBOMIndex, error) {
+	var doc struct {
+		Packages []struct {
+			SPDXID       string   `json:"SPDXID"`
+			Name         string   `json:"name"`
+			VersionInfo  string   `json:"versionInfo"`
+			HasFiles     []string `json:"hasFiles"`
+			ExternalRefs []struct {
+				ReferenceType    string `json:"referenceType"`
+				ReferenceLocator string `json:"referenceLocator"`
+			} `json:"externalRefs"`
+		} `json:"packages"`
+		Files []struct {
+			SPDXID   string `json:"SPDXID"`
+			FileName string `json:"fileName"`
+		} `json:"files"`
+		Relationships []struct {
+			Element string `json:"spdxElementId"`
+			Type    string `json:"relationshipType"`
+			Related string `json:"relatedSpdxElement"`
+		} `json:"relationships"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	index := &SBOMIndex{files: make(map[string][]int)}
+	packages := make(map[string]int)
+	for _, p := range doc.Packages {
+		component := SBOMComponent{Name: p.Name, Version: p.VersionInfo}
+		for _, ref := range p.ExternalRefs {
+			if ref.ReferenceType == "purl" {
+				component.PURL = ref.ReferenceLocator
+			}
+		}
+		packages[p.SPDXID] = len(index.components)
+		index.components = append(index.components, component)
+	}
+	files := make(map[string]string)
+	for _, f := range doc.Files {
+		files[f.SPDXID] = f.FileName
+	}
+
+	for _, p := range doc.Packages {
+		for _, file := range p.HasFiles {
+			index.add(files[file], packages[p.SPDXID])
+		}
+	}
+	for _, r := range doc.Relationships {
+		switch r.Type {
+		case "CONTAINS":
+			if p, ok := packages[r.Element]; ok {
+				index.add(files[r.Related], p)
+			}
+		case "CONTAINED_BY":
+			if p, ok := packages[r.Related]; ok {
+				index.add(files[r.Element], p)
+			}
+		}
+	}
+	return index, nil
+}
+
+func parseCycloneDX(data []byte) (*SBOMIndex, error) {
+	type component struct {
+		Name     string `json:"name"`
+		Version  string `json:"version"`
+		PURL     string `json:"purl"`
+		Evidence struct {
+			Occurrences []struct {
+				Location string `json:"location"`
+			} `json:"occurrences"`
+		} `json:"evidence"`
+		Properties []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"properties"`
+	}
+	var doc struct {
+		Components []component `json:"components"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	index := &SBOMIndex{files: make(map[string][]int)}
+	for _, c := range doc.Components {
+		i := len(index.components)
+		index.components = append(index.components, SBOMComponent{Name: c.Name, Version: c.Version, PURL: c.PURL})
+		for _, occurrence := range c.Evidence.Occurrences {
+			index.add(occurrence.Location, i)
+		}
+		// Syft records the files of a package as properties
+		for _, property := range c.Properties {
+			if strings.HasPrefix(property.Name, "syft:location:") && strings.HasSuffix(property.Name, ":path") {
+				index.add(property.Value, i)
+			}
+		}
+	}
+	return index, nil
+}
+
+func (i *SBOMIndex) add(file string, component int) {
+	if file == "" {
+		return
+	}
+	file = normalizeSBOMPath(file)
+	for _, c := range i.files[file] {
+		if c == component {
+			return
+		}
+	}
+	i.files[file] = append(i.files[file], component)
+}
+
+func normalizeSBOMPath(file string) string {
+	return path.Clean("/" + strings.TrimPrefix(file, "./"))
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Protobuf definition of the events this build encodes
+//
+//go:embed proto/event.proto
+var eventProtoSource string
+
+func registerSchemaHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/schema", schemaHandler)
+}
+
+// schemaHandler serves the schema of the events emitted by this build in the format of ?format=:
+//   - json (default): the JSON Schema of the JSON events
+//   - avro: the Avro schema of the records
+//   - proto: the protobuf definition, proto/event.proto
+//   - descriptor: the protobuf definition as a serialized FileDescriptorSet, e.g. for protoc --descriptor_set_in
+//
+// The ETag is the digest of the schema, so consumers notice when it changes.
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	contentType := "application/json"
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		schema, err := json.MarshalIndent(eventJSONSchema(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = schema
+		contentType = "application/schema+json"
+	case "avro":
+		body = []byte(avroEventSchema())
+	case "proto":
+		body = []byte(eventProtoSource)
+		contentType = "text/plain; charset=utf-8"
+	case "descriptor":
+		descriptor, err := eventProtoDescriptor()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = descriptor
+		contentType = "application/x-protobuf"
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q, expected json, avro, proto or descriptor", format), http.StatusBadRequest)
+		return
+	}
+
+	digest := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(digest[:]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// eventJSONSchema returns the JSON Schema of the events, derived from the Event struct so it matches the encoder
+func eventJSONSchema() map[string]interface{} {
+	schema := jsonSchemaOf(reflect.TypeOf(Event{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "Event"
+	return schema
+}
+
+func jsonSchemaOf(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchemaOf(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchemaOf(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if !field.IsExported() || tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = jsonSchemaOf(field.Type)
+			if options != "omitempty" {
+				required = append(required, name)
+			}
+		}
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+	}
+	return map[string]interface{}{}
+}
+
+var (
+	protoPackageRe = regexp.MustCompile(`^package\s+([\w.]+)\s*;$`)
+	protoOptionRe  = regexp.MustCompile(`^option\s+go_package\s*=\s*"([^"]*)"\s*;$`)
+	protoMessageRe = regexp.MustCompile(`^message\s+(\w+)\s*\{$`)
+	protoFieldRe   = regexp.MustCompile(`^(repeated\s+)?(?:map<\s*(\w+)\s*,\s*(\w+)\s*>|([\w.]+))\s+(\w+)\s*=\s*(\d+)\s*;$`)
+)
+
+var protoScalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"double":   descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+	"float":    descriptorpb.FieldDescriptorProto_TYPE_FLOAT,
+	"int64":    descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"uint64":   descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+	"int32":    descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"uint32":   descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+	"sint32":   descriptorpb.FieldDescriptorProto_TYPE_SINT32,
+	"sint64":   descriptorpb.FieldDescriptorProto_TYPE_SINT64,
+	"fixed32":  descriptorpb.FieldDescriptorProto_TYPE_FIXED32,
+	"fixed64":  descriptorpb.FieldDescriptorProto_TYPE_FIXED64,
+	"sfixed32": descriptorpb.FieldDescriptorProto_TYPE_SFIXED32,
+	"sfixed64": descriptorpb.FieldDescriptorProto_TYPE_SFIXED64,
+	"bool":     descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"string":   descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":    descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+}
+
+// eventProtoDescriptor returns the embedded protobuf definition as a serialized FileDescriptorSet. The definition only
+// uses top level messages of scalar, message, repeated and map fields, which is all this parses.
+func eventProtoDescriptor() ([]byte, error) {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:   proto.String("event.proto"),
+		Syntax: proto.String("proto3"),
+	}
+	var message *descriptorpb.DescriptorProto
+	for i, line := range strings.Split(eventProtoSource, "\n") {
+		if comment := strings.Index(line, "//"); comment >= 0 {
+			line = line[:comment]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "syntax") {
+			continue
+		}
+		if match := protoPackageRe.FindStringSubmatch(line); match != nil {
+			file.Package = proto.String(match[1])
+		} else if match := protoOptionRe.FindStringSubmatch(line); match != nil {
+			file.Options = &descriptorpb.FileOptions{GoPackage: proto.String(match[1])}
+		} else if match := protoMessageRe.FindStringSubmatch(line); match != nil && message == nil {
+			message = &descriptorpb.DescriptorProto{Name: proto.String(match[1])}
+		} else if line == "}" && message != nil {
+			file.MessageType = append(file.MessageType, message)
+			message = nil
+		} else if match := protoFieldRe.FindStringSubmatch(line); match != nil && message != nil {
+			number, _ := strconv.Atoi(match[6])
+			field := &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String(match[5]),
+				Number:   proto.Int32(int32(number)),
+				JsonName: proto.String(protoJSONName(match[5])),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}
+			if match[1] != "" {
+				field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			}
+			if match[2] != "" {
+				// A map is a repeated entry message of its key and value
+				entry := &descriptorpb.DescriptorProto{
+					Name:    proto.String(protoCamelName(match[5]) + "Entry"),
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				}
+				for j, name := range []string{"key", "value"} {
+					entryField := &descriptorpb.FieldDescriptorProto{
+						Name:     proto.String(name),
+						Number:   proto.Int32(int32(j + 1)),
+						JsonName: proto.String(name),
+						Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					}
+					setProtoFieldType(file, entryField, match[2+j])
+					entry.Field = append(entry.Field, entryField)
+				}
+				message.NestedType = append(message.NestedType, entry)
+				field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				field.TypeName = proto.String("." + file.GetPackage() + "." + message.GetName() + "." + entry.GetName())
+			} else {
+				setProtoFieldType(file, field, match[4])
+			}
+			message.Field = append(message.Field, field)
+		} else {
+			return nil, fmt.Errorf("event.proto:%d: unsupported definition %q", i+1, line)
+		}
+	}
+	if message != nil {
+		return nil, fmt.Errorf("event.proto: message %s isn't closed", message.GetName())
+	}
+	return proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+}
+
+// setProtoFieldType sets the type of a field, the types which aren't scalars are the messages of the file
+func setProtoFieldType(file *descriptorpb.FileDescriptorProto, field *descriptorpb.FieldDescriptorProto, typeName string) {
+	if scalar, ok := protoScalarTypes[typeName]; ok {
+		field.Type = scalar.Enum()
+		return
+	}
+	field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+	field.TypeName = proto.String("." + file.GetPackage() + "." + typeName)
+}
+
+// protoJSONName returns the JSON name protoc gives a field, e.g. timeUnixNano for time_unix_nano
+func protoJSONName(name string) string {
+	camel := protoCamelName(name)
+	return strings.ToLower(camel[:1]) + camel[1:]
+}
+
+// protoCamelName returns the name of a field in camel case, e.g. TimeUnixNano for time_unix_nano
+func protoCamelName(name string) string {
+	var camel strings.Builder
+	upper := true
+	for _, r := range name {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper && r >= 'a' && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		upper = false
+		camel.WriteRune(r)
+	}
+	return camel.String()
+}
@@ -0,0 +1,6 @@
+#!/bin/bash
+
+export NAMESPACE=ig-wl-filetracer-dev-env
+export POD=$(kubectl -n $NAMESPACE get pods -l k8s-app=ig-wl-filetracer-dev-env -o jsonpath="{.items[0].metadata.name}")
+
+kubectl exec $POD -n $NAMESPACE -- /bin/wlftracer diagnose "$@"
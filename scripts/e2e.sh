@@ -0,0 +1,169 @@
+#!/bin/bash
+# End-to-end harness: deploys the sample workloads of dev/e2e/workloads.yaml, then runs the monitor once per scenario
+# of dev/e2e/scenarios and checks the events and profiles it produced.
+#
+# Usage: scripts/e2e.sh [scenario...] (all the scenarios by default)
+#
+# Environment:
+#   E2E_CLUSTER        kind cluster to create or reuse (default wlftracer-e2e)
+#   E2E_USE_EXISTING   set to 1 to run against the current kubectl context instead of kind, E2E_IMAGE must then be
+#                      pullable by the nodes
+#   E2E_IMAGE          image of the monitor (default wlftracer:e2e, built from the Containerfile)
+#   E2E_SKIP_BUILD     set to 1 to use E2E_IMAGE as is
+#   E2E_TIMEOUT        seconds a scenario has to meet its expectations (default 120)
+#   E2E_KEEP           set to 1 to keep the namespaces, and the kind cluster the harness created, for debugging
+#   CONTAINER_TOOL     docker or podman (default docker)
+#
+# A scenario is a text file of lines:
+#   args: <flags of the monitor>
+#   expect file <glob in the monitor Pod> <extended regular expression a line of the files must match>
+#   absent file <glob in the monitor Pod> <extended regular expression no line of the files may match>
+#   expect log <extended regular expression a line of the logs of the monitor must match>
+set -e
+
+ROOT=$(cd "$(dirname "$0")/.." && pwd)
+CLUSTER=${E2E_CLUSTER:-wlftracer-e2e}
+IMAGE=${E2E_IMAGE:-wlftracer:e2e}
+TIMEOUT=${E2E_TIMEOUT:-120}
+CONTAINER_TOOL=${CONTAINER_TOOL:-docker}
+MONITOR_NAMESPACE=wlftracer-e2e-system
+CREATED_CLUSTER=""
+
+for tool in kubectl $([ "$E2E_USE_EXISTING" = "1" ] || echo kind) $([ "$E2E_SKIP_BUILD" = "1" ] || echo $CONTAINER_TOOL); do
+    if ! command -v $tool > /dev/null; then
+        echo "$tool is required"
+        exit 1
+    fi
+done
+
+if [ $# -gt 0 ]; then
+    SCENARIOS=()
+    for name in "$@"; do
+        SCENARIOS+=("$ROOT/dev/e2e/scenarios/${name%.txt}.txt")
+    done
+else
+    SCENARIOS=("$ROOT"/dev/e2e/scenarios/*.txt)
+fi
+for scenario in "${SCENARIOS[@]}"; do
+    if [ ! -f "$scenario" ]; then
+        echo "No scenario $scenario"
+        exit 1
+    fi
+done
+
+cleanup() {
+    if [ "$E2E_KEEP" = "1" ]; then
+        echo "Keeping the namespaces$([ -n "$CREATED_CLUSTER" ] && echo " and the kind cluster $CLUSTER")"
+        return
+    fi
+    kubectl delete --ignore-not-found -f "$ROOT/dev/e2e/workloads.yaml" > /dev/null 2>&1 || true
+    kubectl delete --ignore-not-found namespace $MONITOR_NAMESPACE > /dev/null 2>&1 || true
+    kubectl delete --ignore-not-found clusterrole,clusterrolebinding wlftracer-e2e > /dev/null 2>&1 || true
+    if [ -n "$CREATED_CLUSTER" ]; then
+        kind delete cluster --name "$CLUSTER"
+    fi
+}
+trap cleanup EXIT
+
+# Cluster
+if [ "$E2E_USE_EXISTING" != "1" ]; then
+    if ! kind get clusters 2> /dev/null | grep -qx "$CLUSTER"; then
+        kind create cluster --name "$CLUSTER"
+        CREATED_CLUSTER=1
+    fi
+    kubectl config use-context "kind-$CLUSTER" > /dev/null
+fi
+
+# Image of the monitor
+if [ "$E2E_SKIP_BUILD" != "1" ]; then
+    $CONTAINER_TOOL build -f "$ROOT/Containerfile" -t "$IMAGE" "$ROOT"
+fi
+if [ "$E2E_USE_EXISTING" != "1" ]; then
+    if [ "$CONTAINER_TOOL" = "docker" ]; then
+        kind load docker-image "$IMAGE" --name "$CLUSTER"
+    else
+        archive=$(mktemp)
+        $CONTAINER_TOOL save -o "$archive" "$IMAGE"
+        kind load image-archive "$archive" --name "$CLUSTER"
+        rm -f "$archive"
+    fi
+fi
+
+# Sample workloads, running before the monitor starts so every scenario sees them from its first event
+kubectl apply -f "$ROOT/dev/e2e/workloads.yaml"
+for deployment in $(kubectl -n wlftracer-e2e get deployments -o name); do
+    kubectl -n wlftracer-e2e rollout status "$deployment" --timeout=180s
+done
+
+# check runs the expectations of the scenario once, printing the unmet ones
+check() {
+    local scenario=$1 pod=$2 failed=0 kind target pattern
+    while read -r kind target pattern; do
+        case "$kind" in
+        expect|absent)
+            ;;
+        *)
+            continue
+            ;;
+        esac
+        if [ "$target" = "log" ]; then
+            if ! kubectl -n $MONITOR_NAMESPACE logs "$pod" 2>&1 | grep -qE -e "$pattern"; then
+                echo "  missing in the logs: $pattern"
+                failed=1
+            fi
+            continue
+        fi
+        # The glob is expanded in the Pod, the pattern is passed as is
+        glob=${pattern%% *}
+        pattern=${pattern#* }
+        if kubectl -n $MONITOR_NAMESPACE exec "$pod" -- sh -c 'grep -qE -e "$1" -- $0 2> /dev/null' "$glob" "$pattern"; then
+            found=1
+        else
+            found=0
+        fi
+        if [ "$kind" = "expect" ] && [ $found = 0 ]; then
+            echo "  missing in $glob: $pattern"
+            failed=1
+        elif [ "$kind" = "absent" ] && [ $found = 1 ]; then
+            echo "  unexpected in $glob: $pattern"
+            failed=1
+        fi
+    done < "$scenario"
+    return $failed
+}
+
+FAILED=()
+for scenario in "${SCENARIOS[@]}"; do
+    name=$(basename "$scenario" .txt)
+    args=$(sed -n 's/^args: *//p' "$scenario")
+    echo "=== $name: $args"
+
+    # A new monitor with empty output and state directories
+    kubectl -n $MONITOR_NAMESPACE delete --ignore-not-found daemonset wlftracer --wait=true > /dev/null 2>&1 || true
+    kubectl -n $MONITOR_NAMESPACE wait --for=delete pod -l k8s-app=wlftracer-e2e --timeout=120s > /dev/null 2>&1 || true
+    sed -e "s|__IMAGE__|$IMAGE|" -e "s|__ARGS__|$args|" "$ROOT/dev/e2e/monitor.yaml" | kubectl apply -f - > /dev/null
+    kubectl -n $MONITOR_NAMESPACE rollout status daemonset wlftracer --timeout=180s
+    pod=$(kubectl -n $MONITOR_NAMESPACE get pods -l k8s-app=wlftracer-e2e -o jsonpath="{.items[0].metadata.name}")
+
+    deadline=$((SECONDS + TIMEOUT))
+    while true; do
+        if result=$(check "$scenario" "$pod"); then
+            echo "--- PASS: $name"
+            break
+        fi
+        if [ $SECONDS -ge $deadline ]; then
+            echo "$result"
+            echo "--- FAIL: $name, last logs of $pod:"
+            kubectl -n $MONITOR_NAMESPACE logs "$pod" --tail=30 || true
+            FAILED+=("$name")
+            break
+        fi
+        sleep 5
+    done
+done
+
+if [ ${#FAILED[@]} -gt 0 ]; then
+    echo "FAIL: ${FAILED[*]}"
+    exit 1
+fi
+echo "PASS"
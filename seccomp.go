@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	tracersyscall "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/advise/seccomp/tracer"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Whether the learned seccomp profiles are installed in the kubelet seccomp root
+var writeSeccompProfiles bool
+
+// Directory the SeccompProfile resources of the security-profiles-operator are written to, empty if they are not generated
+var seccompProfileCRDir string
+
+// seccompProfileTemplate renders a SeccompProfile allowing the syscalls of a workload container
+var seccompProfileTemplate = template.Must(template.New("seccompprofile").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(`# Generated by wlftracer from the syscalls observed in {{ .Workload }}, review before enforcing
+apiVersion: security-profiles-operator.x-k8s.io/v1beta1
+kind: SeccompProfile
+metadata:
+  name: {{ .Name }}
+  namespace: {{ .Namespace }}
+  annotations:
+    wlftracer.io/workload: {{ quote .Workload }}
+    wlftracer.io/first-seen: {{ quote .FirstSeen }}
+    wlftracer.io/updated-at: {{ quote .UpdatedAt }}
+spec:
+  defaultAction: {{ .Profile.DefaultAction }}
+  architectures:
+{{- range .Profile.Architectures }}
+  - {{ . }}
+{{- end }}
+  syscalls:
+{{- range .Profile.Syscalls }}
+  - action: {{ .Action }}
+    names:
+{{- range .Names }}
+    - {{ . }}
+{{- end }}
+{{- end }}
+`))
+
+// writeSeccompProfile installs the seccomp profile of a learned workload under the kubelet seccomp root, where the admission webhook references it
+func writeSeccompProfile(root string, workload *WorkloadSyscalls) error {
+	data, err := json.MarshalIndent(tracersyscall.SyscallNamesToLinuxSeccomp(workload.Syscalls), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding profile: %w", err)
+	}
+	return writeIfChanged(filepath.Join(root, seccompProfileName(workload.Workload)), append(data, '\n'))
+}
+
+// writeSeccompProfileCR renders the SeccompProfile resource of a learned workload into the directory
+func writeSeccompProfileCR(dir string, workload *WorkloadSyscalls) error {
+	namespace, kind, name, container, ok := parseWorkloadKey(workload.Workload)
+	if !ok {
+		return fmt.Errorf("invalid workload key %q", workload.Workload)
+	}
+
+	var buf bytes.Buffer
+	err := seccompProfileTemplate.Execute(&buf, map[string]interface{}{
+		"Workload":  workload.Workload,
+		"Name":      resourceName("wlftracer", kind, name, container),
+		"Namespace": namespace,
+		"Profile":   tracersyscall.SyscallNamesToLinuxSeccomp(workload.Syscalls),
+		"FirstSeen": workload.FirstSeen.UTC().Format("2006-01-02T15:04:05Z"),
+		"UpdatedAt": workload.UpdatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+	})
+	if err != nil {
+		return fmt.Errorf("rendering profile: %w", err)
+	}
+	return writeIfChanged(filepath.Join(dir, storeFileName(workload.Workload)+".yaml"), buf.Bytes())
+}
+
+// writeIfChanged writes a generated file, leaving it untouched if its content didn't change, and signs it if a signing key is configured
+func writeIfChanged(path string, data []byte) error {
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		// The file may predate the signing key, or have been signed with a previous one
+		if profileSigner == nil || signatureValid(path, data) {
+			return nil
+		}
+		return writeSignature(path, data)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("creating directory: %w", err)
+	}
+	// The previous signature goes first, so the file is never seen along with the signature of another content
+	if err := os.Remove(path + ".sig"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	if profileSigner != nil {
+		return writeSignature(path, data)
+	}
+	return nil
+}
+
+// writeFileAtomic writes to a temporary file and renames it, so the kubelet and the readers never see a half written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Label of the ConfigMaps sharing the learned seccomp profiles with the agents of every node
+const seccompProfileShareLabel = "wlftracer.io/seccomp-profile"
+
+// How often the shared profiles are installed on the node
+const seccompProfileSyncInterval = time.Minute
+
+// SeccompProfileShare shares the profiles learned on a node through ConfigMaps of the namespace of the agent, and
+// installs the profiles shared by every node under the kubelet seccomp root, so a Pod gets its profile wherever it runs
+type SeccompProfileShare struct {
+	client    kubernetes.Interface
+	namespace string
+	root      string
+	lock      sync.Mutex
+	// Profiles of the ConfigMaps installed on this node, by workload
+	installed map[string]*WorkloadSyscalls
+}
+
+var seccompProfiles *SeccompProfileShare
+
+// NewSeccompProfileShare creates the share of the ConfigMaps of the namespace
+func NewSeccompProfileShare(client kubernetes.Interface, namespace string, root string) (*SeccompProfileShare, error) {
+	if namespace == "" {
+		return nil, fmt.Errorf("sharing the seccomp profiles requires $POD_NAMESPACE")
+	}
+	return &SeccompProfileShare{client: client, namespace: namespace, root: root, installed: make(map[string]*WorkloadSyscalls)}, nil
+}
+
+// Publish shares the profile of a learned workload with the other nodes and installs it
+func (s *SeccompProfileShare) Publish(workload *WorkloadSyscalls) error {
+	s.lock.Lock()
+	installed := s.installed[workload.Workload]
+	s.lock.Unlock()
+	if installed != nil && len(mergeWorkloadSyscalls(installed, workload).Syscalls) == len(installed.Syscalls) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	data, err := json.Marshal(workload)
+	if err != nil {
+		return err
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        resourceName("wlftracer-seccomp", storeFileName(workload.Workload)),
+			Namespace:   s.namespace,
+			Labels:      map[string]string{"app.kubernetes.io/managed-by": "wlftracer", seccompProfileShareLabel: "true"},
+			Annotations: map[string]string{"wlftracer.io/workload": workload.Workload},
+		},
+		Data: map[string]string{"workload.json": string(data)},
+	}
+	shared := workload
+	configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+	existing, err := configMaps.Get(ctx, configMap.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+	} else if err == nil {
+		// Other nodes may have learned more syscalls of the workload, the profile is their union
+		var other WorkloadSyscalls
+		if json.Unmarshal([]byte(existing.Data["workload.json"]), &other) == nil && other.Workload == workload.Workload {
+			shared = mergeWorkloadSyscalls(&other, workload)
+			if data, err = json.Marshal(shared); err != nil {
+				return err
+			}
+		}
+		existing.Data = map[string]string{"workload.json": string(data)}
+		_, err = configMaps.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("sharing the profile: %w", err)
+	}
+	if err := writeSeccompProfile(s.root, shared); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.installed[workload.Workload] = shared
+	s.lock.Unlock()
+	return nil
+}
+
+// mergeWorkloadSyscalls returns the union of the profiles of a workload learned on two nodes, updated when b added
+// syscalls to a
+func mergeWorkloadSyscalls(a *WorkloadSyscalls, b *WorkloadSyscalls) *WorkloadSyscalls {
+	merged := *a
+	merged.Syscalls = append([]string{}, a.Syscalls...)
+	for _, syscall := range b.Syscalls {
+		if !containsString(merged.Syscalls, syscall) {
+			merged.Syscalls = append(merged.Syscalls, syscall)
+			merged.UpdatedAt = b.UpdatedAt
+		}
+	}
+	sort.Strings(merged.Syscalls)
+	if b.FirstSeen.Before(merged.FirstSeen) {
+		merged.FirstSeen = b.FirstSeen
+	}
+	merged.RootObserved = a.RootObserved || b.RootObserved
+	merged.CapabilitiesTraced = a.CapabilitiesTraced || b.CapabilitiesTraced
+	merged.Capabilities = append([]string{}, a.Capabilities...)
+	mergeStrings(&merged.Capabilities, b.Capabilities)
+	return &merged
+}
+
+// Sync installs the profiles shared by every node
+func (s *SeccompProfileShare) Sync() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	configMaps, err := s.client.CoreV1().ConfigMaps(s.namespace).List(ctx, metav1.ListOptions{LabelSelector: seccompProfileShareLabel + "=true"})
+	if err != nil {
+		return err
+	}
+	for _, configMap := range configMaps.Items {
+		var workload WorkloadSyscalls
+		if err := json.Unmarshal([]byte(configMap.Data["workload.json"]), &workload); err != nil {
+			log.Printf("Error reading shared seccomp profile %s: %v\n", configMap.Name, err)
+			continue
+		}
+		if err := writeSeccompProfile(s.root, &workload); err != nil {
+			log.Printf("Error installing seccomp profile of %s: %v\n", workload.Workload, err)
+			continue
+		}
+		s.lock.Lock()
+		s.installed[workload.Workload] = &workload
+		s.lock.Unlock()
+	}
+	return nil
+}
+
+// syncLoop installs the shared profiles every interval until stop is closed
+func (s *SeccompProfileShare) syncLoop(stop chan struct{}) {
+	ticker := time.NewTicker(seccompProfileSyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.Sync(); err != nil {
+			log.Printf("Error syncing the shared seccomp profiles: %v\n", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Installed returns the profile of a workload shared with every node, nil if none was
+func (s *SeccompProfileShare) Installed(workload string) *WorkloadSyscalls {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.installed[workload]
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Whether the arguments of the processes executed are scanned for credentials
+var detectArgSecrets bool
+
+// Name of the alerts raised for the credentials found in the arguments
+const argSecretRule = "secret-in-exec-arguments"
+
+// argSecretPattern finds a kind of credential in the command line, the first capture group is the secret itself, the
+// whole match if there is none
+type argSecretPattern struct {
+	kind    string
+	pattern *regexp.Regexp
+}
+
+// Credentials commonly passed on the command line, matched against the arguments joined with spaces
+var argSecretPatterns = []argSecretPattern{
+	{"AWS access key", regexp.MustCompile(`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`)},
+	{"AWS secret key", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[=:\s]\s*["']?([A-Za-z0-9/+=]{40})\b`)},
+	{"GitHub token", regexp.MustCompile(`\b((?:gh[pousr]|github_pat)_[A-Za-z0-9_]{36,})\b`)},
+	{"Slack token", regexp.MustCompile(`\b(xox[abposr]-[A-Za-z0-9-]{10,})`)},
+	{"JSON web token", regexp.MustCompile(`\b(eyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,})`)},
+	{"bearer token", regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9._~+/-]{16,}=*)`)},
+	{"password in URL", regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:([^/\s@]+)@`)},
+	{"password option", regexp.MustCompile(`(?i)(?:^|\s)--?(?:password|passwd|pass|pwd|secret|token|api-?key|access-?key|client-?secret)(?:=|\s+)["']?([^\s"'-][^\s"']*)`)},
+	{"secret variable", regexp.MustCompile(`\b[A-Z0-9_]*(?:PASSWORD|PASSWD|SECRET|TOKEN|API_KEY|APIKEY|PRIVATE_KEY)[A-Z0-9_]*=["']?([^\s"']+)`)},
+}
+
+// Clients taking the password glued to -p (e.g. mysql -psecret)
+var gluedPasswordClients = map[string]bool{"mysql": true, "mysqldump": true, "mysqladmin": true, "mariadb": true, "mariadb-dump": true}
+
+// argSecret is a credential found in the arguments
+type argSecret struct {
+	kind  string
+	value string
+}
+
+// findArgSecrets returns the credentials in the arguments of an exec event, the first argument (the program) aside
+func findArgSecrets(path string, args []string) []argSecret {
+	if len(args) < 2 {
+		return nil
+	}
+	var secrets []argSecret
+	seen := make(map[string]bool)
+	add := func(kind string, value string) {
+		// Placeholders and references to the environment aren't secrets
+		if len(value) < 4 || seen[value] || strings.HasPrefix(value, "$") {
+			return
+		}
+		seen[value] = true
+		secrets = append(secrets, argSecret{kind: kind, value: value})
+	}
+	commandLine := strings.Join(args[1:], " ")
+	for _, p := range argSecretPatterns {
+		for _, match := range p.pattern.FindAllStringSubmatch(commandLine, -1) {
+			value := match[0]
+			if len(match) > 1 && match[1] != "" {
+				value = match[1]
+			}
+			add(p.kind, value)
+		}
+	}
+	if gluedPasswordClients[filepath.Base(path)] {
+		for _, arg := range args[1:] {
+			if strings.HasPrefix(arg, "-p") && !strings.HasPrefix(arg, "--") && len(arg) > 2 {
+				add("password option", arg[2:])
+			}
+		}
+	}
+	return secrets
+}
+
+// maskSecrets replaces the credentials in a value, keeping the first characters of the long ones to tell them apart
+func maskSecrets(value string, secrets []argSecret) string {
+	for _, secret := range secrets {
+		mask := redactedMask
+		if len(secret.value) >= 16 {
+			mask = secret.value[:4] + redactedMask
+		}
+		value = strings.ReplaceAll(value, secret.value, mask)
+	}
+	return value
+}
+
+// detectExecSecrets masks the credentials of the arguments of an exec event, in its line and in the event, and raises
+// an alert naming them, called from the event worker. The workloads which aren't in alert mode only record the alert in
+// their container file, their arguments are masked all the same.
+func detectExecSecrets(event *queuedEvent) {
+	secrets := findArgSecrets(event.event.Path, event.event.Args)
+	if len(secrets) == 0 {
+		return
+	}
+	metrics.ArgSecretsDetected.Add(uint64(len(secrets)))
+	for i, arg := range event.event.Args {
+		event.event.Args[i] = maskSecrets(arg, secrets)
+	}
+	event.line = maskSecrets(event.line, secrets)
+
+	kinds := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		if !containsString(kinds, secret.kind) {
+			kinds = append(kinds, secret.kind)
+		}
+	}
+	key := event.key
+	message := fmt.Sprintf("%s passed in the arguments of %s", strings.Join(kinds, ", "), event.event.Path)
+	log.Printf("Alert %s in %s/%s/%s: %s\n", argSecretRule, key.Namespace, key.Podname, key.ContainerName, message)
+	writeContainerEvent(key, event.event.Time, fmt.Sprintf("alert: %s severity: critical kinds: %s\n", argSecretRule, strings.Join(kinds, ",")))
+	if state, ok := containers.Get(key); !ok || !state.Alerts() {
+		return
+	}
+
+	alert := *event.event
+	alert.Args = append([]string{}, event.event.Args...)
+	alert.Type = "alert"
+	alert.Rule = argSecretRule
+	alert.Severity = "critical"
+	alert.Message = message
+	alert.AlertedType = event.event.Type
+	alert.ID = nextEventID()
+	enrichEvent(key, &alert)
+	dispatchAlert(&alert)
+	activityMetrics.ObserveAlert(&alert)
+	if riskScores != nil {
+		riskScores.ObserveAlert(&alert)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	containercollection "github.com/inspektor-gadget/inspektor-gadget/pkg/container-collection"
+	"sigs.k8s.io/yaml"
+)
+
+// SelectorRule matches the containers of Pods, the empty fields match everything
+type SelectorRule struct {
+	Namespace    string            `json:"namespace,omitempty"`
+	PodNameRegex string            `json:"podNameRegex,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+
+	podName *regexp.Regexp
+}
+
+// SelectorConfig selects the traced containers: the ones matching any include rule (all if there is none) and no exclude rule
+type SelectorConfig struct {
+	Include []SelectorRule `json:"include,omitempty"`
+	Exclude []SelectorRule `json:"exclude,omitempty"`
+	// Narrower selections of the containers whose events of one type are traced, by tracer (exec, open, tcp, dns, capabilities or syscalls)
+	Tracers map[string]*SelectorConfig `json:"tracers,omitempty"`
+}
+
+// Tracers by the name used in the selector config and the --tracer-label flag
+var selectorTracerNames = map[string]string{
+	"exec":         execTraceName,
+	"open":         openTraceName,
+	"tcp":          tcpTraceName,
+	"syscalls":     syscallTraceName,
+	"syscall":      syscallTraceName,
+	"dns":          dnsTraceName,
+	"capabilities": capabilitiesTraceName,
+}
+
+// stringList is a flag which can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// LoadSelectorConfig reads the include and exclude rules of a YAML (or JSON) file
+func LoadSelectorConfig(path string) (*SelectorConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading selector config: %w", err)
+	}
+	config := &SelectorConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("decoding selector config: %w", err)
+	}
+	return config, nil
+}
+
+// compile prepares the rules for matching
+func (c *SelectorConfig) compile() error {
+	for name, tracer := range c.Tracers {
+		if _, ok := selectorTracerNames[name]; !ok {
+			return fmt.Errorf("unknown tracer %q, expected exec, open, tcp, dns, capabilities or syscalls", name)
+		}
+		if len(tracer.Tracers) > 0 {
+			return fmt.Errorf("the selector of the %s tracer can't have tracer selectors", name)
+		}
+		if err := tracer.compile(); err != nil {
+			return fmt.Errorf("tracer %s: %w", name, err)
+		}
+	}
+	for _, rules := range [][]SelectorRule{c.Include, c.Exclude} {
+		for i := range rules {
+			rule := &rules[i]
+			if rule.PodNameRegex == "" {
+				continue
+			}
+			podName, err := regexp.Compile(rule.PodNameRegex)
+			if err != nil {
+				return fmt.Errorf("invalid Pod name regex %q: %w", rule.PodNameRegex, err)
+			}
+			rule.podName = podName
+		}
+	}
+	return nil
+}
+
+// Matches returns true if the container has to be traced
+func (c *SelectorConfig) Matches(container *containercollection.Container) bool {
+	included := len(c.Include) == 0
+	for i := range c.Include {
+		if c.Include[i].matches(container) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for i := range c.Exclude {
+		if c.Exclude[i].matches(container) {
+			return false
+		}
+	}
+	return true
+}
+
+// ContainerSelector returns the selector of the tracers, narrowing what the tracers capture when the rules can be expressed by it
+func (c *SelectorConfig) ContainerSelector() containercollection.ContainerSelector {
+	// A single include rule without regex is the only selection the tracers support, the rest is filtered once the events are received
+	if len(c.Include) == 1 && c.Include[0].podName == nil {
+		return containercollection.ContainerSelector{
+			Namespace: c.Include[0].Namespace,
+			Labels:    c.Include[0].Labels,
+		}
+	}
+	return containercollection.ContainerSelector{}
+}
+
+// MatchesTracer returns true if the events of the tracer are traced for the container, which matches the selector
+func (c *SelectorConfig) MatchesTracer(tracer string, container *containercollection.Container) bool {
+	for name, selector := range c.Tracers {
+		if selectorTracerNames[name] == tracer {
+			return selector.Matches(container)
+		}
+	}
+	return true
+}
+
+// TracerSelector returns the selector of a tracer, combining the selector of all the tracers with the one of the tracer when both can be expressed by it
+func (c *SelectorConfig) TracerSelector(tracer string) containercollection.ContainerSelector {
+	selector := c.ContainerSelector()
+	for name, tracerConfig := range c.Tracers {
+		if selectorTracerNames[name] != tracer {
+			continue
+		}
+		if len(tracerConfig.Include) != 1 || tracerConfig.Include[0].podName != nil {
+			return selector
+		}
+		rule := tracerConfig.Include[0]
+		if rule.Namespace != "" && selector.Namespace != "" && rule.Namespace != selector.Namespace {
+			// Nothing matches both, which is left to the events filter
+			return selector
+		}
+		combined := containercollection.ContainerSelector{Namespace: selector.Namespace, Labels: make(map[string]string)}
+		if combined.Namespace == "" {
+			combined.Namespace = rule.Namespace
+		}
+		for key, value := range selector.Labels {
+			combined.Labels[key] = value
+		}
+		for key, value := range rule.Labels {
+			if existing, ok := combined.Labels[key]; ok && existing != value {
+				return selector
+			}
+			combined.Labels[key] = value
+		}
+		return combined
+	}
+	return selector
+}
+
+// AddTracerLabel adds a key=value label to the include rule of a tracer, from a <tracer>:<key>=<value> flag
+func (c *SelectorConfig) AddTracerLabel(flag string) error {
+	name, label, ok := strings.Cut(flag, ":")
+	if !ok {
+		return fmt.Errorf("invalid tracer label %q, expected <tracer>:<key>=<value>", flag)
+	}
+	if _, ok := selectorTracerNames[name]; !ok {
+		return fmt.Errorf("unknown tracer %q, expected exec, open, tcp, dns, capabilities or syscalls", name)
+	}
+	labels, err := parseLabels([]string{label})
+	if err != nil {
+		return err
+	}
+	if c.Tracers == nil {
+		c.Tracers = make(map[string]*SelectorConfig)
+	}
+	tracer := c.Tracers[name]
+	if tracer == nil {
+		tracer = &SelectorConfig{}
+		c.Tracers[name] = tracer
+	}
+	// The labels given for a tracer by the flags all have to match
+	if len(tracer.Include) == 0 {
+		tracer.Include = []SelectorRule{{}}
+	}
+	rule := &tracer.Include[len(tracer.Include)-1]
+	if rule.Labels == nil {
+		rule.Labels = make(map[string]string)
+	}
+	for key, value := range labels {
+		rule.Labels[key] = value
+	}
+	return nil
+}
+
+func (r *SelectorRule) matches(container *containercollection.Container) bool {
+	if r.Namespace != "" && r.Namespace != container.Namespace {
+		return false
+	}
+	if r.podName != nil && !r.podName.MatchString(container.Podname) {
+		return false
+	}
+	for key, value := range r.Labels {
+		if container.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLabels parses key=value labels
+func parseLabels(labels []string) (map[string]string, error) {
+	parsed := make(map[string]string, len(labels))
+	for _, label := range labels {
+		key, value, ok := strings.Cut(strings.TrimSpace(label), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", label)
+		}
+		parsed[key] = value
+	}
+	return parsed, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Programs started as interactive shells
+var interactiveShells = map[string]bool{
+	"sh": true, "ash": true, "bash": true, "dash": true, "zsh": true, "ksh": true, "mksh": true, "fish": true, "busybox": true,
+}
+
+// ttySession is an interactive shell session of a container, recorded command after command
+type ttySession struct {
+	// Kernel session id, the pid of the shell leading the session, and when that process started, zero if unknown
+	id          int
+	leaderStart time.Time
+	tty         int
+	start       time.Time
+	file        *os.File
+	key         ContainerKey
+	// Exec request of the API server which opened the session, nil until it is found in the audit log
+	request *execRequest
+}
+
+// containerSessions are the sessions of a single container
+type containerSessions struct {
+	containerID string
+	sessions    map[int]*ttySession
+	// Processes known to belong to a session, for the ones exiting before their session can be read
+	members map[uint32]*ttySession
+}
+
+// execSession is the session and controlling terminal of a process executed
+type execSession struct {
+	id  int
+	tty int
+}
+
+// SessionRecorder records the commands of the interactive shell sessions into one artifact per session
+type SessionRecorder struct {
+	dir string
+	// How long the recordings of the ended sessions are kept, forever if zero
+	retention  time.Duration
+	lock       sync.Mutex
+	containers map[ContainerKey]*containerSessions
+}
+
+var sessionRecorder *SessionRecorder
+
+// NewSessionRecorder creates a recorder writing the sessions into the directory, keeping the recordings of the ended
+// sessions for the retention unless it is zero
+func NewSessionRecorder(dir string, retention time.Duration) (*SessionRecorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating session directory: %w", err)
+	}
+	return &SessionRecorder{dir: dir, retention: retention, containers: make(map[ContainerKey]*containerSessions)}, nil
+}
+
+// procSession returns the session id and controlling terminal of a process, from /proc/<pid>/stat
+func procSession(pid uint32) (int, int, bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, false
+	}
+	// The command name may contain spaces and parentheses, the fields start after the last parenthesis:
+	// state ppid pgrp session tty_nr ...
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 5 {
+		return 0, 0, false
+	}
+	session, err1 := strconv.Atoi(fields[3])
+	tty, err2 := strconv.Atoi(fields[4])
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return session, tty, true
+}
+
+// execSessionOf reads the session of a process executed, from the tracer callback while the process is most likely
+// still running, nil if it is unknown
+func execSessionOf(pid uint32) *execSession {
+	id, tty, ok := procSession(pid)
+	if !ok {
+		return nil
+	}
+	return &execSession{id: id, tty: tty}
+}
+
+// RecordExec starts a session when an interactive shell is executed, and records the commands run within the sessions.
+// session is the one of the process when it was executed, nil if unknown.
+func (r *SessionRecorder) RecordExec(key ContainerKey, event *Event, session *execSession) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	containerID := event.ContainerID
+	sessions, known := r.containers[key]
+	if !known || sessions.containerID != containerID {
+		if known {
+			r.closeContainer(sessions, event.Time)
+		}
+		sessions = &containerSessions{containerID: containerID, sessions: make(map[int]*ttySession), members: make(map[uint32]*ttySession)}
+		r.containers[key] = sessions
+	}
+
+	var current *ttySession
+	if session != nil && session.tty != 0 {
+		current = sessions.sessions[session.id]
+		if current == nil && interactiveShells[filepath.Base(event.Path)] {
+			current = r.startSession(key, sessions, session.id, session.tty, event)
+		}
+	}
+	if current == nil {
+		// The process may be gone already, fall back to its parent
+		current = sessions.members[event.Ppid]
+	}
+	if current == nil {
+		return
+	}
+	sessions.members[event.Pid] = current
+	r.correlate(current, event.Time)
+	if current.request != nil {
+		event.User = current.request.User
+		event.AuditID = current.request.AuditID
+	}
+
+	redacted := redactEvent(event)
+	line := fmt.Sprintf("%s uid=%d pid=%d ppid=%d %s\n", event.Time.UTC().Format(time.RFC3339Nano), event.Uid, event.Pid, event.Ppid,
+		strings.Join(append([]string{redacted.Path}, execArguments(redacted)...), " "))
+	if err := writeWithRetry(current.file, line); err != nil {
+		log.Printf("Error recording session %s: %v\n", current.file.Name(), err)
+	}
+}
+
+func (r *SessionRecorder) startSession(key ContainerKey, sessions *containerSessions, id int, tty int, event *Event) *ttySession {
+	path := filepath.Join(r.dir, fmt.Sprintf("%s-%s-%s-%d-%d.log", key.Namespace, key.Podname, key.ContainerName, id, event.Time.Unix()))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("Error creating session recording: %v\n", err)
+		return nil
+	}
+	session := &ttySession{id: id, tty: tty, start: event.Time, file: f, key: key}
+	// The leader is compared by start time too when looking for the sessions which ended, its pid may be reused
+	if leaderStart, err := processStartTime(uint32(id)); err == nil {
+		session.leaderStart = leaderStart
+	}
+	sessions.sessions[id] = session
+
+	header := fmt.Sprintf("# session %d on tty %d:%d of container %s (%s/%s/%s) started %s\n", id, tty>>8, tty&0xff, sessions.containerID,
+		key.Namespace, key.Podname, key.ContainerName, event.Time.UTC().Format(time.RFC3339Nano))
+	if err := writeWithRetry(f, header); err != nil {
+		log.Printf("Error recording session %s: %v\n", path, err)
+	}
+	log.Printf("Interactive session %d started in %s/%s/%s, recording it to %s\n", id, key.Namespace, key.Podname, key.ContainerName, path)
+	writeContainerEvent(key, event.Time, fmt.Sprintf("session-start: %d tty: %d:%d shell: %s recording: %s\n", id, tty>>8, tty&0xff, event.Path, path))
+	return session
+}
+
+// correlate looks for the API server exec request which opened the session, as the audit events are batched it is retried until the session ends
+func (r *SessionRecorder) correlate(session *ttySession, now time.Time) {
+	if auditCorrelator == nil || session.request != nil {
+		return
+	}
+	session.request = auditCorrelator.Lookup(session.key, session.start)
+	if session.request == nil {
+		return
+	}
+	log.Printf("Interactive session %d of %s/%s/%s opened by %s\n", session.id, session.key.Namespace, session.key.Podname, session.key.ContainerName, session.request.User)
+	if err := writeWithRetry(session.file, fmt.Sprintf("# requested by %s at %s (audit ID %s)\n", session.request.User,
+		session.request.Time.UTC().Format(time.RFC3339Nano), session.request.AuditID)); err != nil {
+		log.Printf("Error recording session %s: %v\n", session.file.Name(), err)
+	}
+	writeContainerEvent(session.key, now, fmt.Sprintf("session-user: %d user: %s audit-id: %s\n", session.id, session.request.User, session.request.AuditID))
+}
+
+// endSession closes the recording of a session
+func (r *SessionRecorder) endSession(sessions *containerSessions, session *ttySession, end time.Time) {
+	r.correlate(session, end)
+	if err := writeWithRetry(session.file, fmt.Sprintf("# session %d ended %s\n", session.id, end.UTC().Format(time.RFC3339Nano))); err != nil {
+		log.Printf("Error recording session %s: %v\n", session.file.Name(), err)
+	}
+	if err := session.file.Close(); err != nil {
+		log.Printf("Error closing session %s: %v\n", session.file.Name(), err)
+	}
+	delete(sessions.sessions, session.id)
+	for pid, member := range sessions.members {
+		if member == session {
+			delete(sessions.members, pid)
+		}
+	}
+}
+
+func (r *SessionRecorder) closeContainer(sessions *containerSessions, end time.Time) {
+	for _, session := range sessions.sessions {
+		r.endSession(sessions, session, end)
+	}
+}
+
+// ContainerRemoved ends the sessions of a removed container
+func (r *SessionRecorder) ContainerRemoved(key ContainerKey, containerID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	sessions, ok := r.containers[key]
+	if !ok || sessions.containerID != containerID {
+		return
+	}
+	r.closeContainer(sessions, clock.Now())
+	delete(r.containers, key)
+}
+
+// EndExitedSessions ends the sessions whose leading shell exited
+func (r *SessionRecorder) EndExitedSessions() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := clock.Now()
+	for _, sessions := range r.containers {
+		for id, session := range sessions.sessions {
+			started, err := processStartTime(uint32(id))
+			if err != nil || (!session.leaderStart.IsZero() && !started.Equal(session.leaderStart)) {
+				r.endSession(sessions, session, now)
+			}
+		}
+	}
+}
+
+// ExpireRecordings deletes the recordings of the ended sessions last written longer than the retention ago
+func (r *SessionRecorder) ExpireRecordings() {
+	if r.retention == 0 {
+		return
+	}
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		log.Printf("Error listing session recordings: %v\n", err)
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// The recordings of the sessions still running are kept whatever their age
+	open := make(map[string]bool)
+	for _, sessions := range r.containers {
+		for _, session := range sessions.sessions {
+			open[session.file.Name()] = true
+		}
+	}
+	cutoff := time.Now().Add(-r.retention)
+	for _, entry := range entries {
+		path := filepath.Join(r.dir, entry.Name())
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") || open[path] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error deleting session recording %s: %v\n", path, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Key signing the generated profiles, nil if they are not signed
+var profileSigner crypto.Signer
+
+// LoadSigningKey reads a PEM private key (ECDSA, RSA or Ed25519). Encrypted cosign keys have to be exported first.
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in %s", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY":
+		return nil, fmt.Errorf("encrypted cosign keys are not supported, decrypt the key into a PKCS#8 PEM file")
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing signing key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// signBlob returns the base64 signature of the data, as produced by cosign sign-blob, so it verifies with cosign verify-blob --key
+func signBlob(signer crypto.Signer, data []byte) (string, error) {
+	var signature []byte
+	var err error
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		// Ed25519 signs the message itself
+		signature, err = signer.Sign(rand.Reader, data, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(data)
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// verifyBlob returns true if the base64 signature of the data verifies with the public key of the signer
+func verifyBlob(signer crypto.Signer, data []byte, signature string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256(data)
+	switch key := signer.Public().(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, decoded)
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], decoded)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], decoded) == nil
+	}
+	return false
+}
+
+// signatureValid returns true if the signature next to a generated file verifies with the current signing key
+func signatureValid(path string, data []byte) bool {
+	signature, err := os.ReadFile(path + ".sig")
+	return err == nil && verifyBlob(profileSigner, data, string(signature))
+}
+
+// writeSignature writes the signature of a generated file next to it, as <file>.sig
+func writeSignature(path string, data []byte) error {
+	signature, err := signBlob(profileSigner, data)
+	if err != nil {
+		return fmt.Errorf("signing %s: %w", path, err)
+	}
+	return writeFileAtomic(path+".sig", []byte(signature))
+}
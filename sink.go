@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sink receives the structured events, it is called from the event worker only
+type Sink interface {
+	Write(event *Event) error
+	Close() error
+}
+
+// Sinks the events are dispatched to, and their names (e.g. http, splunk) for the routes of the rules
+var sinks []Sink
+var sinkNames []string
+
+// sinkRegistration sets up one of the optional sinks, which the slim builds leave out with the build tag of its file
+// (e.g. -tags no_splunk_sink,no_datadog_sink)
+type sinkRegistration struct {
+	name string
+	// Defines the flags of the sink, before they are parsed
+	flags func()
+	// Creates the sink, nil if its flags don't enable it
+	create func() (Sink, error)
+}
+
+// Optional sinks built in
+var sinkRegistry []sinkRegistration
+
+// registerSink adds an optional sink to the build, called from the init of its file
+func registerSink(registration sinkRegistration) {
+	sinkRegistry = append(sinkRegistry, registration)
+}
+
+// addSink adds a sink the events are dispatched to
+func addSink(name string, sink Sink) {
+	sinks = append(sinks, sink)
+	sinkNames = append(sinkNames, name)
+}
+
+// hasSinks returns true if events are sent anywhere besides the container files, the history and the recent events
+// included
+func hasSinks() bool {
+	return len(sinks) > 0 || tenants != nil || eventHistory != nil || recentEvents != nil
+}
+
+// dispatchEvent hands the event over to every sink, and to the sinks of the tenant of its namespace
+func dispatchEvent(event *Event) {
+	if event.ID == "" {
+		event.ID = nextEventID()
+	}
+	// Nothing sensitive may leave the node
+	if redactor != nil {
+		event = redactor.Redact(event)
+	}
+	// The events filtered out by the rules go to none of the sinks, the routes select the events of each sink
+	var activation celActivation
+	if rulesConfig != nil && (rulesConfig.filter != nil || len(rulesConfig.routes) > 0) {
+		activation = rulesActivation(event)
+		if rulesConfig.filter != nil && !rulesConfig.filter.Matches(activation) {
+			metrics.EventsFilteredOut.Add(1)
+			return
+		}
+	}
+	for i, sink := range sinks {
+		if activation != nil {
+			if route := rulesConfig.routes[sinkNames[i]]; route != nil && !route.Matches(activation) {
+				continue
+			}
+		}
+		if err := sink.Write(event); err != nil {
+			log.Printf("Error writing event to sink: %v\n", err)
+		}
+	}
+	if tenants != nil {
+		tenants.Dispatch(event)
+	}
+	// Recorded last, so the backfills started while dispatching the event don't send it twice
+	if eventHistory != nil {
+		eventHistory.Record(event)
+	}
+	if recentEvents != nil {
+		recentEvents.Record(event)
+	}
+	if traceSessions != nil {
+		traceSessions.Record(event)
+	}
+}
+
+// backfiller is implemented by the sinks which can be sent past events from another goroutine than the event worker
+type backfiller interface {
+	// Backfill queues a past event, waiting for room, it returns false once stop is closed
+	Backfill(event *Event, stop <-chan struct{}) bool
+}
+
+// containerObserver is implemented by the sinks which need to know when a container is gone
+type containerObserver interface {
+	ContainerRemoved(state *ContainerState)
+}
+
+// notifyContainerRemoved tells the sinks that the container was finalized
+func notifyContainerRemoved(state *ContainerState) {
+	for _, sink := range sinks {
+		if observer, ok := sink.(containerObserver); ok {
+			observer.ContainerRemoved(state)
+		}
+	}
+}
+
+// closeSinks flushes and closes the sinks
+func closeSinks() {
+	if tenants != nil {
+		tenants.Close()
+	}
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("Error closing sink: %v\n", err)
+		}
+	}
+}
+
+// exportSink writes the events, one JSON document per line, as they are or in the format of another tool. Protobuf
+// messages and Avro records are prefixed with their size instead.
+type exportSink struct {
+	w         io.WriteCloser
+	errors    sinkErrorTracker
+	format    func(event *Event) ([]byte, error)
+	delimited bool
+}
+
+// NewExportSink creates a sink writing the events in the given format to the file, or stdout for -
+func NewExportSink(format string, path string) (Sink, error) {
+	sink := &exportSink{errors: sinkErrorTracker{name: "export:" + format}}
+	switch format {
+	case "json":
+		sink.format = func(event *Event) ([]byte, error) { return json.Marshal(event) }
+	case "protobuf":
+		sink.format = func(event *Event) ([]byte, error) { return marshalEventProto(nil, event), nil }
+		sink.delimited = true
+	case "avro":
+		sink.format = func(event *Event) ([]byte, error) { return marshalEventAvro(event), nil }
+		sink.delimited = true
+	case "falco":
+		sink.format = formatFalcoEvent
+	case "tetragon":
+		sink.format = formatTetragonEvent
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+
+	if path == "-" {
+		sink.w = os.Stdout
+		return sink, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening export file: %w", err)
+	}
+	sink.w = f
+	return sink, nil
+}
+
+func (s *exportSink) Write(event *Event) error {
+	data, err := s.format(event)
+	if err != nil {
+		return fmt.Errorf("formatting event: %w", err)
+	}
+	if data == nil {
+		// The format has no representation of the event
+		return nil
+	}
+	if s.delimited {
+		err = writeWithRetry(s.w, string(protowire.AppendVarint(nil, uint64(len(data))))+string(data))
+	} else {
+		err = writeWithRetry(s.w, string(data)+"\n")
+	}
+	if s.errors.Track(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *exportSink) Close() error {
+	if s.w == os.Stdout {
+		return nil
+	}
+	return s.w.Close()
+}
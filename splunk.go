@@ -0,0 +1,359 @@
+//go:build !no_splunk_sink
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SplunkConfig configures the Splunk HTTP Event Collector sink
+type SplunkConfig struct {
+	URL   string
+	Token string
+	Index string
+	// Sourcetype of each event type, as type=sourcetype pairs separated by commas
+	Sourcetypes        string
+	BatchSize          int
+	FlushInterval      time.Duration
+	Ack                bool
+	AckTimeout         time.Duration
+	InsecureSkipVerify bool
+	// Compression of the batches: none or gzip
+	Compression string
+	// Delivery guarantee of the events: best-effort or at-least-once
+	Delivery string
+}
+
+var splunkConfig SplunkConfig
+
+func init() {
+	registerSink(sinkRegistration{
+		name: "Splunk",
+		flags: func() {
+			flag.StringVar(&splunkConfig.URL, "splunk-url", "", "URL of the Splunk HTTP Event Collector (e.g. https://splunk:8088), disabled if empty")
+			flag.StringVar(&splunkConfig.Token, "splunk-token", os.Getenv("SPLUNK_HEC_TOKEN"), "Token of the Splunk HTTP Event Collector, defaults to $SPLUNK_HEC_TOKEN")
+			flag.StringVar(&splunkConfig.Index, "splunk-index", "", "Splunk index of the events, the token default index if empty")
+			flag.StringVar(&splunkConfig.Sourcetypes, "splunk-sourcetypes", "", "Sourcetype of each event type as type=sourcetype pairs (e.g. exec=linux:exec), wlftracer:<type> by default")
+			flag.IntVar(&splunkConfig.BatchSize, "splunk-batch-size", 100, "Maximum number of events sent to Splunk at once")
+			flag.DurationVar(&splunkConfig.FlushInterval, "splunk-flush-interval", time.Second, "Maximum time events wait before being sent to Splunk")
+			flag.BoolVar(&splunkConfig.Ack, "splunk-ack", false, "Wait for the indexer acknowledgement of the events and resend the ones not acknowledged")
+			flag.DurationVar(&splunkConfig.AckTimeout, "splunk-ack-timeout", time.Minute, "Time to wait for an acknowledgement before resending the events")
+			flag.BoolVar(&splunkConfig.InsecureSkipVerify, "splunk-insecure-skip-verify", false, "Don't verify the certificate of the Splunk HTTP Event Collector")
+			flag.StringVar(&splunkConfig.Compression, "splunk-compression", "none", "Compression of the batches sent to Splunk: none or gzip")
+			flag.StringVar(&splunkConfig.Delivery, "splunk-delivery", deliveryBestEffort, "Delivery guarantee of the events sent to Splunk: best-effort or at-least-once")
+		},
+		create: func() (Sink, error) {
+			if splunkConfig.URL == "" {
+				return nil, nil
+			}
+			return NewSplunkSink(splunkConfig)
+		},
+	})
+	newTenantSplunkSink = func(url string, token string, index string) (Sink, error) {
+		return NewSplunkSink(SplunkConfig{
+			URL:           url,
+			Token:         token,
+			Index:         index,
+			BatchSize:     100,
+			FlushInterval: time.Second,
+			Delivery:      deliveryBestEffort,
+		})
+	}
+}
+
+// Interval between two polls of the acknowledgements
+const splunkAckPollInterval = 5 * time.Second
+
+// splunkHECEvent is the envelope of an event sent to the collector
+type splunkHECEvent struct {
+	Time       float64 `json:"time"`
+	Host       string  `json:"host,omitempty"`
+	Source     string  `json:"source"`
+	Sourcetype string  `json:"sourcetype"`
+	Index      string  `json:"index,omitempty"`
+	Event      *Event  `json:"event"`
+}
+
+// splunkPendingBatch is a batch sent with indexer acknowledgement enabled, waiting to be acknowledged
+type splunkPendingBatch struct {
+	body   []byte
+	sentAt time.Time
+}
+
+// splunkSink sends the events to a Splunk HTTP Event Collector
+type splunkSink struct {
+	config      SplunkConfig
+	sourcetypes map[string]string
+	client      *http.Client
+	// Channel identifying the sender, required by the collector when acknowledgements are enabled
+	channel string
+	codec   Codec
+	batcher *batcher
+
+	lock    sync.Mutex
+	pending map[int64]*splunkPendingBatch
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewSplunkSink creates a sink sending batches of events to the collector
+func NewSplunkSink(config SplunkConfig) (Sink, error) {
+	if config.Token == "" {
+		return nil, fmt.Errorf("a Splunk HEC token is required")
+	}
+	sourcetypes := map[string]string{}
+	for _, pair := range strings.Split(config.Sourcetypes, ",") {
+		if pair == "" {
+			continue
+		}
+		eventType, sourcetype, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid sourcetype mapping %q", pair)
+		}
+		sourcetypes[eventType] = sourcetype
+	}
+	codec, err := NewCodec(config.Compression, "gzip")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDelivery(config.Delivery); err != nil {
+		return nil, err
+	}
+	if err := checkBatching(config.BatchSize, config.FlushInterval); err != nil {
+		return nil, err
+	}
+	channel, err := newUUID()
+	if err != nil {
+		return nil, fmt.Errorf("generating channel: %w", err)
+	}
+
+	s := &splunkSink{
+		config:      config,
+		sourcetypes: sourcetypes,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}},
+		},
+		channel: channel,
+		codec:   codec,
+		pending: make(map[int64]*splunkPendingBatch),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s.batcher = newBatcher("splunk", config.BatchSize, config.FlushInterval, config.Delivery, s.sendBatch)
+	if config.Ack {
+		go s.ackLoop()
+	} else {
+		close(s.done)
+	}
+	return s, nil
+}
+
+func (s *splunkSink) Write(event *Event) error {
+	s.batcher.Add(event)
+	return nil
+}
+
+func (s *splunkSink) Backfill(event *Event, stop <-chan struct{}) bool {
+	return s.batcher.AddWait(event, stop)
+}
+
+// Close sends the remaining events and waits for their acknowledgement
+func (s *splunkSink) Close() error {
+	s.batcher.Close()
+	close(s.stop)
+	<-s.done
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.pending) > 0 {
+		return fmt.Errorf("%d batches were not acknowledged by Splunk", len(s.pending))
+	}
+	return nil
+}
+
+// sourcetype returns the sourcetype of an event type, wlftracer:<type> unless mapped
+func (s *splunkSink) sourcetype(eventType string) string {
+	if sourcetype, ok := s.sourcetypes[eventType]; ok {
+		return sourcetype
+	}
+	return "wlftracer:" + eventType
+}
+
+func (s *splunkSink) sendBatch(batch []*Event) error {
+	// The collector accepts a stream of concatenated events
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range batch {
+		err := encoder.Encode(splunkHECEvent{
+			Time:       float64(event.Time.UnixNano()) / 1e9,
+			Host:       event.Node,
+			Source:     "wlftracer",
+			Sourcetype: s.sourcetype(event.Type),
+			Index:      s.config.Index,
+			Event:      event,
+		})
+		if err != nil {
+			return fmt.Errorf("encoding event: %w", err)
+		}
+	}
+	return s.post(body.Bytes())
+}
+
+// post sends a body of events, registering it for acknowledgement when enabled
+func (s *splunkSink) post(body []byte) error {
+	var response struct {
+		Text  string `json:"text"`
+		Code  int    `json:"code"`
+		AckID *int64 `json:"ackId"`
+	}
+	if err := s.request(strings.TrimSuffix(s.config.URL, "/")+"/services/collector/event", body, &response); err != nil {
+		return err
+	}
+	if response.Code != 0 {
+		return fmt.Errorf("collector error %d: %s", response.Code, response.Text)
+	}
+
+	if s.config.Ack && response.AckID != nil {
+		s.lock.Lock()
+		s.pending[*response.AckID] = &splunkPendingBatch{body: body, sentAt: time.Now()}
+		s.lock.Unlock()
+	}
+	return nil
+}
+
+func (s *splunkSink) request(url string, body []byte, response interface{}) error {
+	req, err := newCompressedRequest(s.codec, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.config.Token)
+	req.Header.Set("X-Splunk-Request-Channel", s.channel)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// ackLoop polls the acknowledgements of the batches sent and resends the ones not acknowledged in time
+func (s *splunkSink) ackLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(splunkAckPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			// Give the last batches a chance to be acknowledged
+			deadline := time.Now().Add(s.config.AckTimeout)
+			for s.pendingCount() > 0 && time.Now().Before(deadline) {
+				s.pollAcks()
+				time.Sleep(time.Second)
+			}
+			return
+		case <-ticker.C:
+			s.pollAcks()
+			s.resendExpired()
+		}
+	}
+}
+
+func (s *splunkSink) pendingCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.pending)
+}
+
+func (s *splunkSink) pollAcks() {
+	s.lock.Lock()
+	ids := make([]int64, 0, len(s.pending))
+	for id := range s.pending {
+		ids = append(ids, id)
+	}
+	s.lock.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(map[string][]int64{"acks": ids})
+	if err != nil {
+		log.Printf("Error encoding Splunk acknowledgement request: %v\n", err)
+		return
+	}
+	var response struct {
+		Acks map[string]bool `json:"acks"`
+	}
+	url := fmt.Sprintf("%s/services/collector/ack?channel=%s", strings.TrimSuffix(s.config.URL, "/"), s.channel)
+	if err := s.request(url, body, &response); err != nil {
+		log.Printf("Error polling Splunk acknowledgements: %v\n", err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, acked := range response.Acks {
+		var ackID int64
+		if _, err := fmt.Sscan(id, &ackID); err == nil && acked {
+			delete(s.pending, ackID)
+		}
+	}
+}
+
+// resendExpired sends again the batches which were not acknowledged within the timeout
+func (s *splunkSink) resendExpired() {
+	s.lock.Lock()
+	var expired [][]byte
+	for id, batch := range s.pending {
+		if time.Since(batch.sentAt) > s.config.AckTimeout {
+			expired = append(expired, batch.body)
+			delete(s.pending, id)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, body := range expired {
+		log.Printf("Splunk batch not acknowledged within %s, resending it\n", s.config.AckTimeout)
+		if err := s.post(body); err != nil {
+			metrics.SinkBatchesDropped.Add(1)
+			log.Printf("Error resending Splunk batch: %v\n", err)
+		}
+	}
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long after its start the open and exec events of a container are considered part of its initialization, disabled if zero
+var startupGracePeriod time.Duration
+
+// Whether the initialization events are dropped instead of being tagged
+var suppressStartup bool
+
+// Clock ticks per second used by /proc/<pid>/stat, USER_HZ is 100 on all the supported architectures
+const procClockTicks = 100
+
+// processStartTime returns when a process started, e.g. the init process of a container so containers already running
+// when the agent starts aren't considered starting
+func processStartTime(pid uint32) (time.Time, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+	// The command name may contain spaces, the fields are counted after it
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return time.Time{}, fmt.Errorf("malformed stat of %d", pid)
+	}
+	fields := strings.Fields(string(data)[i+1:])
+	// starttime is the 22nd field, the 20th after the command name
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("malformed stat of %d", pid)
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing start time of %d: %w", pid, err)
+	}
+	// Whole seconds first, ticks*time.Second overflows after about 1067 days of uptime
+	uptime := time.Duration(ticks/procClockTicks)*time.Second + time.Duration(ticks%procClockTicks)*time.Second/procClockTicks
+	return time.Unix(0, int64(uptime+clock.offset)), nil
+}
+
+// isStartupEvent returns true if the open or exec event happened during the initialization of its container
+func isStartupEvent(event queuedEvent) bool {
+	if startupGracePeriod == 0 || event.event == nil {
+		return false
+	}
+	switch event.event.Type {
+	case "exec", "exec-failed", "open":
+	default:
+		return false
+	}
+
+	state, ok := containers.Get(event.key)
+	if !ok {
+		return false
+	}
+	return event.timestamp.Sub(state.Started) < startupGracePeriod
+}
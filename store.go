@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WorkloadSyscalls is the persisted syscall set of a single workload
+type WorkloadSyscalls struct {
+	Workload  string    `json:"workload"`
+	Syscalls  []string  `json:"syscalls"`
+	FirstSeen time.Time `json:"firstSeen"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Set once a process of the workload ran as root
+	RootObserved bool `json:"rootObserved,omitempty"`
+	// Capabilities the processes of the workload were granted when checked
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Set once the capability checks of the workload were traced, without them no capability is known to be unused
+	CapabilitiesTraced bool `json:"capabilitiesTraced,omitempty"`
+}
+
+// RelevancyReport lists the components of an image which were actually used at runtime
+type RelevancyReport struct {
+	Image      string          `json:"image"`
+	Components []SBOMComponent `json:"relevantComponents"`
+	UpdatedAt  time.Time       `json:"updatedAt"`
+}
+
+// ReachabilityReport lists the binaries executed and the libraries loaded from an image, for vulnerability scanners
+type ReachabilityReport struct {
+	// Digest of the image, and the last reference it was run by
+	Image       string    `json:"image"`
+	Reference   string    `json:"reference,omitempty"`
+	Executables []string  `json:"executables"`
+	Libraries   []string  `json:"libraries"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// WorkloadBehavior lists the processes, files and network protocols used by a workload
+type WorkloadBehavior struct {
+	Workload  string            `json:"workload"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Processes []string          `json:"processes"`
+	Files     []string          `json:"files"`
+	Protocols []string          `json:"protocols"`
+	FirstSeen time.Time         `json:"firstSeen"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+// WorkloadNetwork lists the connections accepted and initiated by a workload
+type WorkloadNetwork struct {
+	Workload  string            `json:"workload"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Rules     []NetworkRule     `json:"rules"`
+	FirstSeen time.Time         `json:"firstSeen"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+// Boot is a boot of the node seen by the agent
+type Boot struct {
+	BootID    string    `json:"bootID"`
+	FirstSeen time.Time `json:"firstSeen"`
+}
+
+// Store keeps the state collected per workload on the local disk, so it survives agent restarts and node reboots
+type Store struct {
+	dir  string
+	lock sync.Mutex
+}
+
+// NewStore creates a store rooted at the given directory
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating store directory: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// LoadSyscalls returns the syscall state persisted for the workload (nil if there is none yet)
+func (s *Store) LoadSyscalls(workload string) (*WorkloadSyscalls, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := &WorkloadSyscalls{}
+	if err := s.readJSON(s.path("syscalls", workload), state); err != nil {
+		return nil, fmt.Errorf("reading syscalls of %s: %w", workload, err)
+	}
+	if state.Workload == "" {
+		return nil, nil
+	}
+	return state, nil
+}
+
+// ListSyscalls returns the syscall state of all the workloads whose key starts with the prefix
+func (s *Store) ListSyscalls(prefix string) ([]*WorkloadSyscalls, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, "syscalls"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("listing syscalls: %w", err)
+	}
+	var states []*WorkloadSyscalls
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		state := &WorkloadSyscalls{}
+		if err := s.readJSON(filepath.Join(s.dir, "syscalls", entry.Name()), state); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", entry.Name(), err)
+		}
+		// The key stored in the file is the reference, the names of the files of the previous versions are lossy
+		if strings.HasPrefix(state.Workload, prefix) {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
+
+// MergeSyscalls adds the given syscalls and capabilities to the sets persisted for the workload and returns the updated state along with the syscalls which were not known before
+func (s *Store) MergeSyscalls(workload string, syscalls []string, rootObserved bool, capabilities []string, capabilitiesTraced bool) (*WorkloadSyscalls, []string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path := s.path("syscalls", workload)
+	state := &WorkloadSyscalls{}
+	if err := s.readJSON(path, state); err != nil {
+		return nil, nil, fmt.Errorf("reading syscalls of %s: %w", workload, err)
+	}
+
+	added := mergeStrings(&state.Syscalls, syscalls)
+	addedCapabilities := mergeStrings(&state.Capabilities, capabilities)
+
+	// Nothing new, no need to touch the disk
+	if len(added) == 0 && len(addedCapabilities) == 0 && state.Workload != "" && (state.RootObserved || !rootObserved) && (state.CapabilitiesTraced || !capabilitiesTraced) {
+		return state, nil, nil
+	}
+	state.RootObserved = state.RootObserved || rootObserved
+	state.CapabilitiesTraced = state.CapabilitiesTraced || capabilitiesTraced
+
+	now := time.Now()
+	if state.FirstSeen.IsZero() {
+		state.FirstSeen = now
+	}
+	state.Workload = workload
+	state.UpdatedAt = now
+
+	if err := s.writeJSON(path, state); err != nil {
+		return nil, nil, fmt.Errorf("writing syscalls of %s: %w", workload, err)
+	}
+	return state, added, nil
+}
+
+// MergeRelevantComponents adds components used at runtime to the relevancy report of the image
+func (s *Store) MergeRelevantComponents(image string, components []SBOMComponent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path := s.path("relevancy", image)
+	report := &RelevancyReport{}
+	if err := s.readJSON(path, report); err != nil {
+		return fmt.Errorf("reading relevancy report of %s: %w", image, err)
+	}
+
+	known := make(map[SBOMComponent]bool, len(report.Components))
+	for _, component := range report.Components {
+		known[component] = true
+	}
+	for _, component := range components {
+		if !known[component] {
+			known[component] = true
+			report.Components = append(report.Components, component)
+		}
+	}
+	sort.Slice(report.Components, func(i, j int) bool {
+		return report.Components[i].Name < report.Components[j].Name
+	})
+	report.Image = image
+	report.UpdatedAt = time.Now()
+
+	if err := s.writeJSON(path, report); err != nil {
+		return fmt.Errorf("writing relevancy report of %s: %w", image, err)
+	}
+	return nil
+}
+
+// MergeReachability adds executed binaries and loaded libraries to the reachability report of the image digest, run by
+// the reference
+func (s *Store) MergeReachability(image string, reference string, executables []string, libraries []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path := s.path("reachability", image)
+	report := &ReachabilityReport{}
+	if err := s.readJSON(path, report); err != nil {
+		return fmt.Errorf("reading reachability report of %s: %w", image, err)
+	}
+
+	addedExecutables := mergeStrings(&report.Executables, executables)
+	addedLibraries := mergeStrings(&report.Libraries, libraries)
+	if len(addedExecutables) == 0 && len(addedLibraries) == 0 && report.Image != "" && report.Reference == reference {
+		return nil
+	}
+	report.Image = image
+	report.Reference = reference
+	report.UpdatedAt = time.Now()
+
+	if err := s.writeJSON(path, report); err != nil {
+		return fmt.Errorf("writing reachability report of %s: %w", image, err)
+	}
+	return nil
+}
+
+// MergeBehavior adds processes, files and protocols to the behavior persisted for the workload and returns the updated behavior
+func (s *Store) MergeBehavior(workload string, labels map[string]string, processes []string, files []string, protocols []string) (*WorkloadBehavior, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path := s.path("behavior", workload)
+	behavior := &WorkloadBehavior{}
+	if err := s.readJSON(path, behavior); err != nil {
+		return nil, fmt.Errorf("reading behavior of %s: %w", workload, err)
+	}
+
+	addedProcesses := mergeStrings(&behavior.Processes, processes)
+	addedFiles := mergeStrings(&behavior.Files, files)
+	addedProtocols := mergeStrings(&behavior.Protocols, protocols)
+	if len(addedProcesses) == 0 && len(addedFiles) == 0 && len(addedProtocols) == 0 && behavior.Workload != "" {
+		return behavior, nil
+	}
+
+	now := time.Now()
+	if behavior.FirstSeen.IsZero() {
+		behavior.FirstSeen = now
+	}
+	behavior.Workload = workload
+	behavior.Labels = labels
+	behavior.UpdatedAt = now
+
+	if err := s.writeJSON(path, behavior); err != nil {
+		return nil, fmt.Errorf("writing behavior of %s: %w", workload, err)
+	}
+	return behavior, nil
+}
+
+// MergeNetwork adds network rules to the ones persisted for the workload and returns the updated rules
+func (s *Store) MergeNetwork(workload string, labels map[string]string, rules []NetworkRule) (*WorkloadNetwork, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path := s.path("network", workload)
+	network := &WorkloadNetwork{}
+	if err := s.readJSON(path, network); err != nil {
+		return nil, fmt.Errorf("reading network rules of %s: %w", workload, err)
+	}
+
+	known := make(map[string]bool, len(network.Rules))
+	for _, rule := range network.Rules {
+		known[rule.key()] = true
+	}
+	added := 0
+	for _, rule := range rules {
+		if !known[rule.key()] {
+			known[rule.key()] = true
+			network.Rules = append(network.Rules, rule)
+			added++
+		}
+	}
+	if added == 0 && network.Workload != "" {
+		return network, nil
+	}
+	sort.Slice(network.Rules, func(i, j int) bool { return network.Rules[i].key() < network.Rules[j].key() })
+
+	now := time.Now()
+	if network.FirstSeen.IsZero() {
+		network.FirstSeen = now
+	}
+	network.Workload = workload
+	network.Labels = labels
+	network.UpdatedAt = now
+
+	if err := s.writeJSON(path, network); err != nil {
+		return nil, fmt.Errorf("writing network rules of %s: %w", workload, err)
+	}
+	return network, nil
+}
+
+// LoadInventory returns the behavioral inventory persisted for the workload (nil if there is none yet)
+func (s *Store) LoadInventory(workload string) (*WorkloadInventory, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	inv := &WorkloadInventory{}
+	if err := s.readJSON(s.path("inventory", workload), inv); err != nil {
+		return nil, fmt.Errorf("reading inventory of %s: %w", workload, err)
+	}
+	if inv.Workload == "" {
+		return nil, nil
+	}
+	return inv, nil
+}
+
+// SaveInventory persists the behavioral inventory of a workload
+func (s *Store) SaveInventory(inv *WorkloadInventory) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.writeJSON(s.path("inventory", inv.Workload), inv); err != nil {
+		return fmt.Errorf("writing inventory of %s: %w", inv.Workload, err)
+	}
+	return nil
+}
+
+// HasImageProfile returns true if a runtime profile (reachability or relevancy report) was recorded for the image, the
+// reachability reports are only found by digest
+func (s *Store) HasImageProfile(image string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	paths := []string{s.path("relevancy", image)}
+	if digest := imageDigest(image); digest != "" {
+		paths = append(paths, s.path("reachability", digest))
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// BootSequence returns the position of the boot among all the boots seen by the agent, registering it if it is new
+func (s *Store) BootSequence(bootID string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path := filepath.Join(s.dir, "boots.json")
+	var boots []Boot
+	if err := s.readJSON(path, &boots); err != nil {
+		return 0, fmt.Errorf("reading boots: %w", err)
+	}
+
+	for i, boot := range boots {
+		if boot.BootID == bootID {
+			return i + 1, nil
+		}
+	}
+
+	boots = append(boots, Boot{BootID: bootID, FirstSeen: time.Now()})
+	if err := s.writeJSON(path, boots); err != nil {
+		return 0, fmt.Errorf("writing boots: %w", err)
+	}
+	return len(boots), nil
+}
+
+// path returns the file of a key in one of the store sections
+func (s *Store) path(section string, key string) string {
+	path := filepath.Join(s.dir, section, storeFileName(key)+".json")
+	// The files written by the previous versions are renamed on first use
+	if legacy := filepath.Join(s.dir, section, legacyStoreFileName(key)+".json"); legacy != path {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := os.Rename(legacy, path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error renaming %s: %v\n", legacy, err)
+			}
+		}
+	}
+	return path
+}
+
+// readJSON decodes a file of the store, leaving v untouched if the file doesn't exist yet
+func (s *Store) readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if data, err = openAtRest(data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON encodes v into a file of the store
+func (s *Store) writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = sealAtRest(data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, so a crash never leaves a half written file behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// mergeStrings adds the values missing from the sorted set and returns them
+func mergeStrings(set *[]string, values []string) []string {
+	known := make(map[string]bool, len(*set))
+	for _, value := range *set {
+		known[value] = true
+	}
+
+	var added []string
+	for _, value := range values {
+		if !known[value] {
+			known[value] = true
+			added = append(added, value)
+		}
+	}
+	if len(added) > 0 {
+		*set = append(*set, added...)
+		sort.Strings(*set)
+	}
+	return added
+}
+
+// storeFileNameReplacer escapes the characters of the keys which aren't kept in the file names, '/' becomes '_' to keep
+// the names of the workloads readable
+var storeFileNameReplacer = strings.NewReplacer("%", "%25", "_", "%5F", ":", "%3A", "@", "%40", "/", "_")
+
+// storeFileName turns a workload key or an image into a name which is safe to use as a file name, distinct keys get
+// distinct names
+func storeFileName(key string) string {
+	return storeFileNameReplacer.Replace(key)
+}
+
+// legacyStoreFileName is the name the previous versions used, which "registry/a_b:1" and "registry/a/b:1" shared
+func legacyStoreFileName(key string) string {
+	return strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(key)
+}
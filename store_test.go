@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreFileNameDistinct(t *testing.T) {
+	keys := []string{
+		"registry/a_b:1",
+		"registry/a/b:1",
+		"registry/a_b_1",
+		"registry/a/b@1",
+		"registry/a%2Fb:1",
+	}
+	names := make(map[string]string)
+	for _, key := range keys {
+		name := storeFileName(key)
+		if other, ok := names[name]; ok {
+			t.Errorf("%q and %q share the file name %q", key, other, name)
+		}
+		names[name] = key
+	}
+
+	// The workloads keep readable names
+	if name := storeFileName("default/Deployment/nginx/nginx"); name != "default_Deployment_nginx_nginx" {
+		t.Errorf("got %q for a workload", name)
+	}
+}
+
+func TestStoreRenamesLegacyFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const image = "registry/app:1.0"
+	legacy := filepath.Join(dir, "relevancy", "registry_app_1.0.json")
+	if err := os.MkdirAll(filepath.Dir(legacy), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacy, []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := s.path("relevancy", image)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("legacy file not renamed: %v", err)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("legacy file still present: %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Number of events queued for a subscriber before its new events are dropped
+const subscriberQueueSize = 1024
+
+// EventFilter selects the events of a subscription, the empty fields match everything
+type EventFilter struct {
+	Namespace string
+	Pod       string
+	Container string
+	Types     map[string]bool
+}
+
+// Matches returns whether the event is selected by the filter
+func (f *EventFilter) Matches(event *Event) bool {
+	if f.Namespace != "" && event.Namespace != f.Namespace {
+		return false
+	}
+	if f.Pod != "" && event.Pod != f.Pod {
+		return false
+	}
+	if f.Container != "" && event.Container != f.Container {
+		return false
+	}
+	return len(f.Types) == 0 || f.Types[event.Type]
+}
+
+// eventSubscription is a live stream of the events matching a filter
+type eventSubscription struct {
+	filter EventFilter
+	events chan *Event
+}
+
+// eventBroker is the sink handing the events over to the live subscriptions of the API
+type eventBroker struct {
+	lock          sync.Mutex
+	subscriptions map[*eventSubscription]bool
+	closed        bool
+}
+
+// Broker of the live event streams, nil if the API isn't served
+var eventStreams *eventBroker
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscriptions: make(map[*eventSubscription]bool)}
+}
+
+// Subscribe starts a subscription, nil once the broker is closed
+func (b *eventBroker) Subscribe(filter EventFilter) *eventSubscription {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	subscription := &eventSubscription{filter: filter, events: make(chan *Event, subscriberQueueSize)}
+	b.subscriptions[subscription] = true
+	return subscription
+}
+
+// Unsubscribe ends a subscription
+func (b *eventBroker) Unsubscribe(subscription *eventSubscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.subscriptions[subscription] {
+		delete(b.subscriptions, subscription)
+		close(subscription.events)
+	}
+}
+
+func (b *eventBroker) Write(event *Event) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for subscription := range b.subscriptions {
+		if !subscription.filter.Matches(event) {
+			continue
+		}
+		select {
+		case subscription.events <- event:
+		default:
+			// A slow subscriber never blocks the event worker
+			metrics.SinkEventsDropped.Add(1)
+		}
+	}
+	return nil
+}
+
+// Close ends all the subscriptions
+func (b *eventBroker) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	for subscription := range b.subscriptions {
+		delete(b.subscriptions, subscription)
+		close(subscription.events)
+	}
+	return nil
+}
+
+func registerStreamHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/events/stream", eventStreamHandler)
+}
+
+// eventStreamHandler streams the events of a namespace (?namespace=<namespace>, all the namespaces if empty) as they
+// happen, filtered by ?pod=, ?container= and ?type= (comma separated). The events are NDJSON, or protobuf messages
+// prefixed with their size when application/x-protobuf is accepted.
+func eventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := EventFilter{Namespace: query.Get("namespace"), Pod: query.Get("pod"), Container: query.Get("container")}
+	if filter.Pod != "" && filter.Namespace == "" {
+		http.Error(w, "pod requires namespace", http.StatusBadRequest)
+		return
+	}
+	if types := query.Get("type"); types != "" {
+		filter.Types = make(map[string]bool)
+		for _, eventType := range strings.Split(types, ",") {
+			filter.Types[strings.TrimSpace(eventType)] = true
+		}
+	}
+	if status, err := authorizeNamespace(r, filter.Namespace); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	subscription := eventStreams.Subscribe(filter)
+	if subscription == nil {
+		http.Error(w, "the agent is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer eventStreams.Unsubscribe(subscription)
+
+	encoding := "json"
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if strings.Contains(r.Header.Get("Accept"), "application/x-protobuf") {
+		encoding = "protobuf"
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-subscription.events:
+			if !ok {
+				return
+			}
+			data, err := encodeEventRecord(encoding, event)
+			if err != nil {
+				log.Printf("Error streaming event: %v\n", err)
+				continue
+			}
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+			// Only flushed once the subscriber caught up, so bursts are written at once
+			if len(subscription.events) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// runWatchCommand implements "wlftracer watch", printing the events streamed by the API of a running agent
+func runWatchCommand(args []string) int {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	apiURLPtr := flags.String("api-url", defaultAPIURL, "URL of the API of the agent")
+	caFilePtr := flags.String("ca-file", "", "CA certificates verifying the certificate of the API, the ones of the system if empty")
+	namespacePtr := flags.String("namespace", "", "Only show the events of this namespace")
+	podPtr := flags.String("pod", "", "Only show the events of this Pod")
+	containerPtr := flags.String("container", "", "Only show the events of this container")
+	typesPtr := flags.String("type", "", "Only show the events of these comma separated types (e.g. exec,tcp)")
+	tokenFilePtr := flags.String("token-file", "/var/run/secrets/kubernetes.io/serviceaccount/token", "File of the bearer token authorizing the request")
+	jsonPtr := flags.Bool("json", false, "Print the raw JSON events")
+	flags.Parse(args)
+
+	token, err := os.ReadFile(*tokenFilePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the token: %v\n", err)
+		return 1
+	}
+	query := url.Values{}
+	for name, value := range map[string]string{"namespace": *namespacePtr, "pod": *podPtr, "container": *containerPtr, "type": *typesPtr} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	endpoint := strings.TrimSuffix(*apiURLPtr, "/") + "/api/v1/events/stream?" + query.Encode()
+	request, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create the request: %v\n", err)
+		return 1
+	}
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	// No timeout, the stream lasts until interrupted
+	client, err := newAPIClient(*caFilePtr, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up the client: %v\n", err)
+		return 1
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to query the agent: %v\n", err)
+		return 1
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		fmt.Fprintf(os.Stderr, "The agent answered %s: %s\n", response.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if *jsonPtr {
+			fmt.Println(scanner.Text())
+			continue
+		}
+		event := &Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to decode an event: %v\n", err)
+			continue
+		}
+		fmt.Println(formatWatchedEvent(event))
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "The stream ended: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// formatWatchedEvent summarizes an event on one line
+func formatWatchedEvent(event *Event) string {
+	detail := eventDetail(event)
+	if len(event.Lineage) > 0 {
+		detail += " < " + formatLineage(event.Lineage)
+	}
+	return fmt.Sprintf("%s %s/%s/%s %s %s", event.Time.Local().Format("15:04:05"), event.Namespace, event.Pod, event.Container, event.Type, detail)
+}
+
+// eventDetail describes what an event did, depending on its type
+func eventDetail(event *Event) string {
+	var detail string
+	switch {
+	case event.Type == "tcp":
+		detail = fmt.Sprintf("%s %s:%d -> %s:%d", event.Operation, event.Src, event.Sport, event.Dst, event.Dport)
+	case event.Type == "dns":
+		detail = fmt.Sprintf("%s %s %s %s", event.Operation, event.QueryType, event.DNSName, strings.Join(event.Addresses, ","))
+	case event.Type == "capability":
+		detail = fmt.Sprintf("%s %s", event.Capability, event.Verdict)
+	case event.Type == "alert":
+		detail = fmt.Sprintf("%s (%s) %s", event.Rule, event.Severity, event.Message)
+	case event.Syscall != "":
+		detail = event.Syscall
+	default:
+		detail = strings.TrimSpace(event.Path + " " + strings.Join(event.Args, " "))
+	}
+	return detail
+}
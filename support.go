@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/features"
+	"github.com/cilium/ebpf/rlimit"
+	"golang.org/x/sys/unix"
+)
+
+// Program types the tracers attach with, by tracer
+var tracerProgramTypes = map[string][]ebpf.ProgramType{
+	execTraceName:         {ebpf.TracePoint},
+	openTraceName:         {ebpf.TracePoint},
+	tcpTraceName:          {ebpf.Kprobe},
+	capabilitiesTraceName: {ebpf.Kprobe, ebpf.RawTracepoint},
+	syscallTraceName:      {ebpf.RawTracepoint},
+	dnsTraceName:          {ebpf.SocketFilter},
+}
+
+// TracingProblem is a reason why tracers can't run on the node, along with how to fix it
+type TracingProblem struct {
+	Problem     string `json:"problem"`
+	Remediation string `json:"remediation,omitempty"`
+	// Tracers it prevents from running, all of them if empty
+	Tracers []string `json:"tracers,omitempty"`
+}
+
+func (p *TracingProblem) String() string {
+	if p.Remediation == "" {
+		return p.Problem
+	}
+	return p.Problem + ", " + p.Remediation
+}
+
+// TracingSupport tells whether the node can run the eBPF tracers, and why not
+type TracingSupport struct {
+	// All the tracers can run
+	Supported bool   `json:"supported"`
+	Kernel    string `json:"kernel"`
+	// Lockdown mode of the kernel (none, integrity or confidentiality), empty if the kernel has no lockdown
+	Lockdown string `json:"lockdown,omitempty"`
+	// Mode of SELinux (enforcing or permissive), empty if it is disabled
+	SELinux string `json:"selinux,omitempty"`
+	// The kernel describes its types with BTF
+	BTF bool `json:"btf"`
+	// Set when the containers are only registered, none of their events traced
+	MetadataOnly bool `json:"metadataOnly"`
+	// Tracers left out as they can't run on the node
+	Disabled []string `json:"disabled,omitempty"`
+	// Reasons why tracers can't run
+	Problems []TracingProblem `json:"problems,omitempty"`
+}
+
+// Support of the tracers by the node, probed on startup
+var tracingSupport *TracingSupport
+
+// Set when the node can't run the tracers and the agent only registers the containers
+var metadataOnly bool
+
+// probeTracingSupport checks which tracers can be loaded: the memlock limit can be raised, the kernel, the permissions
+// of the agent and SELinux allow loading the eBPF programs they attach with, and the lockdown of the kernel allows the
+// tracing programs reading its memory
+func probeTracingSupport() *TracingSupport {
+	support := &TracingSupport{}
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err == nil {
+		support.Kernel = unix.ByteSliceToString(uname.Release[:])
+	}
+	if data, err := os.ReadFile("/sys/kernel/security/lockdown"); err == nil {
+		support.Lockdown = selectedLockdown(string(data))
+	}
+	support.SELinux = selinuxMode()
+	if _, err := os.Stat("/sys/kernel/btf/vmlinux"); err == nil {
+		support.BTF = true
+	}
+
+	// eBPF needs the limit raised on the kernels accounting its memory with memlock
+	if err := rlimit.RemoveMemlock(); err != nil {
+		support.Problems = append(support.Problems, TracingProblem{
+			Problem:     fmt.Sprintf("raising the memlock limit: %v", err),
+			Remediation: "grant CAP_SYS_RESOURCE to the agent or raise its memlock limit",
+		})
+	}
+
+	// Probe every program type once, then attribute the failures to the tracers using them
+	blocked := make(map[ebpf.ProgramType]*TracingProblem)
+	for _, name := range tracerLoadOrder {
+		for _, programType := range tracerProgramTypes[name] {
+			problem, probed := blocked[programType]
+			if !probed {
+				problem = probeProgramType(programType, support.SELinux)
+				blocked[programType] = problem
+			}
+			if problem != nil {
+				problem.Tracers = appendUnique(problem.Tracers, name)
+			}
+		}
+	}
+	programTypes := make([]ebpf.ProgramType, 0, len(blocked))
+	for programType, problem := range blocked {
+		if problem != nil {
+			programTypes = append(programTypes, programType)
+		}
+	}
+	sort.Slice(programTypes, func(i, j int) bool { return programTypes[i] < programTypes[j] })
+	for _, programType := range programTypes {
+		support.Problems = append(support.Problems, *blocked[programType])
+	}
+
+	// The tracing programs read the arguments and paths from the kernel memory, the socket filters only the packets
+	if support.Lockdown == "confidentiality" {
+		problem := TracingProblem{
+			Problem:     "the kernel lockdown in confidentiality mode forbids the tracing programs reading the kernel memory",
+			Remediation: "boot the node with lockdown=integrity or without lockdown (it is often enforced along with Secure Boot)",
+		}
+		for _, name := range tracerLoadOrder {
+			if name != dnsTraceName {
+				problem.Tracers = append(problem.Tracers, name)
+			}
+		}
+		support.Problems = append(support.Problems, problem)
+	}
+	support.Supported = len(support.Problems) == 0
+	return support
+}
+
+// probeProgramType returns why the programs of the type can't be loaded, nil if they can
+func probeProgramType(programType ebpf.ProgramType, selinux string) *TracingProblem {
+	err := features.HaveProgramType(programType)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ebpf.ErrNotSupported):
+		return &TracingProblem{
+			Problem:     fmt.Sprintf("the kernel doesn't support the eBPF %s programs", programType),
+			Remediation: "run the agent on a kernel built with CONFIG_BPF_SYSCALL and CONFIG_BPF_EVENTS",
+		}
+	case errors.Is(err, unix.EPERM):
+		return &TracingProblem{
+			Problem:     fmt.Sprintf("loading the eBPF %s programs isn't permitted", programType),
+			Remediation: "grant CAP_SYS_ADMIN, or CAP_BPF and CAP_PERFMON, to the agent",
+		}
+	case errors.Is(err, unix.EACCES) && selinux == "enforcing":
+		return &TracingProblem{
+			Problem:     fmt.Sprintf("SELinux denies loading the eBPF %s programs", programType),
+			Remediation: "allow the bpf class (map_create, map_read, map_write, prog_load, prog_run) to the domain of the agent, e.g. run it as spc_t, the denials are listed by ausearch -m avc",
+		}
+	case errors.Is(err, unix.EACCES):
+		return &TracingProblem{
+			Problem:     fmt.Sprintf("a security module denies loading the eBPF %s programs", programType),
+			Remediation: "check the AppArmor profile and the seccomp profile of the agent allow the bpf syscall",
+		}
+	}
+	return &TracingProblem{Problem: fmt.Sprintf("probing the eBPF %s programs: %v", programType, err)}
+}
+
+// Blocking returns the problem preventing a tracer from running, nil if it can run
+func (s *TracingSupport) Blocking(tracer string) *TracingProblem {
+	for i := range s.Problems {
+		if len(s.Problems[i].Tracers) == 0 || containsString(s.Problems[i].Tracers, tracer) {
+			return &s.Problems[i]
+		}
+	}
+	return nil
+}
+
+// Summary lists the problems of the node in one line
+func (s *TracingSupport) Summary() string {
+	problems := make([]string, 0, len(s.Problems))
+	for _, problem := range s.Problems {
+		problems = append(problems, problem.Problem)
+	}
+	return strings.Join(problems, "; ")
+}
+
+// selectedLockdown returns the mode between brackets of /sys/kernel/security/lockdown (e.g. none [integrity] confidentiality)
+func selectedLockdown(modes string) string {
+	for _, mode := range strings.Fields(modes) {
+		if strings.HasPrefix(mode, "[") && strings.HasSuffix(mode, "]") {
+			return strings.Trim(mode, "[]")
+		}
+	}
+	return ""
+}
+
+// selinuxMode returns the mode of SELinux on the host, empty if it is disabled or its filesystem isn't mounted
+func selinuxMode() string {
+	for _, dir := range []string{"/sys/fs/selinux", filepath.Join(os.Getenv("HOST_ROOT"), "sys/fs/selinux")} {
+		data, err := os.ReadFile(filepath.Join(dir, "enforce"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(data)) == "1" {
+			return "enforcing"
+		}
+		return "permissive"
+	}
+	return ""
+}
+
+// appendUnique appends the value unless it is already in the values
+func appendUnique(values []string, value string) []string {
+	if containsString(values, value) {
+		return values
+	}
+	return append(values, value)
+}
+
+// tracingSupportHandler serves the support of the tracers by the node
+func tracingSupportHandler(w http.ResponseWriter, r *http.Request) {
+	if status, err := authorizeNamespace(r, ""); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, tracingSupport)
+}
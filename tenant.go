@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Name of the ConfigMap (and of the optional Secret holding its credentials) configuring a tenant in its namespace
+const tenantConfigName = "wlftracer-tenant"
+
+// Hosts the tenants may send their events and digests to, over HTTPS unless the entry is prefixed with http://. A
+// *. prefix matches the subdomains. The tenants may set no endpoint if empty, the agent mustn't post to any URL a
+// namespace admin picks (e.g. the cloud metadata service).
+var tenantAllowedHosts stringList
+
+// checkTenantURL returns an error unless the URL is allowed by --tenant-allowed-host
+func checkTenantURL(name string, value string) error {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid %s %q", name, value)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, entry := range tenantAllowedHosts {
+		scheme := "https"
+		if strings.HasPrefix(entry, "http://") {
+			scheme = "http"
+			entry = strings.TrimPrefix(entry, "http://")
+		}
+		entry = strings.ToLower(strings.TrimPrefix(entry, "https://"))
+		if u.Scheme != scheme {
+			continue
+		}
+		if host == entry || (strings.HasPrefix(entry, "*.") && strings.HasSuffix(host, entry[1:])) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %q is not allowed, see --tenant-allowed-host", name, value)
+}
+
+// TenantConfig is the configuration a namespace (tenant) sets for its own events
+type TenantConfig struct {
+	// Endpoint receiving the events of the namespace as newline delimited JSON
+	WebhookURL string
+	// Splunk HTTP Event Collector of the tenant, the token comes from the Secret
+	SplunkURL   string
+	SplunkToken string
+	SplunkIndex string
+	// Event types sent to the sinks of the tenant, all of them if empty
+	EventTypes map[string]bool
+	// Files under these prefixes are not sent to the sinks of the tenant
+	ExcludePaths []string
+	// How long the container files of the namespace are kept once their container is gone, forever if zero
+	Retention time.Duration
+	// How long the profiles of the workloads of the namespace are kept once they stopped running, forever if zero
+	ProfileRetention time.Duration
+	// How far back the events of the history are sent to the sinks added by a reload, none if zero
+	Backfill time.Duration
+	// Where the digests of the namespace are delivered instead of the default targets
+	DigestSlackWebhook string
+	DigestEmailTo      string
+}
+
+// tenant is a configured namespace along with the sinks created from its configuration
+type tenant struct {
+	namespace string
+	version   string
+	config    TenantConfig
+	loadedAt  time.Time
+	sinks     []Sink
+	// Destination of each sink, to tell the new ones when the configuration is updated
+	destinations []string
+
+	// Sinks to backfill with the history, until it is done or the tenant is closed
+	backfillSinks []Sink
+	stopBackfill  chan struct{}
+	backfills     sync.WaitGroup
+}
+
+// closedFile is a container file kept until the retention of its tenant expires
+type closedFile struct {
+	key      ContainerKey
+	path     string
+	closedAt time.Time
+}
+
+// TenantRegistry keeps the configurations of the tenants in sync with their ConfigMaps
+type TenantRegistry struct {
+	client kubernetes.Interface
+
+	// Held for reading while dispatching, so sinks are never closed while in use
+	lock    sync.RWMutex
+	tenants map[string]*tenant
+
+	filesLock sync.Mutex
+	files     []closedFile
+
+	// Set once the configurations were loaded, only the sinks added by the later reloads are backfilled
+	loaded bool
+}
+
+var tenants *TenantRegistry
+
+// Creates the Splunk sinks of the tenants, nil if the Splunk sink isn't built in
+var newTenantSplunkSink func(url string, token string, index string) (Sink, error)
+
+// NewTenantRegistry creates a registry loading the tenant configurations with the client
+func NewTenantRegistry(client kubernetes.Interface) *TenantRegistry {
+	return &TenantRegistry{client: client, tenants: make(map[string]*tenant)}
+}
+
+// reconcileLoop reloads the configurations and applies the retentions on each tick until stop is closed
+func (r *TenantRegistry) reconcileLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	r.reconcile()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.reconcile()
+			r.applyRetention()
+		}
+	}
+}
+
+// reconcile creates the sinks of the new or updated tenants and closes the ones of the updated or deleted tenants
+func (r *TenantRegistry) reconcile() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	configMaps, err := r.client.CoreV1().ConfigMaps("").List(ctx, metav1.ListOptions{FieldSelector: "metadata.name=" + tenantConfigName})
+	if err != nil {
+		log.Printf("Error listing tenant configurations: %v\n", err)
+		return
+	}
+
+	current := make(map[string]*tenant, len(configMaps.Items))
+	r.lock.RLock()
+	for namespace, t := range r.tenants {
+		current[namespace] = t
+	}
+	r.lock.RUnlock()
+
+	updated := make(map[string]*tenant, len(configMaps.Items))
+	backfill := false
+	for i := range configMaps.Items {
+		configMap := &configMaps.Items[i]
+		secret, err := r.client.CoreV1().Secrets(configMap.Namespace).Get(ctx, tenantConfigName, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Printf("Error reading tenant secret of %s: %v\n", configMap.Namespace, err)
+			continue
+		}
+		version := configMap.ResourceVersion
+		if secret != nil && err == nil {
+			version += "/" + secret.ResourceVersion
+		} else {
+			secret = nil
+		}
+
+		if existing, ok := current[configMap.Namespace]; ok && existing.version == version {
+			updated[configMap.Namespace] = existing
+			continue
+		}
+		t, err := newTenant(configMap, secret, version)
+		if err != nil {
+			log.Printf("Invalid tenant configuration in %s: %v\n", configMap.Namespace, err)
+			continue
+		}
+		log.Printf("Loaded tenant configuration of %s\n", configMap.Namespace)
+		if r.loaded {
+			backfill = t.planBackfill(current[configMap.Namespace]) || backfill
+		}
+		updated[configMap.Namespace] = t
+	}
+
+	r.lock.Lock()
+	r.tenants = updated
+	r.loaded = true
+	r.lock.Unlock()
+
+	// Backfilled from the event worker, so the history stops where the new sinks start receiving the events
+	if backfill {
+		eventQueue.Enqueue(queuedEvent{backfill: true})
+	}
+
+	// No event is dispatched to the replaced tenants anymore, their sinks can be flushed
+	for namespace, t := range current {
+		if updated[namespace] != t {
+			t.close()
+		}
+	}
+}
+
+// newTenant parses the configuration of a tenant and creates its sinks
+func newTenant(configMap *corev1.ConfigMap, secret *corev1.Secret, version string) (*tenant, error) {
+	config := TenantConfig{
+		WebhookURL:  configMap.Data["webhookURL"],
+		SplunkURL:   configMap.Data["splunkURL"],
+		SplunkIndex: configMap.Data["splunkIndex"],
+
+		DigestSlackWebhook: configMap.Data["digestSlackWebhook"],
+		DigestEmailTo:      configMap.Data["digestEmailTo"],
+	}
+	for _, name := range []string{"webhookURL", "splunkURL", "digestSlackWebhook"} {
+		if value := configMap.Data[name]; value != "" {
+			if err := checkTenantURL(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if secret != nil {
+		config.SplunkToken = string(secret.Data["splunkToken"])
+	}
+	if eventTypes := configMap.Data["eventTypes"]; eventTypes != "" {
+		config.EventTypes = make(map[string]bool)
+		for _, eventType := range strings.Split(eventTypes, ",") {
+			config.EventTypes[strings.TrimSpace(eventType)] = true
+		}
+	}
+	for _, prefix := range strings.Split(configMap.Data["excludePaths"], ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			config.ExcludePaths = append(config.ExcludePaths, prefix)
+		}
+	}
+	if retention := configMap.Data["retention"]; retention != "" {
+		var err error
+		if config.Retention, err = time.ParseDuration(retention); err != nil {
+			return nil, fmt.Errorf("invalid retention: %w", err)
+		}
+	}
+	if retention := configMap.Data["profileRetention"]; retention != "" {
+		var err error
+		if config.ProfileRetention, err = time.ParseDuration(retention); err != nil {
+			return nil, fmt.Errorf("invalid profile retention: %w", err)
+		}
+	}
+	if backfill := configMap.Data["backfill"]; backfill != "" {
+		var err error
+		if config.Backfill, err = time.ParseDuration(backfill); err != nil {
+			return nil, fmt.Errorf("invalid backfill: %w", err)
+		}
+	}
+
+	t := &tenant{namespace: configMap.Namespace, version: version, config: config, loadedAt: time.Now(), stopBackfill: make(chan struct{})}
+	if config.WebhookURL != "" {
+		t.sinks = append(t.sinks, NewHTTPSink(config.WebhookURL, "json", nil, 100, time.Second, deliveryBestEffort))
+		t.destinations = append(t.destinations, "webhook:"+config.WebhookURL)
+	}
+	if config.SplunkURL != "" {
+		if newTenantSplunkSink == nil {
+			t.close()
+			return nil, fmt.Errorf("the Splunk sink isn't part of this build")
+		}
+		sink, err := newTenantSplunkSink(config.SplunkURL, config.SplunkToken, config.SplunkIndex)
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		t.sinks = append(t.sinks, sink)
+		t.destinations = append(t.destinations, "splunk:"+config.SplunkURL+"/"+config.SplunkIndex)
+	}
+	return t, nil
+}
+
+// planBackfill selects the sinks to backfill: the ones whose destination the previous configuration of the tenant
+// didn't have, if any. It returns true if there are some.
+func (t *tenant) planBackfill(previous *tenant) bool {
+	if t.config.Backfill <= 0 {
+		return false
+	}
+	if eventHistory == nil {
+		log.Printf("Not backfilling the sinks of tenant %s: no history is kept, see --backfill-window\n", t.namespace)
+		return false
+	}
+	existing := make(map[string]bool)
+	if previous != nil {
+		for _, destination := range previous.destinations {
+			existing[destination] = true
+		}
+	}
+	for i, sink := range t.sinks {
+		if _, ok := sink.(backfiller); ok && !existing[t.destinations[i]] {
+			t.backfillSinks = append(t.backfillSinks, sink)
+		}
+	}
+	return len(t.backfillSinks) > 0
+}
+
+// startBackfills starts sending the history to the sinks to backfill, it is called from the event worker so the
+// history ends right before the events the sinks receive
+func (r *TenantRegistry) startBackfills() {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, t := range r.tenants {
+		if len(t.backfillSinks) == 0 {
+			continue
+		}
+		sinks := t.backfillSinks
+		t.backfillSinks = nil
+		t.backfills.Add(1)
+		go t.backfill(sinks, eventHistory.Position())
+	}
+}
+
+// backfill sends the events of the namespace recorded in the backfill window of the tenant, up to the position
+func (t *tenant) backfill(sinks []Sink, until historyPosition) {
+	defer t.backfills.Done()
+
+	window := t.config.Backfill
+	if window > backfillWindow {
+		window = backfillWindow
+	}
+	count := 0
+	eventHistory.Replay(t.loadedAt.Add(-window), until, func(event *Event) bool {
+		if event.Namespace != t.namespace || !t.accepts(event) {
+			return true
+		}
+		for _, sink := range sinks {
+			if !sink.(backfiller).Backfill(event, t.stopBackfill) {
+				return false
+			}
+		}
+		count++
+		return true
+	})
+	metrics.SinkEventsBackfilled.Add(uint64(count))
+	log.Printf("Backfilled %d events of the last %s to the new sinks of tenant %s\n", count, window, t.namespace)
+}
+
+// accepts returns true if the event passes the filters of the tenant
+func (t *tenant) accepts(event *Event) bool {
+	if t.config.EventTypes != nil && !t.config.EventTypes[event.Type] {
+		return false
+	}
+	for _, prefix := range t.config.ExcludePaths {
+		if event.Path != "" && strings.HasPrefix(event.Path, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *tenant) close() {
+	// The sinks are closed once nothing is backfilled into them anymore
+	close(t.stopBackfill)
+	t.backfills.Wait()
+	for _, sink := range t.sinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("Error closing tenant sink: %v\n", err)
+		}
+	}
+}
+
+// Dispatch hands the event over to the sinks of the tenant owning its namespace
+func (r *TenantRegistry) Dispatch(event *Event) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	t, ok := r.tenants[event.Namespace]
+	if !ok || !t.accepts(event) {
+		return
+	}
+	for _, sink := range t.sinks {
+		if err := sink.Write(event); err != nil {
+			log.Printf("Error writing event to the sink of tenant %s: %v\n", event.Namespace, err)
+		}
+	}
+}
+
+// Config returns the configuration of the tenant owning the namespace
+func (r *TenantRegistry) Config(namespace string) (TenantConfig, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	t, ok := r.tenants[namespace]
+	if !ok {
+		return TenantConfig{}, false
+	}
+	return t.config, true
+}
+
+// FileClosed records the file of a removed container, to delete it once the retention of its tenant expires
+func (r *TenantRegistry) FileClosed(key ContainerKey, path string) {
+	r.filesLock.Lock()
+	defer r.filesLock.Unlock()
+	r.files = append(r.files, closedFile{key: key, path: path, closedAt: time.Now()})
+}
+
+// applyRetention deletes the files of removed containers which outlived the retention of their tenant, the files of the
+// workloads setting their own retention are left to the janitor
+func (r *TenantRegistry) applyRetention() {
+	policies := loadRetentionPolicies()
+	r.lock.RLock()
+	retentions := make(map[string]time.Duration, len(r.tenants))
+	for namespace, t := range r.tenants {
+		retentions[namespace] = t.config.Retention
+	}
+	r.lock.RUnlock()
+
+	r.filesLock.Lock()
+	defer r.filesLock.Unlock()
+	kept := r.files[:0]
+	for _, file := range r.files {
+		if policies.overridesFile(file.path) {
+			continue
+		}
+		retention := retentions[file.key.Namespace]
+		if retention == 0 || time.Since(file.closedAt) < retention {
+			kept = append(kept, file)
+			continue
+		}
+		// A new container with the same name appends to the same file
+		_, running := containers.Get(file.key)
+		if !running {
+			if err := removeContainerFiles(file.path); err != nil {
+				log.Printf("Error deleting %s: %v\n", file.path, err)
+				kept = append(kept, file)
+				continue
+			}
+		}
+	}
+	r.files = kept
+}
+
+// Close flushes the sinks of all the tenants
+func (r *TenantRegistry) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, t := range r.tenants {
+		t.close()
+	}
+	r.tenants = make(map[string]*tenant)
+}
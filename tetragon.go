@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Tetragon JSON export, see https://tetragon.io/docs/concepts/events/
+type tetragonImage struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+type tetragonContainer struct {
+	ID    string        `json:"id"`
+	Name  string        `json:"name"`
+	Image tetragonImage `json:"image"`
+}
+
+type tetragonPod struct {
+	Namespace    string            `json:"namespace"`
+	Name         string            `json:"name"`
+	Container    tetragonContainer `json:"container"`
+	Workload     string            `json:"workload,omitempty"`
+	WorkloadKind string            `json:"workload_kind,omitempty"`
+}
+
+type tetragonProcess struct {
+	ExecID    string      `json:"exec_id"`
+	Pid       uint32      `json:"pid"`
+	UID       uint32      `json:"uid"`
+	Binary    string      `json:"binary"`
+	Arguments string      `json:"arguments,omitempty"`
+	Flags     string      `json:"flags,omitempty"`
+	StartTime string      `json:"start_time"`
+	Pod       tetragonPod `json:"pod"`
+}
+
+type tetragonExec struct {
+	Process tetragonProcess  `json:"process"`
+	Parent  *tetragonProcess `json:"parent,omitempty"`
+}
+
+type tetragonKprobe struct {
+	Process      tetragonProcess          `json:"process"`
+	Parent       *tetragonProcess         `json:"parent,omitempty"`
+	FunctionName string                   `json:"function_name"`
+	Args         []map[string]interface{} `json:"args"`
+	Action       string                   `json:"action"`
+}
+
+type tetragonEvent struct {
+	ProcessExec   *tetragonExec   `json:"process_exec,omitempty"`
+	ProcessKprobe *tetragonKprobe `json:"process_kprobe,omitempty"`
+	NodeName      string          `json:"node_name"`
+	Time          string          `json:"time"`
+}
+
+// Kernel functions Tetragon hooks for the TCP operations
+var tetragonTCPFunctions = map[string]string{
+	"connect": "tcp_connect",
+	"accept":  "inet_csk_accept",
+	"close":   "tcp_close",
+}
+
+func formatTetragonEvent(event *Event) ([]byte, error) {
+	process := tetragonProcess{
+		// Tetragon identifies processes by the base64 encoded node, start time and pid
+		ExecID:    base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d:%d", event.Node, event.Time.UnixNano(), event.Pid))),
+		Pid:       event.Pid,
+		UID:       event.Uid,
+		Binary:    event.Comm,
+		StartTime: event.Time.UTC().Format(time.RFC3339Nano),
+		Pod: tetragonPod{
+			Namespace: event.Namespace,
+			Name:      event.Pod,
+			Container: tetragonContainer{
+				ID:    event.ContainerID,
+				Name:  event.Container,
+				Image: tetragonImage{Name: event.Image},
+			},
+		},
+	}
+	if _, kind, name, _, ok := parseWorkloadKey(event.Workload); ok && kind != "Pod" {
+		process.Pod.Workload = name
+		process.Pod.WorkloadKind = kind
+	}
+
+	// Only the pid and binary of the parent are known
+	var parent *tetragonProcess
+	if len(event.Lineage) > 0 {
+		ancestor := event.Lineage[0]
+		parent = &tetragonProcess{
+			ExecID: base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d", event.Node, ancestor.Pid))),
+			Pid:    ancestor.Pid,
+			Binary: ancestor.Path,
+			Pod:    process.Pod,
+		}
+		if parent.Binary == "" {
+			parent.Binary = ancestor.Comm
+		}
+	}
+
+	out := tetragonEvent{NodeName: event.Node, Time: event.Time.UTC().Format(time.RFC3339Nano)}
+	switch event.Type {
+	case "exec":
+		process.Binary = event.Path
+		process.Arguments = strings.Join(execArguments(event), " ")
+		process.Flags = "execve"
+		out.ProcessExec = &tetragonExec{Process: process, Parent: parent}
+	case "open":
+		out.ProcessKprobe = &tetragonKprobe{
+			Process:      process,
+			Parent:       parent,
+			FunctionName: "security_file_open",
+			Args:         []map[string]interface{}{{"file_arg": map[string]string{"path": event.Path}}},
+			Action:       "KPROBE_ACTION_POST",
+		}
+	case "tcp":
+		out.ProcessKprobe = &tetragonKprobe{
+			Process:      process,
+			Parent:       parent,
+			FunctionName: tetragonTCPFunctions[event.Operation],
+			Args: []map[string]interface{}{{"sock_arg": map[string]interface{}{
+				"type":     "SOCK_STREAM",
+				"protocol": "IPPROTO_TCP",
+				"saddr":    event.Src,
+				"daddr":    event.Dst,
+				"sport":    event.Sport,
+				"dport":    event.Dport,
+			}}},
+			Action: "KPROBE_ACTION_POST",
+		}
+	default:
+		// Tetragon has no equivalent of the other events
+		return nil, nil
+	}
+	return json.Marshal(out)
+}
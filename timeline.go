@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Time without events beyond which the timeline marks a gap
+const timelineGap = time.Minute
+
+// runTimelineCommand implements "wlftracer timeline", printing the events of a Pod kept in the history of a running
+// agent as a single chronological narrative, followed by the tree of the processes involved
+func runTimelineCommand(args []string) int {
+	flags := flag.NewFlagSet("timeline", flag.ExitOnError)
+	apiURLPtr := flags.String("api-url", defaultAPIURL, "URL of the API of the agent")
+	caFilePtr := flags.String("ca-file", "", "CA certificates verifying the certificate of the API, the ones of the system if empty")
+	namespacePtr := flags.String("namespace", "", "Namespace of the Pod")
+	podPtr := flags.String("pod", "", "Pod of the timeline")
+	containerPtr := flags.String("container", "", "Only show the events of this container")
+	fromPtr := flags.String("from", "1h", "Start of the timeline, RFC 3339 or a duration ago (e.g. 30m)")
+	toPtr := flags.String("to", "", "End of the timeline, RFC 3339 or a duration ago, now if empty")
+	tokenFilePtr := flags.String("token-file", "/var/run/secrets/kubernetes.io/serviceaccount/token", "File of the bearer token authorizing the request")
+	flags.Parse(args)
+
+	if *namespacePtr == "" || *podPtr == "" {
+		fmt.Fprintf(os.Stderr, "--namespace and --pod are required\n")
+		return 1
+	}
+	now := time.Now()
+	from, err := parseTimelineTime(*fromPtr, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --from: %v\n", err)
+		return 1
+	}
+	to, err := parseTimelineTime(*toPtr, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --to: %v\n", err)
+		return 1
+	}
+	token, err := os.ReadFile(*tokenFilePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the token: %v\n", err)
+		return 1
+	}
+
+	query := url.Values{"namespace": {*namespacePtr}, "pod": {*podPtr}, "from": {from.Format(time.RFC3339Nano)}, "to": {to.Format(time.RFC3339Nano)}}
+	if *containerPtr != "" {
+		query.Set("container", *containerPtr)
+	}
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*apiURLPtr, "/")+"/api/v1/events/export?"+query.Encode(), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create the request: %v\n", err)
+		return 1
+	}
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	client, err := newAPIClient(*caFilePtr, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up the client: %v\n", err)
+		return 1
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to query the agent: %v\n", err)
+		return 1
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		fmt.Fprintf(os.Stderr, "The agent answered %s: %s\n", response.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+
+	var events []*Event
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxHistoryLine)
+	for scanner.Scan() {
+		event := &Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to decode an event: %v\n", err)
+			continue
+		}
+		if event.Type != "checkpoint" {
+			events = append(events, event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "The export ended: %v\n", err)
+		return 1
+	}
+	writeTimeline(os.Stdout, *namespacePtr+"/"+*podPtr, from, to, events)
+	return 0
+}
+
+// parseTimelineTime parses a time in RFC 3339 or as a duration before now, now if empty
+func parseTimelineTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return now, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil {
+		return now.Add(-ago), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// writeTimeline writes the events of a Pod in chronological order, each with the process which caused it and its
+// ancestors, the gaps and the alerts marked, and then the tree of the processes
+func writeTimeline(w io.Writer, pod string, from time.Time, to time.Time, events []*Event) {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	fmt.Fprintf(w, "Timeline of %s from %s to %s, %d events\n\n", pod, from.Local().Format(time.RFC3339), to.Local().Format(time.RFC3339), len(events))
+
+	containers := make(map[string]bool)
+	for _, event := range events {
+		containers[event.Container] = true
+	}
+	var previous time.Time
+	for _, event := range events {
+		if !previous.IsZero() && event.Time.Sub(previous) >= timelineGap {
+			fmt.Fprintf(w, "%14s ... %s without events\n", "", event.Time.Sub(previous).Round(time.Second))
+		}
+		previous = event.Time
+
+		marker := " "
+		if event.Type == "alert" || event.Type == "anomaly" || event.Type == "drift" {
+			marker = "!"
+		}
+		line := fmt.Sprintf("%s %s %-11s %s", event.Time.Local().Format("15:04:05.000"), marker, event.Type, eventDetail(event))
+		if len(containers) > 1 {
+			line += " [" + event.Container + "]"
+		}
+		if process := timelineProcess(event); process != "" {
+			line += " by " + process
+		}
+		if event.Startup {
+			line += " (startup)"
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	if tree := timelineProcessTree(events); len(tree) > 0 {
+		fmt.Fprintf(w, "\nProcesses\n")
+		for _, line := range tree {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// timelineProcess returns the process of an event and its ancestors, e.g. curl(42) < sh(12) < node(1)
+func timelineProcess(event *Event) string {
+	if event.Pid == 0 {
+		return ""
+	}
+	process := fmt.Sprintf("%s(%d)", event.Comm, event.Pid)
+	if len(event.Lineage) > 0 {
+		process += " < " + formatLineage(event.Lineage)
+	}
+	return process
+}
+
+// timelineNode is a process of the tree of a timeline
+type timelineNode struct {
+	pid      uint32
+	ppid     uint32
+	comm     string
+	path     string
+	args     []string
+	started  time.Time
+	children []*timelineNode
+}
+
+// timelineProcessTree returns the lines of the tree of the processes of the events, from their executions and their
+// lineages, the children indented under their parent in the order they started
+func timelineProcessTree(events []*Event) []string {
+	nodes := make(map[uint32]*timelineNode)
+	node := func(pid uint32) *timelineNode {
+		if n, ok := nodes[pid]; ok {
+			return n
+		}
+		n := &timelineNode{pid: pid}
+		nodes[pid] = n
+		return n
+	}
+	for _, event := range events {
+		if event.Pid == 0 {
+			continue
+		}
+		n := node(event.Pid)
+		if n.comm == "" {
+			n.comm = event.Comm
+		}
+		if event.Type == "exec" {
+			n.path, n.args, n.ppid = event.Path, event.Args, event.Ppid
+			if n.started.IsZero() {
+				n.started = event.Time
+			}
+		}
+		// The lineage has the parent first
+		child := n
+		for _, ancestor := range event.Lineage {
+			parent := node(ancestor.Pid)
+			if parent.comm == "" {
+				parent.comm = ancestor.Comm
+			}
+			if parent.path == "" {
+				parent.path = ancestor.Path
+			}
+			if child.ppid == 0 {
+				child.ppid = ancestor.Pid
+			}
+			child = parent
+		}
+	}
+
+	var roots []*timelineNode
+	for _, n := range nodes {
+		if parent, ok := nodes[n.ppid]; ok && n.ppid != n.pid {
+			parent.children = append(parent.children, n)
+		} else {
+			roots = append(roots, n)
+		}
+	}
+	var lines []string
+	var walk func(nodes []*timelineNode, depth int)
+	walk = func(nodes []*timelineNode, depth int) {
+		sort.Slice(nodes, func(i, j int) bool {
+			if !nodes[i].started.Equal(nodes[j].started) {
+				return nodes[i].started.Before(nodes[j].started)
+			}
+			return nodes[i].pid < nodes[j].pid
+		})
+		for _, n := range nodes {
+			line := fmt.Sprintf("%s%s(%d)", strings.Repeat("  ", depth+1), n.comm, n.pid)
+			if n.path != "" {
+				line += " " + strings.TrimSpace(n.path+" "+strings.Join(n.args, " "))
+			}
+			if !n.started.IsZero() {
+				line += " at " + n.started.Local().Format("15:04:05.000")
+			}
+			lines = append(lines, line)
+			walk(n.children, depth+1)
+		}
+	}
+	walk(roots, 0)
+	return lines
+}
@@ -0,0 +1,49 @@
+//go:build !no_capabilities_tracer
+
+package main
+
+import (
+	"fmt"
+
+	tracercapabilities "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/capabilities/tracer"
+	tracercapabilitiestype "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/capabilities/types"
+)
+
+func init() {
+	registerTracer(capabilitiesTraceName, func(targets *tracerTargets) (func(), error) {
+		mountnsmap, err := addTracer(targets.tracers, capabilitiesTraceName, targets.selector.TracerSelector(capabilitiesTraceName))
+		if err != nil {
+			return nil, err
+		}
+		// Only the checks which would be logged by the kernel, once per process and capability
+		tracer, err := tracercapabilities.NewTracer(&tracercapabilities.Config{MountnsMap: mountnsmap, AuditOnly: true, Unique: true}, targets.containers, handleCapabilityEvent)
+		if err != nil {
+			removeTracer(targets.tracers, capabilitiesTraceName)
+			return nil, fmt.Errorf("creating tracer: %w", err)
+		}
+		return func() {
+			tracer.Stop()
+			removeTracer(targets.tracers, capabilitiesTraceName)
+		}, nil
+	})
+}
+
+// handleCapabilityEvent reports the capability checks
+func handleCapabilityEvent(event *tracercapabilitiestype.Event) {
+	if !tracerEventOK(capabilitiesTraceName, event.Event) || exclusions.ExcludedPod(capabilitiesTraceName, event.Namespace, event.Pod) {
+		return
+	}
+	reportCapabilityInPod(&Event{
+		Time:       eventTime(event.Timestamp),
+		Type:       "capability",
+		Namespace:  event.Namespace,
+		Pod:        event.Pod,
+		Container:  event.Container,
+		Pid:        event.Pid,
+		Uid:        event.Uid,
+		Comm:       event.Comm,
+		Capability: event.CapName,
+		Verdict:    event.Verdict,
+		Syscall:    event.Syscall,
+	})
+}
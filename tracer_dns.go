@@ -0,0 +1,106 @@
+//go:build !no_dns_tracer
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	containercollection "github.com/inspektor-gadget/inspektor-gadget/pkg/container-collection"
+	tracerdns "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/dns/tracer"
+	tracerdnstype "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/dns/types"
+)
+
+func init() {
+	registerTracer(dnsTraceName, func(targets *tracerTargets) (func(), error) {
+		stop, err := loadDNSTracer(targets.containers, targets.selector.TracerSelector(dnsTraceName), handleDNSEvent)
+		if err != nil {
+			return nil, fmt.Errorf("creating tracer: %w", err)
+		}
+		return stop, nil
+	})
+}
+
+// loadDNSTracer attaches the DNS tracer to the network namespace of the selected containers, as they come and go, and
+// returns the function stopping it. The containers of a Pod share their network namespace, its events are attributed
+// to the first container attached.
+func loadDNSTracer(containerCollection *containercollection.ContainerCollection, selector containercollection.ContainerSelector,
+	callback func(*containercollection.Container, *tracerdnstype.Event),
+) (func(), error) {
+	tracer, err := tracerdns.NewTracer()
+	if err != nil {
+		return nil, err
+	}
+
+	// The attachments of the tracer aren't safe for concurrent use
+	var lock sync.Mutex
+	attach := func(container *containercollection.Container) {
+		// The network namespace of the host isn't the one of a workload
+		if container.HostNetwork || container.Pid == 0 {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if err := tracer.Attach(container.Pid, func(event *tracerdnstype.Event) {
+			callback(container, event)
+		}); err != nil {
+			log.Printf("Error attaching the DNS tracer to container %v: %v\n", container.ID, err)
+		}
+	}
+	detach := func(container *containercollection.Container) {
+		if container.HostNetwork || container.Pid == 0 {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		// Containers which failed to attach aren't known to the tracer
+		tracer.Detach(container.Pid)
+	}
+
+	existing := containerCollection.Subscribe(dnsTraceName, selector, func(notif containercollection.PubSubEvent) {
+		switch notif.Type {
+		case containercollection.EventTypeAddContainer:
+			attach(notif.Container)
+		case containercollection.EventTypeRemoveContainer:
+			detach(notif.Container)
+		}
+	})
+	for _, container := range existing {
+		attach(container)
+	}
+
+	return func() {
+		containerCollection.Unsubscribe(dnsTraceName)
+		lock.Lock()
+		defer lock.Unlock()
+		tracer.Close()
+	}, nil
+}
+
+// handleDNSEvent reports the DNS queries and responses, of the container owning the network namespace
+func handleDNSEvent(container *containercollection.Container, event *tracerdnstype.Event) {
+	if !tracerEventOK(dnsTraceName, event.Event) || exclusions.ExcludedPod(dnsTraceName, container.Namespace, container.Podname) {
+		return
+	}
+	operation := "query"
+	if event.Qr == tracerdnstype.DNSPktTypeResponse {
+		operation = "response"
+	}
+	reportDNSInPod(&Event{
+		Time:       eventTime(event.Timestamp),
+		Type:       "dns",
+		Namespace:  container.Namespace,
+		Pod:        container.Podname,
+		Container:  container.Name,
+		Pid:        event.Pid,
+		Uid:        event.Uid,
+		Comm:       event.Comm,
+		Operation:  operation,
+		DNSName:    event.DNSName,
+		QueryType:  event.QType,
+		Rcode:      event.Rcode,
+		Addresses:  event.Addresses,
+		Nameserver: event.Nameserver,
+	})
+}
@@ -0,0 +1,78 @@
+//go:build !no_exec_tracer
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	tracerexec "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/exec/tracer"
+	tracerexectype "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/exec/types"
+)
+
+func init() {
+	registerTracer(execTraceName, func(targets *tracerTargets) (func(), error) {
+		mountnsmap, err := addTracer(targets.tracers, execTraceName, targets.selector.TracerSelector(execTraceName))
+		if err != nil {
+			return nil, err
+		}
+		tracer, err := tracerexec.NewTracer(&tracerexec.Config{MountnsMap: mountnsmap}, targets.containers, handleExecEvent)
+		if err != nil {
+			removeTracer(targets.tracers, execTraceName)
+			return nil, fmt.Errorf("creating tracer: %w", err)
+		}
+		return func() {
+			tracer.Stop()
+			removeTracer(targets.tracers, execTraceName)
+		}, nil
+	})
+}
+
+// handleExecEvent reports the exec events, and the failed ones with --record-failed-exec
+func handleExecEvent(event *tracerexectype.Event) {
+	if !tracerEventOK(execTraceName, event.Event) {
+		return
+	}
+	if event.Retval > -1 && !exclusions.ExcludedPod(execTraceName, event.Namespace, event.Pod) {
+		procImageName := event.Comm
+		if len(event.Args) > 0 {
+			procImageName = event.Args[0]
+		}
+		reportExecInPod(&Event{
+			Time:      eventTime(event.Timestamp),
+			Type:      "exec",
+			Namespace: event.Namespace,
+			Pod:       event.Pod,
+			Container: event.Container,
+			Pid:       event.Pid,
+			Ppid:      event.Ppid,
+			Uid:       event.Uid,
+			Gid:       event.Gid,
+			Comm:      event.Comm,
+			Path:      procImageName,
+			Args:      event.Args,
+		}, isExecArgsTruncated(event.Args))
+	} else if recordFailedExec && !exclusions.ExcludedPod(execTraceName, event.Namespace, event.Pod) {
+		procImageName := event.Comm
+		if len(event.Args) > 0 {
+			procImageName = event.Args[0]
+		}
+		reportFailedExecInPod(&Event{
+			Time:      eventTime(event.Timestamp),
+			Type:      "exec-failed",
+			Namespace: event.Namespace,
+			Pod:       event.Pod,
+			Container: event.Container,
+			Pid:       event.Pid,
+			Ppid:      event.Ppid,
+			Uid:       event.Uid,
+			Gid:       event.Gid,
+			Comm:      event.Comm,
+			Path:      procImageName,
+			Args:      event.Args,
+			Errno:     unix.ErrnoName(syscall.Errno(-event.Retval)),
+		})
+	}
+}
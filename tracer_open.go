@@ -0,0 +1,53 @@
+//go:build !no_open_tracer
+
+package main
+
+import (
+	"fmt"
+
+	traceropen "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/open/tracer"
+	traceropentype "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/open/types"
+)
+
+func init() {
+	registerTracer(openTraceName, func(targets *tracerTargets) (func(), error) {
+		mountnsmap, err := addTracer(targets.tracers, openTraceName, targets.selector.TracerSelector(openTraceName))
+		if err != nil {
+			return nil, err
+		}
+		tracer, err := traceropen.NewTracer(&traceropen.Config{MountnsMap: mountnsmap}, targets.containers, handleOpenEvent)
+		if err != nil {
+			removeTracer(targets.tracers, openTraceName)
+			return nil, fmt.Errorf("creating tracer: %w", err)
+		}
+		return func() {
+			tracer.Stop()
+			removeTracer(targets.tracers, openTraceName)
+		}, nil
+	})
+}
+
+// handleOpenEvent reports the successful opens allowed by the open filter
+func handleOpenEvent(event *traceropentype.Event) {
+	if !tracerEventOK(openTraceName, event.Event) {
+		return
+	}
+	if event.Ret > -1 && !exclusions.ExcludedPod(openTraceName, event.Namespace, event.Pod) {
+		if openFilter != nil && !openFilter.Allows(event.Path) {
+			metrics.OpenEventsFiltered.Add(1)
+			return
+		}
+		reportOpenInPod(&Event{
+			Time:      eventTime(event.Timestamp),
+			Type:      "open",
+			Namespace: event.Namespace,
+			Pod:       event.Pod,
+			Container: event.Container,
+			Pid:       event.Pid,
+			Uid:       event.Uid,
+			Gid:       event.Gid,
+			Comm:      event.Comm,
+			Path:      event.Path,
+		}, event.Fd, openFilter != nil && openFilter.ChecksReadOnly(event.Path))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	tracersyscall "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/advise/seccomp/tracer"
+)
+
+// The syscall tracer is always built in, the seccomp profiles rely on it
+
+func init() {
+	registerTracer(syscallTraceName, func(targets *tracerTargets) (func(), error) {
+		if err := targets.tracers.AddTracer(syscallTraceName, targets.selector.TracerSelector(syscallTraceName)); err != nil {
+			return nil, fmt.Errorf("adding tracer: %w", err)
+		}
+		tracer, err := tracersyscall.NewTracer()
+		if err != nil {
+			removeTracer(targets.tracers, syscallTraceName)
+			return nil, fmt.Errorf("creating tracer: %w", err)
+		}
+		setSyscallTracer(tracer)
+		return func() {
+			setSyscallTracer(nil)
+			tracer.Close()
+			removeTracer(targets.tracers, syscallTraceName)
+		}, nil
+	})
+}
+
+var traceSystemCall *tracersyscall.Tracer
+
+var traceSystemCallLock sync.RWMutex
+
+// setSyscallTracer sets the syscall tracer once it is loaded, or nil once it is stopped
+func setSyscallTracer(tracer *tracersyscall.Tracer) {
+	traceSystemCallLock.Lock()
+	defer traceSystemCallLock.Unlock()
+
+	traceSystemCall = tracer
+}
+
+// errSyscallsNotTraced is returned for the containers not selected by the selector of the syscall tracer
+var errSyscallsNotTraced = errors.New("syscalls not traced for the container")
+
+// peekSyscalls returns the syscalls done so far in the mount namespace of a container
+func peekSyscalls(state *ContainerState) ([]string, error) {
+	// The syscall tracer records all the containers, the selection is applied here
+	if !enabledTracers[syscallTraceName] || exclusions.ExcludedPod(syscallTraceName, state.Key.Namespace, state.Key.Podname) {
+		return nil, errSyscallsNotTraced
+	}
+
+	traceSystemCallLock.RLock()
+	defer traceSystemCallLock.RUnlock()
+
+	if traceSystemCall == nil {
+		return nil, fmt.Errorf("syscall tracer not loaded")
+	}
+	return traceSystemCall.Peek(state.Mntns)
+}
@@ -0,0 +1,51 @@
+//go:build !no_tcp_tracer
+
+package main
+
+import (
+	"fmt"
+
+	tracertcp "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/tcp/tracer"
+	tracertcptype "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/tcp/types"
+)
+
+func init() {
+	registerTracer(tcpTraceName, func(targets *tracerTargets) (func(), error) {
+		mountnsmap, err := addTracer(targets.tracers, tcpTraceName, targets.selector.TracerSelector(tcpTraceName))
+		if err != nil {
+			return nil, err
+		}
+		tracer, err := tracertcp.NewTracer(&tracertcp.Config{MountnsMap: mountnsmap}, targets.containers, handleTCPEvent)
+		if err != nil {
+			removeTracer(targets.tracers, tcpTraceName)
+			return nil, fmt.Errorf("creating tracer: %w", err)
+		}
+		return func() {
+			tracer.Stop()
+			removeTracer(targets.tracers, tcpTraceName)
+		}, nil
+	})
+}
+
+// handleTCPEvent reports the TCP connections
+func handleTCPEvent(event *tracertcptype.Event) {
+	if !tracerEventOK(tcpTraceName, event.Event) || exclusions.ExcludedPod(tcpTraceName, event.Namespace, event.Pod) {
+		return
+	}
+	reportTCPActivityInPod(&Event{
+		Time:      eventTime(event.Timestamp),
+		Type:      "tcp",
+		Namespace: event.Namespace,
+		Pod:       event.Pod,
+		Container: event.Container,
+		Pid:       event.Pid,
+		Uid:       event.Uid,
+		Gid:       event.Gid,
+		Comm:      event.Comm,
+		Operation: event.Operation,
+		Src:       event.Saddr,
+		Dst:       event.Daddr,
+		Sport:     event.Sport,
+		Dport:     event.Dport,
+	})
+}
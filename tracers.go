@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	containercollection "github.com/inspektor-gadget/inspektor-gadget/pkg/container-collection"
+	tracercollection "github.com/inspektor-gadget/inspektor-gadget/pkg/tracer-collection"
+	eventtypes "github.com/inspektor-gadget/inspektor-gadget/pkg/types"
+)
+
+// tracerLoader loads one of the tracers, returning the function stopping it
+type tracerLoader struct {
+	name string
+	load func() (func(), error)
+}
+
+// tracerTargets are the collections and the selector the tracers are loaded with
+type tracerTargets struct {
+	containers *containercollection.ContainerCollection
+	tracers    *tracercollection.TracerCollection
+	selector   *SelectorConfig
+}
+
+// Loads one of the tracers, returning the function stopping it
+type tracerFactory func(targets *tracerTargets) (func(), error)
+
+// Tracers built in by name. Each tracer registers itself from the init of its file, so the slim builds leave it out
+// with the build tag of the file (e.g. -tags no_tcp_tracer,no_dns_tracer,no_capabilities_tracer)
+var tracerRegistry = make(map[string]tracerFactory)
+
+// Order in which the enabled tracers are loaded
+var tracerLoadOrder = []string{execTraceName, openTraceName, tcpTraceName, syscallTraceName, dnsTraceName, capabilitiesTraceName}
+
+// registerTracer adds a tracer to the build, called from the init of its file
+func registerTracer(name string, factory tracerFactory) {
+	tracerRegistry[name] = factory
+}
+
+// defaultTracers returns the tracers run when --tracers isn't set, among the ones built in
+func defaultTracers() string {
+	var names []string
+	for _, name := range []string{"exec", "open", "tcp", "syscall"} {
+		if _, ok := tracerRegistry[tracerNames[name]]; ok {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// TracerManager loads the tracers, keeping the service running with the ones which loaded while it retries the others.
+// A tracer failing at runtime is stopped and loaded again the same way.
+type TracerManager struct {
+	lock    sync.Mutex
+	loaders []tracerLoader
+	// Stop functions of the loaded tracers by name
+	loaded map[string]func()
+	// Last error of the tracers which aren't loaded, and when they are retried next
+	errors    map[string]string
+	nextRetry map[string]time.Time
+	backoff   map[string]time.Duration
+	// Tracers which failed at runtime, to be stopped and loaded again
+	failed chan string
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+var tracerManager *TracerManager
+
+// Maximum delay between two attempts to load a tracer
+const maxTracerRetryBackoff = time.Hour
+
+// Time a loaded tracer may go without any event while containers are traced before it is loaded again, 0 to never
+// consider a quiet tracer stalled
+var tracerStallTimeout time.Duration
+
+// Time of the last event received by each tracer, in Unix nanoseconds
+var tracerLastEvents = map[string]*atomic.Int64{
+	execTraceName:         new(atomic.Int64),
+	openTraceName:         new(atomic.Int64),
+	tcpTraceName:          new(atomic.Int64),
+	dnsTraceName:          new(atomic.Int64),
+	capabilitiesTraceName: new(atomic.Int64),
+}
+
+// observeTracerEvent records that the tracer is receiving events
+func observeTracerEvent(name string) {
+	tracerLastEvents[name].Store(time.Now().UnixNano())
+}
+
+// tracerEventOK tells whether an event of a tracer is a normal one to report. An error means the tracer stopped reading
+// its events, it is loaded again.
+func tracerEventOK(name string, event eventtypes.Event) bool {
+	switch event.Type {
+	case eventtypes.NORMAL:
+		observeTracerEvent(name)
+		return true
+	case eventtypes.ERR:
+		tracerManager.Failed(name, event.Message)
+	case eventtypes.WARN:
+		log.Printf("Tracer %s: %s\n", name, event.Message)
+	}
+	return false
+}
+
+// NewTracerManager creates the manager of the tracers, they are loaded by Start
+func NewTracerManager(loaders []tracerLoader) *TracerManager {
+	return &TracerManager{
+		loaders:   loaders,
+		loaded:    make(map[string]func()),
+		errors:    make(map[string]string),
+		nextRetry: make(map[string]time.Time),
+		backoff:   make(map[string]time.Duration),
+		failed:    make(chan string, len(loaders)),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start loads the tracers once and retries the failed ones, starting after retryInterval and backing off up to
+// maxTracerRetryBackoff. The callbacks of the tracers may report their failures as soon as they are loaded.
+func (m *TracerManager) Start(retryInterval time.Duration) {
+	probedTracers.Store(m)
+	if m.loadMissing(retryInterval) == len(m.loaders) {
+		log.Printf("No tracer could be loaded, retrying every %s\n", retryInterval)
+	}
+	go m.retryLoop(retryInterval)
+}
+
+// loadMissing tries to load the tracers which aren't loaded yet and are due for a retry, and returns how many are
+// still missing
+func (m *TracerManager) loadMissing(retryInterval time.Duration) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	missing := 0
+	for _, loader := range m.loaders {
+		if _, ok := m.loaded[loader.name]; ok {
+			continue
+		}
+		if time.Now().Before(m.nextRetry[loader.name]) {
+			missing++
+			continue
+		}
+		objects := snapshotBPFObjects()
+		stop, err := loader.load()
+		if err != nil {
+			missing++
+			metrics.TracerLoadFailures.Add(1)
+			health.SetDegraded("tracer:"+loader.name, err.Error())
+			backoff := m.backoff[loader.name]
+			if backoff == 0 {
+				backoff = retryInterval
+			} else if backoff *= 2; backoff > maxTracerRetryBackoff {
+				backoff = maxTracerRetryBackoff
+			}
+			m.backoff[loader.name] = backoff
+			m.nextRetry[loader.name] = time.Now().Add(backoff)
+			m.errors[loader.name] = err.Error()
+			continue
+		}
+		log.Printf("Tracer %s loaded\n", loader.name)
+		recordTracerBPFObjects(loader.name, objects)
+		m.loaded[loader.name] = stop
+		delete(m.errors, loader.name)
+		delete(m.backoff, loader.name)
+		delete(m.nextRetry, loader.name)
+		if lastEvent, ok := tracerLastEvents[loader.name]; ok {
+			// The stall timeout starts over
+			lastEvent.Store(time.Now().UnixNano())
+		}
+		health.SetHealthy("tracer:" + loader.name)
+	}
+	metrics.TracersDegraded.Store(uint64(missing))
+	return missing
+}
+
+// Failed reports a tracer which stopped working at runtime, it is loaded again by the retry loop. It never blocks, so
+// it can be called from the callbacks of the tracer.
+func (m *TracerManager) Failed(name string, reason string) {
+	m.lock.Lock()
+	m.errors[name] = reason
+	m.lock.Unlock()
+	select {
+	case m.failed <- name:
+	default:
+	}
+}
+
+// unload stops a tracer which failed, so it is loaded again
+func (m *TracerManager) unload(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stop, ok := m.loaded[name]
+	if !ok {
+		return
+	}
+	log.Printf("Tracer %s failed, loading it again: %s\n", name, m.errors[name])
+	metrics.TracerRuntimeFailures.Add(1)
+	health.SetDegraded("tracer:"+name, m.errors[name])
+	stop()
+	forgetTracerBPFObjects(name)
+	delete(m.loaded, name)
+}
+
+// stalledTracers returns the loaded tracers which didn't receive any event for tracerStallTimeout
+func (m *TracerManager) stalledTracers() []string {
+	if tracerStallTimeout <= 0 || len(containers.States()) == 0 {
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var stalled []string
+	for name := range m.loaded {
+		lastEvent, ok := tracerLastEvents[name]
+		if ok && time.Since(time.Unix(0, lastEvent.Load())) > tracerStallTimeout {
+			m.errors[name] = fmt.Sprintf("no event received for %s", tracerStallTimeout)
+			stalled = append(stalled, name)
+		}
+	}
+	return stalled
+}
+
+func (m *TracerManager) retryLoop(interval time.Duration) {
+	defer close(m.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case name := <-m.failed:
+			m.unload(name)
+			m.loadMissing(interval)
+		case <-ticker.C:
+			for _, name := range m.stalledTracers() {
+				m.unload(name)
+			}
+			m.loadMissing(interval)
+		}
+	}
+}
+
+// TracerStatus is the state of a tracer reported by the probes
+type TracerStatus struct {
+	Loaded bool   `json:"loaded"`
+	Error  string `json:"error,omitempty"`
+	// Time of the last event received by the tracer
+	LastEvent *time.Time `json:"lastEvent,omitempty"`
+}
+
+// Status returns the state of every enabled tracer by name
+func (m *TracerManager) Status() map[string]TracerStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	status := make(map[string]TracerStatus, len(m.loaders))
+	for _, loader := range m.loaders {
+		_, loaded := m.loaded[loader.name]
+		tracer := TracerStatus{Loaded: loaded, Error: m.errors[loader.name]}
+		if lastEvent, ok := tracerLastEvents[loader.name]; ok && lastEvent.Load() != 0 {
+			t := time.Unix(0, lastEvent.Load())
+			tracer.LastEvent = &t
+		}
+		status[loader.name] = tracer
+	}
+	return status
+}
+
+// Close stops retrying and stops the loaded tracers
+func (m *TracerManager) Close() {
+	close(m.stop)
+	<-m.done
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Stop in the reverse order of the loaders
+	for i := len(m.loaders) - 1; i >= 0; i-- {
+		if stop, ok := m.loaded[m.loaders[i].name]; ok {
+			stop()
+			delete(m.loaded, m.loaders[i].name)
+		}
+	}
+}
+
+// Loaded returns true if the tracer is loaded
+func (m *TracerManager) Loaded(name string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, ok := m.loaded[name]
+	return ok
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the trace sessions, also the names of their directories
+var traceSessionNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// Files of a trace session artifact
+const (
+	traceSessionEventsFile   = "events.ndjson"
+	traceSessionManifestFile = "manifest.json"
+	traceSessionProfilesDir  = "profiles"
+)
+
+// TraceSessionFilter selects the events recorded by a trace session, all the events of the node if empty
+type TraceSessionFilter struct {
+	Namespace string   `json:"namespace,omitempty"`
+	Pod       string   `json:"pod,omitempty"`
+	Container string   `json:"container,omitempty"`
+	Types     []string `json:"types,omitempty"`
+}
+
+// TraceSessionFile is a file of a trace session artifact, with its digest
+type TraceSessionFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// TraceSessionManifest summarizes a trace session, it is written along with its events and profiles
+type TraceSessionManifest struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description,omitempty"`
+	Node        string             `json:"node"`
+	Filter      TraceSessionFilter `json:"filter"`
+	// recording or stopped
+	State   string     `json:"state"`
+	Started time.Time  `json:"started"`
+	Stopped *time.Time `json:"stopped,omitempty"`
+	// Set when the agent stopped before the session, its profiles are then missing
+	Interrupted bool `json:"interrupted,omitempty"`
+	// Time the session is stopped at if it wasn't before
+	Deadline     *time.Time        `json:"deadline,omitempty"`
+	Events       uint64            `json:"events"`
+	EventsByType map[string]uint64 `json:"eventsByType"`
+	// Containers which had events recorded, <namespace>/<pod>/<container>
+	Containers []string           `json:"containers"`
+	Files      []TraceSessionFile `json:"files,omitempty"`
+}
+
+// traceSession is a named window of collection, whose events and profiles are recorded into its directory
+type traceSession struct {
+	dir      string
+	filter   EventFilter
+	manifest TraceSessionManifest
+	events   *os.File
+	timer    *time.Timer
+	// Activity of the containers during the session
+	profiles map[ContainerKey]*traceSessionProfile
+}
+
+// traceSessionProfile is the activity of a container during a session
+type traceSessionProfile struct {
+	state      *ContainerState
+	aggregator *profileAggregator
+	syscalls   map[string]bool
+}
+
+// TraceSessions records the trace sessions started through the API
+type TraceSessions struct {
+	dir      string
+	lock     sync.Mutex
+	sessions map[string]*traceSession
+	// Sessions recording, looked up for every event
+	active map[string]*traceSession
+}
+
+var traceSessions *TraceSessions
+
+// NewTraceSessions creates the trace sessions stored in the directory, the sessions left recording by a previous
+// instance of the agent are stopped
+func NewTraceSessions(dir string) (*TraceSessions, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating trace session directory: %w", err)
+	}
+	s := &TraceSessions{dir: dir, sessions: make(map[string]*traceSession), active: make(map[string]*traceSession)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading trace session directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		session := &traceSession{dir: filepath.Join(dir, entry.Name())}
+		data, err := os.ReadFile(filepath.Join(session.dir, traceSessionManifestFile))
+		if err != nil {
+			log.Printf("Error reading the manifest of trace session %s: %v\n", entry.Name(), err)
+			continue
+		}
+		if err := json.Unmarshal(data, &session.manifest); err != nil {
+			log.Printf("Error decoding the manifest of trace session %s: %v\n", entry.Name(), err)
+			continue
+		}
+		if session.manifest.State == "recording" {
+			session.manifest.Interrupted = true
+			if err := session.finish(clock.Now()); err != nil {
+				log.Printf("Error stopping trace session %s: %v\n", session.manifest.Name, err)
+			}
+		}
+		s.sessions[session.manifest.Name] = session
+	}
+	return s, nil
+}
+
+// Start starts recording a session, stopped after the duration if it isn't zero
+func (s *TraceSessions) Start(name string, description string, filter TraceSessionFilter, duration time.Duration) (*TraceSessionManifest, error) {
+	if !traceSessionNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid session name %q, expected lowercase alphanumeric characters or '-'", name)
+	}
+	if filter.Pod != "" && filter.Namespace == "" {
+		return nil, fmt.Errorf("pod requires namespace")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.sessions[name]; exists {
+		return nil, fmt.Errorf("session %q already exists", name)
+	}
+	session := &traceSession{
+		dir:      filepath.Join(s.dir, name),
+		filter:   EventFilter{Namespace: filter.Namespace, Pod: filter.Pod, Container: filter.Container},
+		profiles: make(map[ContainerKey]*traceSessionProfile),
+		manifest: TraceSessionManifest{
+			Name:         name,
+			Description:  description,
+			Node:         NodeName,
+			Filter:       filter,
+			State:        "recording",
+			Started:      clock.Now(),
+			EventsByType: make(map[string]uint64),
+			Containers:   []string{},
+		},
+	}
+	if len(filter.Types) > 0 {
+		session.filter.Types = make(map[string]bool)
+		for _, eventType := range filter.Types {
+			session.filter.Types[eventType] = true
+		}
+	}
+	if err := os.MkdirAll(session.dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating session directory: %w", err)
+	}
+	events, err := os.OpenFile(filepath.Join(session.dir, traceSessionEventsFile), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("creating session events: %w", err)
+	}
+	session.events = events
+	if duration > 0 {
+		deadline := session.manifest.Started.Add(duration)
+		session.manifest.Deadline = &deadline
+		session.timer = time.AfterFunc(duration, func() {
+			if _, err := s.Stop(name); err != nil {
+				log.Printf("Error stopping trace session %s: %v\n", name, err)
+			}
+		})
+	}
+	// Written right away so a session left recording by a crash is found on restart
+	if err := session.writeManifest(); err != nil {
+		if session.timer != nil {
+			session.timer.Stop()
+		}
+		events.Close()
+		return nil, err
+	}
+	s.sessions[name] = session
+	s.active[name] = session
+	log.Printf("Trace session %s started, recording to %s\n", name, session.dir)
+	return session.snapshot(), nil
+}
+
+// Stop stops recording a session and completes its artifact
+func (s *TraceSessions) Stop(name string) (*TraceSessionManifest, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if _, recording := s.active[name]; recording {
+		delete(s.active, name)
+		if err := session.finish(clock.Now()); err != nil {
+			return nil, err
+		}
+		log.Printf("Trace session %s stopped, %d events recorded\n", name, session.manifest.Events)
+	}
+	return session.snapshot(), nil
+}
+
+// Record records the event into the sessions it matches
+func (s *TraceSessions) Record(event *Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.active) == 0 {
+		return
+	}
+	var line []byte
+	for _, session := range s.active {
+		if !session.filter.Matches(event) {
+			continue
+		}
+		if line == nil {
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Error encoding event for trace session: %v\n", err)
+				return
+			}
+			line = append(data, '\n')
+		}
+		if err := writeWithRetry(session.events, string(line)); err != nil {
+			log.Printf("Error recording trace session %s: %v\n", session.manifest.Name, err)
+			continue
+		}
+		session.record(event)
+		metrics.TraceSessionEvents.Add(1)
+	}
+}
+
+// record accounts for the event in the summary and the profile of its container
+func (t *traceSession) record(event *Event) {
+	t.manifest.Events++
+	t.manifest.EventsByType[event.Type]++
+	if event.Namespace == "" && event.Pod == "" && event.Container == "" {
+		return
+	}
+	key := ContainerKey{event.Namespace, event.Pod, event.Container}
+	profile, ok := t.profiles[key]
+	if !ok {
+		profile = &traceSessionProfile{
+			state:      &ContainerState{Key: key, ID: event.ContainerID, Workload: event.Workload, Image: event.Image},
+			aggregator: newProfileAggregator(),
+			syscalls:   make(map[string]bool),
+		}
+		t.profiles[key] = profile
+		t.manifest.Containers = append(t.manifest.Containers, fmt.Sprintf("%s/%s/%s", key.Namespace, key.Podname, key.ContainerName))
+	}
+	if event.Type == "new-syscall" {
+		profile.syscalls[event.Syscall] = true
+		return
+	}
+	profile.aggregator.Add(event)
+}
+
+// finish closes the events, writes the profiles and the manifest with the digests of the files
+func (t *traceSession) finish(now time.Time) error {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	if t.events != nil {
+		if err := t.events.Close(); err != nil {
+			log.Printf("Error closing trace session %s: %v\n", t.manifest.Name, err)
+		}
+		t.events = nil
+	}
+	if len(t.profiles) > 0 {
+		if err := os.MkdirAll(filepath.Join(t.dir, traceSessionProfilesDir), 0700); err != nil {
+			return fmt.Errorf("creating profile directory: %w", err)
+		}
+	}
+	for key, profile := range t.profiles {
+		syscalls := make([]string, 0, len(profile.syscalls))
+		for syscall := range profile.syscalls {
+			syscalls = append(syscalls, syscall)
+		}
+		sort.Strings(syscalls)
+		data, err := json.MarshalIndent(profile.aggregator.Profile(profile.state, syscalls), "", "  ")
+		if err != nil {
+			return fmt.Errorf("encoding profile: %w", err)
+		}
+		name := fmt.Sprintf("%s_%s_%s.json", key.Namespace, key.Podname, key.ContainerName)
+		if err := os.WriteFile(filepath.Join(t.dir, traceSessionProfilesDir, name), data, 0600); err != nil {
+			return fmt.Errorf("writing profile: %w", err)
+		}
+	}
+	t.profiles = nil
+
+	t.manifest.State = "stopped"
+	t.manifest.Stopped = &now
+	sort.Strings(t.manifest.Containers)
+	files, err := t.digestFiles()
+	if err != nil {
+		return err
+	}
+	t.manifest.Files = files
+	return t.writeManifest()
+}
+
+// digestFiles lists the files of the artifact but the manifest, with their digests
+func (t *traceSession) digestFiles() ([]TraceSessionFile, error) {
+	var files []TraceSessionFile
+	err := filepath.Walk(t.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(t.dir, path)
+		if err != nil || name == traceSessionManifestFile {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, f); err != nil {
+			return err
+		}
+		files = append(files, TraceSessionFile{Name: filepath.ToSlash(name), Size: info.Size(), SHA256: hex.EncodeToString(hash.Sum(nil))})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("digesting session files: %w", err)
+	}
+	return files, nil
+}
+
+// snapshot copies the manifest, the one of a recording session changes with every event
+func (t *traceSession) snapshot() *TraceSessionManifest {
+	manifest := t.manifest
+	manifest.EventsByType = make(map[string]uint64, len(t.manifest.EventsByType))
+	for eventType, count := range t.manifest.EventsByType {
+		manifest.EventsByType[eventType] = count
+	}
+	manifest.Containers = append([]string{}, t.manifest.Containers...)
+	return &manifest
+}
+
+func (t *traceSession) writeManifest() error {
+	data, err := json.MarshalIndent(&t.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(t.dir, traceSessionManifestFile), data, 0600); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	return nil
+}
+
+// Get returns the manifest of a session
+func (s *TraceSessions) Get(name string) (*TraceSessionManifest, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[name]
+	if !ok {
+		return nil, false
+	}
+	return session.snapshot(), true
+}
+
+// List returns the manifests of the sessions, sorted by start time
+func (s *TraceSessions) List() []TraceSessionManifest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	manifests := make([]TraceSessionManifest, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		manifests = append(manifests, *session.snapshot())
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Started.Before(manifests[j].Started) })
+	return manifests
+}
+
+// Delete removes a stopped session and its artifact
+func (s *TraceSessions) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if _, recording := s.active[name]; recording {
+		return fmt.Errorf("session %q is recording, stop it first", name)
+	}
+	if err := os.RemoveAll(session.dir); err != nil {
+		return fmt.Errorf("removing session: %w", err)
+	}
+	delete(s.sessions, name)
+	return nil
+}
+
+// WriteArtifact writes the files of a stopped session as a gzipped tar archive, under a directory named after it
+func (s *TraceSessions) WriteArtifact(name string, w io.Writer) error {
+	s.lock.Lock()
+	session, ok := s.sessions[name]
+	_, recording := s.active[name]
+	s.lock.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	if recording {
+		return fmt.Errorf("session %q is recording, stop it first", name)
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	err := filepath.Walk(session.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(session.dir, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name + "/" + filepath.ToSlash(rel)
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(archive, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Close stops the sessions still recording
+func (s *TraceSessions) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := clock.Now()
+	for name, session := range s.active {
+		if err := session.finish(now); err != nil {
+			log.Printf("Error stopping trace session %s: %v\n", name, err)
+		}
+		delete(s.active, name)
+	}
+}
+
+func registerTraceSessionHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/trace-sessions", traceSessionsHandler)
+	mux.HandleFunc("/api/v1/trace-sessions/", traceSessionHandler)
+}
+
+// traceSessionsHandler lists the trace sessions on GET, and starts one on POST with a JSON body:
+// {"name": ..., "description": ..., "filter": {"namespace": ..., "pod": ..., "container": ..., "types": [...]},
+// "duration": "30m"}. The sessions of a namespace are for the users allowed to read its Pods, the ones of the whole
+// node for the users allowed to read all the Pods.
+func traceSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if traceSessions == nil {
+		http.Error(w, "the trace sessions are disabled, see --trace-sessions", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var visible []TraceSessionManifest
+		for _, manifest := range traceSessions.List() {
+			if _, err := authorizeNamespace(r, manifest.Filter.Namespace); err == nil {
+				visible = append(visible, manifest)
+			}
+		}
+		writeJSONResponse(w, http.StatusOK, map[string]interface{}{"sessions": visible})
+	case http.MethodPost:
+		request := struct {
+			Name        string             `json:"name"`
+			Description string             `json:"description"`
+			Filter      TraceSessionFilter `json:"filter"`
+			Duration    string             `json:"duration"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("decoding request: %v", err), http.StatusBadRequest)
+			return
+		}
+		var duration time.Duration
+		if request.Duration != "" {
+			var err error
+			if duration, err = time.ParseDuration(request.Duration); err != nil || duration < 0 {
+				http.Error(w, fmt.Sprintf("invalid duration %q", request.Duration), http.StatusBadRequest)
+				return
+			}
+		}
+		if status, err := authorizeNamespace(r, request.Filter.Namespace); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		manifest, err := traceSessions.Start(request.Name, request.Description, request.Filter, duration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSONResponse(w, http.StatusCreated, manifest)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// traceSessionHandler serves a trace session:
+//   - GET /api/v1/trace-sessions/<name>: its manifest
+//   - POST /api/v1/trace-sessions/<name>/stop: stops it
+//   - GET /api/v1/trace-sessions/<name>/artifact: its events, profiles and manifest as a .tar.gz, once stopped
+//   - DELETE /api/v1/trace-sessions/<name>: removes it once stopped
+func traceSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if traceSessions == nil {
+		http.Error(w, "the trace sessions are disabled, see --trace-sessions", http.StatusServiceUnavailable)
+		return
+	}
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/trace-sessions/"), "/")
+	manifest, ok := traceSessions.Get(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if status, err := authorizeNamespace(r, manifest.Filter.Namespace); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSONResponse(w, http.StatusOK, manifest)
+	case action == "" && r.Method == http.MethodDelete:
+		if err := traceSessions.Delete(name); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "stop" && r.Method == http.MethodPost:
+		manifest, err := traceSessions.Stop(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, manifest)
+	case action == "artifact" && r.Method == http.MethodGet:
+		if manifest.State != "stopped" {
+			http.Error(w, fmt.Sprintf("session %q is recording, stop it first", name), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+		if err := traceSessions.WriteArtifact(name, w); err != nil {
+			// The headers are gone already, the client gets a truncated archive
+			log.Printf("Error writing the artifact of trace session %s: %v\n", name, err)
+		}
+	case action == "" || action == "stop" || action == "artifact":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// Sizes of the buffers used by the eBPF tracers (see opensnoop.h and execsnoop.h), values filling them were cut
+const (
+	// NAME_MAX minus the terminating NUL
+	openPathMax = 255 - 1
+	// ARGSIZE minus the terminating NUL
+	execArgMax = 128 - 1
+	// TOTAL_MAX_ARGS
+	execArgsMax = 60
+)
+
+// Whether truncated values are completed from /proc when the process is still alive
+var completeTruncated bool
+
+func isOpenPathTruncated(path string) bool {
+	return len(path) >= openPathMax
+}
+
+func isExecArgsTruncated(args []string) bool {
+	if len(args) >= execArgsMax {
+		return true
+	}
+	for _, arg := range args {
+		if len(arg) >= execArgMax {
+			return true
+		}
+	}
+	return false
+}
+
+// procFdPath returns the full path of a file descriptor of a running process
+func procFdPath(pid uint32, fd int) (string, bool) {
+	path, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", pid, fd))
+	if err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// procCmdline returns the full argument list of a running process
+func procCmdline(pid uint32) ([]string, bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || len(data) == 0 {
+		return nil, false
+	}
+	var args []string
+	for _, arg := range bytes.Split(bytes.TrimSuffix(data, []byte{0}), []byte{0}) {
+		args = append(args, string(arg))
+	}
+	return args, true
+}
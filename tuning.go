@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate of the events of a type in a container, per second, beyond which they are deduplicated and then sampled, 0 to
+// never tune the events
+var autoTuneMaxRate float64
+
+// Interval over which the rates are measured
+const autoTuneWindow = 10 * time.Second
+
+// Highest level of tuning: a 2m8s dedup window and 1 event in 128 kept
+const maxAutoTuneLevel = 8
+
+// Dedup window of the first level, doubled at each level
+const baseDedupWindow = time.Second
+
+// Number of quiet windows before the tuning of a container is relaxed by a level
+const autoTuneCalmWindows = 3
+
+// Maximum number of distinct events remembered per container and type for the dedup
+const maxDedupSignatures = 10000
+
+// Types of events which are tuned, the execs are always recorded
+var autoTunedTypes = map[string]bool{"open": true, "tcp": true, "dns": true, "capability": true}
+
+type tuningKey struct {
+	container ContainerKey
+	eventType string
+}
+
+// tuningState is the measured rate and the tuning of the events of a type in a container
+type tuningState struct {
+	windowStart time.Time
+	count       uint64
+	rate        float64
+	level       int
+	// Consecutive windows with a rate well under the maximum
+	calm int
+	// Last time each distinct event was recorded, for the dedup
+	seen map[string]time.Time
+	// Events left after the dedup, for the sampling
+	kept uint64
+}
+
+// dedupWindow returns the time during which the identical events are dropped
+func (s *tuningState) dedupWindow() time.Duration {
+	return baseDedupWindow << (s.level - 1)
+}
+
+// sampling returns the number of events among which one is kept
+func (s *tuningState) sampling() uint64 {
+	return 1 << (s.level - 1)
+}
+
+// AutoTuner deduplicates and samples the events of the noisy containers before they are queued, more as their rate
+// grows, and relaxes once it drops again
+type AutoTuner struct {
+	lock   sync.Mutex
+	states map[tuningKey]*tuningState
+}
+
+var autoTuner *AutoTuner
+
+// NewAutoTuner creates a tuner which doesn't tune any container until their rates are measured
+func NewAutoTuner() *AutoTuner {
+	return &AutoTuner{states: make(map[tuningKey]*tuningState)}
+}
+
+// Admit tells whether an event of a tracer callback is queued, or dropped by the tuning of its container
+func (t *AutoTuner) Admit(key ContainerKey, event *Event) bool {
+	if !autoTunedTypes[event.Type] {
+		return true
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	tuning := tuningKey{key, event.Type}
+	state, ok := t.states[tuning]
+	if !ok {
+		state = &tuningState{windowStart: now}
+		t.states[tuning] = state
+	}
+	state.count++
+	if now.Sub(state.windowStart) >= autoTuneWindow {
+		t.adjust(tuning, state, now)
+	}
+	if state.level == 0 {
+		return true
+	}
+
+	signature := eventSignature(event)
+	if last, ok := state.seen[signature]; ok && now.Sub(last) < state.dedupWindow() {
+		metrics.EventsDeduplicated.Add(1)
+		return false
+	}
+	if len(state.seen) >= maxDedupSignatures {
+		state.seen = make(map[string]time.Time)
+	}
+	state.seen[signature] = now
+	state.kept++
+	if state.kept%state.sampling() != 0 {
+		metrics.EventsSampled.Add(1)
+		return false
+	}
+	return true
+}
+
+// adjust measures the rate of the window which ended and raises or relaxes the tuning
+func (t *AutoTuner) adjust(tuning tuningKey, state *tuningState, now time.Time) {
+	state.rate = float64(state.count) / now.Sub(state.windowStart).Seconds()
+	state.windowStart, state.count = now, 0
+
+	previous := state.level
+	switch {
+	case state.rate > autoTuneMaxRate && state.level < maxAutoTuneLevel:
+		state.level++
+		state.calm = 0
+	case state.rate < autoTuneMaxRate/4 && state.level > 0:
+		if state.calm++; state.calm >= autoTuneCalmWindows {
+			state.level--
+			state.calm = 0
+		}
+	default:
+		state.calm = 0
+	}
+	if state.level == 0 {
+		state.seen = nil
+	} else if state.seen == nil {
+		state.seen = make(map[string]time.Time)
+	} else {
+		for signature, last := range state.seen {
+			if now.Sub(last) >= state.dedupWindow() {
+				delete(state.seen, signature)
+			}
+		}
+	}
+	if state.level == previous {
+		return
+	}
+	metrics.AutoTuneAdjustments.Add(1)
+	container := tuning.container
+	if state.level == 0 {
+		log.Printf("Auto-tuning of the %s events of %s/%s/%s removed: %.0f/s\n", tuning.eventType, container.Namespace, container.Podname, container.ContainerName, state.rate)
+		return
+	}
+	sampling := "no sampling"
+	if state.sampling() > 1 {
+		sampling = fmt.Sprintf("1 event in %d kept", state.sampling())
+	}
+	log.Printf("Auto-tuning the %s events of %s/%s/%s at %.0f/s: dedup window %s, %s\n", tuning.eventType,
+		container.Namespace, container.Podname, container.ContainerName, state.rate, state.dedupWindow(), sampling)
+}
+
+// eventSignature identifies the identical events of a container for the dedup
+func eventSignature(event *Event) string {
+	switch event.Type {
+	case "tcp":
+		return fmt.Sprintf("%s %s %s:%d", event.Comm, event.Operation, event.Dst, event.Dport)
+	case "dns":
+		return fmt.Sprintf("%s %s %s %s", event.Comm, event.Operation, event.QueryType, event.DNSName)
+	case "capability":
+		return fmt.Sprintf("%s %s %s", event.Comm, event.Capability, event.Verdict)
+	}
+	return event.Comm + " " + event.Path
+}
+
+// ContainerRemoved drops the tuning of a removed container
+func (t *AutoTuner) ContainerRemoved(key ContainerKey) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for tuning := range t.states {
+		if tuning.container == key {
+			delete(t.states, tuning)
+		}
+	}
+}
+
+// Reset removes the tuning of the containers of the namespace, Pod and container, the empty ones matching all, the
+// rates are measured again from scratch. It returns the number of tunings removed.
+func (t *AutoTuner) Reset(filter EventFilter) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	reset := 0
+	for tuning, state := range t.states {
+		if filter.Matches(&Event{Namespace: tuning.container.Namespace, Pod: tuning.container.Podname, Container: tuning.container.ContainerName}) {
+			if state.level > 0 {
+				log.Printf("Auto-tuning of the %s events of %s/%s/%s reset\n", tuning.eventType, tuning.container.Namespace, tuning.container.Podname, tuning.container.ContainerName)
+				reset++
+			}
+			delete(t.states, tuning)
+		}
+	}
+	return reset
+}
+
+// ContainerTuning is the tuning of the events of a type in a container
+type ContainerTuning struct {
+	Namespace string  `json:"namespace"`
+	Pod       string  `json:"pod"`
+	Container string  `json:"container"`
+	Type      string  `json:"type"`
+	Rate      float64 `json:"rate"`
+	Level     int     `json:"level"`
+	// Time during which the identical events are dropped, and number of events among which one is kept
+	DedupWindow string `json:"dedupWindow"`
+	Sampling    uint64 `json:"sampling"`
+}
+
+// Tunings returns the containers currently tuned in the namespace, all if empty
+func (t *AutoTuner) Tunings(namespace string) []ContainerTuning {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	tunings := []ContainerTuning{}
+	for tuning, state := range t.states {
+		if state.level == 0 || (namespace != "" && tuning.container.Namespace != namespace) {
+			continue
+		}
+		tunings = append(tunings, ContainerTuning{
+			Namespace:   tuning.container.Namespace,
+			Pod:         tuning.container.Podname,
+			Container:   tuning.container.ContainerName,
+			Type:        tuning.eventType,
+			Rate:        state.rate,
+			Level:       state.level,
+			DedupWindow: state.dedupWindow().String(),
+			Sampling:    state.sampling(),
+		})
+	}
+	sort.Slice(tunings, func(i, j int) bool {
+		a, b := tunings[i], tunings[j]
+		if a.Namespace+"/"+a.Pod+"/"+a.Container != b.Namespace+"/"+b.Pod+"/"+b.Container {
+			return a.Namespace+"/"+a.Pod+"/"+a.Container < b.Namespace+"/"+b.Pod+"/"+b.Container
+		}
+		return a.Type < b.Type
+	})
+	return tunings
+}
+
+// tuningHandler lists the containers whose events are tuned in a namespace (?namespace=, all if empty), and resets
+// their tuning on DELETE, restricted to ?pod= and ?container=
+func tuningHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := EventFilter{Namespace: query.Get("namespace"), Pod: query.Get("pod"), Container: query.Get("container")}
+	if status, err := authorizeNamespace(r, filter.Namespace); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if autoTuner == nil {
+		http.Error(w, "the auto-tuning is disabled, see --auto-tune-max-rate", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSONResponse(w, http.StatusOK, autoTuner.Tunings(filter.Namespace))
+	case http.MethodDelete:
+		writeJSONResponse(w, http.StatusOK, map[string]string{"reset": strconv.Itoa(autoTuner.Reset(filter))})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Single page UI of the agent, its data comes from the API with the bearer token of the user
+//
+//go:embed ui/index.html
+var uiIndex []byte
+
+// WorkloadSummary sums up the activity of the traced containers of a workload
+type WorkloadSummary struct {
+	Namespace string   `json:"namespace"`
+	Workload  string   `json:"workload"`
+	Mode      string   `json:"mode"`
+	Pods      []string `json:"pods"`
+	Images    []string `json:"images"`
+	// Number of events of each type of the containers still traced
+	Events    map[string]uint64 `json:"events"`
+	LastEvent *time.Time        `json:"lastEvent,omitempty"`
+}
+
+func registerUIHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/ui/", uiHandler)
+	mux.HandleFunc("/api/v1/workloads", workloadsHandler)
+}
+
+// uiHandler serves the page of the UI, which holds no data
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/ui/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write(uiIndex)
+}
+
+// workloadsHandler serves the summaries of the workloads of a namespace (?namespace=<namespace>) to the users allowed
+// to read its Pods, or of all the workloads to the users allowed to read all the Pods
+func workloadsHandler(w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get("namespace")
+	if status, err := authorizeNamespace(r, namespace); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, collectWorkloadSummaries(namespace))
+}
+
+// collectWorkloadSummaries sums up the traced containers of the namespace (all if empty) by workload, the containers
+// of a Pod without a known owner are their own workload
+func collectWorkloadSummaries(namespace string) []*WorkloadSummary {
+	byWorkload := make(map[string]*WorkloadSummary)
+	pods := make(map[*WorkloadSummary]map[string]bool)
+	images := make(map[*WorkloadSummary]map[string]bool)
+	for _, state := range containers.States() {
+		if namespace != "" && state.Key.Namespace != namespace {
+			continue
+		}
+		workload := state.Workload
+		if workload == "" {
+			workload = state.Key.Namespace + "/Pod/" + state.Key.Podname
+		}
+		summary, ok := byWorkload[workload]
+		if !ok {
+			summary = &WorkloadSummary{Namespace: state.Key.Namespace, Workload: workload, Mode: state.Mode, Events: make(map[string]uint64)}
+			byWorkload[workload] = summary
+			pods[summary] = make(map[string]bool)
+			images[summary] = make(map[string]bool)
+		}
+		pods[summary][state.Key.Podname] = true
+		if state.Image != "" {
+			images[summary][state.Image] = true
+		}
+		for eventType, count := range activityMetrics.Counts(state.Key) {
+			summary.Events[eventType] += count
+		}
+		state.lock.Lock()
+		for _, last := range state.lastEvents {
+			if summary.LastEvent == nil || last.After(*summary.LastEvent) {
+				last := last
+				summary.LastEvent = &last
+			}
+		}
+		state.lock.Unlock()
+	}
+
+	summaries := make([]*WorkloadSummary, 0, len(byWorkload))
+	for _, summary := range byWorkload {
+		summary.Pods = setToSlice(pods[summary])
+		summary.Images = setToSlice(images[summary])
+		sort.Strings(summary.Pods)
+		sort.Strings(summary.Images)
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Namespace != summaries[j].Namespace {
+			return summaries[i].Namespace < summaries[j].Namespace
+		}
+		return summaries[i].Workload < summaries[j].Workload
+	})
+	return summaries
+}
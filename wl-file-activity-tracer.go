@@ -5,25 +5,19 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
-	"github.com/cilium/ebpf/rlimit"
+	"github.com/cilium/ebpf"
 	containercollection "github.com/inspektor-gadget/inspektor-gadget/pkg/container-collection"
-
-	tracerexec "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/exec/tracer"
-	tracerexectype "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/exec/types"
-
-	traceropen "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/open/tracer"
-	traceropentype "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/open/types"
-
-	tracertcp "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/tcp/tracer"
-	tracertcptype "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/trace/tcp/types"
-
-	tracersyscall "github.com/inspektor-gadget/inspektor-gadget/pkg/gadgets/advise/seccomp/tracer"
-
 	tracercollection "github.com/inspektor-gadget/inspektor-gadget/pkg/tracer-collection"
+	eventtypes "github.com/inspektor-gadget/inspektor-gadget/pkg/types"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -35,12 +29,34 @@ const execTraceName = "trace_exec"
 const openTraceName = "trace_open"
 const tcpTraceName = "trace_tcp"
 const syscallTraceName = "trace_syscall"
+const dnsTraceName = "trace_dns"
+const capabilitiesTraceName = "trace_capabilities"
+
+// Tracers by the name used in the --tracers flag
+var tracerNames = map[string]string{
+	"exec":         execTraceName,
+	"open":         openTraceName,
+	"tcp":          tcpTraceName,
+	"dns":          dnsTraceName,
+	"capabilities": capabilitiesTraceName,
+	"syscall":      syscallTraceName,
+}
 
-var traceSystemCall *tracersyscall.Tracer
+// Tracers enabled with --tracers
+var enabledTracers = make(map[string]bool)
 
 // Global variables
 var NodeName string
-var containerMap = make(map[ContainerKey]*os.File)
+var store *Store
+var learningPeriod time.Duration
+var pendingBuffer *PendingBuffer
+var eventQueue *EventQueue
+
+// Whether the exec attempts which failed are recorded
+var recordFailedExec bool
+
+// How long the events of a removed container are still written before its file is finalized
+var removalDrainPeriod time.Duration
 
 // Global types
 type ContainerKey struct {
@@ -49,19 +65,121 @@ type ContainerKey struct {
 	ContainerName string
 }
 
-func checkKubernetesConnection() error {
-	// Check if the Kubernetes cluster is reachable
+type ContainerState struct {
+	Key ContainerKey
+	ID  string
+	// Mode of the workload: observe, learn or alert
+	Mode     string
+	File     *rotatingFile
+	Mntns    uint64
+	Workload string
+	Image    string
+	ImageRef string
+	// Labels and UID of the Pod
+	Labels map[string]string
+	PodUID string
+	// Time the container started, zero if unknown
+	Started time.Time
+	// SBOM of the image, nil if there is none
+	sbom *SBOMIndex
+
+	lock   sync.Mutex
+	closed bool
+	errors sinkErrorTracker
+	// Sequence number of the last event written, gaps reveal lost events
+	seq uint64
+	// Time of the last event by type
+	lastEvents map[string]time.Time
+	// Last process executed in the container, syscalls are attributed to it
+	lastExec string
+	// Last periodic syscall snapshot, used when the container is already gone on removal
+	lastSyscalls     []string
+	lastSyscallsTime time.Time
+	// Syscalls already written to the container file, each snapshot only writes the new ones
+	writtenSyscalls map[string]bool
+	// Syscalls already recorded in the inventory of the workload
+	inventoriedSyscalls map[string]bool
+	// Components of the image whose files were accessed
+	relevant map[SBOMComponent]bool
+	// Binaries executed and libraries loaded in the container
+	executables map[string]bool
+	libraries   map[string]bool
+	// Set once a process of the container ran as root
+	rootObserved bool
+	// Capabilities the processes of the container were granted
+	capabilities map[string]bool
+	// Processes, files and protocols used by the container, for the allow-list policies
+	behavior *behaviorSet
+	// Layers of the root filesystem, nil if it isn't an overlay, and the paths already checked for drift with the
+	// fingerprint of their runtime version at the time
+	overlay      *overlayLayers
+	driftChecked map[string]string
+	// Deduplicated activity of the container, nil if the events are streamed
+	profile *profileAggregator
+	// Syscalls seen by the previous instance of the agent, before a warm restart
+	restoredSyscalls []string
+	// Process tree of the container, for the lineage of its events
+	processes *processTable
+	// Number of checkpoints of the container sent to the sinks
+	checkpoints uint64
+}
+
+// WriteEvent writes an event line to the container file, prefixed with its sequence number and timestamp, unless the file was already closed
+func (s *ContainerState) WriteEvent(timestamp time.Time, line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.seq++
+	err := writeWithRetry(s.File, fmt.Sprintf("seq=%d ts=%s boot=%d mono=%d %s", s.seq, timestamp.UTC().Format(time.RFC3339Nano), clock.BootSeq, clock.BootTime(timestamp).Nanoseconds(), line))
+	if s.errors.Track(err) {
+		log.Printf("Error writing to %s: %v\n", s.File.Name(), err)
+	}
+}
+
+// Close flushes the container file to disk and closes it
+func (s *ContainerState) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if err := s.File.Sync(); err != nil {
+		log.Printf("Error flushing %s: %v\n", s.File.Name(), err)
+	}
+	if err := s.File.Close(); err != nil {
+		log.Printf("Error closing %s: %v\n", s.File.Name(), err)
+	}
+	// A removed sink must not keep the service degraded
+	health.SetHealthy("sink:" + s.File.Name())
+}
+
+// kubernetesConfig loads the default configuration, or the in-cluster one
+func kubernetesConfig() (*rest.Config, error) {
 	// Load the Kubernetes configuration from the default location
 	config, err := clientcmd.BuildConfigFromFlags("", clientcmd.RecommendedHomeFile)
 	if err != nil {
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			return err
-		}
+		return rest.InClusterConfig()
+	}
+	return config, nil
+}
+
+// kubernetesClient creates a client from the default configuration, or the in-cluster one
+func kubernetesClient() (*kubernetes.Clientset, error) {
+	config, err := kubernetesConfig()
+	if err != nil {
+		return nil, err
 	}
+	return kubernetes.NewForConfig(config)
+}
 
-	// Create a Kubernetes client
-	clientset, err := kubernetes.NewForConfig(config)
+func checkKubernetesConnection() error {
+	// Check if the Kubernetes cluster is reachable
+	clientset, err := kubernetesClient()
 	if err != nil {
 		log.Printf("Failed to create Kubernetes client: %v\n", err)
 		return err
@@ -78,11 +196,6 @@ func checkKubernetesConnection() error {
 }
 
 func serviceInitNChecks() error {
-	// Raise the rlimit for memlock to the maximum allowed (eBPF needs it)
-	if err := rlimit.RemoveMemlock(); err != nil {
-		return err
-	}
-
 	// Check Kubernetes cluster connection
 	if err := checkKubernetesConnection(); err != nil {
 		return err
@@ -99,8 +212,183 @@ func serviceInitNChecks() error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "diagnose" {
+		os.Exit(runDiagnoseCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		os.Exit(runWatchCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		os.Exit(runDecryptCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "timeline" {
+		os.Exit(runTimelineCommand(os.Args[2:]))
+	}
+
 	// Define --all flag
 	allPtr := flag.Bool("all", false, "Trace all containers")
+	// Define --removal-drain-period flag
+	flag.DurationVar(&removalDrainPeriod, "removal-drain-period", 2*time.Second, "How long the events of a removed container still in flight in the tracers are written before its file is finalized")
+	// Define --unsupported-node flag
+	unsupportedNodePtr := flag.String("unsupported-node", "metadata-only", "What to do on the nodes which can't run the eBPF tracers (unsupported kernel, lockdown, missing permissions): metadata-only (register the containers and report the support on /api/v1/diagnostics/node) or fail")
+	// Define --tracers flag
+	tracersPtr := flag.String("tracers", defaultTracers(), "Comma separated tracers to run, among exec, open, tcp, dns, capabilities and syscall when they are built in")
+	// Define --tracer-retry-interval flag
+	tracerRetryIntervalPtr := flag.Duration("tracer-retry-interval", 5*time.Minute, "Interval between attempts to load the tracers which failed to load, doubled after each failure up to an hour")
+	flag.DurationVar(&tracerStallTimeout, "tracer-stall-timeout", 0, "Load a tracer again once it received no event for this long while containers are traced, 0 to never consider a quiet tracer stalled")
+	// Define the container selection flags
+	var labels, excludeNamespaces, tracerLabels stringList
+	flag.Var(&labels, "label", "Trace the Pods with this label (key=value), can be repeated (default ig-trace=file-access unless --all or another selection is given)")
+	namespacePtr := flag.String("namespace", "", "Trace the Pods of this namespace only")
+	podNameRegexPtr := flag.String("pod-name-regex", "", "Trace the Pods whose name matches this regular expression only")
+	flag.Var(&excludeNamespaces, "exclude-namespace", "Don't trace the Pods of this namespace, can be repeated")
+	flag.Var(&tracerLabels, "tracer-label", "Trace the events of one type only for the selected Pods with this label (<exec|open|tcp|dns|capabilities|syscalls>:<key>=<value>), can be repeated, e.g. --all --tracer-label open:ig-trace=file-access")
+	selectorConfigPtr := flag.String("selector-config", "", "YAML file of the include and exclude rules (namespace, podNameRegex, labels) selecting the traced Pods")
+	// Define --event-mode flag
+	eventModePtr := flag.String("event-mode", "stream", "How the open, exec and tcp events are recorded: stream (one line per event in the container files) or profile (deduplicated into <file>.profile.json, written at every syscall snapshot and on container exit)")
+	// Define the activity profile flags
+	profileCRsPtr := flag.Bool("profile-crs", false, "Write the activity of the containers into an ApplicationActivityProfile resource per Pod (see dev/applicationactivityprofile-crd.yaml), owned by the Pod")
+	profileCRQPSPtr := flag.Float64("profile-cr-qps", 5, "Maximum number of requests per second to the API server to write the ApplicationActivityProfile resources")
+	// Define --warm-restart flag
+	warmRestartPtr := flag.Bool("warm-restart", false, "On shutdown, hand the state of the running containers over to the next instance of the agent instead of finalizing them")
+	// Define --metrics-addr flag
+	metricsAddrPtr := flag.String("metrics-addr", "", "Address serving the Prometheus metrics on /metrics (e.g. :9090), disabled if empty")
+	// Define --health-addr flag
+	healthAddrPtr := flag.String("health-addr", "", "Address serving the liveness probe on /healthz and the readiness probe on /readyz (e.g. :8081), disabled if empty")
+	// Define --exclude-labels flag
+	excludeLabelsPtr := flag.String("exclude-labels", "", "Don't trace the Pods with any of these labels (key=value, separated by commas), e.g. other node agents")
+	// Define --state-dir flag
+	stateDirPtr := flag.String("state-dir", "/var/lib/wlftracer", "Directory where the collected state is persisted")
+	// Define --syscall-peek-interval flag
+	syscallPeekIntervalPtr := flag.Duration("syscall-peek-interval", 5*time.Minute, "Interval between syscall snapshots of the traced containers, written to their files and persisted as they go, 0 to only snapshot them on removal")
+	// Define --learning-period flag
+	flag.DurationVar(&learningPeriod, "learning-period", 24*time.Hour, "Time after which new syscalls of a workload are reported as drift")
+	// Define --pending-event-ttl flag
+	pendingEventTTLPtr := flag.Duration("pending-event-ttl", 10*time.Second, "How long events of not yet registered containers are kept")
+	// Define --event-queue-size flag
+	eventQueueSizePtr := flag.Int("event-queue-size", 16384, "Maximum number of events waiting to be written")
+	// Define the namespace fair share and quota flags
+	fairSharePtr := flag.Bool("namespace-fair-share", false, "Once the event queue is half full, drop the events of the namespaces holding more than an equal share of it")
+	namespaceQuotaPtr := flag.Float64("namespace-event-quota", 0, "Events per second of each namespace written to the container files and sent to the sinks, with bursts of 10s worth of events, 0 for no limit")
+	namespaceQuotasPtr := flag.String("namespace-event-quotas", "", "Comma separated <namespace>=<events per second> quotas of the namespaces which don't get --namespace-event-quota")
+	// Define the startup grace flags
+	flag.DurationVar(&startupGracePeriod, "startup-grace-period", 0, "Time after a container start during which its open and exec events are considered initialization: tagged, and kept out of the anomaly alerts (disabled if zero)")
+	startupGraceActionPtr := flag.String("startup-grace-action", "tag", "What to do with the initialization events: tag or suppress (drop them entirely)")
+	// Define --record-failed-exec flag
+	flag.BoolVar(&recordFailedExec, "record-failed-exec", false, "Record the failed exec attempts along with their errno")
+	// Define --complete-truncated flag
+	flag.BoolVar(&completeTruncated, "complete-truncated", false, "Complete paths and arguments truncated by the tracers from /proc when the process is still alive")
+	// Define --sbom-dir flag
+	sbomDirPtr := flag.String("sbom-dir", "", "Directory with the SBOMs (SPDX or CycloneDX JSON) of the images, named after the image reference with '/', ':' and '@' replaced by '_'")
+	// Define --reachability flag
+	flag.BoolVar(&trackReachability, "reachability", false, "Record the binaries executed and the libraries loaded per image digest for vulnerability scanners, the containers whose image digest is unknown are left out")
+	// Define the API server flags
+	apiAddrPtr := flag.String("api-addr", "", "Address of the API server (e.g. :8443), disabled if empty")
+	apiTLSCertPtr := flag.String("api-tls-cert", "", "TLS certificate of the API server, required with --api-addr")
+	apiTLSKeyPtr := flag.String("api-tls-key", "", "TLS key of the API server, required with --api-addr")
+	gatekeeperClientCAFilePtr := flag.String("gatekeeper-client-ca-file", "", "CA certificates the client certificate of Gatekeeper is verified against, serving the external data provider (/gatekeeper/provider) on the API server, disabled if empty")
+	// Define the admission webhook flags
+	admissionWebhookPtr := flag.Bool("admission-webhook", false, "Serve the admission webhooks injecting (/admission/mutate) or checking (/admission/validate) the learned seccomp profiles on the API server, the profiles are only injected with --seccomp-profiles")
+	flag.StringVar(&admissionEnforcement, "admission-enforcement", "warn", "What the validating webhook does with workloads omitting their learned seccomp profile: warn or deny")
+	flag.BoolVar(&atRestMigrate, "encryption-migrate", false, "Read the files of the store and the history written in clear before --encryption-key-file was set, they are rejected otherwise")
+	encryptionKeyFilePtr := flag.String("encryption-key-file", "", "File of an age identity or AES-256 key, typically mounted from a Secret, encrypting the container files and the store at rest (read them with wlftracer decrypt)")
+	flag.IntVar(&lineageDepth, "lineage-depth", 8, "Number of ancestors of the process added to the exec, open and tcp events, 0 to not reconstruct the process lineage")
+	signingKeyPtr := flag.String("signing-key", "", "PEM private key (ECDSA, RSA or Ed25519) signing the generated profiles and policies into <file>.sig, verifiable with cosign verify-blob")
+	flag.BoolVar(&writeSeccompProfiles, "seccomp-profiles", false, "Install the seccomp profile of each learned workload under the kubelet seccomp root, sharing it with the agents of the other nodes through a ConfigMap of $POD_NAMESPACE")
+	flag.StringVar(&seccompProfileCRDir, "seccomp-profile-cr-dir", "", "Directory the SeccompProfile resources of the learned workloads are written to, for the security-profiles-operator, disabled if empty. They are only written, apply them (e.g. kubectl apply -f) once reviewed")
+	flag.StringVar(&seccompProfileRoot, "seccomp-profile-root", "/var/lib/kubelet/seccomp", "Kubelet seccomp root the learned profiles are installed in")
+	// Define --profile-stabilization-window flag
+	flag.DurationVar(&profileStabilizationWindow, "profile-stabilization-window", time.Hour, "Time without changes after the learning period for a profile to be considered stable")
+	// Define --kyverno-policy-dir flag
+	flag.StringVar(&kyvernoPolicyDir, "kyverno-policy-dir", "", "Directory to write Kyverno policies generated from the learned workloads to, disabled if empty")
+	// Define --kubearmor-policy-dir flag
+	flag.StringVar(&kubeArmorPolicyDir, "kubearmor-policy-dir", "", "Directory to write KubeArmor policies generated from the observed behavior to, disabled if empty")
+	flag.StringVar(&networkPolicyDir, "network-policy-dir", "", "Directory to write the NetworkPolicies advised from the TCP connections of the learned workloads to, disabled if empty")
+	networkPolicyConfigMapsPtr := flag.Bool("network-policy-configmaps", false, "Write the NetworkPolicy advised for each learned workload into a ConfigMap of its namespace")
+	// Define the output flags
+	outputPtr := flag.String("output", "text", "Format of the events: text (lines in the container files only), json (NDJSON events sent to --sink as well), protobuf (proto/event.proto messages sent to --sink, size prefixed in the streams) or avro (Avro records in the Confluent wire format sent to --sink, size prefixed in the streams, with the schema registered in --schema-registry-url)")
+	flag.StringVar(&schemaRegistryConfig.URL, "schema-registry-url", "", "URL of the Confluent Schema Registry the Avro schema of the events is checked and registered with, required by --output=avro")
+	flag.StringVar(&schemaRegistryConfig.Subject, "schema-registry-subject", "wlftracer-events-value", "Subject of the Avro schema of the events, <topic>-value for the topic the records are produced to")
+	flag.StringVar(&schemaRegistryConfig.Username, "schema-registry-username", "", "Username authenticating with the Schema Registry, anonymous if empty")
+	flag.StringVar(&schemaRegistryConfig.Password, "schema-registry-password", os.Getenv("SCHEMA_REGISTRY_PASSWORD"), "Password authenticating with the Schema Registry, defaults to $SCHEMA_REGISTRY_PASSWORD")
+	sinkPtr := flag.String("sink", "file", "Where the JSON events are sent: file, stdout, http, unix (streamed to the clients of a Unix domain socket) or fifo (named pipe)")
+	sinkPathPtr := flag.String("sink-path", "/tmp/wlftracer-events.ndjson", "File the JSON events are appended to with --sink=file, or socket or FIFO they are written to with --sink=unix or fifo")
+	sinkURLPtr := flag.String("sink-url", "", "Endpoint the JSON events are posted to with --sink=http")
+	sinkBatchSizePtr := flag.Int("sink-batch-size", 100, "Maximum number of events posted at once with --sink=http")
+	flag.DurationVar(&checkpointInterval, "checkpoint-interval", 0, "Interval between two checkpoints of each container sent to the sinks, with its event counters, so consumers detect gaps and broken streams, 0 to not send any")
+	sinkDeliveryPtr := flag.String("sink-delivery", deliveryBestEffort, "Delivery guarantee of --sink=http: best-effort drops the events it can't send, at-least-once spills them to disk and replays them")
+	spillDirPtr := flag.String("spill-dir", "", "Directory the at-least-once sinks spill their events to, <state-dir>/spill if empty")
+	flag.Int64Var(&maxSpillBytes, "max-spill-size", 512<<20, "Maximum number of bytes spilled to disk per at-least-once sink, the events are dropped beyond")
+	flag.DurationVar(&backfillWindow, "backfill-window", 0, "How long the events sent to the sinks are kept in <state-dir>/history, to backfill the tenant sinks added by a reload (backfill key of the tenant ConfigMap) and to serve the Grafana datasource on /api/v1/grafana, 0 to not keep any")
+	flag.Int64Var(&maxHistoryBytes, "max-history-size", 1<<30, "Maximum number of bytes of events kept for the backfills, the oldest are deleted beyond")
+	flag.IntVar(&recentEventsPerContainer, "recent-events", 0, "Number of events kept in memory per container for the queries on the last minutes (/api/v1/events and the Grafana datasource), 0 to not keep any")
+	flag.DurationVar(&recentEventsTTL, "recent-events-ttl", 15*time.Minute, "How long the events are kept in memory with --recent-events")
+	sinkCompressionPtr := flag.String("sink-compression", "none", "Compression of the batches posted with --sink=http: none, gzip, zstd or snappy")
+	sinkFlushIntervalPtr := flag.Duration("sink-flush-interval", time.Second, "Maximum time an event waits before being posted with --sink=http")
+	// Define the export flags
+	exportFormatPtr := flag.String("export-format", "", "Export the events in the format of another tool (falco, tetragon) or as size prefixed protobuf messages (protobuf), disabled if empty")
+	exportPathPtr := flag.String("export-path", "-", "File to export the events to, - for stdout")
+	rulesPtr := flag.String("rules", "", "YAML file of the rules raising alerts on suspicious events (see dev/rules-example.yaml), disabled if empty")
+	alertSinkPtr := flag.String("alert-sink", "stdout", "Comma separated sinks the alerts are sent to: stdout (NDJSON), webhook (--alert-webhook-url) or kube-event (Warning Event on the Pod)")
+	alertWebhookURLPtr := flag.String("alert-webhook-url", "", "Endpoint the alerts are posted to with --alert-sink=webhook")
+	alertDeliveryPtr := flag.String("alert-delivery", deliveryBestEffort, "Delivery guarantee of --alert-sink=webhook: best-effort or at-least-once")
+	// Define the flags of the optional sinks built in (CSV, archive, Splunk, Datadog, OTLP)
+	for _, registration := range sinkRegistry {
+		registration.flags()
+	}
+	// Define the open filter flags
+	openIncludePtr := flag.String("open-include-prefixes", "", "Comma separated path prefixes, only the opens under them are recorded if set (e.g. /etc,/app)")
+	openExcludePtr := flag.String("open-exclude-prefixes", "", "Comma separated path prefixes whose opens are never recorded (e.g. /proc,/sys,/dev)")
+	// Define --auto-tune-max-rate flag
+	flag.Float64Var(&autoTuneMaxRate, "auto-tune-max-rate", 0, "Rate per second of the open, tcp, dns or capability events of a container beyond which they are deduplicated and then sampled, more as the rate grows, until it drops again (see /api/v1/diagnostics/tuning), 0 to record them all")
+	// Define --ignore-system-reads flag
+	ignoreSystemReadsPtr := flag.Bool("ignore-system-reads", false, "Don't record the read-only opens under /usr and /lib, mostly library loads. The opens whose descriptor is already closed when handled are ignored too, unless --detect-drift is set")
+	// Define --detect-drift flag
+	flag.BoolVar(&detectDrift, "detect-drift", false, "Flag the binaries executed and files opened which are not part of the container image")
+	// Define --mode flag
+	flag.StringVar(&defaultMode, "mode", modeAlert, "Mode of the workloads without a "+modeLabel+" label: observe (record only), learn (record and learn profiles) or alert (also send detections to the sinks)")
+	// Define the tenant flags
+	tenantsPtr := flag.Bool("tenants", false, "Let namespaces configure their own sinks, filters and retention with a "+tenantConfigName+" ConfigMap")
+	tenantsIntervalPtr := flag.Duration("tenants-interval", 30*time.Second, "Interval between two reloads of the tenant configurations")
+	flag.Var(&tenantAllowedHosts, "tenant-allowed-host", "Host the tenants may send their events and digests to over HTTPS (http://<host> to allow HTTP, *.<domain> for the subdomains), can be repeated. The tenants may set no endpoint without it")
+	// Define the session recording flags
+	flag.StringVar(&auditWebhookToken, "audit-webhook-token", os.Getenv("AUDIT_WEBHOOK_TOKEN"), "Bearer token of the API server audit webhook (/audit/webhook), correlating the recorded sessions with the exec requests, disabled if empty (default $AUDIT_WEBHOOK_TOKEN). The agent receiving the events forwards the exec requests into the Pods of the other nodes to their agents")
+	auditPeerCAFilePtr := flag.String("audit-peer-ca-file", "", "CA certificates the API certificates of the other agents are verified against when forwarding the audit events, the system ones if empty")
+	auditPeerServerNamePtr := flag.String("audit-peer-server-name", "", "Name in the API certificates of the agents (e.g. of the webhook Service), they are reached by Pod IP")
+	recordSessionsPtr := flag.Bool("record-sessions", false, "Record the commands of the interactive shell sessions of the containers")
+	sessionDirPtr := flag.String("session-dir", "", "Directory of the session recordings, sessions/ in the state directory if empty")
+	sessionRetentionPtr := flag.Duration("session-retention", 0, "How long the recordings of the ended sessions are kept in --session-dir (e.g. 720h), 0 to keep them forever")
+	traceSessionsPtr := flag.Bool("trace-sessions", false, "Record the named trace sessions started through the API into self-contained artifacts")
+	traceSessionDirPtr := flag.String("trace-session-dir", "", "Directory of the trace sessions, trace-sessions/ in the state directory if empty")
+	// Define --redaction-rules flag
+	redactionRulesPtr := flag.String("redaction-rules", "", "JSON file of the rules redacting the events before they are sent to the sinks")
+	// Define the inventory flags
+	inventoryPtr := flag.Bool("inventory", false, "Keep when every binary, path prefix, destination and syscall was first and last seen per workload, and per image the workload ran to compare its versions")
+	flag.IntVar(&inventoryPathDepth, "inventory-path-depth", 2, "Number of leading path components kept as path prefixes in the inventory")
+	// Define the anomaly flags
+	anomalyAlertsPtr := flag.Bool("anomaly-alerts", false, "Alert on the binaries, path prefixes and destinations showing up after the learning period of a workload (implies --inventory)")
+	anomalySensitivityPtr := flag.String("anomaly-sensitivity", "", "Occurrences needed to alert per category as category=occurrences pairs (e.g. pathPrefixes=3,syscalls=0), 0 disables a category, 1 by default, syscalls only take 0 or 1")
+	// Define the digest flags
+	digestPtr := flag.Bool("digest", false, "Deliver a periodic digest of the activity, new behaviors and alerts of each namespace, merged across the nodes by the one claiming the period on the wlftracer-digest Lease of $POD_NAMESPACE")
+	flag.DurationVar(&digestConfig.Interval, "digest-interval", 24*time.Hour, "Period covered by a digest (e.g. 24h for daily, 168h for weekly), aligned on UTC so every node has the same periods")
+	flag.StringVar(&digestConfig.Dir, "digest-dir", "", "Directory the digests are written to")
+	flag.StringVar(&digestConfig.SlackWebhook, "digest-slack-webhook", "", "Slack incoming webhook the digests are posted to")
+	flag.StringVar(&digestConfig.SMTPAddr, "digest-smtp-addr", "", "SMTP server (host:port) the digests are emailed through, authenticating with $SMTP_USERNAME and $SMTP_PASSWORD")
+	flag.StringVar(&digestConfig.From, "digest-email-from", "wlftracer@localhost", "Sender of the digest emails")
+	flag.StringVar(&digestConfig.To, "digest-email-to", "", "Recipients of the digest emails, separated by commas")
+	// Define --gc-interval flag
+	gcIntervalPtr := flag.Duration("gc-interval", time.Minute, "Interval between the cleanups of containers which vanished without a remove notification")
+	cgroupRootsPtr := flag.String("cgroup-roots", strings.Join(cgroupRoots, ","), "Comma separated mount points of the cgroup hierarchies, tried in order to identify the containers on cgroup v1, v2 and hybrid nodes (e.g. /host/sys/fs/cgroup,/sys/fs/cgroup)")
+	flag.StringVar(&outputDir, "output-dir", outputDir, "Directory of the container files")
+	flag.Int64Var(&maxFileSize, "max-file-size", 100<<20, "Size in bytes above which a container file is rotated, 0 to never rotate")
+	flag.IntVar(&maxRotatedFiles, "max-rotated-files", 3, "Number of rotated files kept per container, 0 to drop the events of a file once it is rotated")
+	flag.BoolVar(&compressRotated, "compress-rotated", false, "Compress the rotated container files with gzip")
+	flag.DurationVar(&profileRetention, "profile-retention", 0, "How long the profiles of the workloads which stopped running are kept in the store (e.g. 2160h), 0 to keep them forever")
+	riskScoringPtr := flag.Bool("risk-scoring", false, "Score the risk of the workloads from their privileged syscalls and capabilities, external egress, writes to sensitive paths and alerts (see /api/v1/risk)")
+	flag.BoolVar(&detectArgSecrets, "detect-arg-secrets", false, "Raise an alert when the arguments of a process executed hold credentials (AWS keys, tokens, passwords passed on the command line), masking them in the events")
+	flag.DurationVar(&riskHalfLife, "risk-half-life", 24*time.Hour, "Time after which the weight of a risk signal is halved, a repeated signal counts again after it")
+	retentionAnnotationsPtr := flag.Bool("retention-annotations", false, "Let the Pods override the retention of their events and profiles with the "+eventRetentionAnnotation+" and "+profileRetentionAnnotation+" annotations, up to the retention of their tenant or --file-retention and --profile-retention")
+	flag.DurationVar(&fileRetention, "file-retention", 0, "How long the files of the containers which are gone are kept in --output-dir (e.g. 168h), 0 to keep them forever. Use a dedicated --output-dir with it, every *.log file of the directory is subject to it")
 	// Use flags package to parse command line arguments
 	flag.Parse()
 
@@ -108,6 +396,498 @@ func main() {
 	if err := serviceInitNChecks(); err != nil {
 		log.Fatalf("Failed to initialize service: %v\n", err)
 	}
+	if *unsupportedNodePtr != "metadata-only" && *unsupportedNodePtr != "fail" {
+		log.Fatalf("Invalid unsupported node action %q, expected metadata-only or fail\n", *unsupportedNodePtr)
+	}
+	if *gcIntervalPtr <= 0 {
+		log.Fatalf("Invalid --gc-interval %s, expected a positive duration\n", *gcIntervalPtr)
+	}
+	tracingSupport = probeTracingSupport()
+
+	// Encrypt the container files and the store, the key is needed to read back the store
+	var err error
+	if *encryptionKeyFilePtr != "" {
+		atRestKey, err = LoadAtRestKey(*encryptionKeyFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load encryption key: %v\n", err)
+		}
+	}
+
+	// Open the local store
+	spillDir = *spillDirPtr
+	if spillDir == "" {
+		spillDir = filepath.Join(*stateDirPtr, "spill")
+	}
+	store, err = NewStore(*stateDirPtr)
+	if err != nil {
+		log.Fatalf("Failed to open store: %v\n", err)
+	}
+
+	// Timestamps are related to the node boot so they can be ordered across restarts and clock adjustments
+	clock, err = NewClock(store)
+	if err != nil {
+		log.Fatalf("Failed to initialize clock: %v\n", err)
+	}
+	log.Printf("Boot %s (#%d)\n", clock.BootID, clock.BootSeq)
+
+	// Keep the last events of each container in memory for the queries
+	if recentEventsPerContainer > 0 {
+		recentEvents = NewRecentEvents()
+	}
+
+	// Keep the recent events to backfill the sinks added later
+	if backfillWindow > 0 {
+		if eventHistory, err = NewEventHistory(filepath.Join(*stateDirPtr, "history")); err != nil {
+			log.Fatalf("Failed to open the event history: %v\n", err)
+		}
+	}
+
+	// Resume the state handed over by the previous instance of the agent
+	if *warmRestartPtr {
+		handoffPath = filepath.Join(*stateDirPtr, "handoff.json")
+		if err := loadHandoff(handoffPath); err != nil {
+			log.Printf("Error loading the state handed over: %v\n", err)
+		}
+	}
+
+	// Buffer events which arrive before their container is registered
+	pendingBuffer = NewPendingBuffer(*pendingEventTTLPtr)
+	stopPendingExpire := make(chan struct{})
+	go pendingBuffer.expireLoop(stopPendingExpire)
+	defer close(stopPendingExpire)
+
+	// Finalize the files of the removed containers in the background
+	finalizer = NewContainerFinalizer()
+
+	if !validMode(defaultMode) {
+		log.Fatalf("Invalid mode %q, expected observe, learn or alert\n", defaultMode)
+	}
+	switch *eventModePtr {
+	case "stream":
+	case "profile":
+		aggregateProfiles = true
+	default:
+		log.Fatalf("Invalid event mode %q, expected stream or profile\n", *eventModePtr)
+	}
+	if *profileCRsPtr {
+		config, err := kubernetesConfig()
+		if err != nil {
+			log.Fatalf("Failed to load Kubernetes configuration: %v\n", err)
+		}
+		client, err := NewActivityProfileClient(config, float32(*profileCRQPSPtr))
+		if err != nil {
+			log.Fatalf("Failed to create ApplicationActivityProfile client: %v\n", err)
+		}
+		activityProfiles = NewActivityProfileSyncer(client)
+	}
+	cgroupRoots = nil
+	for _, root := range strings.Split(*cgroupRootsPtr, ",") {
+		if root = strings.TrimSpace(root); root != "" {
+			cgroupRoots = append(cgroupRoots, root)
+		}
+	}
+	for _, name := range strings.Split(*tracersPtr, ",") {
+		tracer, ok := tracerNames[strings.TrimSpace(name)]
+		if !ok {
+			log.Fatalf("Invalid tracer %q, expected exec, open, tcp, dns, capabilities or syscall\n", name)
+		}
+		if _, ok := tracerRegistry[tracer]; !ok {
+			log.Fatalf("Invalid tracer %q, it isn't part of this build\n", name)
+		}
+		enabledTracers[tracer] = true
+	}
+	// Leave out the tracers the node can't run (e.g. kprobes denied by SELinux), the others still run. The containers
+	// are still registered on the nodes which can't run any, so the node isn't a blind spot.
+	for _, name := range tracerLoadOrder {
+		if problem := tracingSupport.Blocking(name); problem != nil && enabledTracers[name] {
+			delete(enabledTracers, name)
+			tracingSupport.Disabled = append(tracingSupport.Disabled, name)
+			log.Printf("Tracer %s can't run on the node: %s\n", name, problem)
+			health.SetDegraded("tracer:"+name, problem.String())
+		}
+	}
+	if len(enabledTracers) == 0 && len(tracingSupport.Disabled) > 0 {
+		if *unsupportedNodePtr == "fail" {
+			log.Fatalf("Failed to initialize service: the node can't run the tracers: %s\n", tracingSupport.Summary())
+		}
+		metadataOnly = true
+		tracingSupport.MetadataOnly = true
+		log.Printf("The node can't run the tracers (kernel %s): %s. Starting in metadata-only mode\n", tracingSupport.Kernel, tracingSupport.Summary())
+		health.SetDegraded("tracing", "metadata-only mode: "+tracingSupport.Summary())
+	}
+	switch *startupGraceActionPtr {
+	case "tag":
+	case "suppress":
+		suppressStartup = true
+	default:
+		log.Fatalf("Invalid startup grace action %q, expected tag or suppress\n", *startupGraceActionPtr)
+	}
+
+	// Advise NetworkPolicies from the connections, once their peers are resolved to Pods and Services
+	if networkPolicyDir != "" || *networkPolicyConfigMapsPtr {
+		client, err := kubernetesClient()
+		if err != nil {
+			log.Fatalf("Failed to create Kubernetes client: %v\n", err)
+		}
+		if *networkPolicyConfigMapsPtr {
+			networkPolicyConfigMapClient = client
+		}
+		stopResolver := make(chan struct{})
+		defer close(stopResolver)
+		peerResolver, err = NewPeerResolver(client, stopResolver)
+		if err != nil {
+			log.Fatalf("Failed to start the peer resolver: %v\n", err)
+		}
+	}
+
+	// Install the learned seccomp profiles on every node
+	if writeSeccompProfiles {
+		client, err := kubernetesClient()
+		if err != nil {
+			log.Fatalf("Failed to create Kubernetes client: %v\n", err)
+		}
+		seccompProfiles, err = NewSeccompProfileShare(client, os.Getenv("POD_NAMESPACE"), seccompProfileRoot)
+		if err != nil {
+			log.Fatalf("Failed to set up the seccomp profiles: %v\n", err)
+		}
+		stopSeccompProfiles := make(chan struct{})
+		go seccompProfiles.syncLoop(stopSeccompProfiles)
+		defer close(stopSeccompProfiles)
+	}
+
+	// Serve the API
+	if *apiAddrPtr != "" {
+		// The clients send their bearer tokens, never in clear
+		if *apiTLSCertPtr == "" || *apiTLSKeyPtr == "" {
+			log.Fatalf("Failed to set up the API: --api-addr requires --api-tls-cert and --api-tls-key\n")
+		}
+		client, err := kubernetesClient()
+		if err != nil {
+			log.Fatalf("Failed to create Kubernetes client: %v\n", err)
+		}
+		apiAuthClient = client
+		if *gatekeeperClientCAFilePtr != "" {
+			gatekeeperClientCAs, err = readCertPool(*gatekeeperClientCAFilePtr)
+			if err != nil {
+				log.Fatalf("Failed to set up the Gatekeeper provider: %v\n", err)
+			}
+			registerGatekeeperHandlers(apiMux)
+		}
+		registerProfileHandlers(apiMux)
+		registerDiagnosticsHandlers(apiMux)
+		registerSchemaHandlers(apiMux)
+		registerEventHandlers(apiMux)
+		registerGrafanaHandlers(apiMux)
+		registerUIHandlers(apiMux)
+		registerRecentEventHandlers(apiMux)
+		registerExportHandlers(apiMux)
+		registerCanaryHandlers(apiMux)
+		registerTraceSessionHandlers(apiMux)
+		registerRiskHandlers(apiMux)
+		// Stream the events to the subscribers of the API
+		eventStreams = newEventBroker()
+		addSink("stream", eventStreams)
+		registerStreamHandlers(apiMux)
+		if *admissionWebhookPtr {
+			if admissionEnforcement != "warn" && admissionEnforcement != "deny" {
+				log.Fatalf("Invalid admission enforcement %q, expected warn or deny\n", admissionEnforcement)
+			}
+			registerAdmissionHandlers(apiMux)
+		}
+		if auditWebhookToken != "" {
+			if !*recordSessionsPtr {
+				log.Fatalf("Failed to set up the audit webhook: it requires --record-sessions\n")
+			}
+			auditCorrelator = NewAuditCorrelator()
+			_, port, err := net.SplitHostPort(*apiAddrPtr)
+			if err != nil {
+				log.Fatalf("Failed to set up the audit webhook: invalid --api-addr: %v\n", err)
+			}
+			auditForwarder, err = NewAuditForwarder(client, os.Getenv("POD_NAMESPACE"), os.Getenv("POD_NAME"), port, *auditPeerCAFilePtr, *auditPeerServerNamePtr)
+			if err != nil {
+				log.Fatalf("Failed to set up the audit webhook: %v\n", err)
+			}
+			registerAuditHandlers(apiMux)
+		}
+		startAPIServer(*apiAddrPtr, *apiTLSCertPtr, *apiTLSKeyPtr)
+	}
+
+	// Sign the generated profiles
+	if *signingKeyPtr != "" {
+		profileSigner, err = LoadSigningKey(*signingKeyPtr)
+		if err != nil {
+			log.Fatalf("Failed to load signing key: %v\n", err)
+		}
+	}
+
+	// Correlate the accessed files with the SBOMs of the images
+	if *sbomDirPtr != "" {
+		sbomLoader = NewSBOMLoader(*sbomDirPtr)
+	}
+
+	// Redact the events before they leave the node
+	if *redactionRulesPtr != "" {
+		redactor, err = LoadRedactionConfig(*redactionRulesPtr)
+		if err != nil {
+			log.Fatalf("Failed to load redaction rules: %v\n", err)
+		}
+	}
+
+	// Emit the events as NDJSON
+	switch *outputPtr {
+	case "text":
+		if *sinkPtr != "file" {
+			log.Fatalf("Failed to set up the output: --sink=%s requires --output=json, protobuf or avro\n", *sinkPtr)
+		}
+	case "json", "protobuf", "avro":
+		eventEncoding = *outputPtr
+		if eventEncoding == "avro" {
+			if schemaRegistryConfig.URL == "" {
+				log.Fatalf("Failed to set up the output: --output=avro requires --schema-registry-url\n")
+			}
+			avroSchemaID, err = registerAvroSchema(schemaRegistryConfig)
+			if err != nil {
+				log.Fatalf("Failed to register the Avro schema: %v\n", err)
+			}
+			log.Printf("Registered the Avro schema of the events with ID %d\n", avroSchemaID)
+		}
+		var sink Sink
+		switch *sinkPtr {
+		case "file":
+			sink, err = NewExportSink(eventEncoding, *sinkPathPtr)
+		case "stdout":
+			sink, err = NewExportSink(eventEncoding, "-")
+		case "http":
+			if *sinkURLPtr == "" {
+				log.Fatalf("Failed to set up the output: --sink=http requires --sink-url\n")
+			}
+			var codec Codec
+			codec, err = NewCodec(*sinkCompressionPtr, "gzip", "zstd", "snappy")
+			if err == nil {
+				err = checkDelivery(*sinkDeliveryPtr)
+			}
+			if err == nil {
+				sink = NewHTTPSink(*sinkURLPtr, eventEncoding, codec, *sinkBatchSizePtr, *sinkFlushIntervalPtr, *sinkDeliveryPtr)
+			}
+		case "unix":
+			sink, err = NewSocketSink(*sinkPathPtr)
+		case "fifo":
+			sink, err = NewFIFOSink(*sinkPathPtr)
+		default:
+			log.Fatalf("Failed to set up the output: unknown sink %q\n", *sinkPtr)
+		}
+		if err != nil {
+			log.Fatalf("Failed to create %s sink: %v\n", *sinkPtr, err)
+		}
+		addSink(*sinkPtr, sink)
+	default:
+		log.Fatalf("Failed to set up the output: unknown output %q\n", *outputPtr)
+	}
+
+	// Export the events to the other tools
+	if *exportFormatPtr != "" {
+		sink, err := NewExportSink(*exportFormatPtr, *exportPathPtr)
+		if err != nil {
+			log.Fatalf("Failed to create export sink: %v\n", err)
+		}
+		addSink("export", sink)
+	}
+	// Raise alerts on the events matching the rules
+	if *rulesPtr != "" {
+		rulesConfig, err = LoadRulesConfig(*rulesPtr)
+		if err != nil {
+			log.Fatalf("Failed to load rules: %v\n", err)
+		}
+		for _, name := range strings.Split(*alertSinkPtr, ",") {
+			switch strings.TrimSpace(name) {
+			case "stdout":
+				sink, err := NewExportSink("json", "-")
+				if err != nil {
+					log.Fatalf("Failed to set up the alerts: %v\n", err)
+				}
+				alertSinks = append(alertSinks, sink)
+			case "webhook":
+				if *alertWebhookURLPtr == "" {
+					log.Fatalf("Failed to set up the alerts: --alert-sink=webhook requires --alert-webhook-url\n")
+				}
+				if err := checkDelivery(*alertDeliveryPtr); err != nil {
+					log.Fatalf("Failed to set up the alerts: %v\n", err)
+				}
+				alertSinks = append(alertSinks, NewHTTPSink(*alertWebhookURLPtr, "json", nil, 1, time.Second, *alertDeliveryPtr))
+			case "kube-event":
+				client, err := kubernetesClient()
+				if err != nil {
+					log.Fatalf("Failed to create Kubernetes client: %v\n", err)
+				}
+				alertSinks = append(alertSinks, NewKubeEventSink(client))
+			default:
+				log.Fatalf("Failed to set up the alerts: unknown alert sink %q\n", name)
+			}
+		}
+		if len(rulesConfig.Queries) > 0 && eventHistory == nil && recentEvents == nil {
+			log.Fatalf("Failed to load rules: the queries require --backfill-window or --recent-events\n")
+		}
+		log.Printf("Loaded %d rules and %d queries\n", len(rulesConfig.Rules), len(rulesConfig.Queries))
+	}
+	for _, registration := range sinkRegistry {
+		sink, err := registration.create()
+		if err != nil {
+			log.Fatalf("Failed to create %s sink: %v\n", registration.name, err)
+		}
+		if sink != nil {
+			addSink(registration.name, sink)
+		}
+	}
+	if *digestPtr {
+		client, err := kubernetesClient()
+		if err != nil {
+			log.Fatalf("Failed to create Kubernetes client: %v\n", err)
+		}
+		sink, err := NewDigestSink(digestConfig, client, os.Getenv("POD_NAMESPACE"))
+		if err != nil {
+			log.Fatalf("Failed to create digest sink: %v\n", err)
+		}
+		digests = sink.(*digestSink)
+		addSink("digest", digests)
+	}
+	if rulesConfig != nil {
+		if err := rulesConfig.checkRoutes(); err != nil {
+			log.Fatalf("Failed to load rules: %v\n", err)
+		}
+	}
+
+	openFilter, err = NewOpenFilter(*openIncludePtr, *openExcludePtr, *ignoreSystemReadsPtr)
+	if err != nil {
+		log.Fatalf("Invalid open path filters: %v\n", err)
+	}
+	if autoTuneMaxRate > 0 {
+		autoTuner = NewAutoTuner()
+	}
+	if namespaceQuotas, err = NewNamespaceQuotas(*namespaceQuotaPtr, *namespaceQuotasPtr); err != nil {
+		log.Fatalf("Invalid namespace quotas: %v\n", err)
+	}
+
+	if *anomalyAlertsPtr {
+		anomalyThresholds, err = parseAnomalySensitivity(*anomalySensitivityPtr)
+		if err != nil {
+			log.Fatalf("Invalid anomaly sensitivity: %v\n", err)
+		}
+	}
+	if *inventoryPtr || *anomalyAlertsPtr {
+		if inventoryPathDepth < 1 {
+			log.Fatalf("Invalid --inventory-path-depth %d, expected at least 1\n", inventoryPathDepth)
+		}
+		inventory = NewInventory()
+	}
+
+	// Record the interactive sessions
+	if *recordSessionsPtr {
+		sessionDir := *sessionDirPtr
+		if sessionDir == "" {
+			sessionDir = filepath.Join(*stateDirPtr, "sessions")
+		}
+		if *sessionRetentionPtr < 0 {
+			log.Fatalf("Invalid --session-retention %s, expected a positive duration or 0\n", *sessionRetentionPtr)
+		}
+		sessionRecorder, err = NewSessionRecorder(sessionDir, *sessionRetentionPtr)
+		if err != nil {
+			log.Fatalf("Failed to create session recorder: %v\n", err)
+		}
+	}
+
+	// Record the trace sessions, bounded windows of collection started and stopped through the API
+	if *traceSessionsPtr {
+		if *apiAddrPtr == "" {
+			log.Fatalf("Failed to set up the trace sessions: they require --api-addr\n")
+		}
+		traceSessionDir := *traceSessionDirPtr
+		if traceSessionDir == "" {
+			traceSessionDir = filepath.Join(*stateDirPtr, "trace-sessions")
+		}
+		traceSessions, err = NewTraceSessions(traceSessionDir)
+		if err != nil {
+			log.Fatalf("Failed to create trace sessions: %v\n", err)
+		}
+	}
+
+	// Rank the workloads by the risk of their behavior
+	if *riskScoringPtr {
+		if riskHalfLife <= 0 {
+			log.Fatalf("Invalid risk half-life %v, expected a positive duration\n", riskHalfLife)
+		}
+		riskScores = NewRiskScores()
+	}
+
+	// Read the retention the Pods set for their workloads
+	if *retentionAnnotationsPtr {
+		if retentionClient, err = kubernetesClient(); err != nil {
+			log.Fatalf("Failed to create Kubernetes client: %v\n", err)
+		}
+	}
+
+	// Load the configurations of the tenants
+	if *tenantsPtr {
+		if *tenantsIntervalPtr <= 0 {
+			log.Fatalf("Failed to set up the tenants: --tenants-interval must be positive\n")
+		}
+		client, err := kubernetesClient()
+		if err != nil {
+			log.Fatalf("Failed to create Kubernetes client: %v\n", err)
+		}
+		tenants = NewTenantRegistry(client)
+		stopTenants := make(chan struct{})
+		go tenants.reconcileLoop(*tenantsIntervalPtr, stopTenants)
+		defer close(stopTenants)
+	}
+
+	// Select the containers to trace
+	selector := &SelectorConfig{}
+	if *selectorConfigPtr != "" {
+		if selector, err = LoadSelectorConfig(*selectorConfigPtr); err != nil {
+			log.Fatalf("Failed to load the selector config: %v\n", err)
+		}
+	}
+	includeLabels, err := parseLabels(labels)
+	if err != nil {
+		log.Fatalf("Failed to parse the labels: %v\n", err)
+	}
+	if len(includeLabels) > 0 || *namespacePtr != "" || *podNameRegexPtr != "" {
+		selector.Include = append(selector.Include, SelectorRule{Namespace: *namespacePtr, PodNameRegex: *podNameRegexPtr, Labels: includeLabels})
+	} else if !*allPtr && len(selector.Include) == 0 {
+		// We are choosing all Pod containers with the label "ig-trace=file-access" by default
+		selector.Include = []SelectorRule{{Labels: map[string]string{"ig-trace": "file-access"}}}
+	}
+	for _, namespace := range excludeNamespaces {
+		selector.Exclude = append(selector.Exclude, SelectorRule{Namespace: namespace})
+	}
+	for _, label := range tracerLabels {
+		if err := selector.AddTracerLabel(label); err != nil {
+			log.Fatalf("Failed to parse the tracer labels: %v\n", err)
+		}
+	}
+	if err := selector.compile(); err != nil {
+		log.Fatalf("Failed to compile the selector: %v\n", err)
+	}
+
+	// When tracing all containers, keep the monitor out so writing the event files doesn't generate more events
+	exclusions, err = NewExclusions(*allPtr, *excludeLabelsPtr, selector)
+	if err != nil {
+		log.Fatalf("Failed to set up the exclusions: %v\n", err)
+	}
+
+	// Tracer callbacks only queue their events, the I/O happens in the queue worker
+	eventQueue = NewEventQueue(*eventQueueSizePtr, *fairSharePtr)
+
+	// Expose the metrics once the queue they report on exists
+	if *metricsAddrPtr != "" {
+		startMetricsServer(*metricsAddrPtr)
+	}
+	if *healthAddrPtr != "" {
+		startProbeServer(*healthAddrPtr)
+		stopKubernetesCheck := make(chan struct{})
+		go kubernetesCheckLoop(stopKubernetesCheck)
+		defer close(stopKubernetesCheck)
+	}
 
 	// Use container collection to get notified for new containers
 	containerCollection := &containercollection.ContainerCollection{}
@@ -119,6 +899,7 @@ func main() {
 		return
 	}
 	defer tracerCollection.Close()
+	cgroupTracerMapsUpdater = tracerCollection.TracerMapsUpdater()
 
 	containerEventFuncs := []containercollection.FuncNotify{callback}
 
@@ -145,205 +926,645 @@ func main() {
 		containercollection.WithPubSub(containerEventFuncs...),
 	}
 
+	// Get the containers already running, to resume tracking them after a restart
+	if *warmRestartPtr {
+		opts = append(opts, containercollection.WithInitialKubernetesContainers(NodeName))
+	}
+
 	// Initialize the container collection
 	if err := containerCollection.Initialize(opts...); err != nil {
 		log.Printf("failed to initialize container collection: %s\n", err)
 		return
 	}
 	defer containerCollection.Close()
+	containerCollectionReady.Store(true)
+	// The containers still running were added again, the others are gone
+	discardHandoff()
 
-	// Define a callback to handle exec events
-	execEventCallback := func(event *tracerexectype.Event) {
-		if event.Retval > -1 {
-			procImageName := event.Comm
-			if len(event.Args) > 0 {
-				procImageName = event.Args[0]
-			}
-			reportFileAccessInPod(event.Namespace, event.Pod, event.Container, procImageName, "exec")
+	// Clean up the containers which vanished without a remove notification
+	stopGC := make(chan struct{})
+	go gcLoop(containerCollection, *gcIntervalPtr, stopGC)
+	defer close(stopGC)
+
+	// The tracers capture the containers of their selector, those not matching the other rules are filtered out when they are added
+
+	// Setting up the enabled tracers, a tracer which can't be loaded (e.g. missing BTF or tracepoint on this kernel) is retried periodically while the others keep running
+	targets := &tracerTargets{containers: containerCollection, tracers: tracerCollection, selector: selector}
+	var loaders []tracerLoader
+	for _, name := range tracerLoadOrder {
+		if load := tracerRegistry[name]; enabledTracers[name] {
+			loaders = append(loaders, tracerLoader{name: name, load: func() (func(), error) {
+				return load(targets)
+			}})
 		}
 	}
+	tracerManager = NewTracerManager(loaders)
+	tracerManager.Start(*tracerRetryIntervalPtr)
+	defer tracerManager.Close()
 
-	// Define a callback to handle open events
-	openEventCallback := func(event *traceropentype.Event) {
-		if event.Ret > -1 {
-			reportFileAccessInPod(event.Namespace, event.Pod, event.Container, event.Path, "open")
-		}
+	// Periodically persist the syscalls of the traced containers
+	stopSyscallPeek := make(chan struct{})
+	if *syscallPeekIntervalPtr > 0 {
+		go syscallPeekLoop(*syscallPeekIntervalPtr, stopSyscallPeek)
 	}
+	defer close(stopSyscallPeek)
 
-	// Define a callback to handle tcp events
-	tcpEventCallback := func(event *tracertcptype.Event) {
-		log.Printf("TCP event: %v\n", event)
-		reportTCPActivityInPod(event.Namespace, event.Pod, event.Container, event.Operation, event.Saddr, event.Daddr)
+	// Mark the event streams with the checkpoints of the containers
+	if checkpointInterval > 0 {
+		stopCheckpoints := make(chan struct{})
+		go checkpointLoop(checkpointInterval, stopCheckpoints)
+		defer close(stopCheckpoints)
 	}
 
-	var containerSelector containercollection.ContainerSelector
-	if !*allPtr {
-		// Selecting the container to trace, we are choosing all Pod containers with the label "ig-trace=file-access"
-		containerSelector = containercollection.ContainerSelector{
-			Labels: map[string]string{
-				"ig-trace": "file-access",
-			},
-		}
-	} else {
-		// Selecting all containers
-		containerSelector = containercollection.ContainerSelector{}
+	// Run the saved queries of the rules on their schedule
+	if rulesConfig != nil && len(rulesConfig.Queries) > 0 {
+		stopQueries := make(chan struct{})
+		startSavedQueries(rulesConfig, stopQueries)
+		defer close(stopQueries)
 	}
 
-	// Setting up all the tracers
+	// Wait for shutdown signal
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	<-shutdown
+	log.Println("Shutting down...")
 
-	// Add exec tracer
-	if err := tracerCollection.AddTracer(execTraceName, containerSelector); err != nil {
-		log.Printf("error adding tracer: %s\n", err)
-		return
+	// Write the events still queued and finalize the files of all the containers still running, once the ones removed
+	// are finalized
+	eventQueue.Drain()
+	finalizer.Wait()
+	if handoffPath != "" {
+		handOffAllContainers(handoffPath)
+	} else {
+		removeAllContainers()
 	}
-	defer tracerCollection.RemoveTracer(execTraceName)
-
-	// Add open tracer
-	if err := tracerCollection.AddTracer(openTraceName, containerSelector); err != nil {
-		log.Printf("error adding tracer: %s\n", err)
-		return
+	closeSinks()
+	closeAlertSinks()
+	if traceSessions != nil {
+		traceSessions.Close()
+	}
+	if eventHistory != nil {
+		eventHistory.Close()
 	}
-	defer tracerCollection.RemoveTracer(openTraceName)
+	if activityProfiles != nil {
+		activityProfiles.Close()
+	}
+	if inventory != nil {
+		inventory.Flush()
+	}
+
+	// Exit with success
+	os.Exit(0)
+}
 
-	// Add tcp tracer
-	if err := tracerCollection.AddTracer(tcpTraceName, containerSelector); err != nil {
-		log.Printf("error adding tracer: %s\n", err)
+func callback(notif containercollection.PubSubEvent) {
+	// The Kubernetes enrichment misses the containers whose Pod isn't in the v1 systemd or v2 cgroup
+	if notif.Type == containercollection.EventTypeAddContainer && notif.Container.Podname == "" && !enrichFromCgroups(notif.Container) {
 		return
 	}
-	defer tracerCollection.RemoveTracer(tcpTraceName)
+	key := ContainerKey{notif.Container.Namespace, notif.Container.Podname, notif.Container.Name}
+	if notif.Type == containercollection.EventTypeAddContainer {
+		if exclusions.ExcludeContainer(notif.Container) {
+			return
+		}
+		log.Printf("Container in Pod %s added: %v pid %d\n", notif.Container.Podname, notif.Container.ID, notif.Container.Pid)
+		addContainer(key, notif.Container)
+	} else if notif.Type == containercollection.EventTypeRemoveContainer {
+		log.Printf("Container removed: %v pid %d\n", notif.Container.ID, notif.Container.Pid)
 
-	// Add syscall tracer
-	if err := tracerCollection.AddTracer(syscallTraceName, containerSelector); err != nil {
-		log.Printf("error adding tracer: %s\n", err)
-		return
+		// Finalize the file once the events still in flight are written
+		eventQueue.EnqueueRemoveAfter(key, notif.Container.ID, removalDrainPeriod)
 	}
+}
 
-	// Get mount namespace map to filter by containers
-	execMountnsmap, err := tracerCollection.TracerMountNsMap(execTraceName)
+// addContainer registers a container, duplicate notifications for the same container ID are ignored
+func addContainer(key ContainerKey, container *containercollection.Container) {
+	workload := workloadKey(container)
+	var overlay *overlayLayers
+	if detectDrift {
+		overlay = containerOverlay(container.Pid)
+	}
+	// Containers already running when the agent started are past their initialization, as are the ones whose start is
+	// unknown, the zero time keeps their events out of the startup grace period
+	started, err := processStartTime(container.Pid)
 	if err != nil {
-		fmt.Printf("failed to get execMountnsmap: %s\n", err)
-		return
+		log.Printf("Error reading start time of container %s: %v\n", container.ID, err)
+		started = time.Time{}
 	}
 
-	// Get mount namespace map to filter by containers
-	openMountnsmap, err := tracerCollection.TracerMountNsMap(openTraceName)
+	state, existing, err := containers.Register(key, container.ID, func() (*ContainerState, error) {
+		// Open the file to store events for the container
+		f, err := openContainerFile(key)
+		if err != nil {
+			return nil, err
+		}
+		state := &ContainerState{
+			Key:      key,
+			Started:  started,
+			ID:       container.ID,
+			Mode:     workloadMode(container),
+			File:     f,
+			Mntns:    container.Mntns,
+			Workload: workload,
+			Image:    containerImage(container),
+			ImageRef: containerImageRef(container),
+			Labels:   container.Labels,
+			PodUID:   container.PodUID,
+			errors:   sinkErrorTracker{name: f.Name()},
+			relevant: make(map[SBOMComponent]bool),
+
+			capabilities:        make(map[string]bool),
+			executables:         make(map[string]bool),
+			libraries:           make(map[string]bool),
+			behavior:            newBehaviorSet(),
+			overlay:             overlay,
+			driftChecked:        make(map[string]string),
+			writtenSyscalls:     make(map[string]bool),
+			inventoriedSyscalls: make(map[string]bool),
+			processes:           newProcessTable(),
+			lastEvents:          make(map[string]time.Time),
+		}
+		if sbomLoader != nil {
+			state.sbom = sbomLoader.ForImage(state.Image)
+		}
+		if aggregateProfiles || activityProfiles != nil {
+			state.profile = newProfileAggregator()
+		}
+		restoreHandoff(state)
+		return state, nil
+	})
 	if err != nil {
-		fmt.Printf("failed to get openMountnsmap: %s\n", err)
+		log.Printf("Error creating file: %v\n", err)
 		return
 	}
-
-	// Get mount namespace map to filter by containers
-	tcpMountnsmap, err := tracerCollection.TracerMountNsMap(tcpTraceName)
-	if err != nil {
-		fmt.Printf("failed to get tcpMountnsmap: %s\n", err)
+	if state == nil {
+		log.Printf("Ignoring add notification for container %v, it is already registered or was removed\n", container.ID)
 		return
 	}
+	if retentionClient != nil {
+		go lookupRetention(key, workload, state.File.Name())
+	}
 
-	// Create the exec tracer
-	tracerExec, err := tracerexec.NewTracer(&tracerexec.Config{MountnsMap: execMountnsmap}, containerCollection, execEventCallback)
-	if err != nil {
-		fmt.Printf("error creating tracer: %s\n", err)
-		return
+	// The same container name got a new container (e.g. a restart) before the previous one was removed
+	if existing != nil {
+		log.Printf("Container %v replaced by %v\n", existing.ID, container.ID)
+		finalizer.Finalize(key, existing)
 	}
-	defer tracerExec.Stop()
+}
 
-	// Create the open tracer
-	tracerOpen, err := traceropen.NewTracer(&traceropen.Config{MountnsMap: openMountnsmap}, containerCollection, openEventCallback)
-	if err != nil {
-		fmt.Printf("error creating tracer: %s\n", err)
-		return
+// removeContainer unregisters a container and queues the finalization of its file, it returns false if the container
+// wasn't registered
+func removeContainer(key ContainerKey, id string) bool {
+	state, ok := containers.Unregister(key, id)
+	if !ok {
+		return false
+	}
+	activityMetrics.ContainerRemoved(key)
+	if autoTuner != nil {
+		autoTuner.ContainerRemoved(key)
 	}
-	defer tracerOpen.Stop()
 
-	// Create the tcp tracer
-	tracerTCP, err := tracertcp.NewTracer(&tracertcp.Config{MountnsMap: tcpMountnsmap}, containerCollection, tcpEventCallback)
-	if err != nil {
-		fmt.Printf("error creating tracer: %s\n", err)
-		return
+	finalizer.Finalize(key, state)
+	return true
+}
+
+// removeAllContainers finalizes the files of all the registered containers
+func removeAllContainers() {
+	states := containers.TakeAll()
+
+	for key, state := range states {
+		finalizeContainer(key, state)
+	}
+}
+
+// finalizeContainer writes the last events of an unregistered container in a defined order and closes its file
+func finalizeContainer(key ContainerKey, state *ContainerState) {
+	// Writers hold the map lock, so once the container is unregistered no event is in flight anymore.
+	// Events arriving from now on land in the pending buffer, drain them first.
+	for _, event := range pendingBuffer.Take(key) {
+		state.WriteEvent(event.timestamp, event.line)
 	}
-	defer tracerTCP.Stop()
 
-	// Create the syscall tracer
-	tracerSyscall, err := tracersyscall.NewTracer()
-	if err != nil {
-		fmt.Printf("error creating tracer: %s\n", err)
-		return
+	// Then write the final syscall snapshot
+	syscalls, err := peekSyscallsWithRetry(state)
+	if err == nil {
+		syscalls = withRestoredSyscalls(state, syscalls)
+	} else if err != errSyscallsNotTraced {
+		state.lock.Lock()
+		syscalls = state.lastSyscalls
+		snapshotTime := state.lastSyscallsTime
+		state.lock.Unlock()
+		if syscalls != nil {
+			log.Printf("Error peeking syscalls: %v, using the snapshot from %s\n", err, snapshotTime.Format(time.RFC3339))
+		} else {
+			log.Printf("Error peeking syscalls: %v\n", err)
+		}
+	}
+	if syscalls != nil {
+		writeNewSyscalls(state, syscalls)
+		persistSyscalls(state, syscalls)
 	}
-	traceSystemCall = tracerSyscall
-	defer tracerSyscall.Close()
+	persistProfile(state, syscalls)
 
-	// Wait for shutdown signal
-	shutdown := make(chan os.Signal, 1)
-	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
-	<-shutdown
-	log.Println("Shutting down...")
+	// Record which components and binaries of the image were used
+	persistRelevantComponents(state)
+	persistReachability(state)
+	persistBehavior(state)
+	persistNetworkPolicy(state)
+	notifyContainerRemoved(state)
+	if sessionRecorder != nil {
+		sessionRecorder.ContainerRemoved(key, state.ID)
+	}
 
-	// Exit with success
-	os.Exit(0)
+	// And finally flush everything to disk
+	state.Close()
+	if tenants != nil {
+		tenants.FileClosed(key, state.File.Name())
+	}
 }
 
-func callback(notif containercollection.PubSubEvent) {
-	if notif.Type == containercollection.EventTypeAddContainer {
-		log.Printf("Container in Pod %s added: %v pid %d\n", notif.Container.Podname, notif.Container.ID, notif.Container.Pid)
-		// Create a file to store events for the container
-		f, err := os.Create(fmt.Sprintf("/tmp/%s-%s-%s.log", notif.Container.Namespace, notif.Container.Podname, notif.Container.Name))
-		if err != nil {
-			log.Printf("Error creating file: %v\n", err)
-			return
-		}
-		containerMap[ContainerKey{notif.Container.Namespace, notif.Container.Podname, notif.Container.Name}] = f
-	} else if notif.Type == containercollection.EventTypeRemoveContainer {
-		log.Printf("Container removed: %v pid %d\n", notif.Container.ID, notif.Container.Pid)
+// workloadKey identifies the workload a container belongs to, so instances of the same workload share their state
+func workloadKey(container *containercollection.Container) string {
+	owner, err := container.GetOwnerReference()
+	if err != nil || owner == nil {
+		// Fall back to the Pod itself
+		return fmt.Sprintf("%s/Pod/%s/%s", container.Namespace, container.Podname, container.Name)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", container.Namespace, owner.Kind, owner.Name, container.Name)
+}
 
-		// Close the file
-		f, ok := containerMap[ContainerKey{notif.Container.Namespace, notif.Container.Podname, notif.Container.Name}]
-		if !ok {
-			log.Printf("Container not found: %v pid %d\n", notif.Container.ID, notif.Container.Pid)
+// parseWorkloadKey splits a workload key into its namespace, owner kind and name, and container name
+func parseWorkloadKey(workload string) (namespace string, kind string, name string, container string, ok bool) {
+	parts := strings.SplitN(workload, "/", 4)
+	if len(parts) != 4 {
+		return "", "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], parts[3], true
+}
+
+// syscallPeekLoop takes a snapshot of the syscalls of every traced container on each tick and persists it
+func syscallPeekLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
 			return
+		case <-ticker.C:
+			peekAllSyscalls()
+			if inventory != nil {
+				inventory.Flush()
+			}
 		}
+	}
+}
+
+func peekAllSyscalls() {
+	// Copy the states so the store isn't written while holding the lock
+	states := containers.States()
 
-		syscalls, err := traceSystemCall.Peek(notif.Container.Mntns)
+	for _, state := range states {
+		syscalls, err := peekSyscalls(state)
 		if err != nil {
-			log.Printf("Error peeking syscalls: %v\n", err)
-		} else {
-			for _, syscall := range syscalls {
-				f.WriteString(fmt.Sprintf("syscall: %s\n", syscall))
+			// The container may not have done any syscall yet
+			continue
+		}
+		syscalls = withRestoredSyscalls(state, syscalls)
+		state.lock.Lock()
+		state.lastSyscalls = syscalls
+		state.lastSyscallsTime = time.Now()
+		state.lock.Unlock()
+		writeNewSyscalls(state, syscalls)
+		persistSyscalls(state, syscalls)
+	}
+	for _, state := range states {
+		persistBehavior(state)
+		persistNetworkPolicy(state)
+		state.lock.Lock()
+		syscalls := state.lastSyscalls
+		state.lock.Unlock()
+		persistProfile(state, syscalls)
+	}
+}
+
+// writeNewSyscalls writes the syscalls of a snapshot which weren't written to the container file yet
+func writeNewSyscalls(state *ContainerState, syscalls []string) {
+	var added []string
+	state.lock.Lock()
+	for _, syscall := range syscalls {
+		if !state.writtenSyscalls[syscall] {
+			state.writtenSyscalls[syscall] = true
+			added = append(added, syscall)
+		}
+	}
+	state.lock.Unlock()
+
+	now := clock.Now()
+	for _, syscall := range added {
+		state.WriteEvent(now, fmt.Sprintf("syscall: %s\n", syscall))
+	}
+	if riskScores != nil {
+		riskScores.ObserveSyscalls(state, added, now)
+	}
+}
+
+// Number of attempts and delay before the first retry when peeking the syscalls of a removed container
+const peekAttempts = 4
+const peekRetryBackoff = 50 * time.Millisecond
+
+// peekSyscallsWithRetry peeks the syscalls of a container, retrying with backoff as the lookup may fail while the container is torn down
+func peekSyscallsWithRetry(state *ContainerState) ([]string, error) {
+	backoff := peekRetryBackoff
+	for attempt := 1; ; attempt++ {
+		syscalls, err := peekSyscalls(state)
+		if err == nil || err == errSyscallsNotTraced || attempt == peekAttempts {
+			return syscalls, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func persistSyscalls(state *ContainerState, syscalls []string) {
+	if inventory != nil {
+		// Snapshots are cumulative and don't tell when a syscall was last used, so each syscall of the container is
+		// recorded once, when a snapshot first shows it
+		var added []string
+		state.lock.Lock()
+		for _, syscall := range syscalls {
+			if !state.inventoriedSyscalls[syscall] {
+				state.inventoriedSyscalls[syscall] = true
+				added = append(added, syscall)
 			}
 		}
+		state.lock.Unlock()
+		now := time.Now()
+		digest := imageDigest(state.ImageRef)
+		for _, syscall := range added {
+			inventory.Record(state.Workload, inventorySyscalls, syscall, now)
+			inventory.RecordVersion(state.Workload, digest, inventorySyscalls, syscall, now)
+		}
+	}
+	if !state.Learns() {
+		return
+	}
+	state.lock.Lock()
+	rootObserved := state.rootObserved
+	capabilities := setToSlice(state.capabilities)
+	state.lock.Unlock()
+	workloadSyscalls, added, err := store.MergeSyscalls(state.Workload, syscalls, rootObserved, capabilities, capabilitiesTraced(state))
+	if err != nil {
+		log.Printf("Error persisting syscalls of %s: %v\n", state.Workload, err)
+		return
+	}
+
+	// Policies are only generated once the workload was learned
+	if kyvernoPolicyDir != "" && time.Since(workloadSyscalls.FirstSeen) >= learningPeriod {
+		if err := writeKyvernoPolicy(kyvernoPolicyDir, workloadSyscalls); err != nil {
+			log.Printf("Error writing Kyverno policy of %s: %v\n", state.Workload, err)
+		}
+	}
+	// The profiles merge the syscalls of all the containers of the workload seen so far
+	if seccompProfiles != nil && time.Since(workloadSyscalls.FirstSeen) >= learningPeriod {
+		if err := seccompProfiles.Publish(workloadSyscalls); err != nil {
+			log.Printf("Error writing seccomp profile of %s: %v\n", state.Workload, err)
+		}
+	}
+	if seccompProfileCRDir != "" && time.Since(workloadSyscalls.FirstSeen) >= learningPeriod {
+		if err := writeSeccompProfileCR(seccompProfileCRDir, workloadSyscalls); err != nil {
+			log.Printf("Error writing SeccompProfile of %s: %v\n", state.Workload, err)
+		}
+	}
+
+	// Syscalls showing up once the workload was learned are a drift from its profile
+	if len(added) == 0 || time.Since(workloadSyscalls.FirstSeen) < learningPeriod {
+		return
+	}
+	state.lock.Lock()
+	process := state.lastExec
+	state.lock.Unlock()
+	now := clock.Now()
+	for _, syscall := range added {
+		log.Printf("New syscall %s observed in workload %s, process %s\n", syscall, state.Workload, process)
+		state.WriteEvent(now, fmt.Sprintf("new-syscall: %s process: %s\n", syscall, process))
+		if state.Alerts() && syscallAnomaliesEnabled() {
+			alertNewSyscall(state, now, syscall, process)
+		}
+	}
+}
 
-		f.Close()
+// markRelevantPath records the image components owning a file accessed in the container
+func markRelevantPath(key ContainerKey, path string) {
+	state, ok := containers.Get(key)
+	if !ok || state.sbom == nil {
+		return
+	}
+	components := state.sbom.Components(path)
+	if len(components) == 0 {
+		return
 	}
+	state.lock.Lock()
+	for _, component := range components {
+		state.relevant[component] = true
+	}
+	state.lock.Unlock()
 }
 
-func reportFileAccessInPod(namespaceName string, podName string, containerName string, file string, action string) {
-	// Not printing so we don't flood the logs and CPU
-	//log.Printf("File %s was accessed in Pod %s/%s container %s\n", file, namespaceName, podName, containerName)
+func persistRelevantComponents(state *ContainerState) {
+	if state.sbom == nil || !state.Learns() {
+		return
+	}
+	state.lock.Lock()
+	components := make([]SBOMComponent, 0, len(state.relevant))
+	for component := range state.relevant {
+		components = append(components, component)
+	}
+	state.lock.Unlock()
+
+	if err := store.MergeRelevantComponents(state.Image, components); err != nil {
+		log.Printf("Error persisting relevant components of %s: %v\n", state.Image, err)
+	}
+}
 
-	// Write the event to the file
-	f, ok := containerMap[ContainerKey{namespaceName, podName, containerName}]
+func recordExecInPod(key ContainerKey, process string) {
+	state, ok := containers.Get(key)
 	if !ok {
-		log.Printf("Container not found: %s/%s/%s\n", namespaceName, podName, containerName)
 		return
 	}
-	f.WriteString(fmt.Sprintf("%s: %s\n", action, file))
+	state.lock.Lock()
+	state.lastExec = process
+	state.lock.Unlock()
 }
 
-func reportTCPActivityInPod(namespaceName string, podName string, containerName string, operation string, src string, dst string) {
-	// Write the event to the file
-	f, ok := containerMap[ContainerKey{namespaceName, podName, containerName}]
+// recordRootActivity remembers that a process of the container ran as root
+func recordRootActivity(key ContainerKey) {
+	state, ok := containers.Get(key)
 	if !ok {
-		log.Printf("Container not found: %s/%s/%s\n", namespaceName, podName, containerName)
 		return
 	}
-	f.WriteString(fmt.Sprintf("%s: %s->%s\n", operation, src, dst))
+	state.lock.Lock()
+	state.rootObserved = true
+	state.lock.Unlock()
 }
 
-func reportSyscallInPod(namespaceName string, podName string, containerName string, syscall string) {
-	// Write the event to the file
-	f, ok := containerMap[ContainerKey{namespaceName, podName, containerName}]
+// recordCapability remembers a capability a process of the container was granted
+func recordCapability(key ContainerKey, capability string) {
+	state, ok := containers.Get(key)
 	if !ok {
-		log.Printf("Container not found: %s/%s/%s\n", namespaceName, podName, containerName)
 		return
 	}
-	f.WriteString(fmt.Sprintf("syscall: %s\n", syscall))
+	state.lock.Lock()
+	state.capabilities[capability] = true
+	state.lock.Unlock()
+}
+
+func reportExecInPod(event *Event, truncated bool) {
+	// The session, the binary and the full arguments are read before the process can exit or execute another program
+	var session *execSession
+	if sessionRecorder != nil {
+		session = execSessionOf(event.Pid)
+	}
+	var args []string
+	if truncated && completeTruncated {
+		args, _ = procCmdline(event.Pid)
+	}
+	// Queue the event to be written to the file
+	eventQueue.Enqueue(queuedEvent{
+		key:        ContainerKey{event.Namespace, event.Pod, event.Container},
+		timestamp:  event.Time,
+		line:       fmt.Sprintf("exec: %s\n", event.Path),
+		path:       event.Path,
+		pid:        event.Pid,
+		exec:       fmt.Sprintf("%s(%d)", event.Path, event.Pid),
+		session:    session,
+		executable: executablePath(event.Path, event.Pid),
+		root:       event.Uid == 0,
+		truncated:  truncated,
+		complete: func() (string, bool) {
+			if len(args) == 0 {
+				return "", false
+			}
+			event.Path = args[0]
+			event.Args = args
+			return fmt.Sprintf("exec: %s\n", args[0]), true
+		},
+		event: event,
+	})
+}
+
+// reportFailedExecInPod records an exec attempt which failed, the process image is unchanged so there is nothing to learn from it
+func reportFailedExecInPod(event *Event) {
+	errno := event.Errno
+	if errno == "" {
+		errno = "unknown"
+	}
+	eventQueue.Enqueue(queuedEvent{
+		key:       ContainerKey{event.Namespace, event.Pod, event.Container},
+		timestamp: event.Time,
+		line:      fmt.Sprintf("exec-failed: %s errno=%s\n", event.Path, errno),
+		event:     event,
+	})
+}
+
+func reportOpenInPod(event *Event, fd int, checkReadOnly bool) {
+	// The full path is read before the descriptor can be closed and reused
+	truncated := isOpenPathTruncated(event.Path)
+	var fullPath string
+	if truncated && completeTruncated {
+		fullPath, _ = procFdPath(event.Pid, fd)
+	}
+	// Queue the event to be written to the file
+	eventQueue.Enqueue(queuedEvent{
+		key:       ContainerKey{event.Namespace, event.Pod, event.Container},
+		timestamp: event.Time,
+		line:      fmt.Sprintf("open: %s\n", event.Path),
+		path:      event.Path,
+		pid:       event.Pid,
+		root:      event.Uid == 0,
+		fd:        fd,
+		checkRead: checkReadOnly,
+		truncated: truncated,
+		complete: func() (string, bool) {
+			if fullPath == "" {
+				return "", false
+			}
+			event.Path = fullPath
+			return fmt.Sprintf("open: %s\n", fullPath), true
+		},
+		event: event,
+	})
+}
+
+func reportTCPActivityInPod(event *Event) {
+	// Queue the event to be written to the file
+	eventQueue.Enqueue(queuedEvent{
+		key:       ContainerKey{event.Namespace, event.Pod, event.Container},
+		timestamp: event.Time,
+		line:      fmt.Sprintf("%s: %s->%s\n", event.Operation, event.Src, event.Dst),
+		protocol:  "tcp",
+		event:     event,
+	})
+}
+
+func reportDNSInPod(event *Event) {
+	line := fmt.Sprintf("dns: %s %s %s\n", event.Operation, event.QueryType, event.DNSName)
+	if event.Operation == "response" {
+		line = fmt.Sprintf("dns: response %s %s %s %s\n", event.QueryType, event.DNSName, event.Rcode, strings.Join(event.Addresses, ","))
+	}
+	// Queue the event to be written to the file, the DNS tracer only parses the UDP packets
+	eventQueue.Enqueue(queuedEvent{
+		key:       ContainerKey{event.Namespace, event.Pod, event.Container},
+		timestamp: event.Time,
+		line:      line,
+		protocol:  "udp",
+		event:     event,
+	})
+}
+
+func reportCapabilityInPod(event *Event) {
+	// Queue the event to be written to the file
+	eventQueue.Enqueue(queuedEvent{
+		key:       ContainerKey{event.Namespace, event.Pod, event.Container},
+		timestamp: event.Time,
+		line:      fmt.Sprintf("capability: %s verdict: %s syscall: %s\n", event.Capability, event.Verdict, event.Syscall),
+		event:     event,
+	})
+}
+
+func reportSyscallInPod(namespaceName string, podName string, containerName string, syscall string) {
+	// Queue the event to be written to the file
+	eventQueue.Enqueue(queuedEvent{key: ContainerKey{namespaceName, podName, containerName}, timestamp: clock.Now(), line: fmt.Sprintf("syscall: %s\n", syscall)})
+}
+
+// addTracer registers a tracer in the tracer collection and returns its mount namespace map, used to filter by containers
+func addTracer(tracerCollection *tracercollection.TracerCollection, name string, selector containercollection.ContainerSelector) (*ebpf.Map, error) {
+	if err := tracerCollection.AddTracer(name, selector); err != nil {
+		return nil, fmt.Errorf("adding tracer: %w", err)
+	}
+	mountnsmap, err := tracerCollection.TracerMountNsMap(name)
+	if err != nil {
+		removeTracer(tracerCollection, name)
+		return nil, fmt.Errorf("getting mount namespace map: %w", err)
+	}
+	setTracerMountnsMap(name, mountnsmap)
+	return mountnsmap, nil
+}
+
+// removeTracer removes a tracer from the tracer collection, which releases its mount namespace map
+func removeTracer(tracerCollection *tracercollection.TracerCollection, name string) {
+	setTracerMountnsMap(name, nil)
+	tracerCollection.RemoveTracer(name)
+}
+
+// eventTime converts the kernel timestamp of an event, falling back to the current time when the tracer didn't provide one
+func eventTime(timestamp eventtypes.Time) time.Time {
+	if timestamp == 0 {
+		return clock.Now()
+	}
+	return time.Unix(0, int64(timestamp))
+}
+
+func writeContainerEvent(key ContainerKey, timestamp time.Time, line string) {
+	containers.WriteEvent(key, timestamp, line)
 }
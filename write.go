@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+)
+
+// Number of times a write failing with a transient error is retried
+const writeRetries = 3
+
+// Delay before the first retry, doubled on every attempt
+const writeRetryBackoff = 10 * time.Millisecond
+
+// Number of consecutive failed writes after which a sink is considered degraded
+const sinkDegradedThreshold = 10
+
+// writeWithRetry writes the whole line, retrying on transient errors
+func writeWithRetry(w io.Writer, line string) error {
+	data := []byte(line)
+	backoff := writeRetryBackoff
+	for attempt := 0; ; attempt++ {
+		n, err := w.Write(data)
+		if err == nil {
+			return nil
+		}
+		data = data[n:]
+		if !isTransientWriteError(err) || attempt == writeRetries {
+			return err
+		}
+		metrics.SinkWriteRetries.Add(1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func isTransientWriteError(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOBUFS)
+}
+
+// sinkErrorTracker escalates a sink to the degraded health state once it keeps failing
+type sinkErrorTracker struct {
+	name              string
+	consecutiveErrors int
+}
+
+// Track records the result of a write, it returns true if the error should be logged
+func (t *sinkErrorTracker) Track(err error) bool {
+	if err == nil {
+		if t.consecutiveErrors >= sinkDegradedThreshold {
+			health.SetHealthy("sink:" + t.name)
+		}
+		t.consecutiveErrors = 0
+		return false
+	}
+
+	metrics.SinkWriteErrors.Add(1)
+	t.consecutiveErrors++
+	if t.consecutiveErrors == sinkDegradedThreshold {
+		health.SetDegraded("sink:"+t.name, fmt.Sprintf("%d consecutive write failures, last: %v", t.consecutiveErrors, err))
+	}
+	// Log the first failures only, the degraded state covers the rest
+	return t.consecutiveErrors <= sinkDegradedThreshold
+}